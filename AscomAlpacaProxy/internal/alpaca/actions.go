@@ -0,0 +1,443 @@
+package alpaca
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sv241pro-alpaca-proxy/internal/telemetry"
+)
+
+// commonActions are the ASCOM Actions offered by both the Switch and the ObservingConditions device.
+// All of them take an optional JSON object in the "Parameters" field and return a JSON string.
+var commonActions = []string{
+	"GetStatus",
+	"GetVersions",
+	"GetTelemetry",
+	"SetHeater",
+	"BoostHeater",
+	"CancelBoost",
+	"GetBoosts",
+	"ApplyScene",
+	"RunSequence",
+	"CancelSequence",
+	"GetSequenceStatus",
+	"SetTimer",
+	"CancelTimer",
+	"GetTimers",
+	"DrySensor",
+	"Reboot",
+}
+
+// heaterParamKeys maps the friendly parameter names of the SetHeater action to the
+// short keys used by the firmware's "dh" config entries. Short keys are accepted as well.
+var heaterParamKeys = map[string]string{
+	"name":             "n",
+	"enabledonstartup": "en",
+	"mode":             "m",
+	"manualpower":      "mp",
+	"targetoffset":     "to",
+	"kp":               "kp",
+	"ki":               "ki",
+	"kd":               "kd",
+	"startdelta":       "sd",
+	"enddelta":         "ed",
+	"maxpower":         "xp",
+	"pidsyncfactor":    "psf",
+	"mintemp":          "mt",
+}
+
+// maxTelemetryActionMinutes limits the GetTelemetry action to one day of raw samples.
+const maxTelemetryActionMinutes = 24 * 60
+
+// handleCommonAction executes one of the commonActions.
+// It returns false if the action is not one of them, so the caller can report it as unsupported.
+func (a *API) handleCommonAction(w http.ResponseWriter, r *http.Request, action string) bool {
+	var err error
+	switch strings.ToLower(action) {
+	case "getstatus":
+		err = a.actionGetStatus(w, r)
+	case "getversions":
+		err = a.actionGetVersions(w, r)
+	case "gettelemetry":
+		err = a.actionGetTelemetry(w, r)
+	case "setheater":
+		err = a.actionSetHeater(w, r)
+	case "boostheater":
+		err = a.actionBoostHeater(w, r)
+	case "cancelboost":
+		err = a.actionCancelBoost(w, r)
+	case "getboosts":
+		err = actionJSONResponse(w, r, power.ListBoosts())
+	case "applyscene":
+		err = a.actionApplyScene(w, r)
+	case "runsequence":
+		err = a.actionRunSequence(w, r)
+	case "cancelsequence":
+		err = a.actionCancelSequence(w, r)
+	case "getsequencestatus":
+		err = actionJSONResponse(w, r, power.ListJobs())
+	case "settimer":
+		err = a.actionSetTimer(w, r)
+	case "canceltimer":
+		err = a.actionCancelTimer(w, r)
+	case "gettimers":
+		err = actionJSONResponse(w, r, power.ListTimers())
+	case "drysensor":
+		err = a.actionDrySensor(w, r)
+	case "reboot":
+		err = a.actionReboot(w, r)
+	default:
+		return false
+	}
+
+	if err != nil {
+		ErrorResponse(w, r, http.StatusOK, setErrorNumber(err, 0x401), fmt.Sprintf("Action '%s' failed: %v", action, err))
+	}
+	return true
+}
+
+// parseActionParameters decodes the JSON "Parameters" field of an Action request into v.
+// An empty or missing field leaves v untouched.
+func parseActionParameters(r *http.Request, v interface{}) error {
+	raw, _ := GetFormValueIgnoreCase(r, "Parameters")
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(raw), v); err != nil {
+		return fmt.Errorf("invalid JSON in Parameters: %w", err)
+	}
+	return nil
+}
+
+// actionJSONResponse writes v as a JSON encoded string value.
+func actionJSONResponse(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode result: %w", err)
+	}
+	StringResponse(w, r, string(data))
+	return nil
+}
+
+func (a *API) actionGetStatus(w http.ResponseWriter, r *http.Request) error {
+	serial.Status.RLock()
+	status := make(map[string]interface{}, len(serial.Status.Data))
+	for k, v := range serial.Status.Data {
+		status[k] = v
+	}
+	serial.Status.RUnlock()
+
+	serial.Conditions.RLock()
+	sensors := make(map[string]interface{}, len(serial.Conditions.Data))
+	for k, v := range serial.Conditions.Data {
+		sensors[k] = v
+	}
+	serial.Conditions.RUnlock()
+
+	return actionJSONResponse(w, r, map[string]interface{}{
+		"timestamp": time.Now().Unix(),
+		"connected": serial.IsConnected(),
+		"status":    status,
+		"sensors":   sensors,
+		"timers":    power.ListTimers(),
+	})
+}
+
+func (a *API) actionGetVersions(w http.ResponseWriter, r *http.Request) error {
+	return actionJSONResponse(w, r, map[string]string{
+		"proxy":    a.appVersion,
+		"firmware": serial.GetFirmwareVersion(),
+	})
+}
+
+func (a *API) actionGetTelemetry(w http.ResponseWriter, r *http.Request) error {
+	params := struct {
+		Minutes int `json:"minutes"`
+	}{Minutes: 10}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	if params.Minutes <= 0 || params.Minutes > maxTelemetryActionMinutes {
+		return fmt.Errorf("minutes must be between 1 and %d", maxTelemetryActionMinutes)
+	}
+
+	points, err := telemetry.GetRecentHistory(time.Duration(params.Minutes) * time.Minute)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	return actionJSONResponse(w, r, points)
+}
+
+// actionSetHeater changes the live state and/or the firmware configuration of one dew heater.
+// Parameters: {"heater": 1|2|"pwm1"|"pwm2", "enabled": bool, "mode": 0-5, "manualPower": 0-100, ...}
+func (a *API) actionSetHeater(w http.ResponseWriter, r *http.Request) error {
+	var params map[string]interface{}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+
+	heaterKey, err := parseHeaterParam(params["heater"])
+	if err != nil {
+		return err
+	}
+	heaterIdx := 0
+	if heaterKey == "pwm2" {
+		heaterIdx = 1
+	}
+
+	var enabled *bool
+	heaterSettings := make(map[string]interface{})
+	for name, value := range params {
+		lower := strings.ToLower(name)
+		if lower == "heater" {
+			continue
+		}
+		if lower == "enabled" {
+			b, ok := value.(bool)
+			if !ok {
+				return fmt.Errorf("parameter 'enabled' must be a boolean")
+			}
+			enabled = &b
+			continue
+		}
+		shortKey, ok := heaterParamKeys[lower]
+		if !ok {
+			for _, known := range heaterParamKeys {
+				if known == name {
+					shortKey, ok = known, true
+					break
+				}
+			}
+		}
+		if !ok {
+			return fmt.Errorf("unknown heater parameter '%s'", name)
+		}
+		if shortKey == "m" {
+			mode, isNum := value.(float64)
+			if !isNum || mode < 0 || mode > 5 || mode != float64(int(mode)) {
+				return fmt.Errorf("parameter 'mode' must be an integer between 0 and 5")
+			}
+		}
+		heaterSettings[shortKey] = value
+	}
+	if enabled == nil && len(heaterSettings) == 0 {
+		return fmt.Errorf("no heater parameters given")
+	}
+
+	result := make(map[string]interface{})
+	if len(heaterSettings) > 0 {
+		// The firmware skips empty entries, so the other heater is left untouched.
+		dh := []map[string]interface{}{{}, {}}
+		dh[heaterIdx] = heaterSettings
+		command, err := json.Marshal(map[string]interface{}{"sc": map[string]interface{}{"dh": dh}})
+		if err != nil {
+			return err
+		}
+		logger.Info("Executing ASCOM Action SetHeater: %s", command)
+		resp, err := serial.SendCommand(string(command), true, 10*time.Second)
+		if err != nil {
+			return fmt.Errorf("failed to send config to device: %w", err)
+		}
+
+		var fwConfig struct {
+			DH []map[string]interface{} `json:"dh"`
+		}
+		if err := json.Unmarshal([]byte(resp), &fwConfig); err == nil && heaterIdx < len(fwConfig.DH) {
+			result["config"] = fwConfig.DH[heaterIdx]
+		}
+
+		// A mode change may hide or reveal the heater switch (Mode 5 = Disabled).
+		go serial.SyncFirmwareConfig()
+	}
+
+	if enabled != nil {
+		logger.Info("Executing ASCOM Action SetHeater: %s enabled=%t", heaterKey, *enabled)
+		if _, err := power.Set(map[string]interface{}{heaterKey: *enabled}, clientSource(r)); err != nil {
+			return fmt.Errorf("failed to send command to device: %w", err)
+		}
+	}
+
+	serial.Status.RLock()
+	result["state"] = serial.Status.Data[heaterKey]
+	serial.Status.RUnlock()
+	result["heater"] = heaterKey
+
+	return actionJSONResponse(w, r, result)
+}
+
+// parseHeaterParam accepts a heater as 1, 2, "pwm1" or "pwm2" and returns its internal name.
+func parseHeaterParam(v interface{}) (string, error) {
+	switch h := v.(type) {
+	case float64:
+		if h == 1 || h == 2 {
+			return fmt.Sprintf("pwm%d", int(h)), nil
+		}
+	case string:
+		switch strings.ToLower(h) {
+		case "1", "pwm1":
+			return "pwm1", nil
+		case "2", "pwm2":
+			return "pwm2", nil
+		}
+	}
+	return "", fmt.Errorf("parameter 'heater' must be 1, 2, 'pwm1' or 'pwm2'")
+}
+
+// actionBoostHeater boosts a heater in manual mode and reverts it to its previous settings afterwards.
+// Parameters: {"heater": 1|2|"pwm1"|"pwm2", "percent": 100, "minutes": 10}
+func (a *API) actionBoostHeater(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		Heater  interface{} `json:"heater"`
+		Percent float64     `json:"percent"`
+		Minutes float64     `json:"minutes"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	heater, err := parseHeaterParam(params.Heater)
+	if err != nil {
+		return err
+	}
+	boost, err := power.BoostHeater(heater, params.Percent, time.Duration(params.Minutes*float64(time.Minute)), clientSource(r))
+	if err != nil {
+		return err
+	}
+	return actionJSONResponse(w, r, boost)
+}
+
+// actionCancelBoost ends a heater boost now and restores the heater's previous settings.
+// Parameters: {"heater": 1|2|"pwm1"|"pwm2"}
+func (a *API) actionCancelBoost(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		Heater interface{} `json:"heater"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	heater, err := parseHeaterParam(params.Heater)
+	if err != nil {
+		return err
+	}
+	found, err := power.CancelBoost(heater)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no boost running for '%s'", heater)
+	}
+	return actionJSONResponse(w, r, power.ListBoosts())
+}
+
+// actionApplyScene applies a saved output scene. Parameters: {"name": "Park"}
+func (a *API) actionApplyScene(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		Name string `json:"name"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	scene, ok := power.FindScene(params.Name)
+	if !ok {
+		return fmt.Errorf("unknown scene '%s'", params.Name)
+	}
+	result, err := power.ApplyScene(scene, clientSource(r))
+	if err != nil {
+		return err
+	}
+	return actionJSONResponse(w, r, result)
+}
+
+// actionRunSequence starts a saved sequence in the background and returns the job status.
+// Parameters: {"name": "Startup"}
+func (a *API) actionRunSequence(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		Name string `json:"name"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	seq, ok := power.FindSequence(params.Name)
+	if !ok {
+		return fmt.Errorf("unknown sequence '%s'", params.Name)
+	}
+	return actionJSONResponse(w, r, power.StartSequence(seq, clientSource(r)))
+}
+
+// actionCancelSequence cancels a running sequence job. Parameters: {"id": 3}, or none for the running one.
+func (a *API) actionCancelSequence(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		ID int `json:"id"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	if err := power.CancelSequence(params.ID); err != nil {
+		return err
+	}
+	return actionJSONResponse(w, r, power.ListJobs())
+}
+
+// actionSetTimer starts a timed action on an output.
+// Parameters: {"output": "dc4", "state": true, "duration": 1200, "mode": "for"}
+// mode "for" (default) switches now and reverts after duration seconds, "after" switches once duration has passed.
+func (a *API) actionSetTimer(w http.ResponseWriter, r *http.Request) error {
+	params := struct {
+		Output   string  `json:"output"`
+		State    bool    `json:"state"`
+		Duration float64 `json:"duration"`
+		Mode     string  `json:"mode"`
+	}{Mode: power.TimerFor}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	timer, err := power.StartTimer(params.Output, params.Mode, params.State, time.Duration(params.Duration*float64(time.Second)), clientSource(r))
+	if err != nil {
+		return err
+	}
+	return actionJSONResponse(w, r, timer)
+}
+
+// actionCancelTimer cancels the timer of an output. Parameters: {"output": "dc4"}
+func (a *API) actionCancelTimer(w http.ResponseWriter, r *http.Request) error {
+	var params struct {
+		Output string `json:"output"`
+	}
+	if err := parseActionParameters(r, &params); err != nil {
+		return err
+	}
+	if !power.CancelTimer(params.Output) {
+		return fmt.Errorf("no timer running for '%s'", params.Output)
+	}
+	return actionJSONResponse(w, r, power.ListTimers())
+}
+
+func (a *API) actionDrySensor(w http.ResponseWriter, r *http.Request) error {
+	logger.Info("Executing ASCOM Action DrySensor.")
+	resp, err := serial.SendCommand(`{"command":"dry_sensor"}`, true, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to send command to device: %w", err)
+	}
+	var js json.RawMessage
+	if json.Unmarshal([]byte(resp), &js) != nil {
+		return actionJSONResponse(w, r, map[string]string{"status": resp})
+	}
+	StringResponse(w, r, resp)
+	return nil
+}
+
+func (a *API) actionReboot(w http.ResponseWriter, r *http.Request) error {
+	logger.Info("Executing ASCOM Action Reboot.")
+	// Respond first; the device drops off the bus while it restarts.
+	if err := actionJSONResponse(w, r, map[string]string{"status": "rebooting"}); err != nil {
+		return err
+	}
+	go serial.SendCommand(`{"command":"reboot"}`, true, 0)
+	return nil
+}
@@ -2,14 +2,18 @@ package alpaca
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"sv241pro-alpaca-proxy/internal/automation"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
 	"sv241pro-alpaca-proxy/internal/serial"
+	"time"
 )
 
 // --- Management Handlers ---
@@ -123,6 +127,8 @@ func (a *API) HandleConnected(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// The connection is managed automatically, so we just acknowledge.
+		// Connected clients are tracked for the protected-output interlock.
+		power.SetClientConnected(clientIdentity(r), deviceFromPath(r.URL.Path), connected)
 		EmptyResponse(w, r)
 		return
 	}
@@ -130,6 +136,42 @@ func (a *API) HandleConnected(w http.ResponseWriter, r *http.Request) {
 	BoolResponse(w, r, serial.IsConnected())
 }
 
+// clientIdentity returns the Alpaca ClientID of a request, or the remote address if none was sent.
+func clientIdentity(r *http.Request) string {
+	if clientID, ok := GetFormValueIgnoreCase(r, "ClientID"); ok && clientID != "" && clientID != "0" {
+		return clientID
+	}
+	host := r.RemoteAddr
+	if idx := strings.LastIndex(host, ":"); idx > 0 {
+		host = host[:idx]
+	}
+	return host
+}
+
+// clientSource describes an Alpaca client as the source of a switch request.
+func clientSource(r *http.Request) string {
+	return "Alpaca client " + clientIdentity(r)
+}
+
+// deviceFromPath returns the device part of an Alpaca URL, e.g. "switch/0" for /api/v1/switch/0/connected.
+func deviceFromPath(path string) string {
+	path = strings.TrimPrefix(strings.Trim(path, "/"), "api/v1/")
+	if idx := strings.LastIndex(path, "/"); idx > 0 {
+		return path[:idx]
+	}
+	return path
+}
+
+// setErrorNumber returns the ASCOM error number for a failed set: InvalidOperation (0x40B) for
+// interlock violations, otherwise the given default.
+func setErrorNumber(err error, defaultNumber int) int {
+	var interlockErr *power.InterlockError
+	if errors.As(err, &interlockErr) {
+		return 0x40B
+	}
+	return defaultNumber
+}
+
 func (a *API) HandleDeviceName(name string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		StringResponse(w, r, name)
@@ -137,7 +179,8 @@ func (a *API) HandleDeviceName(name string) http.HandlerFunc {
 }
 
 func (a *API) HandleSupportedActions(w http.ResponseWriter, r *http.Request) {
-	StringListResponse(w, r, []string{"getlenstemperature"})
+	actions := append([]string{"getlenstemperature"}, commonActions...)
+	StringListResponse(w, r, actions)
 }
 
 func (a *API) HandleObsCondAction(w http.ResponseWriter, r *http.Request) {
@@ -158,11 +201,18 @@ func (a *API) HandleObsCondAction(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if a.handleCommonAction(w, r, action) {
+		return
+	}
+
 	ErrorResponse(w, r, http.StatusOK, 0x400, fmt.Sprintf("Action '%s' is not supported.", action))
 }
 
 // --- Switch Handlers ---
 
+// maxBatteryRuntime is the runtime reported while the battery is not being discharged, in hours.
+const maxBatteryRuntime = 240.0
+
 func (a *API) HandleSwitchMaxSwitch(w http.ResponseWriter, r *http.Request) {
 	count := len(config.SwitchIDMap)
 	IntResponse(w, r, count)
@@ -183,11 +233,19 @@ func (a *API) HandleSwitchGetSwitchName(w http.ResponseWriter, r *http.Request)
 		case config.SensorPowerKey:
 			StringResponse(w, r, "Total Power")
 			return
+		case config.SensorBatterySoCKey:
+			StringResponse(w, r, "Battery SoC")
+			return
+		case config.SensorBatteryRuntimeKey:
+			StringResponse(w, r, "Battery Runtime")
+			return
 		}
 
 		customName := config.Get().SwitchNames[internalName]
 		if customName != "" {
 			StringResponse(w, r, customName)
+		} else if vs, isGroup := config.GetVirtualSwitch(internalName); isGroup {
+			StringResponse(w, r, vs.Name)
 		} else {
 			StringResponse(w, r, internalName)
 		}
@@ -209,12 +267,36 @@ func (a *API) HandleSwitchGetSwitchDescription(w http.ResponseWriter, r *http.Re
 		case config.SensorPowerKey:
 			StringResponse(w, r, "Total power consumption in Watts (W)")
 			return
+		case config.SensorBatterySoCKey:
+			StringResponse(w, r, "Estimated battery state of charge in percent (%)")
+			return
+		case config.SensorBatteryRuntimeKey:
+			StringResponse(w, r, fmt.Sprintf("Estimated battery runtime at the present load in hours (%.0f = not discharging)", maxBatteryRuntime))
+			return
+		}
+
+		if vs, isGroup := config.GetVirtualSwitch(internalName); isGroup {
+			StringResponse(w, r, fmt.Sprintf("Virtual switch (%s of %s)", vs.Mode, strings.Join(vs.Members, ", ")))
+			return
+		}
+
+		if t, ok := power.GetTimer(internalName); ok {
+			remaining := time.Duration(t.RemainingSeconds) * time.Second
+			StringResponse(w, r, fmt.Sprintf("%s (switches %s in %v)", internalName, onOffText(t.FinalState()), remaining))
+			return
 		}
 
 		StringResponse(w, r, internalName)
 	}
 }
 
+func onOffText(state bool) string {
+	if state {
+		return "on"
+	}
+	return "off"
+}
+
 func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 	id, ok := ParseSwitchID(w, r)
 	if !ok {
@@ -229,6 +311,12 @@ func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Virtual switches combine the states of their members
+	if vs, isGroup := config.GetVirtualSwitch(key); isGroup {
+		BoolResponse(w, r, power.GroupState(vs))
+		return
+	}
+
 	shortKey := config.ShortSwitchKeyByID[id]
 	serial.Status.RLock()
 	defer serial.Status.RUnlock()
@@ -240,8 +328,8 @@ func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 			if key == "all" {
 				continue
 			}
-			// Skip sensor keys - they are not in Status.Data
-			if config.IsSensorSwitch(key) {
+			// Skip sensor and virtual switch keys - they are not in Status.Data
+			if config.IsSensorSwitch(key) || config.IsVirtualSwitch(key) {
 				continue
 			}
 			if val, ok := serial.Status.Data[key]; ok {
@@ -293,6 +381,24 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 
 	key := config.SwitchIDMap[id]
 
+	// Battery estimates come from the battery model
+	if config.IsBatterySensor(key) {
+		soc, runtime := automation.BatteryEstimate()
+		if soc == nil {
+			ErrorResponse(w, r, http.StatusOK, 0x402, "No battery state of charge estimate available")
+			return
+		}
+		value := *soc
+		if key == config.SensorBatteryRuntimeKey {
+			value = maxBatteryRuntime
+			if runtime != nil && *runtime < maxBatteryRuntime {
+				value = *runtime
+			}
+		}
+		FloatResponse(w, r, math.Round(value*100)/100)
+		return
+	}
+
 	// Handle sensor switches - read from Conditions, not Status
 	if config.IsSensorSwitch(key) {
 		serial.Conditions.RLock()
@@ -324,6 +430,15 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if vs, isGroup := config.GetVirtualSwitch(key); isGroup {
+		var switchValue float64
+		if power.GroupState(vs) {
+			switchValue = 1.0
+		}
+		FloatResponse(w, r, switchValue)
+		return
+	}
+
 	shortKey := config.ShortSwitchKeyByID[id]
 	serial.Status.RLock()
 	defer serial.Status.RUnlock()
@@ -334,8 +449,8 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 			if key == "all" {
 				continue
 			}
-			// Skip sensor keys - they are not in Status.Data
-			if config.IsSensorSwitch(key) {
+			// Skip sensor and virtual switch keys - they are not in Status.Data
+			if config.IsSensorSwitch(key) || config.IsVirtualSwitch(key) {
 				continue
 			}
 			if val, ok := serial.Status.Data[key]; ok {
@@ -450,14 +565,16 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 	}
 
 	var state bool
+	var value *float64 // Only set if a Value was given (voltage or manual heater power)
 	var err error
 	if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
-		value, err := strconv.ParseFloat(valueStr, 64)
+		v, err := strconv.ParseFloat(valueStr, 64)
 		if err != nil {
 			ErrorResponse(w, r, http.StatusOK, 400, "Invalid Value parameter")
 			return
 		}
-		state = (value >= 1.0)
+		state = (v >= 1.0)
+		value = &v
 	} else if stateStr, ok := GetFormValueIgnoreCase(r, "State"); ok {
 		state, err = strconv.ParseBool(stateStr)
 		if err != nil {
@@ -469,121 +586,44 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	longKey := config.SwitchIDMap[id]
-	shortKey := config.ShortSwitchIDMap[longKey]
-
-	// Special handling for Adjustable Voltage (ID 7) if enabled
-	var command string
-	var newVoltageTarget float64 = -1.0
-
-	// Special handling for PWM if in Manual Mode (Lightweight check)
-	heaterIdx := -1
-	if longKey == "pwm1" {
-		heaterIdx = 0
-	} else if longKey == "pwm2" {
-		heaterIdx = 1
-	}
-
-	// Track if we should send a manual PWM command (replaces goto pattern)
-	sendManualPWMCommand := false
-
-	if heaterIdx >= 0 {
-		// Check Mode from Status Cache
-		isManual := false
-		serial.Status.RLock()
-		dmVal, found := serial.Status.Data["dm"]
-		serial.Status.RUnlock()
-
-		if found {
-			if dmArray, ok := dmVal.([]interface{}); ok && heaterIdx < len(dmArray) {
-				modeFloat, isFloat := dmArray[heaterIdx].(float64)
-				if isFloat && int(modeFloat) == 0 {
-					isManual = true
-				}
-			}
+	// Optional, non-standard Duration (seconds): the new state only holds for this long and is then reverted
+	var duration time.Duration
+	if durationStr, ok := GetFormValueIgnoreCase(r, "Duration"); ok {
+		seconds, err := strconv.ParseFloat(durationStr, 64)
+		if err != nil || seconds <= 0 {
+			ErrorResponse(w, r, http.StatusOK, 0x401, "Invalid Duration parameter")
+			return
 		}
-
-		if isManual {
-			if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
-				value, _ := strconv.ParseFloat(valueStr, 64)
-				command = fmt.Sprintf(`{"set":{"%s":%.0f}}`, shortKey, value)
-			} else {
-				// Use "true"/"false" so firmware applies default manual power or ON state
-				command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
-			}
-			sendManualPWMCommand = true
+		if config.IsVirtualSwitch(key) || key == "master_power" {
+			ErrorResponse(w, r, http.StatusOK, 0x401, "Duration is only supported for physical outputs")
+			return
 		}
-	}
-
-	// Build command if not already set by manual PWM handler
-	if !sendManualPWMCommand {
-		// Special handling for Adjustable Voltage
-		if longKey == "adj_conv" && config.Get().EnableAlpacaVoltageControl {
-			if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
-				// If Value is provided, set specific voltage
-				value, _ := strconv.ParseFloat(valueStr, 64)
-				command = fmt.Sprintf(`{"set":{"%s":%.2f}}`, shortKey, value)
-				newVoltageTarget = value
-			} else {
-				// Use "true"/"false" for bool to avoid ambiguity with "1"=1V in firmware
-				command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
-			}
-		} else if longKey == "master_power" {
-			// Master Power "all" command usually expects 0/1 in some firmware versions, matching Action handler
-			stateInt := 0
-			if state {
-				stateInt = 1
-			}
-			command = fmt.Sprintf(`{"set":{"%s":%d}}`, shortKey, stateInt)
-		} else {
-			// Use "true"/"false" for bool to avoid ambiguity with "1"=1V in firmware
-			command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
+		duration = time.Duration(seconds * float64(time.Second))
+		if err := power.ValidateTimer(key, power.TimerFor, duration); err != nil {
+			ErrorResponse(w, r, http.StatusOK, 0x401, fmt.Sprintf("Invalid Duration parameter: %v", err))
+			return
 		}
 	}
 
-	responseJSON, err := serial.SendCommand(command, true, 0)
-	if err != nil {
-		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
+	if err := power.SetOutput(key, state, value, clientSource(r)); err != nil {
+		if number := setErrorNumber(err, 0); number != 0 {
+			ErrorResponse(w, r, http.StatusOK, number, fmt.Sprintf("Failed to set switch: %v", err))
+			return
+		}
+		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to set switch: %v", err))
 		return
 	}
 
-	// Update the Voltage Target Cache if this was a voltage change command
-	if newVoltageTarget >= 0 {
-		serial.VoltageMutex.Lock()
-		serial.ActiveVoltageTarget = newVoltageTarget
-		serial.VoltageMutex.Unlock()
-	}
-
-	// Parse response which can contain mixed types ("status" object and "dm" array)
-	var rootData map[string]interface{}
-	if json.Unmarshal([]byte(responseJSON), &rootData) == nil {
-		if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-			serial.Status.Lock()
-
-			// Inject "dm" (Dew Mode) array into the status map so handlers can find it easily
-			if dmVal, found := rootData["dm"]; found {
-				statusMap["dm"] = dmVal
-			} else {
-				// If not found in response (e.g. from SET command), preserve existing DM from cache
-				// We must do this before overwriting serial.Status.Data
-				// ALREADY LOCKED via serial.Status.Lock() above, so we can access directly.
-				if existingDM, exists := serial.Status.Data["dm"]; exists {
-					statusMap["dm"] = existingDM
-				}
-			}
-
-			serial.Status.Data = statusMap
-			serial.Status.Unlock()
-		} else {
-			logger.Warn("Status JSON missing 'status' object after set command.")
+	// A timed set arms a timer that reverts the state; a plain set overrides any pending timer
+	if duration > 0 {
+		if _, err := power.ArmTimer(key, power.TimerFor, state, duration, clientSource(r)); err != nil {
+			ErrorResponse(w, r, http.StatusOK, 0x40B, fmt.Sprintf("Switch set, but the timer could not be started: %v", err))
+			return
 		}
-	} else {
-		logger.Warn("Failed to unmarshal status JSON from device after set command. Raw data: %s", responseJSON)
+	} else if key != "master_power" && !config.IsVirtualSwitch(key) {
+		power.CancelTimer(key)
 	}
 
-	// Handle auto-enable/disable logic in a goroutine
-	go handleHeaterInteractions(id, state)
-
 	EmptyResponse(w, r)
 }
 
@@ -647,6 +687,12 @@ func (a *API) HandleSwitchMaxSwitchValue(w http.ResponseWriter, r *http.Request)
 		case config.SensorPowerKey:
 			FloatResponse(w, r, 150.0) // Max power in W
 			return
+		case config.SensorBatterySoCKey:
+			FloatResponse(w, r, 100.0) // Percent
+			return
+		case config.SensorBatteryRuntimeKey:
+			FloatResponse(w, r, maxBatteryRuntime) // Hours
+			return
 		}
 
 		if key == "adj_conv" && config.Get().EnableAlpacaVoltageControl {
@@ -709,7 +755,7 @@ func (a *API) HandleSwitchSwitchStep(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) HandleSwitchSupportedActions(w http.ResponseWriter, r *http.Request) {
-	actions := []string{"MasterSwitchOn", "MasterSwitchOff"}
+	actions := append([]string{"MasterSwitchOn", "MasterSwitchOff"}, commonActions...)
 	StringListResponse(w, r, actions)
 }
 
@@ -724,17 +770,28 @@ func (a *API) HandleSwitchAction(w http.ResponseWriter, r *http.Request) {
 	case "masterswitchon", "masterswitchoff":
 		state := strings.ToLower(action) == "masterswitchon"
 		logger.Info("Executing ASCOM Action: %s", action)
+		if seq, ok := power.MasterPowerSequence(state); ok {
+			StringResponse(w, r, "")
+			power.StartSequence(seq, clientSource(r))
+			return
+		}
+		stateInt := 0
+		if state {
+			stateInt = 1
+		}
+		// The command is sent after responding, so check the interlocks now to be able to report a violation.
+		if err := power.CheckInterlocks(map[string]interface{}{"all": float64(stateInt)}); err != nil {
+			ErrorResponse(w, r, http.StatusOK, 0x40B, fmt.Sprintf("Action '%s' failed: %v", action, err))
+			return
+		}
 		StringResponse(w, r, "") // Respond immediately with empty string value per ASCOM spec
-		go func() {
-			stateInt := 0
-			if state {
-				stateInt = 1
-			}
-			command := fmt.Sprintf(`{"set":{"all":%d}}`, stateInt)
-			serial.SendCommand(command, true, 0)
-		}()
+		source := clientSource(r)
+		go power.Set(map[string]interface{}{"all": stateInt}, source)
 		return
 	default:
+		if a.handleCommonAction(w, r, action) {
+			return
+		}
 		ErrorResponse(w, r, http.StatusOK, 0x400, fmt.Sprintf("Action '%s' is not supported.", action))
 		return
 	}
@@ -846,127 +903,3 @@ func (a *API) HandleObsCondRefresh(w http.ResponseWriter, r *http.Request) {
 	}
 	EmptyResponse(w, r)
 }
-
-// --- Helper Logic ---
-
-func handleHeaterInteractions(id int, state bool) {
-	// This logic checks for heater inter-dependencies (PID leader/follower).
-	key := config.SwitchIDMap[id]
-	if key != "pwm1" && key != "pwm2" {
-		return // Not a heater
-	}
-
-	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
-	if err != nil {
-		logger.Warn("HeaterInteraction: Could not get firmware config: %v", err)
-		return
-	}
-	var fwConfig struct {
-		DH []struct {
-			M int `json:"m"` // Mode
-		} `json:"dh"`
-	}
-	if err := json.Unmarshal([]byte(configJSON), &fwConfig); err != nil {
-		logger.Warn("HeaterInteraction: Could not parse firmware config: %v", err)
-		return
-	}
-
-	if state { // Logic for turning a heater ON
-		followerHeaterIndex := 0
-		if key == "pwm2" {
-			followerHeaterIndex = 1
-		}
-
-		followerKey := key
-		if !config.Get().HeaterAutoEnableLeader[followerKey] {
-			logger.Debug("Auto-enable leader is disabled for %s. Skipping.", followerKey)
-			return
-		}
-
-		leaderHeaterIndex := 1 - followerHeaterIndex
-		isFollower := fwConfig.DH[followerHeaterIndex].M == 3 // 3 = PID-Sync (Follower)
-		leaderMode := fwConfig.DH[leaderHeaterIndex].M
-		isLeaderValid := leaderMode == 1 || leaderMode == 4 // 1 = PID, 4 = MinTemp
-		if isFollower && isLeaderValid {
-			// Determine Leader Key
-			leaderLongKey := "pwm1"
-			if leaderHeaterIndex == 1 {
-				leaderLongKey = "pwm2"
-			}
-
-			logger.Info("Activating Leader (%s) for Follower (%s).", leaderLongKey, followerKey)
-			leaderShortKey := config.ShortSwitchIDMap[leaderLongKey]
-			leaderCommand := fmt.Sprintf(`{"set":{"%s":true}}`, leaderShortKey)
-			responseJSON, err := serial.SendCommand(leaderCommand, true, 0)
-			if err != nil {
-				logger.Error("HeaterInteraction: Failed to send enable command to Leader (%s): %v", leaderLongKey, err)
-			} else {
-				// Update Cache
-				var rootData map[string]interface{}
-				if json.Unmarshal([]byte(responseJSON), &rootData) == nil {
-					if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-						serial.Status.Lock()
-						if dmVal, found := rootData["dm"]; found {
-							statusMap["dm"] = dmVal
-						} else {
-							if existingDM, exists := serial.Status.Data["dm"]; exists {
-								statusMap["dm"] = existingDM
-							}
-						}
-						serial.Status.Data = statusMap
-						serial.Status.Unlock()
-						logger.Info("HeaterInteraction: Successfully activated Leader (%s).", leaderLongKey)
-					}
-				}
-			}
-		}
-	} else { // Logic for turning a heater OFF
-		// If a PID Leader is turned OFF, disable its Follower if needed
-
-		leaderHeaterIndex := 0
-		if key == "pwm2" {
-			leaderHeaterIndex = 1
-		}
-
-		leaderLongKey := key // The heater being turned off is potentially a leader
-
-		followerHeaterIndex := 1 - leaderHeaterIndex
-		leaderMode := fwConfig.DH[leaderHeaterIndex].M
-		isLeaderValid := leaderMode == 1 || leaderMode == 4 // 1 = PID, 4 = MinTemp
-		isFollower := fwConfig.DH[followerHeaterIndex].M == 3
-
-		if isLeaderValid && isFollower {
-			followerLongKey := "pwm1"
-			if followerHeaterIndex == 1 {
-				followerLongKey = "pwm2"
-			}
-
-			logger.Info("Deactivating PID Follower (%s) because Leader (%s) was turned off.", followerLongKey, leaderLongKey)
-			followerShortKey := config.ShortSwitchIDMap[followerLongKey]
-			followerCommand := fmt.Sprintf(`{"set":{"%s":false}}`, followerShortKey)
-			responseJSON, err := serial.SendCommand(followerCommand, true, 0)
-			if err != nil {
-				logger.Error("HeaterInteraction: Failed to send disable command to Follower (%s): %v", followerLongKey, err)
-			} else {
-				// Update Cache with response to ensure UI reflects the change immediately
-				var rootData map[string]interface{}
-				if json.Unmarshal([]byte(responseJSON), &rootData) == nil {
-					if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-						serial.Status.Lock()
-						if dmVal, found := rootData["dm"]; found {
-							statusMap["dm"] = dmVal
-						} else {
-							// Preserve existing DM
-							if existingDM, exists := serial.Status.Data["dm"]; exists {
-								statusMap["dm"] = existingDM
-							}
-						}
-						serial.Status.Data = statusMap
-						serial.Status.Unlock()
-						logger.Info("HeaterInteraction: Successfully deactivated Follower (%s).", followerLongKey)
-					}
-				}
-			}
-		}
-	}
-}
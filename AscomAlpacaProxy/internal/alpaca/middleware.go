@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
 	"sync/atomic"
 )
 
@@ -30,10 +31,8 @@ func Handler(fn http.HandlerFunc) http.HandlerFunc {
 			atomic.StoreUint32(&ClientTransactionID, 0)
 		}
 
-		// We don't use ClientID, but we acknowledge its presence.
-		if _, ok := GetFormValueIgnoreCase(r, "ClientID"); ok {
-			// Acknowledged.
-		}
+		// Any request keeps a connected client alive for the protected-output interlock.
+		power.TouchClient(clientIdentity(r))
 
 		fn(w, r)
 	}
@@ -0,0 +1,128 @@
+// Package astro provides the observatory site model and a small built-in sun/moon ephemeris.
+// The formulas are the low-precision ones from the Astronomical Almanac; they are accurate to
+// about 0.01° for the sun and 0.3° for the moon, i.e. rise/set times within a minute or two.
+package astro
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	deg = math.Pi / 180
+	rad = 180 / math.Pi
+
+	j2000 = 2451545.0
+)
+
+// Equatorial is an apparent geocentric position.
+type Equatorial struct {
+	RA  float64 // Right ascension, degrees
+	Dec float64 // Declination, degrees
+}
+
+// Horizontal is a topocentric position.
+type Horizontal struct {
+	Altitude float64 `json:"altitude"` // Degrees above the horizon
+	Azimuth  float64 `json:"azimuth"`  // Degrees, north = 0, east = 90
+}
+
+// daysSinceJ2000 returns the (fractional) number of days since 2000-01-01 12:00 TT.
+// The difference between UT and TT (about a minute) is irrelevant at this precision.
+func daysSinceJ2000(t time.Time) float64 {
+	return float64(t.UTC().UnixNano())/86400e9 + 2440587.5 - j2000
+}
+
+func normalize(angle float64) float64 {
+	angle = math.Mod(angle, 360)
+	if angle < 0 {
+		angle += 360
+	}
+	return angle
+}
+
+func sinD(a float64) float64 { return math.Sin(a * deg) }
+func cosD(a float64) float64 { return math.Cos(a * deg) }
+
+// obliquity of the ecliptic in degrees.
+func obliquity(d float64) float64 {
+	return 23.439 - 0.0000004*d
+}
+
+// eclipticToEquatorial converts ecliptic longitude/latitude to RA/Dec.
+func eclipticToEquatorial(lon, lat, eps float64) Equatorial {
+	ra := math.Atan2(sinD(lon)*cosD(eps)-math.Tan(lat*deg)*sinD(eps), cosD(lon)) * rad
+	dec := math.Asin(sinD(lat)*cosD(eps)+cosD(lat)*sinD(eps)*sinD(lon)) * rad
+	return Equatorial{RA: normalize(ra), Dec: dec}
+}
+
+// sunEclipticLongitude returns the apparent ecliptic longitude of the sun in degrees.
+func sunEclipticLongitude(d float64) float64 {
+	g := normalize(357.529 + 0.98560028*d) // Mean anomaly
+	q := normalize(280.459 + 0.98564736*d) // Mean longitude
+	return normalize(q + 1.915*sinD(g) + 0.020*sinD(2*g))
+}
+
+// SunPosition returns the equatorial position of the sun.
+func SunPosition(t time.Time) Equatorial {
+	d := daysSinceJ2000(t)
+	return eclipticToEquatorial(sunEclipticLongitude(d), 0, obliquity(d))
+}
+
+// moonEcliptic returns the geocentric ecliptic longitude, latitude and horizontal parallax of the moon in degrees.
+func moonEcliptic(d float64) (lon, lat, parallax float64) {
+	T := d / 36525
+	lon = 218.32 + 481267.881*T +
+		6.29*sinD(135.0+477198.87*T) - 1.27*sinD(259.3-413335.36*T) +
+		0.66*sinD(235.7+890534.22*T) + 0.21*sinD(269.9+954397.74*T) -
+		0.19*sinD(357.5+35999.05*T) - 0.11*sinD(186.5+966404.03*T)
+	lat = 5.13*sinD(93.3+483202.02*T) + 0.28*sinD(228.2+960400.89*T) -
+		0.28*sinD(318.3+6003.15*T) - 0.17*sinD(217.6-407332.21*T)
+	parallax = 0.9508 + 0.0518*cosD(135.0+477198.87*T) + 0.0095*cosD(259.3-413335.36*T) +
+		0.0078*cosD(235.7+890534.22*T) + 0.0028*cosD(269.9+954397.74*T)
+	return normalize(lon), lat, parallax
+}
+
+// MoonPosition returns the geocentric equatorial position of the moon.
+func MoonPosition(t time.Time) Equatorial {
+	d := daysSinceJ2000(t)
+	lon, lat, _ := moonEcliptic(d)
+	return eclipticToEquatorial(lon, lat, obliquity(d))
+}
+
+// MoonIllumination returns the illuminated fraction of the moon (0-1) and whether it is waxing.
+func MoonIllumination(t time.Time) (fraction float64, waxing bool) {
+	d := daysSinceJ2000(t)
+	moonLon, moonLat, _ := moonEcliptic(d)
+	elongation := normalize(moonLon - sunEclipticLongitude(d))
+	cosPsi := cosD(moonLat) * cosD(elongation)
+	return (1 - cosPsi) / 2, elongation < 180
+}
+
+// localSiderealTime returns the local mean sidereal time in degrees.
+func localSiderealTime(t time.Time, longitude float64) float64 {
+	d := daysSinceJ2000(t)
+	return normalize(280.46061837 + 360.98564736629*d + longitude)
+}
+
+// toHorizontal converts an equatorial position to altitude/azimuth for an observer.
+func toHorizontal(pos Equatorial, t time.Time, latitude, longitude float64) Horizontal {
+	ha := localSiderealTime(t, longitude) - pos.RA
+	sinAlt := sinD(latitude)*sinD(pos.Dec) + cosD(latitude)*cosD(pos.Dec)*cosD(ha)
+	alt := math.Asin(math.Max(-1, math.Min(1, sinAlt))) * rad
+	az := math.Atan2(-cosD(pos.Dec)*sinD(ha), sinD(pos.Dec)*cosD(latitude)-cosD(pos.Dec)*cosD(ha)*sinD(latitude)) * rad
+	return Horizontal{Altitude: alt, Azimuth: normalize(az)}
+}
+
+// SunHorizontal returns the altitude and azimuth of the sun's centre (without refraction).
+func (s Site) SunHorizontal(t time.Time) Horizontal {
+	return toHorizontal(SunPosition(t), t, s.Latitude, s.Longitude)
+}
+
+// MoonHorizontal returns the topocentric altitude and azimuth of the moon's centre (without refraction).
+func (s Site) MoonHorizontal(t time.Time) Horizontal {
+	_, _, parallax := moonEcliptic(daysSinceJ2000(t))
+	h := toHorizontal(MoonPosition(t), t, s.Latitude, s.Longitude)
+	h.Altitude -= parallax * cosD(h.Altitude)
+	return h
+}
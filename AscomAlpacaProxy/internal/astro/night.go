@@ -0,0 +1,279 @@
+package astro
+
+import (
+	"fmt"
+	"math"
+	"sv241pro-alpaca-proxy/internal/config"
+	"time"
+	_ "time/tzdata" // Windows has no system zoneinfo database
+)
+
+// DateLayout is the format of night labels ("2024-03-15" = the night starting on the evening of March 15).
+const DateLayout = "2006-01-02"
+
+// Sun altitudes that define the night boundaries, in degrees.
+const (
+	altSunset       = -0.833 // Upper limb on the horizon, including refraction
+	altCivil        = -6.0
+	altNautical     = -12.0
+	altAstronomical = -18.0
+)
+
+const (
+	searchStep      = 10 * time.Minute
+	searchPrecision = 10 * time.Second
+)
+
+// Site is the configured observatory location with its resolved time zone.
+type Site struct {
+	config.Site
+	Location *time.Location
+}
+
+// CurrentSite returns the observatory site from the proxy configuration.
+func CurrentSite() Site {
+	return NewSite(config.Get().Site)
+}
+
+// NewSite resolves the time zone of a site definition. An empty or unknown zone uses the system time zone.
+func NewSite(site config.Site) Site {
+	loc := time.Local
+	if site.TimeZone != "" {
+		if l, err := time.LoadLocation(site.TimeZone); err == nil {
+			loc = l
+		}
+	}
+	if site.NightBoundary == "" {
+		site.NightBoundary = config.NightNoon
+	}
+	return Site{Site: site, Location: loc}
+}
+
+// Night is the time window of one observing night.
+type Night struct {
+	Date     string    `json:"date"` // Date of the evening
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Boundary string    `json:"boundary"`
+	// Fallback is set when the sun does not cross the boundary altitude (e.g. summer at high latitudes);
+	// the night then falls back to the noon-to-noon window.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// Contains reports whether t lies within the night.
+func (n Night) Contains(t time.Time) bool {
+	return !t.Before(n.Start) && t.Before(n.End)
+}
+
+// Twilight lists the sun and moon events of one night. Events that do not occur are null.
+type Twilight struct {
+	Date             string     `json:"date"`
+	Sunset           *time.Time `json:"sunset"`
+	CivilDusk        *time.Time `json:"civilDusk"`
+	NauticalDusk     *time.Time `json:"nauticalDusk"`
+	AstronomicalDusk *time.Time `json:"astronomicalDusk"`
+	AstronomicalDawn *time.Time `json:"astronomicalDawn"`
+	NauticalDawn     *time.Time `json:"nauticalDawn"`
+	CivilDawn        *time.Time `json:"civilDawn"`
+	Sunrise          *time.Time `json:"sunrise"`
+	Moonrise         *time.Time `json:"moonrise"`
+	Moonset          *time.Time `json:"moonset"`
+	MoonIllumination float64    `json:"moonIllumination"` // Illuminated fraction at local midnight (0-1)
+	MoonWaxing       bool       `json:"moonWaxing"`
+	Night            Night      `json:"night"`
+}
+
+// ParseDate parses a night label in the site's time zone.
+func (s Site) ParseDate(date string) (time.Time, error) {
+	t, err := time.ParseInLocation(DateLayout, date, s.Location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date '%s' (expected YYYY-MM-DD)", date)
+	}
+	return t, nil
+}
+
+// NightOf returns the label of the night a point in time belongs to: the date of the preceding noon
+// in the site's time zone. Every instant belongs to exactly one label, whatever the boundary definition.
+func (s Site) NightOf(t time.Time) string {
+	local := t.In(s.Location)
+	if local.Hour() < 12 {
+		local = local.AddDate(0, 0, -1)
+	}
+	return local.Format(DateLayout)
+}
+
+// NoonSpan returns the noon-to-noon window of a night label. All other night windows lie within it.
+func (s Site) NoonSpan(date string) (start, end time.Time, err error) {
+	day, err := s.ParseDate(date)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start = time.Date(day.Year(), day.Month(), day.Day(), 12, 0, 0, 0, s.Location)
+	end = time.Date(day.Year(), day.Month(), day.Day()+1, 12, 0, 0, 0, s.Location)
+	return start, end, nil
+}
+
+// Night returns the window of the night with the given label according to the configured boundary.
+func (s Site) Night(date string) (Night, error) {
+	start, end, err := s.NoonSpan(date)
+	if err != nil {
+		return Night{}, err
+	}
+	night := Night{Date: date, Start: start, End: end, Boundary: s.NightBoundary}
+
+	alt, ok := s.boundaryAltitude()
+	if !ok {
+		return night, nil
+	}
+	dusk, dawn := s.sunCrossings(alt, start, end)
+	if dusk == nil && dawn == nil {
+		night.Fallback = true
+		return night, nil
+	}
+	// Around the start or end of a polar day only one of the events may occur.
+	if dusk != nil {
+		night.Start = *dusk
+	}
+	if dawn != nil {
+		night.End = *dawn
+	}
+	return night, nil
+}
+
+// Twilight computes the sun and moon events of the night with the given label.
+func (s Site) Twilight(date string) (Twilight, error) {
+	start, end, err := s.NoonSpan(date)
+	if err != nil {
+		return Twilight{}, err
+	}
+	night, err := s.Night(date)
+	if err != nil {
+		return Twilight{}, err
+	}
+	tw := Twilight{Date: date, Night: night}
+	tw.Sunset, tw.Sunrise = s.sunCrossings(altSunset-s.horizonDip(), start, end)
+	tw.CivilDusk, tw.CivilDawn = s.sunCrossings(altCivil, start, end)
+	tw.NauticalDusk, tw.NauticalDawn = s.sunCrossings(altNautical, start, end)
+	tw.AstronomicalDusk, tw.AstronomicalDawn = s.sunCrossings(altAstronomical, start, end)
+
+	moonAlt := func(t time.Time) float64 { return s.MoonHorizontal(t).Altitude }
+	tw.Moonset, tw.Moonrise = crossings(moonAlt, altSunset-s.horizonDip(), start, end)
+
+	midnight := start.Add(end.Sub(start) / 2)
+	tw.MoonIllumination, tw.MoonWaxing = MoonIllumination(midnight)
+	tw.MoonIllumination = math.Round(tw.MoonIllumination*1000) / 1000
+	return tw, nil
+}
+
+// boundaryAltitude returns the sun altitude of the configured night boundary.
+// ok is false for noon-to-noon nights, which do not depend on the sun.
+func (s Site) boundaryAltitude() (alt float64, ok bool) {
+	switch s.NightBoundary {
+	case config.NightSunset:
+		return altSunset - s.horizonDip(), true
+	case config.NightCivil:
+		return altCivil, true
+	case config.NightNautical:
+		return altNautical, true
+	case config.NightAstronomical:
+		return altAstronomical, true
+	}
+	return 0, false
+}
+
+// horizonDip is the depression of the visible horizon for an observer above sea level, in degrees.
+func (s Site) horizonDip() float64 {
+	if s.Elevation <= 0 {
+		return 0
+	}
+	return 0.0293 * math.Sqrt(s.Elevation)
+}
+
+// sunCrossings returns the first downward (dusk) and the last upward (dawn) crossing of the given sun altitude.
+func (s Site) sunCrossings(alt float64, from, to time.Time) (dusk, dawn *time.Time) {
+	sunAlt := func(t time.Time) float64 { return s.SunHorizontal(t).Altitude }
+	return crossings(sunAlt, alt, from, to)
+}
+
+// crossings scans f between from and to and returns the first time it drops below threshold
+// and the last time it rises above it. Each crossing is refined by bisection.
+func crossings(f func(time.Time) float64, threshold float64, from, to time.Time) (down, up *time.Time) {
+	prevT := from
+	prev := f(from) - threshold
+	for t := from.Add(searchStep); !t.After(to); t = t.Add(searchStep) {
+		cur := f(t) - threshold
+		if prev >= 0 && cur < 0 && down == nil {
+			c := refine(f, threshold, prevT, t)
+			down = &c
+		} else if prev < 0 && cur >= 0 {
+			c := refine(f, threshold, prevT, t)
+			up = &c
+		}
+		prev, prevT = cur, t
+	}
+	return down, up
+}
+
+// refine narrows down a crossing of threshold between a and b.
+func refine(f func(time.Time) float64, threshold float64, a, b time.Time) time.Time {
+	aAbove := f(a) >= threshold
+	for b.Sub(a) > searchPrecision {
+		mid := a.Add(b.Sub(a) / 2)
+		if (f(mid) >= threshold) == aAbove {
+			a = mid
+		} else {
+			b = mid
+		}
+	}
+	return a.Add(b.Sub(a) / 2).Truncate(time.Second)
+}
+
+// Named sun events that can be used by schedules.
+const (
+	EventSunset           = "sunset"
+	EventCivilDusk        = "civil_dusk"
+	EventNauticalDusk     = "nautical_dusk"
+	EventAstronomicalDusk = "astronomical_dusk"
+	EventAstronomicalDawn = "astronomical_dawn"
+	EventNauticalDawn     = "nautical_dawn"
+	EventCivilDawn        = "civil_dawn"
+	EventSunrise          = "sunrise"
+)
+
+// SunEvent returns the sun altitude and direction of a named event. ok is false for unknown names.
+func (s Site) SunEvent(name string) (alt float64, rising bool, ok bool) {
+	switch name {
+	case EventSunset:
+		return altSunset - s.horizonDip(), false, true
+	case EventCivilDusk:
+		return altCivil, false, true
+	case EventNauticalDusk:
+		return altNautical, false, true
+	case EventAstronomicalDusk:
+		return altAstronomical, false, true
+	case EventAstronomicalDawn:
+		return altAstronomical, true, true
+	case EventNauticalDawn:
+		return altNautical, true, true
+	case EventCivilDawn:
+		return altCivil, true, true
+	case EventSunrise:
+		return altSunset - s.horizonDip(), true, true
+	}
+	return 0, false, false
+}
+
+// SunCrossing returns when the sun passes the given altitude during the night with the given label:
+// the evening crossing (setting) or the morning crossing (rising). It returns nil if the sun
+// does not reach that altitude in this night.
+func (s Site) SunCrossing(alt float64, rising bool, date string) (*time.Time, error) {
+	start, end, err := s.NoonSpan(date)
+	if err != nil {
+		return nil, err
+	}
+	down, up := s.sunCrossings(alt, start, end)
+	if rising {
+		return up, nil
+	}
+	return down, nil
+}
@@ -0,0 +1,100 @@
+package automation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/power"
+	"time"
+)
+
+// actionSpec is the action part shared by schedules and rules.
+type actionSpec struct {
+	Outputs      map[string]interface{}
+	HeaterManual map[string]float64
+	Scene        string
+	Sequence     string
+	Boost        *config.BoostAction
+}
+
+// runAction switches outputs through power.SetOutput (the Alpaca SetSwitchValue path),
+// sets heaters to manual power, applies a scene, starts a sequence or boosts a heater.
+func runAction(action actionSpec, source string) error {
+	switch {
+	case action.Scene != "":
+		scene, ok := power.FindScene(action.Scene)
+		if !ok {
+			return fmt.Errorf("unknown scene '%s'", action.Scene)
+		}
+		result, err := power.ApplyScene(scene, source)
+		if err != nil {
+			return err
+		}
+		if !result.Success {
+			return fmt.Errorf("%d output(s) did not reach their target", len(result.Failed))
+		}
+		return nil
+
+	case action.Sequence != "":
+		seq, ok := power.FindSequence(action.Sequence)
+		if !ok {
+			return fmt.Errorf("unknown sequence '%s'", action.Sequence)
+		}
+		power.StartSequence(seq, source)
+		return nil
+
+	case action.Boost != nil:
+		b := action.Boost
+		_, err := power.BoostHeater(b.Heater, b.Percent, time.Duration(b.Minutes*float64(time.Minute)), source)
+		return err
+	}
+
+	var failed []string
+	if err := setOutputs(action.Outputs, source); err != nil {
+		failed = append(failed, err.Error())
+	}
+	heaters := make([]string, 0, len(action.HeaterManual))
+	for key := range action.HeaterManual {
+		heaters = append(heaters, key)
+	}
+	sort.Strings(heaters)
+	for _, key := range heaters {
+		if err := power.SetHeaterManual(key, action.HeaterManual[key], source); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// setOutputs applies output targets (bool, voltage or manual power) one by one through power.SetOutput.
+func setOutputs(outputs map[string]interface{}, source string) error {
+	keys := make([]string, 0, len(outputs))
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var failed []string
+	for _, key := range keys {
+		var err error
+		switch target := outputs[key].(type) {
+		case bool:
+			err = power.SetOutput(key, target, nil, source)
+		case float64:
+			err = power.SetOutput(key, target > 0, &target, source)
+		default:
+			err = fmt.Errorf("invalid target %v", target)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	batteryStateFile      = "battery"
+	batterySaveInterval   = time.Minute
+	batteryMaxStep        = time.Minute     // Longer gaps between samples are not integrated
+	batteryStateMaxAge    = time.Hour       // An older saved state is replaced by the voltage estimate
+	batteryCurrentAverage = 5 * time.Minute // Time constant of the load average used for the runtime
+	minDischargeCurrent   = 0.01            // A; below this the runtime is unlimited
+	defaultRestCurrent    = 0.2
+	defaultRestMinutes    = 30.0
+	defaultFullSeconds    = 60.0
+)
+
+// Calibration sources of the state of charge.
+const (
+	CalibrationVoltage = "voltage" // Estimated from the voltage at startup, possibly under load
+	CalibrationRest    = "rest"    // Resting voltage after RestMinutes below RestCurrent
+	CalibrationFull    = "full"    // Voltage at or above FullVoltage for FullSeconds
+	CalibrationManual  = "manual"  // Set through the REST API
+)
+
+// socPoint is one point of a resting-voltage curve: the state of charge in % at a cell voltage.
+type socPoint struct {
+	soc   float64
+	volts float64
+}
+
+// socCurves are the resting cell voltages of each chemistry, in ascending order.
+var socCurves = map[string][]socPoint{
+	config.ChemistryLiFePO4: {
+		{0, 2.5}, {10, 3.0}, {20, 3.2}, {30, 3.225}, {40, 3.25}, {50, 3.2625},
+		{60, 3.275}, {70, 3.3}, {80, 3.325}, {90, 3.35}, {100, 3.4},
+	},
+	config.ChemistryAGM: {
+		{0, 1.75}, {10, 1.917}, {20, 1.942}, {30, 1.967}, {40, 1.983}, {50, 2.017},
+		{60, 2.033}, {70, 2.05}, {80, 2.083}, {90, 2.117}, {100, 2.133},
+	},
+	config.ChemistryLiIon: {
+		{0, 3.0}, {5, 3.3}, {10, 3.45}, {20, 3.6}, {30, 3.68}, {40, 3.74}, {50, 3.79},
+		{60, 3.85}, {70, 3.92}, {80, 4.0}, {90, 4.08}, {100, 4.2},
+	},
+}
+
+// defaultCells is the number of cells of a 12 V battery of each chemistry.
+var defaultCells = map[string]int{
+	config.ChemistryLiFePO4: 4,
+	config.ChemistryAGM:     6,
+	config.ChemistryLiIon:   3,
+}
+
+// BatteryStatus is the battery model configuration with its estimate, as returned by the REST API.
+type BatteryStatus struct {
+	config.Battery
+	SoC          *float64   `json:"soc"`          // State of charge in %
+	VoltageSoC   *float64   `json:"voltageSoc"`   // State of charge read from the curve at the present voltage
+	Voltage      *float64   `json:"voltage"`      // V
+	Current      *float64   `json:"current"`      // Load average in A
+	RemainingAh  *float64   `json:"remainingAh"`  // Charge above the reserve
+	RuntimeHours *float64   `json:"runtimeHours"` // At the load average; null while not discharging
+	EmptyAt      *time.Time `json:"emptyAt"`      // Time the reserve is reached
+	// NightEnd is the end of the current (or, during the day, the next) night according to the configured boundary.
+	NightEnd           *time.Time `json:"nightEnd"`
+	LastsUntilNightEnd *bool      `json:"lastsUntilNightEnd"`
+	RestingSince       *time.Time `json:"restingSince,omitempty"`
+	Calibrated         *time.Time `json:"calibrated"`
+	CalibrationSource  string     `json:"calibrationSource"`
+}
+
+// batteryState is persisted, so the coulomb count survives a restart of the proxy.
+type batteryState struct {
+	SoC               *float64   `json:"soc"`
+	Updated           time.Time  `json:"updated"`
+	Calibrated        *time.Time `json:"calibrated"`
+	CalibrationSource string     `json:"calibrationSource"`
+}
+
+var (
+	batteryMutex   sync.Mutex
+	battery        batteryState
+	batteryStarted bool // Set after the first sample since the start (or since the model was enabled)
+	batteryVoltage *float64
+	batteryAverage *float64 // A
+	batterySample  time.Time
+	batteryRest    time.Time
+	batteryFull    time.Time
+	batteryLogged  bool // The calibration of the present rest or full period has been logged
+	batterySaved   time.Time
+	batteryOnce    sync.Once
+)
+
+// StartBattery loads the saved state of charge and updates the estimate after every cache update.
+func StartBattery() {
+	batteryOnce.Do(func() {
+		if err := config.LoadState(batteryStateFile, &battery); err != nil {
+			logger.Warn("Battery: %v", err)
+		}
+		serial.OnCacheUpdate(evaluateBattery)
+	})
+}
+
+// evaluateBattery counts the charge drawn since the last cache update and recalibrates the state of
+// charge from the voltage whenever the battery rests or is full.
+func evaluateBattery(snapshot serial.CacheSnapshot) {
+	b := config.Get().Battery
+	v, okV := numericValue(snapshot.Conditions["v"])
+	amps, okI := numericValue(snapshot.Conditions["i"])
+	amps /= 1000 // Reported in mA
+	now := snapshot.Time
+
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	if !b.Enabled {
+		batteryStarted, batteryVoltage, batteryAverage = false, nil, nil
+		batterySample, batteryRest, batteryFull, batteryLogged = time.Time{}, time.Time{}, time.Time{}, false
+		return
+	}
+	if okV {
+		batteryVoltage = &v
+	} else {
+		batteryVoltage = nil
+	}
+
+	if !batteryStarted && okV {
+		batteryStarted = true
+		if battery.SoC == nil || now.Sub(battery.Updated) > batteryStateMaxAge {
+			calibrateBatteryLocked(b, v, now, CalibrationVoltage, true)
+		}
+	}
+
+	if okI {
+		if dt := now.Sub(batterySample); !batterySample.IsZero() && dt > 0 && dt <= batteryMaxStep {
+			if battery.SoC != nil {
+				soc := clampPercent(*battery.SoC - amps*dt.Hours()/b.CapacityAh*100)
+				battery.SoC = &soc
+				battery.Updated = now
+			}
+			avg := amps
+			if batteryAverage != nil {
+				avg = *batteryAverage + math.Min(1, dt.Seconds()/batteryCurrentAverage.Seconds())*(amps-*batteryAverage)
+			}
+			batteryAverage = &avg
+		} else if batteryAverage == nil {
+			batteryAverage = &amps
+		}
+		batterySample = now
+
+		if amps <= defaultIfZero(b.RestCurrent, defaultRestCurrent) {
+			if batteryRest.IsZero() {
+				batteryRest = now
+			}
+		} else if !batteryRest.IsZero() {
+			batteryRest, batteryLogged = time.Time{}, false
+		}
+	}
+
+	// While resting, the state of charge follows the curve.
+	if okV && !batteryRest.IsZero() && now.Sub(batteryRest) >= seconds(defaultIfZero(b.RestMinutes, defaultRestMinutes)*60) {
+		calibrateBatteryLocked(b, v, now, CalibrationRest, !batteryLogged)
+		batteryLogged = true
+	}
+
+	if okV && b.FullVoltage > 0 && v >= b.FullVoltage {
+		if batteryFull.IsZero() {
+			batteryFull = now
+		}
+		if now.Sub(batteryFull) >= seconds(defaultIfZero(b.FullSeconds, defaultFullSeconds)) {
+			if !batteryLogged {
+				logger.Info("Battery: %.2f V for %.0f s, state of charge reset to 100 %%.", v, defaultIfZero(b.FullSeconds, defaultFullSeconds))
+				batteryLogged = true
+			}
+			setBatterySoCLocked(100, now, CalibrationFull)
+		}
+	} else if !batteryFull.IsZero() {
+		batteryFull, batteryLogged = time.Time{}, false
+	}
+
+	if now.Sub(batterySaved) >= batterySaveInterval {
+		saveBatteryStateLocked(now)
+	}
+}
+
+// calibrateBatteryLocked sets the state of charge from the voltage curve. The caller must hold batteryMutex.
+func calibrateBatteryLocked(b config.Battery, voltage float64, now time.Time, source string, log bool) {
+	soc, ok := voltageSoC(b, voltage)
+	if !ok {
+		return
+	}
+	if log {
+		logger.Info("Battery: State of charge set to %.0f %% from %.2f V (%s).", soc, voltage, source)
+	}
+	setBatterySoCLocked(soc, now, source)
+}
+
+// setBatterySoCLocked replaces the state of charge. The caller must hold batteryMutex.
+func setBatterySoCLocked(soc float64, now time.Time, source string) {
+	battery.SoC = &soc
+	battery.Updated = now
+	battery.Calibrated = &now
+	battery.CalibrationSource = source
+}
+
+// voltageSoC reads the state of charge at a battery voltage from the curve of the configured chemistry.
+func voltageSoC(b config.Battery, voltage float64) (float64, bool) {
+	curve := socCurves[b.Chemistry]
+	if len(curve) == 0 {
+		return 0, false
+	}
+	cells := b.Cells
+	if cells == 0 {
+		cells = defaultCells[b.Chemistry]
+	}
+	cell := voltage / float64(cells)
+	if cell <= curve[0].volts {
+		return curve[0].soc, true
+	}
+	for i := 1; i < len(curve); i++ {
+		if cell <= curve[i].volts {
+			lo, hi := curve[i-1], curve[i]
+			return lo.soc + (cell-lo.volts)/(hi.volts-lo.volts)*(hi.soc-lo.soc), true
+		}
+	}
+	return curve[len(curve)-1].soc, true
+}
+
+func clampPercent(v float64) float64 {
+	return math.Max(0, math.Min(100, v))
+}
+
+// GetBatteryStatus returns the battery settings with the present estimate.
+func GetBatteryStatus() BatteryStatus {
+	b := config.Get().Battery
+	now := time.Now()
+
+	batteryMutex.Lock()
+	status := BatteryStatus{
+		Battery: b, Voltage: batteryVoltage, Current: batteryAverage,
+		Calibrated: battery.Calibrated, CalibrationSource: battery.CalibrationSource,
+	}
+	if b.Enabled {
+		status.SoC = battery.SoC
+		if !batteryRest.IsZero() {
+			rest := batteryRest
+			status.RestingSince = &rest
+		}
+	}
+	batteryMutex.Unlock()
+
+	if !b.Enabled {
+		return status
+	}
+	if status.Voltage != nil {
+		if soc, ok := voltageSoC(b, *status.Voltage); ok {
+			status.VoltageSoC = &soc
+		}
+	}
+	remaining, runtime := batteryRuntime(b, status.SoC, status.Current)
+	status.RemainingAh, status.RuntimeHours = remaining, runtime
+
+	nightEnd, err := upcomingNightEnd(now)
+	if err != nil {
+		logger.Warn("Battery: %v", err)
+	} else {
+		status.NightEnd = &nightEnd
+	}
+	if runtime != nil {
+		empty := now.Add(time.Duration(*runtime * float64(time.Hour)))
+		status.EmptyAt = &empty
+	}
+	if remaining != nil && status.NightEnd != nil {
+		lasts := status.EmptyAt == nil || status.EmptyAt.After(nightEnd)
+		status.LastsUntilNightEnd = &lasts
+	}
+	return status
+}
+
+// BatteryEstimate returns the state of charge in % and the runtime at the present load in hours.
+// Both are nil while the battery model is disabled or has no estimate yet; the runtime is also nil
+// while the battery is not being discharged.
+func BatteryEstimate() (soc, runtimeHours *float64) {
+	b := config.Get().Battery
+	if !b.Enabled {
+		return nil, nil
+	}
+	batteryMutex.Lock()
+	soc, current := battery.SoC, batteryAverage
+	batteryMutex.Unlock()
+	_, runtimeHours = batteryRuntime(b, soc, current)
+	return soc, runtimeHours
+}
+
+// batteryRuntime computes the charge above the reserve and how long it lasts at the given current.
+func batteryRuntime(b config.Battery, soc, current *float64) (remainingAh, runtimeHours *float64) {
+	if soc == nil {
+		return nil, nil
+	}
+	remaining := math.Max(0, *soc-b.ReservePercent) / 100 * b.CapacityAh
+	remainingAh = &remaining
+	if current != nil && *current >= minDischargeCurrent {
+		hours := remaining / *current
+		runtimeHours = &hours
+	}
+	return remainingAh, runtimeHours
+}
+
+// upcomingNightEnd returns the end of the night in progress or, once it has ended, of the next night.
+func upcomingNightEnd(now time.Time) (time.Time, error) {
+	site := astro.CurrentSite()
+	date := site.NightOf(now)
+	night, err := site.Night(date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if night.End.After(now) {
+		return night.End, nil
+	}
+	day, err := site.ParseDate(date)
+	if err != nil {
+		return time.Time{}, err
+	}
+	night, err = site.Night(day.AddDate(0, 0, 1).Format(astro.DateLayout))
+	return night.End, err
+}
+
+// ResetBattery sets the state of charge, e.g. to 100 % after charging the battery elsewhere.
+func ResetBattery(soc float64) error {
+	if !config.Get().Battery.Enabled {
+		return fmt.Errorf("the battery model is disabled")
+	}
+	if soc < 0 || soc > 100 {
+		return fmt.Errorf("state of charge must be between 0 and 100 %%")
+	}
+	now := time.Now()
+	batteryMutex.Lock()
+	defer batteryMutex.Unlock()
+	setBatterySoCLocked(soc, now, CalibrationManual)
+	batteryStarted = true // Keep the value even if no sample arrived since the start
+	saveBatteryStateLocked(now)
+	logger.Info("Battery: State of charge set to %.0f %% via API.", soc)
+	return nil
+}
+
+// saveBatteryStateLocked persists the state of charge. The caller must hold batteryMutex.
+func saveBatteryStateLocked(now time.Time) {
+	batterySaved = now
+	if err := config.SaveState(batteryStateFile, battery); err != nil {
+		logger.Error("Battery: Failed to persist state: %v", err)
+	}
+}
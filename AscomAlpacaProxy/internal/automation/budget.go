@@ -0,0 +1,365 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	budgetStateFile       = "power_budget"
+	budgetSource          = "power budget"
+	defaultBudgetStep     = 10.0
+	defaultBudgetHeadroom = 10.0
+	defaultBudgetRestore  = 30.0
+)
+
+// HeaterThrottle describes a heater whose power is limited by the power budget.
+// Manual-mode heaters are limited through a RAM override of their power ("pwm"), so the flash is not
+// written on every step; all other modes through their maximum power ("xp"). Original is written
+// back when the heater is released, unless the value was changed by someone else in the meantime.
+type HeaterThrottle struct {
+	Heater   string    `json:"heater"`
+	Field    string    `json:"field"`
+	Original float64   `json:"original"`
+	Limit    float64   `json:"limit"` // Current power limit in %
+	Since    time.Time `json:"since"`
+}
+
+// PowerBudgetStatus is the power budget configuration with its runtime state, as returned by the REST API.
+type PowerBudgetStatus struct {
+	config.PowerBudget
+	Current   *float64         `json:"current"` // Measured total current in A
+	Power     *float64         `json:"power"`   // Measured total power in W
+	OverLimit bool             `json:"overLimit"`
+	Throttled []HeaterThrottle `json:"throttled"`
+}
+
+var (
+	budgetMutex     sync.Mutex
+	budgetThrottles = make(map[string]*HeaterThrottle) // Persisted, so a restart can still restore the heaters
+	budgetCurrent   *float64
+	budgetPower     *float64
+	budgetOver      bool
+	headroomSince   time.Time
+	budgetBusy      bool
+	budgetOnce      sync.Once
+)
+
+// StartPowerBudget loads the throttle state and checks the budget after every cache update.
+func StartPowerBudget() {
+	budgetOnce.Do(func() {
+		if err := config.LoadState(budgetStateFile, &budgetThrottles); err != nil {
+			logger.Warn("Power budget: %v", err)
+		}
+		if budgetThrottles == nil {
+			budgetThrottles = make(map[string]*HeaterThrottle)
+		}
+		serial.OnCacheUpdate(evaluatePowerBudget)
+	})
+}
+
+// GetPowerBudgetStatus returns the settings, the last measurement and the throttled heaters.
+func GetPowerBudgetStatus() PowerBudgetStatus {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	status := PowerBudgetStatus{
+		PowerBudget: config.Get().PowerBudget,
+		Current:     budgetCurrent,
+		Power:       budgetPower,
+		OverLimit:   budgetOver,
+		Throttled:   []HeaterThrottle{},
+	}
+	for _, key := range throttledHeatersLocked() {
+		status.Throttled = append(status.Throttled, *budgetThrottles[key])
+	}
+	return status
+}
+
+// HeaterLimits returns the current power limit in % of each throttled heater.
+func HeaterLimits() map[string]float64 {
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	limits := make(map[string]float64, len(budgetThrottles))
+	for key, t := range budgetThrottles {
+		limits[key] = t.Limit
+	}
+	return limits
+}
+
+// evaluatePowerBudget compares the measured total with the budget after every cache update.
+// Heater adjustments need several serial commands, so they run in a goroutine; while one is
+// in progress, further cycles only update the measurement.
+func evaluatePowerBudget(snapshot serial.CacheSnapshot) {
+	pb := config.Get().PowerBudget
+	current, okI := numericValue(snapshot.Conditions["i"])
+	pwr, okP := numericValue(snapshot.Conditions["p"])
+
+	budgetMutex.Lock()
+	defer budgetMutex.Unlock()
+	if okI {
+		current /= 1000 // Reported in mA
+		budgetCurrent = &current
+	}
+	if okP {
+		budgetPower = &pwr
+	}
+
+	if !pb.Enabled {
+		budgetOver = false
+		if len(budgetThrottles) > 0 && !budgetBusy {
+			budgetBusy = true
+			go adjustHeaters(nil, 0, "power budget disabled")
+		}
+		return
+	}
+
+	headroom := 1 - defaultIfZero(pb.HeadroomPercent, defaultBudgetHeadroom)/100
+	over, hasHeadroom := false, true
+	if pb.MaxCurrent > 0 && okI {
+		over = over || current > pb.MaxCurrent
+		hasHeadroom = hasHeadroom && current < pb.MaxCurrent*headroom
+	}
+	if pb.MaxPower > 0 && okP {
+		over = over || pwr > pb.MaxPower
+		hasHeadroom = hasHeadroom && pwr < pb.MaxPower*headroom
+	}
+	budgetOver = over
+	if budgetBusy {
+		return
+	}
+
+	step := defaultIfZero(pb.StepPercent, defaultBudgetStep)
+	switch {
+	case over:
+		headroomSince = time.Time{}
+		if heaters := heatersToThrottleLocked(pb, snapshot.Status); len(heaters) > 0 {
+			budgetBusy = true
+			go adjustHeaters(heaters, -step, fmt.Sprintf("over budget (%s)", measurementText(budgetCurrent, budgetPower)))
+		}
+
+	case hasHeadroom && len(budgetThrottles) > 0:
+		if headroomSince.IsZero() {
+			headroomSince = snapshot.Time
+		}
+		if snapshot.Time.Sub(headroomSince) < seconds(defaultIfZero(pb.RestoreSeconds, defaultBudgetRestore)) {
+			return
+		}
+		headroomSince = snapshot.Time // Wait again before the next release step
+		budgetBusy = true
+		go adjustHeaters(throttledHeatersLocked(), step, "headroom available")
+
+	default:
+		headroomSince = time.Time{}
+	}
+}
+
+// adjustHeaters changes the limit of the given heaters by delta percent. Negative deltas throttle,
+// positive ones release; a heater whose limit reaches its original value is restored completely.
+// With heaters == nil, all throttled heaters are restored at once.
+func adjustHeaters(heaters []string, delta float64, reason string) {
+	defer func() {
+		budgetMutex.Lock()
+		budgetBusy = false
+		budgetMutex.Unlock()
+	}()
+	pb := config.Get().PowerBudget
+
+	restoreAll := heaters == nil
+	if restoreAll {
+		budgetMutex.Lock()
+		heaters = throttledHeatersLocked()
+		budgetMutex.Unlock()
+	}
+
+	for _, key := range heaters {
+		// A boost overrides the throttled settings and writes them back when it ends; release afterwards.
+		if power.IsBoosted(key) {
+			continue
+		}
+
+		budgetMutex.Lock()
+		var throttle *HeaterThrottle
+		if t, ok := budgetThrottles[key]; ok {
+			copied := *t
+			throttle = &copied
+		}
+		budgetMutex.Unlock()
+
+		if throttle == nil {
+			if delta >= 0 {
+				continue
+			}
+			var err error
+			if throttle, err = newHeaterThrottle(key); err != nil {
+				logger.Warn("Power budget: Cannot throttle %s: %v", key, err)
+				continue
+			}
+		}
+
+		limit := throttle.Limit + delta
+		restore := restoreAll || limit >= throttle.Original
+		if restore {
+			limit = throttle.Original
+		} else {
+			limit = math.Max(limit, math.Min(pb.MinPercent, throttle.Original))
+		}
+
+		// Releasing must not undo a change made while the heater was throttled.
+		if delta >= 0 {
+			if current, err := heaterLimit(key, throttle.Field); err != nil {
+				logger.Warn("Power budget: Cannot read %s of %s, will retry: %v", throttle.Field, key, err)
+				continue
+			} else if math.Abs(current-math.Round(throttle.Limit)) >= 1 {
+				budgetMutex.Lock()
+				delete(budgetThrottles, key)
+				saveBudgetStateLocked()
+				budgetMutex.Unlock()
+				logger.Info("Power budget: %s released, %s was changed to %.0f%% in the meantime and is kept (%s).", key, throttle.Field, current, reason)
+				continue
+			}
+		}
+
+		if err := setHeaterLimit(key, throttle.Field, limit); err != nil {
+			logger.Error("Power budget: Failed to set %s of %s: %v", throttle.Field, key, err)
+			continue
+		}
+
+		budgetMutex.Lock()
+		if restore {
+			delete(budgetThrottles, key)
+			logger.Info("Power budget: %s released, %s restored to %.0f%% (%s).", key, throttle.Field, limit, reason)
+		} else {
+			throttle.Limit = limit
+			budgetThrottles[key] = throttle
+			logger.Info("Power budget: %s limited to %.0f%% (%s).", key, limit, reason)
+		}
+		saveBudgetStateLocked()
+		budgetMutex.Unlock()
+	}
+}
+
+// newHeaterThrottle reads the heater's config and starts throttling from its current output power.
+func newHeaterThrottle(key string) (*HeaterThrottle, error) {
+	hc, err := power.GetHeaterConfig(key)
+	if err != nil {
+		return nil, err
+	}
+	mode, _ := hc["m"].(float64)
+	field, configField := "xp", "xp"
+	if mode == 0 {
+		field, configField = "pwm", "mp" // Manual mode ignores the maximum power
+	}
+	original, ok := hc[configField].(float64)
+	if !ok {
+		original = 100
+	}
+
+	// Start from what the heater actually delivers, so the first step has an effect.
+	start := original
+	serial.Conditions.RLock()
+	if p, ok := numericValue(serial.Conditions.Data[key]); ok && p < start {
+		start = p
+	}
+	serial.Conditions.RUnlock()
+	return &HeaterThrottle{Heater: key, Field: field, Original: original, Limit: start, Since: time.Now()}, nil
+}
+
+// heatersToThrottleLocked returns the heaters that are on and can still be limited; a heater at its
+// minimum cannot help any more. Boosted heaters are left alone, the boost was requested deliberately
+// and ends by itself. The caller must hold budgetMutex.
+func heatersToThrottleLocked(pb config.PowerBudget, status map[string]interface{}) []string {
+	var heaters []string
+	for _, key := range budgetHeaters(pb) {
+		if power.IsBoosted(key) || !power.IsOn(status[config.ShortSwitchIDMap[key]]) {
+			continue
+		}
+		if t := budgetThrottles[key]; t == nil || t.Limit > pb.MinPercent {
+			heaters = append(heaters, key)
+		}
+	}
+	return heaters
+}
+
+// setHeaterLimit sets the power limit of a heater: a RAM override for "pwm", a config write otherwise.
+func setHeaterLimit(key, field string, limit float64) error {
+	if field == "pwm" {
+		_, err := power.Set(map[string]interface{}{config.ShortSwitchIDMap[key]: math.Round(limit)}, budgetSource)
+		return err
+	}
+	return power.SetHeaterConfig(key, map[string]interface{}{field: math.Round(limit)}, budgetSource)
+}
+
+// heaterLimit returns the current value of the field a heater is throttled through.
+func heaterLimit(key, field string) (float64, error) {
+	if field == "pwm" {
+		serial.Conditions.RLock()
+		p, ok := numericValue(serial.Conditions.Data[key])
+		serial.Conditions.RUnlock()
+		if !ok {
+			return 0, fmt.Errorf("no power reading")
+		}
+		return p, nil
+	}
+	hc, err := power.GetHeaterConfig(key)
+	if err != nil {
+		return 0, err
+	}
+	value, ok := hc[field].(float64)
+	if !ok {
+		return 0, fmt.Errorf("firmware config has no %s", field)
+	}
+	return value, nil
+}
+
+// budgetHeaters returns the heaters the budget may throttle.
+func budgetHeaters(pb config.PowerBudget) []string {
+	if len(pb.Heaters) == 0 {
+		return []string{"pwm1", "pwm2"}
+	}
+	return pb.Heaters
+}
+
+// throttledHeatersLocked returns the throttled heaters in a stable order. The caller must hold budgetMutex.
+func throttledHeatersLocked() []string {
+	keys := make([]string, 0, len(budgetThrottles))
+	for key := range budgetThrottles {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func measurementText(current, pwr *float64) string {
+	text := ""
+	if current != nil {
+		text = fmt.Sprintf("%.2f A", *current)
+	}
+	if pwr != nil {
+		if text != "" {
+			text += ", "
+		}
+		text += fmt.Sprintf("%.1f W", *pwr)
+	}
+	return text
+}
+
+func defaultIfZero(v, def float64) float64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
+
+// saveBudgetStateLocked persists the throttled heaters. The caller must hold budgetMutex.
+func saveBudgetStateLocked() {
+	if err := config.SaveState(budgetStateFile, budgetThrottles); err != nil {
+		logger.Error("Power budget: Failed to persist state: %v", err)
+	}
+}
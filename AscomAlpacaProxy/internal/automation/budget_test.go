@@ -0,0 +1,64 @@
+package automation
+
+import (
+	"reflect"
+	"testing"
+
+	"sv241pro-alpaca-proxy/internal/config"
+)
+
+func TestHeatersToThrottle(t *testing.T) {
+	tests := []struct {
+		name      string
+		pb        config.PowerBudget
+		status    map[string]interface{}
+		throttles map[string]*HeaterThrottle
+		want      []string
+	}{
+		{
+			// Heaters in manual mode report their power in %, the other modes true/false.
+			name:   "manual heater reported as percent",
+			status: map[string]interface{}{"pwm1": 60.0, "pwm2": true},
+			want:   []string{"pwm1", "pwm2"},
+		},
+		{
+			name:   "heaters off",
+			status: map[string]interface{}{"pwm1": 0.0, "pwm2": false},
+			want:   nil,
+		},
+		{
+			name:   "configured heaters only",
+			pb:     config.PowerBudget{Heaters: []string{"pwm2"}},
+			status: map[string]interface{}{"pwm1": 60.0, "pwm2": 30.0},
+			want:   []string{"pwm2"},
+		},
+		{
+			name:      "heater at its minimum",
+			pb:        config.PowerBudget{MinPercent: 20},
+			status:    map[string]interface{}{"pwm1": 20.0, "pwm2": 50.0},
+			throttles: map[string]*HeaterThrottle{"pwm1": {Heater: "pwm1", Field: "pwm", Original: 80, Limit: 20}},
+			want:      []string{"pwm2"},
+		},
+		{
+			name:      "throttled heater above its minimum",
+			pb:        config.PowerBudget{MinPercent: 20},
+			status:    map[string]interface{}{"pwm1": 40.0},
+			throttles: map[string]*HeaterThrottle{"pwm1": {Heater: "pwm1", Field: "pwm", Original: 80, Limit: 40}},
+			want:      []string{"pwm1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			budgetMutex.Lock()
+			budgetThrottles = tt.throttles
+			if budgetThrottles == nil {
+				budgetThrottles = make(map[string]*HeaterThrottle)
+			}
+			got := heatersToThrottleLocked(tt.pb, tt.status)
+			budgetMutex.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("heatersToThrottleLocked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
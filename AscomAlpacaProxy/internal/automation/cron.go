@@ -0,0 +1,123 @@
+package automation
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five-field cron expression ("minute hour day-of-month month day-of-week").
+// Each field supports "*", numbers, ranges ("1-5"), lists ("1,15") and steps ("*/10", "0-30/5").
+type cronSpec struct {
+	minute, hour, dom, month, dow [64]bool
+	domAny, dowAny                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are Sunday
+}
+
+// parseCron parses a five-field cron expression.
+func parseCron(expr string) (*cronSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression '%s' must have 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+
+	spec := &cronSpec{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	targets := []*[64]bool{&spec.minute, &spec.hour, &spec.dom, &spec.month, &spec.dow}
+	for i, field := range fields {
+		if err := parseCronField(field, cronFields[i].min, cronFields[i].max, targets[i]); err != nil {
+			return nil, fmt.Errorf("cron %s field '%s': %w", cronFields[i].name, field, err)
+		}
+	}
+	if spec.dow[7] {
+		spec.dow[0] = true
+	}
+	return spec, nil
+}
+
+func parseCronField(field string, min, max int, set *[64]bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			s, err := strconv.Atoi(part[idx+1:])
+			if err != nil || s <= 0 {
+				return fmt.Errorf("invalid step")
+			}
+			step = s
+			part = part[:idx]
+		}
+
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return fmt.Errorf("invalid value '%s'", bounds[0])
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return fmt.Errorf("invalid value '%s'", bounds[1])
+				}
+			} else if step > 1 {
+				hi = max // "5/15" means "5-max/15"
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return fmt.Errorf("value out of range %d-%d", min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return nil
+}
+
+// matches reports whether the minute containing t matches the expression.
+// As in standard cron, day-of-month and day-of-week are OR-ed if both are restricted.
+func (c *cronSpec) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	domMatch, dowMatch := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dowMatch
+	case c.dowAny:
+		return domMatch
+	}
+	return domMatch || dowMatch
+}
+
+// previous returns the latest matching minute in (after, until], or the zero time if there is none.
+func (c *cronSpec) previous(after, until time.Time) time.Time {
+	for t := until.Truncate(time.Minute); t.After(after); t = t.Add(-time.Minute) {
+		if c.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// next returns the first matching minute after t within the given horizon, or the zero time.
+func (c *cronSpec) next(t time.Time, horizon time.Duration) time.Time {
+	limit := t.Add(horizon)
+	for m := t.Truncate(time.Minute).Add(time.Minute); !m.After(limit); m = m.Add(time.Minute) {
+		if c.matches(m) {
+			return m
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,167 @@
+package automation
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// setValues returns the values set in a parsed cron field.
+func setValues(set [64]bool) []int {
+	var values []int
+	for v, ok := range set {
+		if ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		min, max int
+		want     []int
+	}{
+		{"single value", "5", 0, 59, []int{5}},
+		{"lower bound", "0", 0, 59, []int{0}},
+		{"upper bound", "59", 0, 59, []int{59}},
+		{"wildcard", "*", 1, 12, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}},
+		{"range", "1-5", 0, 7, []int{1, 2, 3, 4, 5}},
+		{"list", "1,15,30", 1, 31, []int{1, 15, 30}},
+		{"list of ranges", "1-2,22-23", 0, 23, []int{1, 2, 22, 23}},
+		{"wildcard step", "*/15", 0, 59, []int{0, 15, 30, 45}},
+		{"wildcard step from 1", "*/5", 1, 12, []int{1, 6, 11}},
+		{"range step", "0-30/10", 0, 59, []int{0, 10, 20, 30}},
+		{"range step not reaching end", "1-10/4", 0, 59, []int{1, 5, 9}},
+		{"value step runs to max", "50/4", 0, 59, []int{50, 54, 58}},
+		{"step of one", "20-22/1", 0, 23, []int{20, 21, 22}},
+		{"overlapping list", "1-3,2-4", 0, 59, []int{1, 2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var set [64]bool
+			if err := parseCronField(tt.field, tt.min, tt.max, &set); err != nil {
+				t.Fatalf("parseCronField(%q): %v", tt.field, err)
+			}
+			if got := setValues(set); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCronField(%q) = %v, want %v", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCronFieldErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		min, max int
+	}{
+		{"below range", "0", 1, 31},
+		{"above range", "60", 0, 59},
+		{"range above max", "20-24", 0, 23},
+		{"reversed range", "5-1", 0, 59},
+		{"zero step", "*/0", 0, 59},
+		{"negative step", "*/-5", 0, 59},
+		{"missing step", "*/", 0, 59},
+		{"text", "mon", 0, 7},
+		{"empty", "", 0, 59},
+		{"empty list entry", "1,,2", 0, 59},
+		{"open range", "5-", 0, 59},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var set [64]bool
+			if err := parseCronField(tt.field, tt.min, tt.max, &set); err == nil {
+				t.Errorf("parseCronField(%q) succeeded, want an error", tt.field)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+	}
+	for _, expr := range tests {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	at := func(value string) time.Time {
+		ts, err := time.ParseInLocation("2006-01-02 15:04", value, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts
+	}
+	// 2024-01-07 is a Sunday, 2024-01-15 a Monday.
+	tests := []struct {
+		name string
+		expr string
+		time string
+		want bool
+	}{
+		{"every minute", "* * * * *", "2024-01-15 13:37", true},
+		{"minute step match", "*/15 * * * *", "2024-01-15 13:45", true},
+		{"minute step miss", "*/15 * * * *", "2024-01-15 13:46", false},
+		{"hour range", "0 18-23 * * *", "2024-01-15 22:00", true},
+		{"hour range miss", "0 18-23 * * *", "2024-01-15 06:00", false},
+		{"sunday as 0", "0 12 * * 0", "2024-01-07 12:00", true},
+		{"sunday as 7", "0 12 * * 7", "2024-01-07 12:00", true},
+		{"weekdays miss on sunday", "0 12 * * 1-5", "2024-01-07 12:00", false},
+		{"weekdays match on monday", "0 12 * * 1-5", "2024-01-15 12:00", true},
+		{"month", "0 0 1 1 *", "2024-01-01 00:00", true},
+		{"month miss", "0 0 1 2 *", "2024-01-01 00:00", false},
+		{"day of month or day of week: dom", "0 0 15 * 0", "2024-01-15 00:00", true},
+		{"day of month or day of week: dow", "0 0 15 * 0", "2024-01-07 00:00", true},
+		{"day of month or day of week: neither", "0 0 15 * 0", "2024-01-08 00:00", false},
+		{"day of month only", "0 0 15 * *", "2024-01-07 00:00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if got := spec.matches(at(tt.time)); got != tt.want {
+				t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.time, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNextAndPrevious(t *testing.T) {
+	spec, err := parseCron("30 21 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 15, 22, 10, 20, 0, time.Local)
+
+	wantNext := time.Date(2024, 1, 16, 21, 30, 0, 0, time.Local)
+	if got := spec.next(now, 48*time.Hour); !got.Equal(wantNext) {
+		t.Errorf("next = %v, want %v", got, wantNext)
+	}
+	if got := spec.next(now, time.Hour); !got.IsZero() {
+		t.Errorf("next beyond horizon = %v, want zero time", got)
+	}
+
+	wantPrevious := time.Date(2024, 1, 15, 21, 30, 0, 0, time.Local)
+	if got := spec.previous(now.Add(-time.Hour), now); !got.Equal(wantPrevious) {
+		t.Errorf("previous = %v, want %v", got, wantPrevious)
+	}
+	if got := spec.previous(wantPrevious, now); !got.IsZero() {
+		t.Errorf("previous with exclusive lower bound = %v, want zero time", got)
+	}
+}
@@ -0,0 +1,257 @@
+package automation
+
+import (
+	"fmt"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	dewGuardStateFile       = "dew_guard"
+	dewGuardSource          = "dew guard"
+	maxDewGuardHistory      = 100
+	defaultDewAlertInterval = 15.0
+)
+
+// Dew risk levels as reported by the REST API.
+const (
+	DewRiskUnknown  = "unknown"  // No dew point or temperature available
+	DewRiskLow      = "low"      // Margin at least twice the threshold
+	DewRiskElevated = "elevated" // Margin below twice the threshold
+	DewRiskHigh     = "high"     // Margin below the threshold
+)
+
+// DewGuardHeater is the state of a guarded heater.
+type DewGuardHeater struct {
+	Heater  string   `json:"heater"`
+	On      bool     `json:"on"`
+	Power   *float64 `json:"power"`   // Current output in %
+	Heating bool     `json:"heating"` // On and producing more than 0 %
+}
+
+// DewGuardEvent is one reaction of the dew guard.
+type DewGuardEvent struct {
+	Time    time.Time `json:"time"`
+	Margin  float64   `json:"margin"`
+	Probe   string    `json:"probe"`   // Temperature used for the margin ("t_lens" or "t_amb")
+	Heaters []string  `json:"heaters"` // Heaters that were not heating
+	Action  string    `json:"action"`
+	Success bool      `json:"success"`
+	Message string    `json:"message"`
+}
+
+// DewGuardStatus is the dew guard configuration with its runtime state, as returned by the REST API.
+type DewGuardStatus struct {
+	config.DewGuard
+	Margin       *float64         `json:"margin"`
+	Probe        string           `json:"probe,omitempty"`
+	Risk         string           `json:"risk"`
+	Triggered    bool             `json:"triggered"` // Reacted and waiting for the margin to recover
+	PendingSince *time.Time       `json:"pendingSince,omitempty"`
+	HeaterStates []DewGuardHeater `json:"heaterStates"`
+	History      []DewGuardEvent  `json:"history"` // Most recent first
+}
+
+var (
+	dewMutex        sync.Mutex
+	dewMargin       *float64
+	dewProbe        string
+	dewHeaters      []DewGuardHeater
+	dewPending      time.Time
+	dewTriggered    bool
+	dewLastReaction time.Time
+	dewHistory      []DewGuardEvent // Persisted
+	dewOnce         sync.Once
+)
+
+// StartDewGuard loads the event history and checks the dew margin after every cache update.
+func StartDewGuard() {
+	dewOnce.Do(func() {
+		if err := config.LoadState(dewGuardStateFile, &dewHistory); err != nil {
+			logger.Warn("Dew guard: %v", err)
+		}
+		serial.OnCacheUpdate(evaluateDewGuard)
+	})
+}
+
+// GetDewGuardStatus returns the settings, the current dew risk and the recent reactions.
+func GetDewGuardStatus() DewGuardStatus {
+	dg := config.Get().DewGuard
+
+	dewMutex.Lock()
+	defer dewMutex.Unlock()
+	status := DewGuardStatus{
+		DewGuard:     dg,
+		Margin:       dewMargin,
+		Probe:        dewProbe,
+		Risk:         DewRiskUnknown,
+		Triggered:    dewTriggered,
+		HeaterStates: append([]DewGuardHeater{}, dewHeaters...),
+		History:      make([]DewGuardEvent, 0, len(dewHistory)),
+	}
+	if dewMargin != nil {
+		status.Risk = dewRisk(*dewMargin, dg.Threshold)
+	}
+	if !dewPending.IsZero() {
+		pending := dewPending
+		status.PendingSince = &pending
+	}
+	for i := len(dewHistory) - 1; i >= 0; i-- {
+		status.History = append(status.History, dewHistory[i])
+	}
+	return status
+}
+
+// dewRisk classifies a dew margin. Without a configured threshold, 2 °C is used.
+func dewRisk(margin, threshold float64) string {
+	threshold = defaultIfZero(threshold, 2)
+	switch {
+	case margin < threshold:
+		return DewRiskHigh
+	case margin < 2*threshold:
+		return DewRiskElevated
+	}
+	return DewRiskLow
+}
+
+// evaluateDewGuard compares the optics temperature with the dew point after every cache update.
+func evaluateDewGuard(snapshot serial.CacheSnapshot) {
+	dg := config.Get().DewGuard
+
+	dewMutex.Lock()
+	defer dewMutex.Unlock()
+
+	dewHeaters = guardedHeaters(dg, snapshot)
+	dewMargin, dewProbe = nil, ""
+	dewPoint, okD := numericValue(snapshot.Conditions["d"])
+	for _, probe := range []string{"t_lens", "t_amb"} {
+		if t, ok := numericValue(snapshot.Conditions[probe]); ok && okD {
+			margin := t - dewPoint
+			dewMargin, dewProbe = &margin, probe
+			break
+		}
+	}
+	if !dg.Enabled || dewMargin == nil {
+		dewPending = time.Time{}
+		dewTriggered = false
+		return
+	}
+	margin := *dewMargin
+	now := snapshot.Time
+
+	if margin >= dg.Threshold+dg.Hysteresis {
+		if dewTriggered {
+			logger.Info("Dew guard: Dew margin recovered (%.1f °C), re-armed.", margin)
+		}
+		dewPending = time.Time{}
+		dewTriggered = false
+		return
+	}
+	if margin >= dg.Threshold {
+		dewPending = time.Time{}
+		return
+	}
+
+	if dewPending.IsZero() {
+		dewPending = now
+	}
+	if now.Sub(dewPending) < seconds(dg.SustainSeconds) {
+		return
+	}
+
+	var idle []string
+	for _, h := range dewHeaters {
+		if !h.Heating {
+			idle = append(idle, h.Heater)
+		}
+	}
+	if len(idle) == 0 {
+		return
+	}
+	// React once, then repeat only after the alert interval while heaters are still not heating.
+	if dewTriggered && now.Sub(dewLastReaction) < seconds(defaultIfZero(dg.AlertIntervalMinutes, defaultDewAlertInterval)*60) {
+		return
+	}
+	dewTriggered = true
+	dewLastReaction = now
+	go reactToDew(dg, margin, dewProbe, idle)
+}
+
+// guardedHeaters returns the state of the heaters the dew guard watches.
+func guardedHeaters(dg config.DewGuard, snapshot serial.CacheSnapshot) []DewGuardHeater {
+	keys := dg.Heaters
+	if len(keys) == 0 {
+		keys = []string{"pwm1", "pwm2"}
+	}
+	heaters := make([]DewGuardHeater, 0, len(keys))
+	for _, key := range keys {
+		val, reported := snapshot.Status[config.ShortSwitchIDMap[key]]
+		if !reported {
+			continue // Disabled in the firmware
+		}
+		h := DewGuardHeater{Heater: key, On: power.IsOn(val)}
+		if p, ok := numericValue(snapshot.Conditions[key]); ok {
+			h.Power = &p
+		}
+		h.Heating = h.On && (h.Power == nil || *h.Power > 0)
+		heaters = append(heaters, h)
+	}
+	return heaters
+}
+
+// reactToDew alerts and applies the configured action to the heaters that are not heating.
+func reactToDew(dg config.DewGuard, margin float64, probe string, heaters []string) {
+	action := dg.Action
+	if action == "" {
+		action = config.DewGuardAlert
+	}
+	event := DewGuardEvent{Time: time.Now(), Margin: margin, Probe: probe, Heaters: heaters, Action: action, Success: true, Message: "OK"}
+
+	var failed []string
+	for _, heater := range heaters {
+		var err error
+		switch action {
+		case config.DewGuardEnable:
+			err = power.SetOutput(heater, true, nil, dewGuardSource)
+		case config.DewGuardManual:
+			err = power.SetHeaterManual(heater, dg.ManualPercent, dewGuardSource)
+		case config.DewGuardBoost:
+			_, err = power.BoostHeater(heater, dg.ManualPercent, time.Duration(dg.BoostMinutes*float64(time.Minute)), dewGuardSource)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", heater, err))
+		}
+	}
+	if len(failed) > 0 {
+		event.Success = false
+		event.Message = strings.Join(failed, "; ")
+	}
+
+	message := fmt.Sprintf("Dew margin %.1f °C (%s), %s not heating.", margin, probe, outputList(heaters))
+	switch action {
+	case config.DewGuardEnable:
+		message += " Heater switched on."
+	case config.DewGuardManual:
+		message += fmt.Sprintf(" Heater set to %.0f%%.", dg.ManualPercent)
+	case config.DewGuardBoost:
+		message += fmt.Sprintf(" Heater boosted to %.0f%% for %.0f min.", dg.ManualPercent, dg.BoostMinutes)
+	}
+	logger.Warn("Dew guard: %s Result: %s", message, event.Message)
+	events.Notify("Dew imminent", message)
+
+	dewMutex.Lock()
+	defer dewMutex.Unlock()
+	dewHistory = append(dewHistory, event)
+	if len(dewHistory) > maxDewGuardHistory {
+		dewHistory = dewHistory[len(dewHistory)-maxDewGuardHistory:]
+	}
+	if err := config.SaveState(dewGuardStateFile, dewHistory); err != nil {
+		logger.Error("Dew guard: Failed to persist history: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rule conditions are small arithmetic expressions over the sensor and status values:
+//
+//	h_amb > 90
+//	t_lens - d < 2 && pwm1 == 0
+//	v < 11.8 || (i > 8000 and dc5)
+//
+// Supported are numbers, value names, + - * /, parentheses, the comparisons < <= > >= == !=
+// and && / || (also written "and" / "or"). Comparisons and switch states evaluate to 1 or 0;
+// any non-zero value counts as true.
+
+// lookupFunc resolves a value name. ok is false if the value is not available.
+type lookupFunc func(name string) (value float64, ok bool)
+
+// exprNode is a node of a parsed condition.
+type exprNode interface {
+	// eval evaluates the node. relax widens every comparison by the given margin
+	// (a < b becomes a < b + relax), which is used to implement hysteresis.
+	eval(lookup lookupFunc, relax float64) (float64, error)
+}
+
+type numberNode float64
+
+type varNode string
+
+type unaryNode struct {
+	operand exprNode
+}
+
+type binaryNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n numberNode) eval(lookupFunc, float64) (float64, error) { return float64(n), nil }
+
+func (n varNode) eval(lookup lookupFunc, _ float64) (float64, error) {
+	v, ok := lookup(string(n))
+	if !ok {
+		return 0, fmt.Errorf("value '%s' is not available", string(n))
+	}
+	return v, nil
+}
+
+func (n unaryNode) eval(lookup lookupFunc, relax float64) (float64, error) {
+	v, err := n.operand.eval(lookup, relax)
+	return -v, err
+}
+
+func (n binaryNode) eval(lookup lookupFunc, relax float64) (float64, error) {
+	l, err := n.left.eval(lookup, relax)
+	if err != nil {
+		return 0, err
+	}
+	// Short-circuit the logical operators, so "dc5 && t_lens < 0" does not need t_lens while DC5 is off.
+	switch n.op {
+	case "&&":
+		if l == 0 {
+			return 0, nil
+		}
+	case "||":
+		if l != 0 {
+			return 1, nil
+		}
+	}
+	r, err := n.right.eval(lookup, relax)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/":
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return l / r, nil
+	case "<":
+		return boolValue(l < r+relax), nil
+	case "<=":
+		return boolValue(l <= r+relax), nil
+	case ">":
+		return boolValue(l > r-relax), nil
+	case ">=":
+		return boolValue(l >= r-relax), nil
+	case "==":
+		return boolValue(l == r), nil
+	case "!=":
+		return boolValue(l != r), nil
+	case "&&", "||":
+		return boolValue(r != 0), nil
+	}
+	return 0, fmt.Errorf("unknown operator '%s'", n.op)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseCondition parses a condition expression.
+func parseCondition(expr string) (exprNode, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s'", p.tokens[p.pos])
+	}
+	return node, nil
+}
+
+// conditionVariables returns the value names used in an expression, in order of appearance.
+func conditionVariables(node exprNode) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(exprNode)
+	walk = func(n exprNode) {
+		switch n := n.(type) {
+		case varNode:
+			if !seen[string(n)] {
+				seen[string(n)] = true
+				names = append(names, string(n))
+			}
+		case unaryNode:
+			walk(n.operand)
+		case binaryNode:
+			walk(n.left)
+			walk(n.right)
+		}
+	}
+	walk(node)
+	return names
+}
+
+// tokenize splits an expression into numbers, names, operators and parentheses.
+func tokenize(expr string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, string(runes[start:i]))
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			word := string(runes[start:i])
+			switch strings.ToLower(word) {
+			case "and":
+				word = "&&"
+			case "or":
+				word = "||"
+			}
+			tokens = append(tokens, word)
+		case c == '−': // Unicode minus, e.g. pasted from documentation
+			tokens = append(tokens, "-")
+			i++
+		default:
+			if i+1 < len(runes) {
+				two := string(runes[i : i+2])
+				switch two {
+				case "<=", ">=", "==", "!=", "&&", "||":
+					tokens = append(tokens, two)
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("+-*/<>()", c) {
+				return nil, fmt.Errorf("unexpected character '%c'", c)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// parseLevel parses a left-associative chain of operands joined by one of the given operators.
+func (p *exprParser) parseLevel(next func() (exprNode, error), ops ...string) (exprNode, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, o := range ops {
+			if op == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return left, nil
+		}
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	return p.parseLevel(p.parseAnd, "||")
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	return p.parseLevel(p.parseComparison, "&&")
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	return p.parseLevel(p.parseSum, "<", "<=", ">", ">=", "==", "!=")
+}
+
+func (p *exprParser) parseSum() (exprNode, error) {
+	return p.parseLevel(p.parseProduct, "+", "-")
+}
+
+func (p *exprParser) parseProduct() (exprNode, error) {
+	return p.parseLevel(p.parseUnary, "*", "/")
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peek() == "-" {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.peek()
+	if tok == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+
+	switch {
+	case tok == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return node, nil
+	case unicode.IsDigit(rune(tok[0])) || tok[0] == '.':
+		v, err := strconv.ParseFloat(tok, 64)
+		if err != nil || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid number '%s'", tok)
+		}
+		return numberNode(v), nil
+	case unicode.IsLetter(rune(tok[0])) || tok[0] == '_':
+		return varNode(tok), nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", tok)
+}
@@ -0,0 +1,183 @@
+package automation
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testValues is a lookup over a fixed set of values.
+func testValues(values map[string]float64) lookupFunc {
+	return func(name string) (float64, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+}
+
+func TestParseConditionEval(t *testing.T) {
+	values := map[string]float64{
+		"h_amb": 92, "t_lens": 3.5, "d": 2, "pwm1": 0, "v": 12.4, "i": 9000,
+		"dc5": 1, "dc4": 0, "status.d1": 1,
+	}
+	tests := []struct {
+		name string
+		expr string
+		want float64
+	}{
+		{"number", "42", 42},
+		{"variable", "v", 12.4},
+		{"dotted name", "status.d1", 1},
+		{"product before sum", "1 + 2 * 3", 7},
+		{"parentheses", "(1 + 2) * 3", 9},
+		{"left-associative minus", "10 - 4 - 3", 3},
+		{"left-associative division", "24 / 4 / 3", 2},
+		{"unary minus", "-2 * -3", 6},
+		{"double unary minus", "--4", 4},
+		{"unicode minus", "5 − 2", 3},
+		{"unicode unary minus", "−2 + 3", 1},
+		{"comparison true", "h_amb > 90", 1},
+		{"comparison false", "h_amb <= 90", 0},
+		{"sum before comparison", "t_lens - d < 2", 1},
+		{"equal", "pwm1 == 0", 1},
+		{"not equal", "pwm1 != 0", 0},
+		{"and", "t_lens - d < 2 && pwm1 == 0", 1},
+		{"and false", "h_amb > 90 && dc4", 0},
+		{"or", "v < 11.8 || i > 8000", 1},
+		{"or false", "v < 11.8 || i > 10000", 0},
+		{"and before or", "dc4 && dc4 || dc5", 1},
+		{"and before or, right", "dc5 || dc4 && dc4", 1},
+		{"and before or, grouped", "(dc5 || dc4) && dc4", 0},
+		{"word operators", "v < 11.8 or (i > 8000 and dc5)", 1},
+		{"word operators upper case", "dc5 AND dc4 OR dc5", 1},
+		{"non-zero is true", "dc5 && 2.5", 1},
+		{"decimal without leading zero", ".5 * 4", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parseCondition(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCondition(%q): %v", tt.expr, err)
+			}
+			got, err := node.eval(testValues(values), 0)
+			if err != nil {
+				t.Fatalf("eval(%q): %v", tt.expr, err)
+			}
+			if got != tt.want {
+				t.Errorf("eval(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionShortCircuit(t *testing.T) {
+	// "missing" is not available, so evaluating it is an error.
+	values := map[string]float64{"on": 1, "off": 0}
+	tests := []struct {
+		name    string
+		expr    string
+		want    float64
+		wantErr bool
+	}{
+		{"and skips right side", "off && missing > 0", 0, false},
+		{"or skips right side", "on || missing > 0", 1, false},
+		{"and needs right side", "on && missing > 0", 0, true},
+		{"or needs right side", "off || missing > 0", 0, true},
+		{"missing on the left", "missing > 0 || on", 0, true},
+		{"division by zero", "on / off", 0, true},
+		{"division by zero skipped", "off && on / off", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parseCondition(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCondition(%q): %v", tt.expr, err)
+			}
+			got, err := node.eval(testValues(values), 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eval(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("eval(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConditionHysteresis(t *testing.T) {
+	// A rule stays active while its condition holds with the comparisons relaxed by the hysteresis.
+	tests := []struct {
+		name  string
+		expr  string
+		value float64
+		relax float64
+		want  float64
+	}{
+		{"greater, inside band", "x > 90", 89, 2, 1},
+		{"greater, at band edge", "x > 90", 88, 2, 0},
+		{"greater, without relax", "x > 90", 89, 0, 0},
+		{"greater or equal, at band edge", "x >= 90", 88, 2, 1},
+		{"less, inside band", "x < 11.8", 12.0, 0.5, 1},
+		{"less, outside band", "x < 11.8", 12.4, 0.5, 0},
+		{"less or equal, inside band", "x <= 11.8", 12.2, 0.5, 1},
+		{"equal is not relaxed", "x == 1", 1.5, 1, 0},
+		{"not equal is not relaxed", "x != 1", 1, 1, 0},
+		{"relaxed inside and", "x > 90 && x < 95", 96, 2, 1},
+		{"relaxed both sides", "x - 2 > 90", 91, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := parseCondition(tt.expr)
+			if err != nil {
+				t.Fatalf("parseCondition(%q): %v", tt.expr, err)
+			}
+			got, err := node.eval(testValues(map[string]float64{"x": tt.value}), tt.relax)
+			if err != nil {
+				t.Fatalf("eval(%q): %v", tt.expr, err)
+			}
+			if got != tt.want {
+				t.Errorf("eval(%q) with x=%v, relax=%v = %v, want %v", tt.expr, tt.value, tt.relax, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConditionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		expr string
+	}{
+		{"empty", ""},
+		{"only spaces", "   "},
+		{"unknown character", "h_amb > 90 ; dc1"},
+		{"single ampersand", "dc1 & dc2"},
+		{"single pipe", "dc1 | dc2"},
+		{"assignment", "dc1 = 1"},
+		{"missing operand", "h_amb >"},
+		{"missing left operand", "> 90"},
+		{"missing closing parenthesis", "(h_amb > 90"},
+		{"extra closing parenthesis", "h_amb > 90)"},
+		{"empty parentheses", "()"},
+		{"two operands", "h_amb 90"},
+		{"invalid number", "1.2.3 > 0"},
+		{"number too large", strings.Repeat("9", 400) + " > 0"},
+		{"operator only", "&&"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseCondition(tt.expr); err == nil {
+				t.Errorf("parseCondition(%q) succeeded, want an error", tt.expr)
+			}
+		})
+	}
+}
+
+func TestConditionVariables(t *testing.T) {
+	node, err := parseCondition("t_lens - d < 2 && (pwm1 == 0 || t_lens < -5)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"t_lens", "d", "pwm1"}
+	if got := conditionVariables(node); !reflect.DeepEqual(got, want) {
+		t.Errorf("conditionVariables = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,355 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	loadProfileStateFile   = "load_profiles"
+	maxLoadProfileAlerts   = 50
+	defaultSettleSeconds   = 5.0
+	defaultMinSamples      = 5
+	loadProfileMinRate     = 0.1              // Weight of a new step once the profile has 10 samples
+	loadProfileMaxBefore   = 10 * time.Second // The reading before a step must not be older than this
+	loadProfileStepTimeout = 15 * time.Second // A step without reading after the settle time is dropped
+	loadProfileNoise       = 0.05             // A; a negative step beyond this means the total was disturbed
+	loadProfileMinAlert    = 0.1              // A; smaller deviations are not reported, whatever the percentage
+	minHeaterScale         = 0.05             // Heater steps below 5 % output are too small to scale up
+	maxHeaterDisturbance   = 5.0              // % change of an unprofiled heater that spoils a step
+)
+
+// LoadProfile is the learned draw of one output. Heater profiles are scaled to 100 % heater output.
+type LoadProfile struct {
+	Output  string    `json:"output"`
+	Current float64   `json:"current"` // A
+	Power   float64   `json:"power"`   // W
+	Samples int       `json:"samples"`
+	Last    float64   `json:"last"` // Current of the most recent step in A
+	Updated time.Time `json:"updated"`
+	Heater  bool      `json:"heater,omitempty"` // Current and power are at 100 % heater output
+}
+
+// LoadProfileAlert is a step that deviated from the learned profile.
+type LoadProfileAlert struct {
+	Time     time.Time `json:"time"`
+	Output   string    `json:"output"`
+	Current  float64   `json:"current"`  // Measured step in A
+	Expected float64   `json:"expected"` // Profile in A
+	Percent  float64   `json:"percent"`  // Deviation in %
+}
+
+// OutputLoad is the share of the total draw attributed to one output.
+type OutputLoad struct {
+	LoadProfile
+	On               bool    `json:"on"`
+	EstimatedCurrent float64 `json:"estimatedCurrent"` // A, 0 while off
+	EstimatedPower   float64 `json:"estimatedPower"`   // W, 0 while off
+}
+
+// LoadProfileStatus is the load profiling configuration with the learned profiles and the attribution
+// of the present total, as returned by the REST API.
+type LoadProfileStatus struct {
+	config.LoadProfiles
+	Current *float64 `json:"current"` // Measured total in A
+	Power   *float64 `json:"power"`   // Measured total in W
+	// Unattributed is the part of the total not explained by the profiles of the outputs that are on,
+	// e.g. the device itself and outputs without a profile.
+	UnattributedCurrent *float64           `json:"unattributedCurrent"`
+	UnattributedPower   *float64           `json:"unattributedPower"`
+	Outputs             []OutputLoad       `json:"outputs"`
+	Alerts              []LoadProfileAlert `json:"alerts"` // Most recent first
+}
+
+// loadProfileState is persisted, so the profiles keep improving across restarts.
+type loadProfileState struct {
+	Profiles map[string]*LoadProfile `json:"profiles"`
+	Alerts   []LoadProfileAlert      `json:"alerts"`
+}
+
+// loadStep is a switch of a single output waiting for the reading after the settle time.
+type loadStep struct {
+	output string
+	on     bool
+	at     time.Time
+	before serial.CacheSnapshot
+}
+
+var (
+	profileMutex      sync.Mutex
+	profileState      = loadProfileState{Profiles: make(map[string]*LoadProfile)}
+	profileSnapshot   serial.CacheSnapshot // Most recent cache update
+	profileStep       *loadStep
+	profileLastSwitch time.Time
+	profileOnce       sync.Once
+)
+
+// StartLoadProfiles loads the learned profiles and watches switch events and cache updates.
+func StartLoadProfiles() {
+	profileOnce.Do(func() {
+		if err := config.LoadState(loadProfileStateFile, &profileState); err != nil {
+			logger.Warn("Load profiles: %v", err)
+		}
+		if profileState.Profiles == nil {
+			profileState.Profiles = make(map[string]*LoadProfile)
+		}
+		power.OnSwitchEvent(observeSwitchEvent)
+		serial.OnCacheUpdate(evaluateLoadStep)
+	})
+}
+
+// observeSwitchEvent starts a step measurement when the proxy switches a single output on or off.
+// Any other change within the settle time makes the step ambiguous, so it is dropped.
+func observeSwitchEvent(e power.SwitchEvent) {
+	lp := config.Get().LoadProfiles
+	if !lp.Enabled {
+		return
+	}
+	settle := seconds(defaultIfZero(lp.SettleSeconds, defaultSettleSeconds))
+
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	quiet := profileLastSwitch.IsZero() || e.Time.Sub(profileLastSwitch) >= settle
+	profileLastSwitch = e.Time
+	if profileStep != nil {
+		logger.Debug("Load profiles: Step of %s dropped, %s changed as well.", profileStep.output, e.Output)
+		profileStep = nil
+		return
+	}
+
+	wasOn := e.Old != nil && power.IsOn(*e.Old)
+	isOn := e.New != nil && power.IsOn(*e.New)
+	if !quiet || wasOn == isOn || e.Old == nil || e.New == nil || e.Source == power.SourceFirmware {
+		return // Not a clean on/off step requested through the proxy
+	}
+	before := profileSnapshot
+	if before.Conditions == nil || !before.Time.Before(e.Time) || e.Time.Sub(before.Time) > loadProfileMaxBefore {
+		return
+	}
+	profileStep = &loadStep{output: e.Output, on: isOn, at: e.Time, before: before}
+}
+
+// evaluateLoadStep completes a pending step with the first reading taken after the settle time.
+func evaluateLoadStep(snapshot serial.CacheSnapshot) {
+	lp := config.Get().LoadProfiles
+	settle := seconds(defaultIfZero(lp.SettleSeconds, defaultSettleSeconds))
+
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	profileSnapshot = snapshot
+	if !lp.Enabled {
+		profileStep = nil // Disabled while a step was pending
+		return
+	}
+	step := profileStep
+	if step == nil || snapshot.Time.Sub(step.at) < settle {
+		return
+	}
+	profileStep = nil
+	if snapshot.Time.Sub(step.at) > settle+loadProfileStepTimeout {
+		return
+	}
+
+	current, watts, ok := stepDraw(*step, snapshot)
+	if !ok {
+		return
+	}
+	p := profileState.Profiles[step.output]
+	if p == nil {
+		p = &LoadProfile{Output: step.output, Heater: isHeater(step.output)}
+		profileState.Profiles[step.output] = p
+	}
+
+	minSamples := lp.MinSamples
+	if minSamples == 0 {
+		minSamples = defaultMinSamples
+	}
+	if lp.AlertPercent > 0 && p.Samples >= minSamples {
+		deviation := math.Abs(current - p.Current)
+		if deviation > loadProfileMinAlert && deviation > p.Current*lp.AlertPercent/100 {
+			alert := LoadProfileAlert{Time: snapshot.Time, Output: step.output, Current: round3(current), Expected: round3(p.Current)}
+			if p.Current > 0 {
+				alert.Percent = math.Round((current - p.Current) / p.Current * 100)
+			}
+			go reportLoadDeviation(alert)
+			profileState.Alerts = append(profileState.Alerts, alert)
+			if len(profileState.Alerts) > maxLoadProfileAlerts {
+				profileState.Alerts = profileState.Alerts[len(profileState.Alerts)-maxLoadProfileAlerts:]
+			}
+		}
+	}
+
+	// Average the first steps equally, then follow slow changes of the connected equipment.
+	rate := math.Max(1/float64(p.Samples+1), loadProfileMinRate)
+	p.Current += rate * (current - p.Current)
+	p.Power += rate * (watts - p.Power)
+	p.Samples++
+	p.Last = current
+	p.Updated = snapshot.Time
+	logger.Debug("Load profiles: %s step %.3f A / %.2f W, profile %.3f A / %.2f W (%d samples).",
+		step.output, current, watts, p.Current, p.Power, p.Samples)
+	saveLoadProfileStateLocked()
+}
+
+// stepDraw returns the draw of the switched output from the totals before and after the step.
+// Changes of heaters with a profile are subtracted; heater steps are scaled to 100 % output.
+// The caller must hold profileMutex.
+func stepDraw(step loadStep, after serial.CacheSnapshot) (current, watts float64, ok bool) {
+	iBefore, ok1 := numericValue(step.before.Conditions["i"])
+	iAfter, ok2 := numericValue(after.Conditions["i"])
+	pBefore, ok3 := numericValue(step.before.Conditions["p"])
+	pAfter, ok4 := numericValue(after.Conditions["p"])
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return 0, 0, false
+	}
+	current, watts = (iAfter-iBefore)/1000, pAfter-pBefore // Current reported in mA
+
+	for _, heater := range []string{"pwm1", "pwm2"} {
+		if heater == step.output {
+			continue
+		}
+		hBefore, okB := numericValue(step.before.Conditions[heater])
+		hAfter, okA := numericValue(after.Conditions[heater])
+		if !okB || !okA || hBefore == hAfter {
+			continue
+		}
+		p := profileState.Profiles[heater]
+		if p == nil {
+			if math.Abs(hAfter-hBefore) > maxHeaterDisturbance {
+				return 0, 0, false
+			}
+			continue
+		}
+		current -= p.Current * (hAfter - hBefore) / 100
+		watts -= p.Power * (hAfter - hBefore) / 100
+	}
+
+	if !step.on {
+		current, watts = -current, -watts
+	}
+	if current < -loadProfileNoise {
+		return 0, 0, false // The total fell when the output was switched on (or rose when it was switched off)
+	}
+
+	if isHeater(step.output) {
+		snapshot := after
+		if !step.on {
+			snapshot = step.before
+		}
+		level, ok := numericValue(snapshot.Conditions[step.output])
+		if !ok || level/100 < minHeaterScale {
+			return 0, 0, false
+		}
+		current, watts = current/(level/100), watts/(level/100)
+	}
+	return math.Max(0, current), math.Max(0, watts), true
+}
+
+func isHeater(output string) bool {
+	return output == "pwm1" || output == "pwm2"
+}
+
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// reportLoadDeviation logs and notifies a step that deviated from the learned profile.
+func reportLoadDeviation(a LoadProfileAlert) {
+	name := outputList([]string{a.Output})
+	logger.Warn("Load profiles: %s drew %.2f A when switched, usually %.2f A (%+.0f %%).", name, a.Current, a.Expected, a.Percent)
+	events.Notify("Unusual output draw",
+		fmt.Sprintf("%s drew %.2f A when switched, usually %.2f A.", name, a.Current, a.Expected))
+}
+
+// GetLoadProfileStatus returns the learned profiles with the attribution of the present total draw.
+func GetLoadProfileStatus() LoadProfileStatus {
+	status := LoadProfileStatus{LoadProfiles: config.Get().LoadProfiles, Outputs: []OutputLoad{}, Alerts: []LoadProfileAlert{}}
+
+	profileMutex.Lock()
+	snapshot := profileSnapshot
+	loads := attributeLoadLocked(snapshot)
+	for i := len(profileState.Alerts) - 1; i >= 0; i-- {
+		status.Alerts = append(status.Alerts, profileState.Alerts[i])
+	}
+	profileMutex.Unlock()
+
+	var sumI, sumP float64
+	for _, l := range loads {
+		sumI += l.EstimatedCurrent
+		sumP += l.EstimatedPower
+		status.Outputs = append(status.Outputs, l)
+	}
+	if i, ok := numericValue(snapshot.Conditions["i"]); ok {
+		i /= 1000
+		rest := round3(i - sumI)
+		status.Current, status.UnattributedCurrent = &i, &rest
+	}
+	if p, ok := numericValue(snapshot.Conditions["p"]); ok {
+		rest := round3(p - sumP)
+		status.Power, status.UnattributedPower = &p, &rest
+	}
+	return status
+}
+
+// OutputLoads returns the estimated draw of every output with a profile at the latest cache update.
+func OutputLoads() []OutputLoad {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	return attributeLoadLocked(profileSnapshot)
+}
+
+// attributeLoadLocked estimates the draw of every profiled output from its state in a snapshot.
+// The caller must hold profileMutex.
+func attributeLoadLocked(snapshot serial.CacheSnapshot) []OutputLoad {
+	loads := make([]OutputLoad, 0, len(profileState.Profiles))
+	for output, p := range profileState.Profiles {
+		l := OutputLoad{LoadProfile: *p}
+		if val, ok := numericValue(snapshot.Status[config.ShortSwitchIDMap[output]]); ok && power.IsOn(val) {
+			l.On = true
+			scale := 1.0
+			if isHeater(output) {
+				scale = 0
+				if level, ok := numericValue(snapshot.Conditions[output]); ok {
+					scale = level / 100
+				}
+			}
+			l.EstimatedCurrent = round3(p.Current * scale)
+			l.EstimatedPower = round3(p.Power * scale)
+		}
+		l.Current, l.Power, l.Last = round3(p.Current), round3(p.Power), round3(p.Last)
+		loads = append(loads, l)
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].Output < loads[j].Output })
+	return loads
+}
+
+// ResetLoadProfiles forgets the profile of an output, or all profiles if output is empty.
+func ResetLoadProfiles(output string) error {
+	profileMutex.Lock()
+	defer profileMutex.Unlock()
+	if output == "" {
+		profileState = loadProfileState{Profiles: make(map[string]*LoadProfile)}
+	} else {
+		if _, ok := profileState.Profiles[output]; !ok {
+			return fmt.Errorf("no profile for output '%s'", output)
+		}
+		delete(profileState.Profiles, output)
+	}
+	saveLoadProfileStateLocked()
+	return nil
+}
+
+// saveLoadProfileStateLocked persists the profiles. The caller must hold profileMutex.
+func saveLoadProfileStateLocked() {
+	if err := config.SaveState(loadProfileStateFile, profileState); err != nil {
+		logger.Error("Load profiles: Failed to persist state: %v", err)
+	}
+}
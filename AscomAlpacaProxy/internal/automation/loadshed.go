@@ -0,0 +1,318 @@
+package automation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	loadShedStateFile  = "load_shedding"
+	maxLoadShedHistory = 100
+	loadShedSource     = "load shedding"
+)
+
+// ShedStage is the state of one shed priority.
+type ShedStage struct {
+	Priority  int        `json:"priority"`
+	Threshold float64    `json:"threshold"`
+	Shed      bool       `json:"shed"`
+	Outputs   []string   `json:"outputs,omitempty"` // Outputs switched off by this stage (only those that were on)
+	ShedAt    *time.Time `json:"shedAt,omitempty"`
+	// Time the voltage has been below the threshold (or above threshold + hysteresis while shed)
+	PendingSince *time.Time `json:"pendingSince,omitempty"`
+}
+
+// ShedEvent is one shed or restore action.
+type ShedEvent struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // "shed" or "restore"
+	Priority int       `json:"priority"`
+	Voltage  float64   `json:"voltage"`
+	Outputs  []string  `json:"outputs"`
+	Success  bool      `json:"success"`
+	Message  string    `json:"message"`
+}
+
+// LoadSheddingStatus is the load shedding configuration with its runtime state, as returned by the REST API.
+type LoadSheddingStatus struct {
+	config.LoadShedding
+	Voltage *float64    `json:"voltage"`
+	Stages  []ShedStage `json:"stages"`
+	History []ShedEvent `json:"history"` // Most recent first
+}
+
+// loadShedState is persisted, so outputs shed before a restart can still be restored.
+type loadShedState struct {
+	Stages  map[int]*ShedStage `json:"stages"`
+	History []ShedEvent        `json:"history"`
+}
+
+var (
+	shedMutex   sync.Mutex
+	shedState   = loadShedState{Stages: make(map[int]*ShedStage)}
+	lastVoltage *float64
+	shedOnce    sync.Once
+)
+
+// StartLoadShedding loads the shed state and watches the input voltage after every cache update.
+func StartLoadShedding() {
+	shedOnce.Do(func() {
+		if err := config.LoadState(loadShedStateFile, &shedState); err != nil {
+			logger.Warn("Load shedding: %v", err)
+		}
+		if shedState.Stages == nil {
+			shedState.Stages = make(map[int]*ShedStage)
+		}
+		serial.OnCacheUpdate(evaluateLoadShedding)
+	})
+}
+
+// GetLoadSheddingStatus returns the settings, the state of every stage and the recent events.
+func GetLoadSheddingStatus() LoadSheddingStatus {
+	ls := config.Get().LoadShedding
+
+	shedMutex.Lock()
+	defer shedMutex.Unlock()
+	status := LoadSheddingStatus{LoadShedding: ls, Voltage: lastVoltage}
+	priorities := make(map[int]bool)
+	for p := 1; p <= len(ls.Thresholds); p++ {
+		priorities[p] = true
+	}
+	for p := range shedState.Stages {
+		priorities[p] = true
+	}
+	for _, p := range sortedPriorities(priorities) {
+		stage := ShedStage{Priority: p}
+		if st, ok := shedState.Stages[p]; ok {
+			stage = *st
+		}
+		if p <= len(ls.Thresholds) {
+			stage.Threshold = ls.Thresholds[p-1]
+		}
+		status.Stages = append(status.Stages, stage)
+	}
+	for i := len(shedState.History) - 1; i >= 0; i-- {
+		status.History = append(status.History, shedState.History[i])
+	}
+	return status
+}
+
+// RestoreShedOutputs switches all shed outputs back on, regardless of the voltage.
+func RestoreShedOutputs() []ShedEvent {
+	shedMutex.Lock()
+	var stages []ShedStage
+	for _, p := range stagePriorities() {
+		if st := shedState.Stages[p]; st.Shed {
+			stages = append(stages, *st)
+			delete(shedState.Stages, p)
+		}
+	}
+	saveLoadShedStateLocked()
+	voltage := 0.0
+	if lastVoltage != nil {
+		voltage = *lastVoltage
+	}
+	shedMutex.Unlock()
+
+	var result []ShedEvent
+	for i := len(stages) - 1; i >= 0; i-- {
+		result = append(result, restoreStage(stages[i], voltage, "manual restore"))
+	}
+	return result
+}
+
+// evaluateLoadShedding compares the input voltage with the thresholds after every cache update.
+func evaluateLoadShedding(snapshot serial.CacheSnapshot) {
+	ls := config.Get().LoadShedding
+	v, ok := numericValue(snapshot.Conditions["v"])
+	if !ok {
+		return
+	}
+	now := snapshot.Time
+
+	shedMutex.Lock()
+	defer shedMutex.Unlock()
+	lastVoltage = &v
+	if !ls.Enabled {
+		// Outputs shed before load shedding was disabled stay off until restored manually.
+		for p, st := range shedState.Stages {
+			if !st.Shed {
+				delete(shedState.Stages, p)
+			} else {
+				st.PendingSince = nil
+			}
+		}
+		return
+	}
+
+	// Shed from the least important outputs up.
+	for p := 1; p <= len(ls.Thresholds); p++ {
+		st := shedState.Stages[p]
+		if st != nil && st.Shed {
+			continue
+		}
+		if v >= ls.Thresholds[p-1] {
+			delete(shedState.Stages, p)
+			continue
+		}
+		if st == nil {
+			st = &ShedStage{Priority: p}
+			shedState.Stages[p] = st
+		}
+		if st.PendingSince == nil {
+			st.PendingSince = &now
+		}
+		if now.Sub(*st.PendingSince) < seconds(ls.SustainSeconds) {
+			continue
+		}
+
+		st.Shed = true
+		st.ShedAt = &now
+		st.PendingSince = nil
+		st.Outputs = outputsToShed(ls, p, snapshot.Status)
+		saveLoadShedStateLocked()
+		go shedStage(*st, ls.Thresholds[p-1], v)
+	}
+
+	// Restore from the most important outputs down.
+	priorities := stagePriorities()
+	for i := len(priorities) - 1; i >= 0; i-- {
+		p := priorities[i]
+		st := shedState.Stages[p]
+		if !st.Shed || !ls.Restore {
+			continue
+		}
+		// A stage without threshold (removed from the settings) is restored right away.
+		if p <= len(ls.Thresholds) {
+			if v < ls.Thresholds[p-1]+ls.RestoreHysteresis {
+				st.PendingSince = nil
+				continue
+			}
+			if st.PendingSince == nil {
+				st.PendingSince = &now
+			}
+			if now.Sub(*st.PendingSince) < seconds(ls.RestoreSeconds) {
+				continue
+			}
+		}
+
+		delete(shedState.Stages, p)
+		saveLoadShedStateLocked()
+		go restoreStage(*st, v, "battery recovered")
+	}
+}
+
+// outputsToShed returns the outputs of a priority that are currently on.
+func outputsToShed(ls config.LoadShedding, priority int, status map[string]interface{}) []string {
+	var outputs []string
+	for output, p := range ls.Priorities {
+		if p != priority {
+			continue
+		}
+		if power.IsOn(status[config.ShortSwitchIDMap[output]]) {
+			outputs = append(outputs, output)
+		}
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+// shedStage switches the outputs of a stage off and records the event.
+func shedStage(stage ShedStage, threshold, voltage float64) {
+	event := ShedEvent{Time: time.Now(), Action: "shed", Priority: stage.Priority, Voltage: voltage, Outputs: stage.Outputs}
+	event.Success, event.Message = switchOutputs(stage.Outputs, false)
+	if len(stage.Outputs) == 0 {
+		event.Message = "no outputs on"
+	}
+	logger.Warn("Load shedding: %.2f V below %.2f V, priority %d shed (%s): %s", voltage, threshold, stage.Priority, outputList(stage.Outputs), event.Message)
+	if len(stage.Outputs) > 0 {
+		events.Notify("Battery low: outputs switched off",
+			fmt.Sprintf("%.2f V: %s switched off (priority %d).", voltage, outputList(stage.Outputs), stage.Priority))
+	}
+	recordShedEvent(event)
+}
+
+// restoreStage switches the outputs of a shed stage back on and records the event.
+func restoreStage(stage ShedStage, voltage float64, reason string) ShedEvent {
+	event := ShedEvent{Time: time.Now(), Action: "restore", Priority: stage.Priority, Voltage: voltage, Outputs: stage.Outputs}
+	event.Success, event.Message = switchOutputs(stage.Outputs, true)
+	logger.Info("Load shedding: priority %d restored (%s, %.2f V, %s): %s", stage.Priority, reason, voltage, outputList(stage.Outputs), event.Message)
+	if len(stage.Outputs) > 0 {
+		events.Notify("Outputs restored",
+			fmt.Sprintf("%.2f V: %s switched back on (%s).", voltage, outputList(stage.Outputs), reason))
+	}
+	recordShedEvent(event)
+	return event
+}
+
+func switchOutputs(outputs []string, state bool) (bool, string) {
+	var failed []string
+	for _, output := range outputs {
+		if err := power.SetOutput(output, state, nil, loadShedSource); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", output, err))
+		}
+	}
+	if len(failed) > 0 {
+		return false, strings.Join(failed, "; ")
+	}
+	return true, "OK"
+}
+
+func recordShedEvent(event ShedEvent) {
+	shedMutex.Lock()
+	defer shedMutex.Unlock()
+	shedState.History = append(shedState.History, event)
+	if len(shedState.History) > maxLoadShedHistory {
+		shedState.History = shedState.History[len(shedState.History)-maxLoadShedHistory:]
+	}
+	saveLoadShedStateLocked()
+}
+
+// outputList returns the display names of outputs for log messages and notifications.
+func outputList(outputs []string) string {
+	if len(outputs) == 0 {
+		return "none"
+	}
+	names := config.Get().SwitchNames
+	display := make([]string, len(outputs))
+	for i, output := range outputs {
+		display[i] = output
+		if name := names[output]; name != "" && name != output {
+			display[i] = fmt.Sprintf("%s (%s)", name, output)
+		}
+	}
+	return strings.Join(display, ", ")
+}
+
+// stagePriorities returns the priorities of all known stages in ascending order. The caller must hold shedMutex.
+func stagePriorities() []int {
+	set := make(map[int]bool, len(shedState.Stages))
+	for p := range shedState.Stages {
+		set[p] = true
+	}
+	return sortedPriorities(set)
+}
+
+func sortedPriorities(set map[int]bool) []int {
+	priorities := make([]int, 0, len(set))
+	for p := range set {
+		priorities = append(priorities, p)
+	}
+	sort.Ints(priorities)
+	return priorities
+}
+
+// saveLoadShedStateLocked persists the shed state. The caller must hold shedMutex.
+func saveLoadShedStateLocked() {
+	if err := config.SaveState(loadShedStateFile, shedState); err != nil {
+		logger.Error("Load shedding: Failed to persist state: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package automation
+
+import (
+	"reflect"
+	"testing"
+
+	"sv241pro-alpaca-proxy/internal/config"
+)
+
+func TestOutputsToShed(t *testing.T) {
+	ls := config.LoadShedding{Priorities: map[string]int{
+		"dc1": 3, "dc2": 1, "dc3": 1, "usb345": 1, "usbc12": 2, "pwm1": 1, "adj_conv": 1,
+	}}
+	tests := []struct {
+		name     string
+		priority int
+		status   map[string]interface{}
+		want     []string
+	}{
+		{
+			// DC and USB outputs are reported as 0/1 numbers, heaters as PWM %, adj as volts.
+			name:     "numeric states",
+			priority: 1,
+			status:   map[string]interface{}{"d2": 1.0, "d3": 0.0, "u34": 1.0, "pwm1": 45.0, "adj": 9.0},
+			want:     []string{"adj_conv", "dc2", "pwm1", "usb345"},
+		},
+		{
+			name:     "boolean states",
+			priority: 1,
+			status:   map[string]interface{}{"d2": true, "d3": false, "u34": false, "pwm1": false, "adj": false},
+			want:     []string{"dc2"},
+		},
+		{
+			name:     "other priority",
+			priority: 2,
+			status:   map[string]interface{}{"d2": 1.0, "u12": 1.0},
+			want:     []string{"usbc12"},
+		},
+		{
+			name:     "outputs not reported",
+			priority: 3,
+			status:   map[string]interface{}{"d2": 1.0},
+			want:     nil,
+		},
+		{
+			name:     "all off",
+			priority: 1,
+			status:   map[string]interface{}{"d2": 0.0, "d3": 0.0, "u34": 0.0, "pwm1": 0.0, "adj": 0.0},
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := outputsToShed(ls, tt.priority, tt.status); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("outputsToShed(priority %d) = %v, want %v", tt.priority, got, tt.want)
+			}
+		})
+	}
+}
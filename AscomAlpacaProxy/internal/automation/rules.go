@@ -0,0 +1,310 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	ruleHistoryFile = "rule_history"
+	maxRuleHistory  = 200
+)
+
+// Rule states as reported by the REST API.
+const (
+	RuleIdle     = "idle"     // Condition false, rule armed
+	RulePending  = "pending"  // Condition true, waiting for the hold time (or the cooldown)
+	RuleFired    = "fired"    // Fired, waiting for the condition to clear before re-arming
+	RuleDisabled = "disabled" // Disabled in the configuration
+	RuleError    = "error"    // Condition cannot be evaluated (syntax error or missing value)
+)
+
+// RuleStatus is a rule with its runtime state, as returned by the REST API.
+type RuleStatus struct {
+	config.Rule
+	State        string             `json:"state"`
+	PendingSince *time.Time         `json:"pendingSince"`
+	LastFired    *time.Time         `json:"lastFired"`
+	Values       map[string]float64 `json:"values,omitempty"` // Current values used by the condition
+	Error        string             `json:"error,omitempty"`
+}
+
+// RuleFiring is one firing of a rule.
+type RuleFiring struct {
+	Rule      string             `json:"rule"`
+	Condition string             `json:"condition"`
+	Time      time.Time          `json:"time"`
+	Values    map[string]float64 `json:"values"` // Values that made the condition true
+	Success   bool               `json:"success"`
+	Message   string             `json:"message"`
+}
+
+// ruleState is the runtime state of one rule. It is keyed by rule name and reset when the condition changes.
+type ruleState struct {
+	condition    string
+	node         exprNode
+	parseErr     error
+	armed        bool
+	pendingSince time.Time
+	lastFired    time.Time
+	values       map[string]float64
+	evalErr      error
+}
+
+var (
+	rulesMutex  sync.Mutex
+	ruleStates  = make(map[string]*ruleState)
+	ruleHistory []RuleFiring
+	rulesOnce   sync.Once
+)
+
+// StartRules loads the firing history and evaluates the rules after every cache update.
+func StartRules() {
+	rulesOnce.Do(func() {
+		if err := config.LoadState(ruleHistoryFile, &ruleHistory); err != nil {
+			logger.Warn("Rules: %v", err)
+		}
+		serial.OnCacheUpdate(evaluateRules)
+		logger.Info("Rule engine started.")
+	})
+}
+
+// ValidateRule checks a rule including its condition expression.
+func ValidateRule(rule config.Rule) error {
+	if err := config.ValidateRule(rule); err != nil {
+		return err
+	}
+	if _, err := parseCondition(rule.Condition); err != nil {
+		return fmt.Errorf("rule '%s': invalid condition: %w", rule.Name, err)
+	}
+	return nil
+}
+
+// ListRules returns all configured rules with their runtime state.
+func ListRules() []RuleStatus {
+	rules := config.Get().Rules
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	result := make([]RuleStatus, 0, len(rules))
+	for _, rule := range rules {
+		status := RuleStatus{Rule: rule, State: RuleIdle}
+		st := ruleStates[rule.Name]
+		if last := lastFiring(rule.Name, st); !last.IsZero() {
+			status.LastFired = &last
+		}
+		switch {
+		case rule.Disabled:
+			status.State = RuleDisabled
+		case st == nil:
+		case st.parseErr != nil || st.evalErr != nil:
+			status.State = RuleError
+			if st.parseErr != nil {
+				status.Error = st.parseErr.Error()
+			} else {
+				status.Error = st.evalErr.Error()
+			}
+		case !st.armed:
+			status.State = RuleFired
+		case !st.pendingSince.IsZero():
+			status.State = RulePending
+			since := st.pendingSince
+			status.PendingSince = &since
+		}
+		if st != nil && !rule.Disabled {
+			status.Values = st.values
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// RuleHistory returns the recent rule firings, most recent first.
+func RuleHistory() []RuleFiring {
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	result := make([]RuleFiring, 0, len(ruleHistory))
+	for i := len(ruleHistory) - 1; i >= 0; i-- {
+		result = append(result, ruleHistory[i])
+	}
+	return result
+}
+
+// evaluateRules is called after every cache update. Actions run in their own goroutine,
+// so the polling loop is never blocked by the serial commands they send.
+func evaluateRules(snapshot serial.CacheSnapshot) {
+	rules := config.Get().Rules
+	lookup := snapshotLookup(snapshot)
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	pruneRuleStatesLocked(rules)
+
+	for _, rule := range rules {
+		if rule.Disabled {
+			delete(ruleStates, rule.Name)
+			continue
+		}
+		st := ruleStates[rule.Name]
+		if st == nil || st.condition != rule.Condition {
+			st = &ruleState{condition: rule.Condition, armed: true, lastFired: lastFiring(rule.Name, nil)}
+			st.node, st.parseErr = parseCondition(rule.Condition)
+			ruleStates[rule.Name] = st
+		}
+		if st.parseErr != nil {
+			continue
+		}
+
+		st.values = make(map[string]float64)
+		for _, name := range conditionVariables(st.node) {
+			if v, ok := lookup(name); ok {
+				st.values[name] = v
+			}
+		}
+		active, err := st.node.eval(lookup, 0)
+		st.evalErr = err
+		if err != nil {
+			// Missing data neither fires nor re-arms the rule.
+			st.pendingSince = time.Time{}
+			continue
+		}
+
+		if !st.armed {
+			// Re-arm only once the condition is false even with the hysteresis margin applied.
+			if cleared, err := st.node.eval(lookup, rule.Hysteresis); err == nil && cleared == 0 {
+				st.armed = true
+				logger.Debug("Rules: '%s' re-armed.", rule.Name)
+			}
+			continue
+		}
+		if active == 0 {
+			st.pendingSince = time.Time{}
+			continue
+		}
+
+		now := snapshot.Time
+		if st.pendingSince.IsZero() {
+			st.pendingSince = now
+		}
+		if now.Sub(st.pendingSince) < seconds(rule.ForSeconds) {
+			continue
+		}
+		if !st.lastFired.IsZero() && now.Sub(st.lastFired) < seconds(rule.CooldownSeconds) {
+			continue
+		}
+
+		st.armed = false
+		st.pendingSince = time.Time{}
+		st.lastFired = now
+		values := make(map[string]float64, len(st.values))
+		for k, v := range st.values {
+			values[k] = v
+		}
+		go fireRule(rule, now, values)
+	}
+}
+
+// fireRule runs the action of a rule and records the firing.
+func fireRule(rule config.Rule, now time.Time, values map[string]float64) {
+	source := fmt.Sprintf("rule '%s'", rule.Name)
+	firing := RuleFiring{Rule: rule.Name, Condition: rule.Condition, Time: now, Values: values}
+
+	action := actionSpec{Outputs: rule.Outputs, HeaterManual: rule.HeaterManual, Scene: rule.Scene, Sequence: rule.Sequence, Boost: rule.Boost}
+	if err := runAction(action, source); err != nil {
+		firing.Message = err.Error()
+		logger.Error("Rules: '%s' (%s) failed: %v", rule.Name, rule.Condition, err)
+	} else {
+		firing.Success = true
+		firing.Message = "OK"
+		logger.Info("Rules: '%s' fired (%s, values %v).", rule.Name, rule.Condition, values)
+	}
+
+	rulesMutex.Lock()
+	defer rulesMutex.Unlock()
+	ruleHistory = append(ruleHistory, firing)
+	if len(ruleHistory) > maxRuleHistory {
+		ruleHistory = ruleHistory[len(ruleHistory)-maxRuleHistory:]
+	}
+	if err := config.SaveState(ruleHistoryFile, ruleHistory); err != nil {
+		logger.Error("Rules: Failed to persist rule history: %v", err)
+	}
+}
+
+// lastFiring returns the last firing time of a rule from its state or, after a restart, from the history.
+// The caller must hold rulesMutex.
+func lastFiring(name string, st *ruleState) time.Time {
+	if st != nil {
+		return st.lastFired
+	}
+	for i := len(ruleHistory) - 1; i >= 0; i-- {
+		if ruleHistory[i].Rule == name {
+			return ruleHistory[i].Time
+		}
+	}
+	return time.Time{}
+}
+
+// pruneRuleStatesLocked forgets the state of rules that no longer exist. The caller must hold rulesMutex.
+func pruneRuleStatesLocked(rules []config.Rule) {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		names[rule.Name] = true
+	}
+	for name := range ruleStates {
+		if !names[name] {
+			delete(ruleStates, name)
+		}
+	}
+}
+
+// snapshotLookup resolves value names against a cache snapshot. Plain names are looked up in the
+// sensor values first, then in the status (by short key or internal output name, e.g. "d5" or "dc5").
+// The prefixes "sensors." and "status." select one of the two explicitly (e.g. "status.pwm1").
+func snapshotLookup(snapshot serial.CacheSnapshot) lookupFunc {
+	fromStatus := func(name string) (float64, bool) {
+		if v, ok := numericValue(snapshot.Status[name]); ok {
+			return v, true
+		}
+		if short, ok := config.ShortSwitchIDMap[name]; ok {
+			return numericValue(snapshot.Status[short])
+		}
+		return 0, false
+	}
+	return func(name string) (float64, bool) {
+		switch {
+		case strings.HasPrefix(name, "sensors."):
+			return numericValue(snapshot.Conditions[strings.TrimPrefix(name, "sensors.")])
+		case strings.HasPrefix(name, "status."):
+			return fromStatus(strings.TrimPrefix(name, "status."))
+		}
+		if v, ok := numericValue(snapshot.Conditions[name]); ok {
+			return v, true
+		}
+		return fromStatus(name)
+	}
+}
+
+// numericValue converts a cached JSON value to a number. Switch states count as 1 (on) and 0 (off).
+func numericValue(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, !math.IsNaN(val)
+	case bool:
+		return boolValue(val), true
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		return f, err == nil && !math.IsNaN(f)
+	}
+	return 0, false
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
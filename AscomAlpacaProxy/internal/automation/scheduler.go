@@ -0,0 +1,326 @@
+// Package automation contains the proxy-side automation: schedules and rules acting on the outputs.
+package automation
+
+import (
+	"fmt"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	scheduleStateFile  = "schedules"
+	scheduleTickRate   = 20 * time.Second
+	defaultCatchUp     = 12 * time.Hour
+	cronSearchHorizon  = 8 * 24 * time.Hour
+	maxScheduleHistory = 100
+)
+
+// ScheduleStatus is a schedule with its next and last trigger, as returned by the REST API.
+type ScheduleStatus struct {
+	config.Schedule
+	NextRun    *time.Time `json:"nextRun"`
+	LastRun    *time.Time `json:"lastRun"`
+	LastResult string     `json:"lastResult,omitempty"`
+	Error      string     `json:"error,omitempty"` // Set if the trigger cannot be evaluated
+}
+
+// ScheduleRun is one execution of a schedule.
+type ScheduleRun struct {
+	Schedule   string    `json:"schedule"`
+	Trigger    time.Time `json:"trigger"`    // When the schedule was due
+	ExecutedAt time.Time `json:"executedAt"` // Later than Trigger if it was caught up after a restart or sleep
+	Success    bool      `json:"success"`
+	Message    string    `json:"message"`
+}
+
+// scheduleState is persisted per schedule so missed triggers can be caught up after a restart.
+type scheduleState struct {
+	LastTrigger time.Time `json:"lastTrigger"`
+	LastResult  string    `json:"lastResult"`
+}
+
+var (
+	schedMutex   sync.Mutex
+	schedStates  = make(map[string]*scheduleState)
+	schedHistory []ScheduleRun
+	schedOnce    sync.Once
+)
+
+// StartScheduler loads the schedule state and starts the background scheduler.
+func StartScheduler() {
+	schedOnce.Do(func() {
+		if err := config.LoadState(scheduleStateFile, &schedStates); err != nil {
+			logger.Warn("Scheduler: %v", err)
+		}
+		go schedulerLoop()
+	})
+}
+
+// ValidateSchedule checks a schedule including its cron expression and sun event.
+func ValidateSchedule(sched config.Schedule) error {
+	if err := config.ValidateSchedule(sched); err != nil {
+		return err
+	}
+	if sched.Cron != "" {
+		if _, err := parseCron(sched.Cron); err != nil {
+			return fmt.Errorf("schedule '%s': %w", sched.Name, err)
+		}
+	}
+	if sched.SunEvent != "" {
+		if _, _, ok := astro.CurrentSite().SunEvent(sched.SunEvent); !ok {
+			return fmt.Errorf("schedule '%s': unknown sun event '%s'", sched.Name, sched.SunEvent)
+		}
+	}
+	return nil
+}
+
+// ListSchedules returns all configured schedules with their next and last trigger.
+func ListSchedules() []ScheduleStatus {
+	site := astro.CurrentSite()
+	now := time.Now()
+	schedules := config.Get().Schedules
+
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+	result := make([]ScheduleStatus, 0, len(schedules))
+	for _, sched := range schedules {
+		status := ScheduleStatus{Schedule: sched}
+		if next, err := nextTrigger(site, sched, now); err != nil {
+			status.Error = err.Error()
+		} else if !next.IsZero() && !sched.Disabled {
+			status.NextRun = &next
+		}
+		if st, ok := schedStates[sched.Name]; ok && !st.LastTrigger.IsZero() && st.LastResult != "" {
+			last := st.LastTrigger
+			status.LastRun = &last
+			status.LastResult = st.LastResult
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// ScheduleHistory returns the recent schedule executions, most recent first.
+func ScheduleHistory() []ScheduleRun {
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+	result := make([]ScheduleRun, 0, len(schedHistory))
+	for i := len(schedHistory) - 1; i >= 0; i-- {
+		result = append(result, schedHistory[i])
+	}
+	return result
+}
+
+// RunScheduleNow executes the action of a schedule immediately, independent of its trigger.
+func RunScheduleNow(name string) (ScheduleRun, error) {
+	for _, sched := range config.Get().Schedules {
+		if strings.EqualFold(sched.Name, name) {
+			now := time.Now()
+			return executeSchedule(sched, now, now, "manual run"), nil
+		}
+	}
+	return ScheduleRun{}, fmt.Errorf("unknown schedule '%s'", name)
+}
+
+func schedulerLoop() {
+	logger.Info("Scheduler started.")
+	checkSchedules(time.Now())
+
+	ticker := time.NewTicker(scheduleTickRate)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkSchedules(time.Now())
+	}
+}
+
+// checkSchedules runs every schedule whose trigger passed since its last run.
+// The wall clock is compared against the persisted last trigger, so a restart or a sleeping PC
+// catches up with the latest missed trigger (if it is not older than the catch-up time).
+func checkSchedules(now time.Time) {
+	site := astro.CurrentSite()
+	schedules := config.Get().Schedules
+	pruneScheduleStates(schedules)
+
+	for _, sched := range schedules {
+		schedMutex.Lock()
+		if sched.Disabled {
+			// Forget the state, so re-enabling does not catch up triggers missed while disabled.
+			if _, ok := schedStates[sched.Name]; ok {
+				delete(schedStates, sched.Name)
+				saveScheduleStatesLocked()
+			}
+			schedMutex.Unlock()
+			continue
+		}
+		st, known := schedStates[sched.Name]
+		if !known {
+			// New schedule: start counting from now instead of firing past triggers.
+			schedStates[sched.Name] = &scheduleState{LastTrigger: now}
+			saveScheduleStatesLocked()
+		}
+		var after time.Time
+		if known {
+			after = st.LastTrigger
+		}
+		schedMutex.Unlock()
+		if !known {
+			continue
+		}
+
+		catchUp := defaultCatchUp
+		if sched.CatchUpMinutes > 0 {
+			catchUp = time.Duration(sched.CatchUpMinutes) * time.Minute
+		}
+		if earliest := now.Add(-catchUp); after.Before(earliest) {
+			after = earliest
+		}
+
+		trigger, err := previousTrigger(site, sched, after, now)
+		if err != nil || trigger.IsZero() {
+			continue
+		}
+		// Wait for the device (e.g. right after wake-up); the trigger stays due within the catch-up time.
+		if !serial.IsConnected() {
+			continue
+		}
+
+		reason := "scheduled"
+		if now.Sub(trigger) > 2*scheduleTickRate {
+			reason = "caught up"
+		}
+		executeSchedule(sched, trigger, now, reason)
+	}
+}
+
+// previousTrigger returns the latest trigger time in (after, until], or the zero time.
+func previousTrigger(site astro.Site, sched config.Schedule, after, until time.Time) (time.Time, error) {
+	if sched.Cron != "" {
+		spec, err := parseCron(sched.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return spec.previous(after.In(site.Location), until.In(site.Location)), nil
+	}
+
+	var latest time.Time
+	for _, date := range nightLabels(site, until, -2, 0) {
+		t, err := sunTrigger(site, sched, date)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !t.IsZero() && t.After(after) && !t.After(until) && t.After(latest) {
+			latest = t
+		}
+	}
+	return latest, nil
+}
+
+// nextTrigger returns the first trigger time after t, or the zero time if none is found soon.
+func nextTrigger(site astro.Site, sched config.Schedule, t time.Time) (time.Time, error) {
+	if sched.Cron != "" {
+		spec, err := parseCron(sched.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return spec.next(t.In(site.Location), cronSearchHorizon), nil
+	}
+
+	for _, date := range nightLabels(site, t, -1, 2) {
+		next, err := sunTrigger(site, sched, date)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !next.IsZero() && next.After(t) {
+			return next, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// nightLabels returns the labels of the nights from the night of t plus from to plus to days.
+func nightLabels(site astro.Site, t time.Time, from, to int) []string {
+	day, _ := site.ParseDate(site.NightOf(t))
+	var labels []string
+	for i := from; i <= to; i++ {
+		labels = append(labels, day.AddDate(0, 0, i).Format(astro.DateLayout))
+	}
+	return labels
+}
+
+// sunTrigger returns the trigger time of a sun based schedule in the given night, or the zero time
+// if the sun does not reach the altitude in that night.
+func sunTrigger(site astro.Site, sched config.Schedule, date string) (time.Time, error) {
+	var alt float64
+	var rising bool
+	if sched.SunAltitude != nil {
+		alt, rising = *sched.SunAltitude, sched.Rising
+	} else {
+		var ok bool
+		if alt, rising, ok = site.SunEvent(sched.SunEvent); !ok {
+			return time.Time{}, fmt.Errorf("unknown sun event '%s'", sched.SunEvent)
+		}
+	}
+	crossing, err := site.SunCrossing(alt, rising, date)
+	if err != nil || crossing == nil {
+		return time.Time{}, err
+	}
+	return crossing.Add(time.Duration(sched.OffsetMinutes * float64(time.Minute))), nil
+}
+
+// executeSchedule runs the action of a schedule and records the result.
+func executeSchedule(sched config.Schedule, trigger, now time.Time, reason string) ScheduleRun {
+	source := fmt.Sprintf("schedule '%s'", sched.Name)
+	run := ScheduleRun{Schedule: sched.Name, Trigger: trigger, ExecutedAt: now}
+
+	action := actionSpec{Outputs: sched.Outputs, Scene: sched.Scene, Sequence: sched.Sequence, Boost: sched.Boost}
+	if err := runAction(action, source); err != nil {
+		run.Message = err.Error()
+		logger.Error("Scheduler: '%s' (%s, due %s) failed: %v", sched.Name, reason, trigger.Format(time.RFC3339), err)
+	} else {
+		run.Success = true
+		run.Message = "OK"
+		logger.Info("Scheduler: '%s' executed (%s, due %s).", sched.Name, reason, trigger.Format(time.RFC3339))
+	}
+
+	schedMutex.Lock()
+	schedStates[sched.Name] = &scheduleState{LastTrigger: trigger, LastResult: run.Message}
+	saveScheduleStatesLocked()
+	schedHistory = append(schedHistory, run)
+	if len(schedHistory) > maxScheduleHistory {
+		schedHistory = schedHistory[len(schedHistory)-maxScheduleHistory:]
+	}
+	schedMutex.Unlock()
+	return run
+}
+
+// pruneScheduleStates forgets the state of schedules that no longer exist.
+func pruneScheduleStates(schedules []config.Schedule) {
+	names := make(map[string]bool, len(schedules))
+	for _, sched := range schedules {
+		names[sched.Name] = true
+	}
+	schedMutex.Lock()
+	defer schedMutex.Unlock()
+	changed := false
+	for name := range schedStates {
+		if !names[name] {
+			delete(schedStates, name)
+			changed = true
+		}
+	}
+	if changed {
+		saveScheduleStatesLocked()
+	}
+}
+
+// saveScheduleStatesLocked persists the schedule states. The caller must hold schedMutex.
+func saveScheduleStatesLocked() {
+	if err := config.SaveState(scheduleStateFile, schedStates); err != nil {
+		logger.Error("Scheduler: Failed to persist schedule state: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package automation
+
+import (
+	"fmt"
+	"math"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+// Thermostat states as reported by the REST API.
+const (
+	ThermostatIdle     = "idle"     // Output off, no demand
+	ThermostatActive   = "active"   // Output driven by the loop
+	ThermostatDisabled = "disabled" // Disabled in the configuration
+	ThermostatError    = "error"    // Input cannot be evaluated; the output keeps its last state
+)
+
+// minVoltageStep is the smallest voltage change the PID loop sends to the converter.
+const minVoltageStep = 0.1
+
+// ThermostatStatus is a thermostat with its runtime state, as returned by the REST API.
+type ThermostatStatus struct {
+	config.Thermostat
+	State      string     `json:"state"`
+	Value      *float64   `json:"value"`             // Current input value
+	Output     float64    `json:"outputPercent"`     // Controller output: 0/100 for bang-bang, 0..100 for PID
+	Voltage    *float64   `json:"voltage,omitempty"` // PID: commanded converter voltage
+	LastSwitch *time.Time `json:"lastSwitch,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// thermostatState is the runtime state of one loop. It is keyed by name and reset when the loop is changed.
+type thermostatState struct {
+	config   config.Thermostat
+	node     exprNode
+	parseErr error
+	evalErr  error
+	value    *float64
+	output   float64
+	voltage  *float64
+	on       bool
+	changed  time.Time // Last switch (bang-bang) or voltage change (PID)
+	integral float64
+	lastErr  float64
+	lastTime time.Time
+	busy     bool
+}
+
+var (
+	thermostatMutex  sync.Mutex
+	thermostatStates = make(map[string]*thermostatState)
+	thermostatOnce   sync.Once
+)
+
+// StartThermostats runs the control loops after every cache update.
+func StartThermostats() {
+	thermostatOnce.Do(func() {
+		serial.OnCacheUpdate(evaluateThermostats)
+	})
+}
+
+// ValidateThermostat checks a thermostat including its input expression.
+func ValidateThermostat(t config.Thermostat) error {
+	if err := config.ValidateThermostat(t); err != nil {
+		return err
+	}
+	if _, err := parseCondition(t.Input); err != nil {
+		return fmt.Errorf("thermostat '%s': invalid input: %w", t.Name, err)
+	}
+	return nil
+}
+
+// ListThermostats returns all configured thermostats with their runtime state.
+func ListThermostats() []ThermostatStatus {
+	thermostats := config.Get().Thermostats
+
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	result := make([]ThermostatStatus, 0, len(thermostats))
+	for _, t := range thermostats {
+		status := ThermostatStatus{Thermostat: t, State: ThermostatIdle}
+		st := thermostatStates[t.Name]
+		switch {
+		case t.Disabled:
+			status.State = ThermostatDisabled
+		case st == nil:
+		case st.parseErr != nil || st.evalErr != nil:
+			status.State = ThermostatError
+			if st.parseErr != nil {
+				status.Error = st.parseErr.Error()
+			} else {
+				status.Error = st.evalErr.Error()
+			}
+		case st.output > 0:
+			status.State = ThermostatActive
+		}
+		if st != nil && !t.Disabled {
+			status.Value = st.value
+			status.Output = st.output
+			status.Voltage = st.voltage
+			if !st.changed.IsZero() {
+				changed := st.changed
+				status.LastSwitch = &changed
+			}
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+// evaluateThermostats computes every loop's output after a cache update. Commands are sent in a
+// goroutine; while one is in progress for a loop, that loop only updates its input value.
+func evaluateThermostats(snapshot serial.CacheSnapshot) {
+	thermostats := config.Get().Thermostats
+	lookup := snapshotLookup(snapshot)
+
+	thermostatMutex.Lock()
+	defer thermostatMutex.Unlock()
+	names := make(map[string]bool, len(thermostats))
+	for _, t := range thermostats {
+		names[t.Name] = true
+	}
+	for name := range thermostatStates {
+		if !names[name] {
+			delete(thermostatStates, name)
+		}
+	}
+
+	for _, t := range thermostats {
+		if t.Disabled {
+			delete(thermostatStates, t.Name)
+			continue
+		}
+		st := thermostatStates[t.Name]
+		if st == nil || st.config != t {
+			// A changed loop starts over, without its integral
+			st = &thermostatState{config: t}
+			st.node, st.parseErr = parseCondition(t.Input)
+			thermostatStates[t.Name] = st
+		}
+		if st.parseErr != nil {
+			continue
+		}
+
+		value, err := st.node.eval(lookup, 0)
+		st.evalErr = err
+		if err != nil {
+			st.value = nil
+			st.lastTime = time.Time{} // Do not integrate over the gap
+			continue
+		}
+		st.value = &value
+
+		// Error in the direction the output drives the input
+		e := t.Setpoint - value
+		if t.Action == config.ThermostatCool {
+			e = -e
+		}
+		on, _ := numericValue(snapshot.Status[config.ShortSwitchIDMap[t.Output]])
+		st.on = on != 0
+
+		if t.Mode == config.ThermostatPID {
+			evaluatePID(t, st, e, snapshot.Time)
+		} else {
+			evaluateBangBang(t, st, e, snapshot.Time)
+		}
+	}
+}
+
+// evaluateBangBang switches the output on when the error exceeds the hysteresis and off when it falls
+// below minus the hysteresis. The output is compared with the actual state, so a manual change is
+// corrected after the minimum cycle time.
+func evaluateBangBang(t config.Thermostat, st *thermostatState, e float64, now time.Time) {
+	switch {
+	case e > t.Hysteresis:
+		st.output = 100
+	case e < -t.Hysteresis:
+		st.output = 0
+	}
+	want := st.output > 0
+	if want == st.on || st.busy {
+		return
+	}
+	if !st.changed.IsZero() && now.Sub(st.changed) < seconds(t.MinCycleSeconds) {
+		return
+	}
+	st.changed = now
+	st.busy = true
+	go func() {
+		source := fmt.Sprintf("thermostat '%s'", t.Name)
+		if err := power.SetOutput(t.Output, want, nil, source); err != nil {
+			logger.Error("Thermostat '%s': Failed to switch %s %s: %v", t.Name, t.Output, onOff(want), err)
+		} else {
+			logger.Info("Thermostat '%s': %s switched %s.", t.Name, t.Output, onOff(want))
+		}
+		thermostatMutex.Lock()
+		st.busy = false
+		thermostatMutex.Unlock()
+	}()
+}
+
+// evaluatePID computes the controller output in % and maps it onto the converter's voltage range.
+// The integral is clamped to the output range (anti-windup); 0 % switches the converter off.
+func evaluatePID(t config.Thermostat, st *thermostatState, e float64, now time.Time) {
+	derivative := 0.0
+	if !st.lastTime.IsZero() {
+		dt := now.Sub(st.lastTime).Seconds()
+		if dt > 0 {
+			st.integral = math.Max(0, math.Min(100, st.integral+t.Ki*e*dt))
+			derivative = (e - st.lastErr) / dt
+		}
+	}
+	st.lastErr = e
+	st.lastTime = now
+	st.output = math.Max(0, math.Min(100, t.Kp*e+st.integral+t.Kd*derivative))
+
+	voltage := 0.0
+	if st.output > 0 {
+		voltage = math.Round((t.MinVoltage+st.output/100*(t.MaxVoltage-t.MinVoltage))*10) / 10
+	}
+	if st.busy {
+		return
+	}
+	if st.voltage != nil && st.on == (voltage > 0) && math.Abs(*st.voltage-voltage) < minVoltageStep {
+		return
+	}
+	if st.voltage == nil && !st.on && voltage == 0 {
+		return // Already off
+	}
+	st.voltage = &voltage
+	st.changed = now
+	st.busy = true
+	output := st.output
+	go func() {
+		source := fmt.Sprintf("thermostat '%s'", t.Name)
+		if err := power.SetAdjVoltage(voltage, source); err != nil {
+			logger.Error("Thermostat '%s': Failed to set %s to %.1f V: %v", t.Name, t.Output, voltage, err)
+			thermostatMutex.Lock()
+			st.voltage = nil // Send again on the next cycle
+			thermostatMutex.Unlock()
+		} else {
+			logger.Debug("Thermostat '%s': %s set to %.1f V (%.0f%%).", t.Name, t.Output, voltage, output)
+		}
+		thermostatMutex.Lock()
+		st.busy = false
+		thermostatMutex.Unlock()
+	}()
+}
+
+// ThermostatSample is the state of one loop as written to telemetry.
+type ThermostatSample struct {
+	Name     string
+	Value    *float64
+	Setpoint float64
+	Output   float64
+	State    string
+}
+
+// ThermostatSamples returns the current state of all enabled loops for telemetry.
+func ThermostatSamples() []ThermostatSample {
+	var samples []ThermostatSample
+	for _, t := range ListThermostats() {
+		if t.Disabled {
+			continue
+		}
+		samples = append(samples, ThermostatSample{Name: t.Name, Value: t.Value, Setpoint: t.Setpoint, Output: t.Output, State: t.State})
+	}
+	return samples
+}
+
+func onOff(state bool) string {
+	if state {
+		return "on"
+	}
+	return "off"
+}
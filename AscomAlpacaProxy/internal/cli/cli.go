@@ -0,0 +1,92 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"time"
+)
+
+// Run handles command line invocations that control an already running proxy instance,
+// e.g. `AscomAlpacaProxy.exe -scene "Park"`.
+// It returns handled=false if no CLI command was given and the application should start normally.
+func Run(args []string) (handled bool, err error) {
+	fs := flag.NewFlagSet("AscomAlpacaProxy", flag.ContinueOnError)
+	scene := fs.String("scene", "", "apply the named output scene on the running proxy and exit")
+	sequence := fs.String("sequence", "", "start the named power sequence on the running proxy and exit")
+	if err := fs.Parse(args); err != nil {
+		return true, err
+	}
+
+	if *scene != "" {
+		return true, applyScene(*scene)
+	}
+	if *sequence != "" {
+		return true, runSequence(*sequence)
+	}
+	return false, nil
+}
+
+// post sends a JSON request to the REST API of the running proxy and decodes the JSON response into out.
+func post(path string, payload interface{}, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(config.GetBaseURLFromFile()+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not reach the running proxy: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+func applyScene(name string) error {
+	var result struct {
+		Success bool `json:"success"`
+		Failed  []struct {
+			Output string      `json:"output"`
+			Target interface{} `json:"target"`
+			Actual interface{} `json:"actual"`
+		} `json:"failed"`
+	}
+	if err := post("/api/v1/scenes/apply", map[string]string{"name": name}, &result); err != nil {
+		return err
+	}
+	if !result.Success {
+		var failed []string
+		for _, f := range result.Failed {
+			failed = append(failed, fmt.Sprintf("%s (target %v, actual %v)", f.Output, f.Target, f.Actual))
+		}
+		return fmt.Errorf("scene '%s' applied, but some outputs did not reach their target: %s", name, strings.Join(failed, ", "))
+	}
+	fmt.Printf("Scene '%s' applied successfully.\n", name)
+	return nil
+}
+
+func runSequence(name string) error {
+	var status struct {
+		ID         int `json:"id"`
+		TotalSteps int `json:"totalSteps"`
+	}
+	if err := post("/api/v1/sequences/run", map[string]string{"name": name}, &status); err != nil {
+		return err
+	}
+	fmt.Printf("Sequence '%s' started as job %d (%d steps).\n", name, status.ID, status.TotalSteps)
+	return nil
+}
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sync"
+	"time"
 )
 
 // ProxyConfig stores configuration specific to the Go proxy itself.
@@ -24,6 +27,222 @@ type ProxyConfig struct {
 	EnableMasterPower          bool              `json:"enableMasterPower"`          // Show Master Power switch
 	EnableNotifications        bool              `json:"enableNotifications"`        // Show Windows toast notifications
 	FirstRunComplete           bool              `json:"firstRunComplete"`           // Onboarding wizard completed
+	VirtualSwitches            []VirtualSwitch   `json:"virtualSwitches"`            // User-defined output groups
+	Scenes                     []Scene           `json:"scenes"`                     // Named output snapshots
+	Sequences                  []Sequence        `json:"sequences"`                  // Ordered power-up/down sequences
+	MasterPowerOnSequence      string            `json:"masterPowerOnSequence"`      // Sequence run instead of "all on" (optional)
+	MasterPowerOffSequence     string            `json:"masterPowerOffSequence"`     // Sequence run instead of "all off" (optional)
+	Site                       Site              `json:"site"`                       // Observatory location used for ephemeris and night boundaries
+	Schedules                  []Schedule        `json:"schedules"`                  // Clock and sun-altitude based actions
+	Rules                      []Rule            `json:"rules"`                      // Conditional actions on sensor and status data
+	LoadShedding               LoadShedding      `json:"loadShedding"`               // Battery low-voltage output shedding
+	PowerBudget                PowerBudget       `json:"powerBudget"`                // Total current/power limit enforced by throttling the heaters
+	Interlocks                 Interlocks        `json:"interlocks"`                 // Safety constraints checked before every set command
+	Dependencies               []Dependency      `json:"dependencies"`               // Power-on/off relationships between outputs
+	Thermostats                []Thermostat      `json:"thermostats"`                // Proxy-side control loops for DC and adjustable outputs
+	DewGuard                   DewGuard          `json:"dewGuard"`                   // Alert and heater response when dew is imminent
+	RollupRetention            RollupRetention   `json:"rollupRetention"`            // How long aggregated telemetry is kept
+	Energy                     Energy            `json:"energy"`                     // Energy accounting of the telemetry
+	Battery                    Battery           `json:"battery"`                    // Battery model for state of charge and runtime
+	LoadProfiles               LoadProfiles      `json:"loadProfiles"`               // Learning of per-output draw from switching steps
+	BurstSampling              BurstSampling     `json:"burstSampling"`              // Fast sensor polling after set commands
+}
+
+// RollupRetention sets how many days each resolution of the aggregated telemetry is kept.
+// 0 uses the default, a negative value keeps the rollups forever.
+type RollupRetention struct {
+	MinuteDays    int `json:"minuteDays"`    // 1-minute rollups (default 90)
+	TenMinuteDays int `json:"tenMinuteDays"` // 10-minute rollups (default 730)
+	HourDays      int `json:"hourDays"`      // 1-hour rollups (default forever)
+}
+
+// Days returns the retention in days of the rollup with the given resolution (seconds); 0 means forever.
+func (r RollupRetention) Days(resolution int64) int {
+	days, def := r.HourDays, 0
+	switch resolution {
+	case 60:
+		days, def = r.MinuteDays, 90
+	case 600:
+		days, def = r.TenMinuteDays, 730
+	}
+	if days == 0 {
+		days = def
+	}
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+// Energy configures the energy accounting, which integrates the logged power and current.
+type Energy struct {
+	HeaterWatts       map[string]float64 `json:"heaterWatts"`       // Power of a heater at 100 % ("pwm1", "pwm2"), needed for the heater share
+	SessionGapMinutes float64            `json:"sessionGapMinutes"` // A gap without readings longer than this ends a session (default 30)
+}
+
+// ValidateEnergy checks the energy accounting settings.
+func ValidateEnergy(e Energy) error {
+	for heater, watts := range e.HeaterWatts {
+		if heater != "pwm1" && heater != "pwm2" {
+			return fmt.Errorf("unknown heater '%s'", heater)
+		}
+		if watts < 0 {
+			return fmt.Errorf("heater power must not be negative")
+		}
+	}
+	if e.SessionGapMinutes < 0 {
+		return fmt.Errorf("session gap must not be negative")
+	}
+	return nil
+}
+
+// LoadProfiles configures how the draw of each output is learned from the change of the total current
+// when the proxy switches it, and when a deviation from the learned draw is reported.
+type LoadProfiles struct {
+	Enabled       bool    `json:"enabled"`
+	SettleSeconds float64 `json:"settleSeconds"` // Time after switching before the new total is read (default 5)
+	AlertPercent  float64 `json:"alertPercent"`  // Alert when a step deviates by more than this from the profile, 0 = no alerts
+	MinSamples    int     `json:"minSamples"`    // Steps learned before deviations are reported (default 5)
+}
+
+// ValidateLoadProfiles checks the load profiling settings.
+func ValidateLoadProfiles(lp LoadProfiles) error {
+	if lp.SettleSeconds < 0 || lp.SettleSeconds > 60 {
+		return fmt.Errorf("settle time must be between 0 and 60 s")
+	}
+	if lp.AlertPercent < 0 {
+		return fmt.Errorf("alert threshold must not be negative")
+	}
+	if !lp.Enabled && lp.AlertPercent > 0 {
+		return fmt.Errorf("deviation alerts need load profiling to be enabled")
+	}
+	if lp.MinSamples < 0 {
+		return fmt.Errorf("minimum number of samples must not be negative")
+	}
+	return nil
+}
+
+// BurstSampling configures the fast sensor polling that records inrush currents and voltage sags.
+// Bursts can always be started through the API; Enabled also starts one after every set command.
+type BurstSampling struct {
+	Enabled         bool    `json:"enabled"`
+	IntervalMs      int     `json:"intervalMs"`      // Polling interval during a burst (default 200)
+	DurationSeconds float64 `json:"durationSeconds"` // Length of a burst (default 10)
+	MinGapSeconds   float64 `json:"minGapSeconds"`   // Minimum time between bursts started by set commands (default 60)
+}
+
+// ValidateBurstSampling checks the burst sampling settings.
+func ValidateBurstSampling(bs BurstSampling) error {
+	if bs.IntervalMs != 0 && (bs.IntervalMs < 50 || bs.IntervalMs > 5000) {
+		return fmt.Errorf("interval must be between 50 and 5000 ms")
+	}
+	if bs.DurationSeconds != 0 && (bs.DurationSeconds < 1 || bs.DurationSeconds > 120) {
+		return fmt.Errorf("duration must be between 1 and 120 s")
+	}
+	if bs.MinGapSeconds < 0 || bs.MinGapSeconds > 3600 {
+		return fmt.Errorf("minimum gap must be between 0 and 3600 s")
+	}
+	return nil
+}
+
+// Battery chemistries with a built-in resting-voltage curve.
+const (
+	ChemistryLiFePO4 = "lifepo4"
+	ChemistryAGM     = "agm"
+	ChemistryLiIon   = "liion"
+)
+
+// Battery describes the supply battery. The state of charge is counted from the measured current
+// and corrected with the resting-voltage curve of the chemistry whenever the battery rests.
+type Battery struct {
+	Enabled        bool    `json:"enabled"`
+	Chemistry      string  `json:"chemistry"`      // One of the Chemistry* constants
+	Cells          int     `json:"cells"`          // Cells in series, 0 = 12 V battery (4 LiFePO4, 6 AGM, 3 Li-ion)
+	CapacityAh     float64 `json:"capacityAh"`     // Nominal capacity
+	ReservePercent float64 `json:"reservePercent"` // State of charge the runtime counts down to (e.g. 50 for AGM)
+	RestCurrent    float64 `json:"restCurrent"`    // Amps; below this the voltage counts as resting (default 0.2)
+	RestMinutes    float64 `json:"restMinutes"`    // Time below RestCurrent before the curve is trusted (default 30)
+	FullVoltage    float64 `json:"fullVoltage"`    // Reset to 100 % when the voltage stays at or above this, 0 = off
+	FullSeconds    float64 `json:"fullSeconds"`    // Time at FullVoltage before the reset (default 60)
+}
+
+// ValidateBattery checks the battery model settings.
+func ValidateBattery(b Battery) error {
+	switch b.Chemistry {
+	case ChemistryLiFePO4, ChemistryAGM, ChemistryLiIon:
+	case "":
+		if b.Enabled {
+			return fmt.Errorf("chemistry must be set")
+		}
+	default:
+		return fmt.Errorf("chemistry must be '%s', '%s' or '%s'", ChemistryLiFePO4, ChemistryAGM, ChemistryLiIon)
+	}
+	if b.Cells < 0 || b.Cells > 12 {
+		return fmt.Errorf("cells must be between 1 and 12")
+	}
+	if b.CapacityAh < 0 || (b.Enabled && b.CapacityAh == 0) {
+		return fmt.Errorf("capacity must be set")
+	}
+	if b.ReservePercent < 0 || b.ReservePercent >= 100 {
+		return fmt.Errorf("reserve must be between 0 and 100 %%")
+	}
+	if b.RestCurrent < 0 || b.RestMinutes < 0 || b.FullVoltage < 0 || b.FullSeconds < 0 {
+		return fmt.Errorf("currents, voltages and times must not be negative")
+	}
+	return nil
+}
+
+// Night boundary definitions. A night is labelled with the date of its evening.
+const (
+	NightNoon         = "noon"         // Noon to noon in the site time zone (no coordinates needed)
+	NightSunset       = "sunset"       // Sunset to sunrise
+	NightCivil        = "civil"        // Civil dusk to civil dawn (sun 6° below the horizon)
+	NightNautical     = "nautical"     // Nautical dusk to nautical dawn (12°)
+	NightAstronomical = "astronomical" // Astronomical dusk to astronomical dawn (18°)
+)
+
+// Site describes the observatory location.
+type Site struct {
+	Latitude      float64 `json:"latitude"`      // Degrees, north positive
+	Longitude     float64 `json:"longitude"`     // Degrees, east positive
+	Elevation     float64 `json:"elevation"`     // Meters above sea level
+	TimeZone      string  `json:"timeZone"`      // IANA name, e.g. "Europe/Berlin"; empty uses the system time zone
+	NightBoundary string  `json:"nightBoundary"` // One of the Night* constants
+}
+
+// ValidateSite checks an observatory site definition.
+func ValidateSite(site Site) error {
+	if site.Latitude < -90 || site.Latitude > 90 {
+		return fmt.Errorf("latitude must be between -90 and 90")
+	}
+	if site.Longitude < -180 || site.Longitude > 180 {
+		return fmt.Errorf("longitude must be between -180 and 180")
+	}
+	if site.TimeZone != "" {
+		if _, err := time.LoadLocation(site.TimeZone); err != nil {
+			return fmt.Errorf("unknown time zone '%s'", site.TimeZone)
+		}
+	}
+	switch site.NightBoundary {
+	case NightNoon, NightSunset, NightCivil, NightNautical, NightAstronomical:
+	default:
+		return fmt.Errorf("invalid night boundary '%s'", site.NightBoundary)
+	}
+	return nil
+}
+
+// Virtual switch state semantics.
+const (
+	GroupModeAll      = "all"      // On only if every member is on
+	GroupModeAny      = "any"      // On if at least one member is on
+	GroupModeMajority = "majority" // On if more than half of the members are on
+)
+
+// VirtualSwitch combines several outputs into one composite Alpaca switch.
+type VirtualSwitch struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"` // Internal output names, e.g. "dc1", "usb345"
+	Mode    string   `json:"mode"`    // One of the GroupMode* constants
 }
 
 // CombinedConfig defines the structure for a full backup file.
@@ -53,11 +272,20 @@ const (
 	SensorVoltageKey = "sensor_voltage"
 	SensorCurrentKey = "sensor_current"
 	SensorPowerKey   = "sensor_power"
+
+	// Battery estimates, exposed after all other switches while the battery model is enabled
+	SensorBatterySoCKey     = "sensor_battery_soc"
+	SensorBatteryRuntimeKey = "sensor_battery_runtime"
 )
 
 // IsSensorSwitch returns true if the switch key is a read-only sensor
 func IsSensorSwitch(key string) bool {
-	return key == SensorVoltageKey || key == SensorCurrentKey || key == SensorPowerKey
+	return key == SensorVoltageKey || key == SensorCurrentKey || key == SensorPowerKey || IsBatterySensor(key)
+}
+
+// IsBatterySensor returns true if the switch key is one of the battery estimate sensors
+func IsBatterySensor(key string) bool {
+	return key == SensorBatterySoCKey || key == SensorBatteryRuntimeKey
 }
 
 var (
@@ -86,8 +314,639 @@ var (
 
 	proxyConfig     *ProxyConfig // Singleton instance
 	proxyConfigFile string       // Full path to the config file
+	appConfigDir    string       // Directory holding the config and runtime state files
+)
+
+// Scene is a named snapshot of desired output states.
+// Outputs maps internal output names to true/false, a voltage (adj_conv) or a manual power in % (pwm1, pwm2).
+type Scene struct {
+	Name    string                 `json:"name"`
+	Outputs map[string]interface{} `json:"outputs"`
+}
+
+// ValidateScene checks that a scene only references real outputs with sensible target values.
+func ValidateScene(scene Scene) error {
+	if strings.TrimSpace(scene.Name) == "" {
+		return fmt.Errorf("scene name must not be empty")
+	}
+	if len(scene.Outputs) == 0 {
+		return fmt.Errorf("scene '%s' has no outputs", scene.Name)
+	}
+	return validateOutputTargets("scene '"+scene.Name+"'", scene.Outputs)
+}
+
+// validateOutputTargets checks a map of internal output names to target values.
+// owner is used to prefix error messages.
+func validateOutputTargets(owner string, outputs map[string]interface{}) error {
+	for output, target := range outputs {
+		if _, ok := ShortSwitchIDMap[output]; !ok || output == "master_power" {
+			return fmt.Errorf("%s: unknown output '%s'", owner, output)
+		}
+		switch v := target.(type) {
+		case bool:
+		case float64:
+			switch output {
+			case "adj_conv":
+				if v < 0 || v > 15 {
+					return fmt.Errorf("%s: voltage for '%s' must be between 0 and 15", owner, output)
+				}
+			case "pwm1", "pwm2":
+				if v < 0 || v > 100 {
+					return fmt.Errorf("%s: power for '%s' must be between 0 and 100", owner, output)
+				}
+			default:
+				return fmt.Errorf("%s: output '%s' only accepts true or false", owner, output)
+			}
+		default:
+			return fmt.Errorf("%s: invalid target for '%s'", owner, output)
+		}
+	}
+	return nil
+}
+
+// BoostAction boosts a heater from a schedule or rule: manual mode at Percent for Minutes,
+// after which the heater's previous settings are restored.
+type BoostAction struct {
+	Heater  string  `json:"heater"`
+	Percent float64 `json:"percent"`
+	Minutes float64 `json:"minutes"`
+}
+
+func validateBoostAction(owner string, b BoostAction) error {
+	if b.Heater != "pwm1" && b.Heater != "pwm2" {
+		return fmt.Errorf("%s: unknown heater '%s'", owner, b.Heater)
+	}
+	if b.Percent <= 0 || b.Percent > 100 {
+		return fmt.Errorf("%s: boost power must be between 1 and 100", owner)
+	}
+	if b.Minutes <= 0 || b.Minutes > 240 {
+		return fmt.Errorf("%s: boost duration must be between 0 and 240 minutes", owner)
+	}
+	return nil
+}
+
+// Sequence is an ordered list of steps used to power outputs up or down one after another.
+type Sequence struct {
+	Name  string         `json:"name"`
+	Steps []SequenceStep `json:"steps"`
+}
+
+// SequenceStep sets one or more outputs, optionally waits for a condition and then waits DelaySeconds.
+type SequenceStep struct {
+	Outputs      map[string]interface{} `json:"outputs"` // Same targets as Scene.Outputs
+	WaitFor      *StepCondition         `json:"waitFor,omitempty"`
+	DelaySeconds float64                `json:"delaySeconds"`
+}
+
+// StepCondition is a condition a sequence step waits for after switching.
+// All given criteria must hold at the same time.
+type StepCondition struct {
+	MinVoltage     float64 `json:"minVoltage,omitempty"`     // Input voltage recovered to at least this value (V)
+	CurrentSettled float64 `json:"currentSettled,omitempty"` // Current changed less than this between two readings (A)
+	TimeoutSeconds float64 `json:"timeoutSeconds"`           // Give up waiting after this time (default 30 s)
+	AbortOnTimeout bool    `json:"abortOnTimeout"`           // Abort the sequence instead of continuing on timeout
+}
+
+// ValidateSequence checks a sequence definition.
+func ValidateSequence(seq Sequence) error {
+	if strings.TrimSpace(seq.Name) == "" {
+		return fmt.Errorf("sequence name must not be empty")
+	}
+	if len(seq.Steps) == 0 {
+		return fmt.Errorf("sequence '%s' has no steps", seq.Name)
+	}
+	for i, step := range seq.Steps {
+		owner := fmt.Sprintf("sequence '%s' step %d", seq.Name, i+1)
+		if len(step.Outputs) == 0 {
+			return fmt.Errorf("%s has no outputs", owner)
+		}
+		if err := validateOutputTargets(owner, step.Outputs); err != nil {
+			return err
+		}
+		if step.DelaySeconds < 0 {
+			return fmt.Errorf("%s: delay must not be negative", owner)
+		}
+		if c := step.WaitFor; c != nil && (c.MinVoltage < 0 || c.CurrentSettled < 0 || c.TimeoutSeconds < 0) {
+			return fmt.Errorf("%s: wait condition values must not be negative", owner)
+		}
+	}
+	return nil
+}
+
+// Schedule runs an action at clock times (Cron) or when the sun passes an altitude (SunEvent or SunAltitude).
+// Exactly one trigger and one action must be set. Times are evaluated in the site time zone.
+type Schedule struct {
+	Name           string                 `json:"name"`
+	Disabled       bool                   `json:"disabled"`
+	Cron           string                 `json:"cron,omitempty"`        // "minute hour day-of-month month day-of-week"
+	SunEvent       string                 `json:"sunEvent,omitempty"`    // e.g. "sunset", "nautical_dusk", "astronomical_dawn"
+	SunAltitude    *float64               `json:"sunAltitude,omitempty"` // Custom sun altitude in degrees
+	Rising         bool                   `json:"rising,omitempty"`      // With SunAltitude: morning (rising) instead of evening crossing
+	OffsetMinutes  float64                `json:"offsetMinutes"`         // Shift of a sun trigger, e.g. 30 = 30 min after the event
+	Outputs        map[string]interface{} `json:"outputs,omitempty"`     // Same targets as Scene.Outputs
+	Scene          string                 `json:"scene,omitempty"`
+	Sequence       string                 `json:"sequence,omitempty"`
+	Boost          *BoostAction           `json:"boost,omitempty"`
+	CatchUpMinutes int                    `json:"catchUpMinutes"` // Run a missed trigger if it is at most this old (default 720)
+}
+
+// ValidateSchedule checks the structure of a schedule. Cron expressions and sun event
+// names are checked by the scheduler itself.
+func ValidateSchedule(sched Schedule) error {
+	if strings.TrimSpace(sched.Name) == "" {
+		return fmt.Errorf("schedule name must not be empty")
+	}
+	triggers := 0
+	if sched.Cron != "" {
+		triggers++
+	}
+	if sched.SunEvent != "" {
+		triggers++
+	}
+	if sched.SunAltitude != nil {
+		triggers++
+		if *sched.SunAltitude < -90 || *sched.SunAltitude > 90 {
+			return fmt.Errorf("schedule '%s': sun altitude must be between -90 and 90", sched.Name)
+		}
+	}
+	if triggers != 1 {
+		return fmt.Errorf("schedule '%s' needs exactly one of cron, sunEvent or sunAltitude", sched.Name)
+	}
+
+	actions := 0
+	if len(sched.Outputs) > 0 {
+		actions++
+		if err := validateOutputTargets(fmt.Sprintf("schedule '%s'", sched.Name), sched.Outputs); err != nil {
+			return err
+		}
+	}
+	if sched.Scene != "" {
+		actions++
+	}
+	if sched.Sequence != "" {
+		actions++
+	}
+	if sched.Boost != nil {
+		actions++
+		if err := validateBoostAction(fmt.Sprintf("schedule '%s'", sched.Name), *sched.Boost); err != nil {
+			return err
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("schedule '%s' needs exactly one of outputs, scene, sequence or boost", sched.Name)
+	}
+	if sched.CatchUpMinutes < 0 {
+		return fmt.Errorf("schedule '%s': catch-up time must not be negative", sched.Name)
+	}
+	return nil
+}
+
+// Rule runs an action when Condition has been true for ForSeconds. The condition is an expression
+// over the sensor and status values, e.g. "h_amb > 90" or "t_lens - d < 2 && pwm1 == 0".
+// A rule fires once and re-arms only after the condition has cleared by Hysteresis;
+// CooldownSeconds is the minimum time between two firings.
+type Rule struct {
+	Name            string                 `json:"name"`
+	Disabled        bool                   `json:"disabled"`
+	Condition       string                 `json:"condition"`
+	ForSeconds      float64                `json:"forSeconds"`
+	Hysteresis      float64                `json:"hysteresis"`
+	CooldownSeconds float64                `json:"cooldownSeconds"`
+	Outputs         map[string]interface{} `json:"outputs,omitempty"`      // Same targets as Scene.Outputs
+	HeaterManual    map[string]float64     `json:"heaterManual,omitempty"` // Heater ("pwm1"/"pwm2") -> manual power in %
+	Scene           string                 `json:"scene,omitempty"`
+	Sequence        string                 `json:"sequence,omitempty"`
+	Boost           *BoostAction           `json:"boost,omitempty"`
+}
+
+// ValidateRule checks the structure of a rule. The condition expression is checked by the rule engine.
+func ValidateRule(rule Rule) error {
+	if strings.TrimSpace(rule.Name) == "" {
+		return fmt.Errorf("rule name must not be empty")
+	}
+	if strings.TrimSpace(rule.Condition) == "" {
+		return fmt.Errorf("rule '%s': condition must not be empty", rule.Name)
+	}
+	if rule.ForSeconds < 0 || rule.Hysteresis < 0 || rule.CooldownSeconds < 0 {
+		return fmt.Errorf("rule '%s': duration, hysteresis and cooldown must not be negative", rule.Name)
+	}
+
+	actions := 0
+	if len(rule.Outputs) > 0 || len(rule.HeaterManual) > 0 {
+		actions++
+		if err := validateOutputTargets(fmt.Sprintf("rule '%s'", rule.Name), rule.Outputs); err != nil {
+			return err
+		}
+		for heater, power := range rule.HeaterManual {
+			if heater != "pwm1" && heater != "pwm2" {
+				return fmt.Errorf("rule '%s': unknown heater '%s'", rule.Name, heater)
+			}
+			if power < 0 || power > 100 {
+				return fmt.Errorf("rule '%s': manual power for '%s' must be between 0 and 100", rule.Name, heater)
+			}
+		}
+	}
+	if rule.Scene != "" {
+		actions++
+	}
+	if rule.Sequence != "" {
+		actions++
+	}
+	if rule.Boost != nil {
+		actions++
+		if err := validateBoostAction(fmt.Sprintf("rule '%s'", rule.Name), *rule.Boost); err != nil {
+			return err
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("rule '%s' needs exactly one of outputs/heaterManual, scene, sequence or boost", rule.Name)
+	}
+	return nil
+}
+
+// Thermostat control modes and actions.
+const (
+	ThermostatBangBang = "bangbang" // Output on/off with hysteresis
+	ThermostatPID      = "pid"      // adj_conv voltage from a PID controller
+	ThermostatHeat     = "heat"     // Output drives the input up (on below the setpoint)
+	ThermostatCool     = "cool"     // Output drives the input down (on above the setpoint)
+)
+
+// Thermostat is a proxy-side control loop driving an output from an input expression over the sensor
+// values, e.g. "t_lens - d" for the dew margin or "t_lens - t_amb" for a fan cooling the optics.
+type Thermostat struct {
+	Name            string  `json:"name"`
+	Disabled        bool    `json:"disabled"`
+	Output          string  `json:"output"` // Internal output name (DC, USB or adj_conv)
+	Input           string  `json:"input"`  // Expression over sensor values, same syntax as rule conditions
+	Setpoint        float64 `json:"setpoint"`
+	Action          string  `json:"action"`          // ThermostatHeat or ThermostatCool
+	Mode            string  `json:"mode"`            // ThermostatBangBang or ThermostatPID
+	Hysteresis      float64 `json:"hysteresis"`      // Bang-bang: half width of the switching band around the setpoint
+	MinCycleSeconds float64 `json:"minCycleSeconds"` // Bang-bang: minimum time between two switches
+	Kp              float64 `json:"kp"`              // PID gains; the controller output is 0..100 %
+	Ki              float64 `json:"ki"`
+	Kd              float64 `json:"kd"`
+	MinVoltage      float64 `json:"minVoltage"` // PID: converter voltage at the lowest output above 0 %
+	MaxVoltage      float64 `json:"maxVoltage"` // PID: converter voltage at 100 %
+}
+
+// ValidateThermostat checks the structure of a thermostat. The input expression is checked by the automation package.
+func ValidateThermostat(t Thermostat) error {
+	if strings.TrimSpace(t.Name) == "" {
+		return fmt.Errorf("thermostat name must not be empty")
+	}
+	if _, ok := ShortSwitchIDMap[t.Output]; !ok || t.Output == "master_power" {
+		return fmt.Errorf("thermostat '%s': unknown output '%s'", t.Name, t.Output)
+	}
+	if t.Output == "pwm1" || t.Output == "pwm2" {
+		return fmt.Errorf("thermostat '%s': use the firmware heater modes for '%s'", t.Name, t.Output)
+	}
+	if strings.TrimSpace(t.Input) == "" {
+		return fmt.Errorf("thermostat '%s': input must not be empty", t.Name)
+	}
+	if t.Action != ThermostatHeat && t.Action != ThermostatCool {
+		return fmt.Errorf("thermostat '%s': action must be '%s' or '%s'", t.Name, ThermostatHeat, ThermostatCool)
+	}
+	switch t.Mode {
+	case ThermostatBangBang:
+		if t.Hysteresis < 0 || t.MinCycleSeconds < 0 {
+			return fmt.Errorf("thermostat '%s': hysteresis and minimum cycle time must not be negative", t.Name)
+		}
+	case ThermostatPID:
+		if t.Output != "adj_conv" {
+			return fmt.Errorf("thermostat '%s': PID control needs the adjustable converter as output", t.Name)
+		}
+		if t.Kp < 0 || t.Ki < 0 || t.Kd < 0 || t.Kp+t.Ki+t.Kd == 0 {
+			return fmt.Errorf("thermostat '%s': PID gains must not be negative and not all zero", t.Name)
+		}
+		if t.MinVoltage <= 0 || t.MaxVoltage <= t.MinVoltage || t.MaxVoltage > 15 {
+			return fmt.Errorf("thermostat '%s': voltage range must satisfy 0 < minVoltage < maxVoltage <= 15", t.Name)
+		}
+	default:
+		return fmt.Errorf("thermostat '%s': mode must be '%s' or '%s'", t.Name, ThermostatBangBang, ThermostatPID)
+	}
+	return nil
+}
+
+// LoadShedding switches outputs off in priority order when the input voltage sags.
+// Outputs with priority 1 are shed when the voltage stays below Thresholds[0] for SustainSeconds,
+// priority 2 below Thresholds[1] and so on. Outputs without a priority are never shed.
+type LoadShedding struct {
+	Enabled           bool           `json:"enabled"`
+	Priorities        map[string]int `json:"priorities"`        // Internal output name -> shed priority (1 = first)
+	Thresholds        []float64      `json:"thresholds"`        // Volts per priority, descending
+	SustainSeconds    float64        `json:"sustainSeconds"`    // Time below a threshold before shedding (ignores inrush dips)
+	Restore           bool           `json:"restore"`           // Switch shed outputs back on when the battery recovers
+	RestoreHysteresis float64        `json:"restoreHysteresis"` // Volts above the threshold required for restoring
+	RestoreSeconds    float64        `json:"restoreSeconds"`    // Time above threshold + hysteresis before restoring
+}
+
+// ValidateLoadShedding checks the load shedding settings.
+func ValidateLoadShedding(ls LoadShedding) error {
+	for i, threshold := range ls.Thresholds {
+		if threshold <= 0 || threshold > 30 {
+			return fmt.Errorf("threshold %d must be between 0 and 30 V", i+1)
+		}
+		if i > 0 && threshold > ls.Thresholds[i-1] {
+			return fmt.Errorf("thresholds must be in descending order")
+		}
+	}
+	for output, priority := range ls.Priorities {
+		if _, ok := ShortSwitchIDMap[output]; !ok || output == "master_power" {
+			return fmt.Errorf("unknown output '%s'", output)
+		}
+		if priority < 0 || priority > len(ls.Thresholds) {
+			return fmt.Errorf("priority of '%s' must be between 0 and %d (the number of thresholds)", output, len(ls.Thresholds))
+		}
+	}
+	if ls.SustainSeconds < 0 || ls.RestoreHysteresis < 0 || ls.RestoreSeconds < 0 {
+		return fmt.Errorf("times and hysteresis must not be negative")
+	}
+	return nil
+}
+
+// PowerBudget limits the total current and/or power drawn from the supply. While the measured total
+// exceeds the budget, the dew heaters are throttled step by step; they are released again in steps
+// once there is HeadroomPercent of headroom for RestoreSeconds.
+type PowerBudget struct {
+	Enabled         bool     `json:"enabled"`
+	MaxCurrent      float64  `json:"maxCurrent"`      // Amps, 0 = no current limit
+	MaxPower        float64  `json:"maxPower"`        // Watts, 0 = no power limit
+	Heaters         []string `json:"heaters"`         // Heaters that may be throttled ("pwm1", "pwm2"), empty = both
+	StepPercent     float64  `json:"stepPercent"`     // Heater power change per adjustment (default 10)
+	MinPercent      float64  `json:"minPercent"`      // Lowest power a heater is throttled to
+	HeadroomPercent float64  `json:"headroomPercent"` // Headroom below the budget required for releasing (default 10)
+	RestoreSeconds  float64  `json:"restoreSeconds"`  // Time with headroom before each release step (default 30)
+}
+
+// ValidatePowerBudget checks the power budget settings.
+func ValidatePowerBudget(pb PowerBudget) error {
+	if pb.MaxCurrent < 0 || pb.MaxPower < 0 {
+		return fmt.Errorf("budget values must not be negative")
+	}
+	if pb.Enabled && pb.MaxCurrent == 0 && pb.MaxPower == 0 {
+		return fmt.Errorf("maxCurrent or maxPower must be set")
+	}
+	for _, heater := range pb.Heaters {
+		if heater != "pwm1" && heater != "pwm2" {
+			return fmt.Errorf("unknown heater '%s'", heater)
+		}
+	}
+	if pb.StepPercent < 0 || pb.StepPercent > 100 || pb.MinPercent < 0 || pb.MinPercent > 100 {
+		return fmt.Errorf("step and minimum power must be between 0 and 100")
+	}
+	if pb.HeadroomPercent < 0 || pb.HeadroomPercent >= 100 || pb.RestoreSeconds < 0 {
+		return fmt.Errorf("headroom must be between 0 and 100 and the restore time must not be negative")
+	}
+	return nil
+}
+
+// Dew guard responses to a heater that is not heating while dew is imminent.
+const (
+	DewGuardAlert  = "alert"  // Notify only
+	DewGuardEnable = "enable" // Switch the heater on in its configured mode
+	DewGuardManual = "manual" // Switch the heater to manual mode at ManualPercent
+	DewGuardBoost  = "boost"  // Boost the heater at ManualPercent for BoostMinutes, then restore its settings
 )
 
+// DewGuard watches the dew margin (t_lens - d, or t_amb - d without a lens probe). When the margin
+// stays below Threshold for SustainSeconds while a guarded heater is off or at 0 %, it alerts and
+// applies Action to that heater. It re-arms once the margin is Threshold + Hysteresis or more.
+type DewGuard struct {
+	Enabled              bool     `json:"enabled"`
+	Threshold            float64  `json:"threshold"`            // Dew margin in °C
+	Hysteresis           float64  `json:"hysteresis"`           // °C above the threshold before re-arming
+	SustainSeconds       float64  `json:"sustainSeconds"`       // Time below the threshold before reacting
+	Heaters              []string `json:"heaters"`              // Guarded heaters ("pwm1", "pwm2"), empty = both
+	Action               string   `json:"action"`               // One of the DewGuard* constants
+	ManualPercent        float64  `json:"manualPercent"`        // Power for DewGuardManual and DewGuardBoost
+	BoostMinutes         float64  `json:"boostMinutes"`         // Duration for DewGuardBoost
+	AlertIntervalMinutes float64  `json:"alertIntervalMinutes"` // Minimum time between repeated alerts (default 15)
+}
+
+// ValidateDewGuard checks the dew guard settings.
+func ValidateDewGuard(dg DewGuard) error {
+	if dg.Threshold < 0 || dg.Threshold > 20 || dg.Hysteresis < 0 {
+		return fmt.Errorf("threshold must be between 0 and 20 °C and the hysteresis must not be negative")
+	}
+	if dg.Enabled && dg.Threshold == 0 {
+		return fmt.Errorf("threshold must be set")
+	}
+	if dg.SustainSeconds < 0 || dg.AlertIntervalMinutes < 0 {
+		return fmt.Errorf("sustain time and alert interval must not be negative")
+	}
+	for _, heater := range dg.Heaters {
+		if heater != "pwm1" && heater != "pwm2" {
+			return fmt.Errorf("unknown heater '%s'", heater)
+		}
+	}
+	switch dg.Action {
+	case "", DewGuardAlert, DewGuardEnable:
+	case DewGuardManual:
+		if dg.ManualPercent <= 0 || dg.ManualPercent > 100 {
+			return fmt.Errorf("manual power must be between 1 and 100")
+		}
+	case DewGuardBoost:
+		if err := validateBoostAction("dew guard", BoostAction{Heater: "pwm1", Percent: dg.ManualPercent, Minutes: dg.BoostMinutes}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("action must be '%s', '%s', '%s' or '%s'", DewGuardAlert, DewGuardEnable, DewGuardManual, DewGuardBoost)
+	}
+	return nil
+}
+
+// Protection modes of an output.
+const (
+	ProtectAlways    = "always"    // The output can never be turned off by the proxy
+	ProtectConnected = "connected" // The output cannot be turned off while an ASCOM client is connected
+)
+
+// Interlocks are safety constraints enforced before any set command reaches the device.
+type Interlocks struct {
+	Protected     map[string]string `json:"protected"`     // Internal output name -> ProtectAlways or ProtectConnected
+	MaxAdjVoltage float64           `json:"maxAdjVoltage"` // Highest allowed adj_conv voltage, 0 = no limit
+	Exclusive     [][]string        `json:"exclusive"`     // Groups of outputs of which at most one may be on
+}
+
+// ValidateInterlocks checks the interlock settings.
+func ValidateInterlocks(il Interlocks) error {
+	for output, mode := range il.Protected {
+		if _, ok := ShortSwitchIDMap[output]; !ok || output == "master_power" {
+			return fmt.Errorf("unknown protected output '%s'", output)
+		}
+		if mode != ProtectAlways && mode != ProtectConnected {
+			return fmt.Errorf("protection of '%s' must be '%s' or '%s'", output, ProtectAlways, ProtectConnected)
+		}
+	}
+	if il.MaxAdjVoltage < 0 || il.MaxAdjVoltage > 15 {
+		return fmt.Errorf("maximum adj_conv voltage must be between 0 and 15")
+	}
+	for _, group := range il.Exclusive {
+		if len(group) < 2 {
+			return fmt.Errorf("an exclusive group needs at least two outputs")
+		}
+		seen := make(map[string]bool)
+		for _, output := range group {
+			if _, ok := ShortSwitchIDMap[output]; !ok || output == "master_power" {
+				return fmt.Errorf("unknown output '%s' in exclusive group", output)
+			}
+			if seen[output] {
+				return fmt.Errorf("output '%s' is listed twice in an exclusive group", output)
+			}
+			seen[output] = true
+		}
+	}
+	return nil
+}
+
+// sanitizeInterlocks drops the invalid parts of the interlock settings.
+func sanitizeInterlocks(il Interlocks) Interlocks {
+	clean := Interlocks{Protected: make(map[string]string)}
+	for output, mode := range il.Protected {
+		single := Interlocks{Protected: map[string]string{output: mode}}
+		if ValidateInterlocks(single) == nil {
+			clean.Protected[output] = mode
+		}
+	}
+	if ValidateInterlocks(Interlocks{MaxAdjVoltage: il.MaxAdjVoltage}) == nil {
+		clean.MaxAdjVoltage = il.MaxAdjVoltage
+	} else if il.MaxAdjVoltage > 0 {
+		clean.MaxAdjVoltage = 15
+	}
+	for _, group := range il.Exclusive {
+		if ValidateInterlocks(Interlocks{Exclusive: [][]string{group}}) == nil {
+			clean.Exclusive = append(clean.Exclusive, group)
+		}
+	}
+	return clean
+}
+
+// Dependency relates an output to another output it depends on, e.g. a camera port to the USB hub
+// powering its USB connection, or a dew heater to the camera port it should follow.
+type Dependency struct {
+	Output       string  `json:"output"`       // Dependent output (internal name)
+	DependsOn    string  `json:"dependsOn"`    // Output it depends on (internal name)
+	PowerOn      bool    `json:"powerOn"`      // Turning Output on turns DependsOn on first
+	Follow       bool    `json:"follow"`       // Turning DependsOn on turns Output on afterwards
+	CascadeOff   bool    `json:"cascadeOff"`   // Turning DependsOn off turns Output off first
+	DelaySeconds float64 `json:"delaySeconds"` // Wait between switching the two outputs
+}
+
+// ValidateDependency checks a single dependency.
+func ValidateDependency(d Dependency) error {
+	for _, output := range []string{d.Output, d.DependsOn} {
+		if _, ok := ShortSwitchIDMap[output]; !ok || output == "master_power" {
+			return fmt.Errorf("unknown output '%s' in dependency", output)
+		}
+	}
+	if d.Output == d.DependsOn {
+		return fmt.Errorf("output '%s' cannot depend on itself", d.Output)
+	}
+	if !d.PowerOn && !d.Follow && !d.CascadeOff {
+		return fmt.Errorf("dependency %s -> %s needs at least one of powerOn, follow or cascadeOff", d.Output, d.DependsOn)
+	}
+	if d.DelaySeconds < 0 || d.DelaySeconds > 300 {
+		return fmt.Errorf("delay of dependency %s -> %s must be between 0 and 300 seconds", d.Output, d.DependsOn)
+	}
+	return nil
+}
+
+// ValidateDependencies checks a list of dependencies, including duplicates and cycles.
+func ValidateDependencies(deps []Dependency) error {
+	edges := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, d := range deps {
+		if err := ValidateDependency(d); err != nil {
+			return err
+		}
+		pair := d.Output + "/" + d.DependsOn
+		if seen[pair] || seen[d.DependsOn+"/"+d.Output] {
+			return fmt.Errorf("duplicate dependency between '%s' and '%s'", d.Output, d.DependsOn)
+		}
+		seen[pair] = true
+		edges[d.Output] = append(edges[d.Output], d.DependsOn)
+	}
+
+	// Depth-first search for cycles: 1 = on the current path, 2 = done
+	visit := make(map[string]int)
+	var walk func(string) error
+	walk = func(output string) error {
+		switch visit[output] {
+		case 1:
+			return fmt.Errorf("dependencies form a cycle through '%s'", output)
+		case 2:
+			return nil
+		}
+		visit[output] = 1
+		for _, next := range edges[output] {
+			if err := walk(next); err != nil {
+				return err
+			}
+		}
+		visit[output] = 2
+		return nil
+	}
+	for _, d := range deps {
+		if err := walk(d.Output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// virtualSwitchPrefix is the internal name prefix of virtual switches ("group1", "group2", ...).
+const virtualSwitchPrefix = "group"
+
+// VirtualSwitchKey returns the internal switch name of the virtual switch at the given config index.
+func VirtualSwitchKey(index int) string {
+	return fmt.Sprintf("%s%d", virtualSwitchPrefix, index+1)
+}
+
+// IsVirtualSwitch returns true if the switch key refers to a user-defined virtual switch.
+func IsVirtualSwitch(key string) bool {
+	_, ok := GetVirtualSwitch(key)
+	return ok
+}
+
+// GetVirtualSwitch returns the virtual switch definition for an internal switch name.
+func GetVirtualSwitch(key string) (VirtualSwitch, bool) {
+	if !strings.HasPrefix(key, virtualSwitchPrefix) {
+		return VirtualSwitch{}, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(key, virtualSwitchPrefix))
+	if err != nil {
+		return VirtualSwitch{}, false
+	}
+	groups := Get().VirtualSwitches
+	if index < 1 || index > len(groups) {
+		return VirtualSwitch{}, false
+	}
+	return groups[index-1], true
+}
+
+// ValidateVirtualSwitch checks that a virtual switch only references real outputs.
+func ValidateVirtualSwitch(vs VirtualSwitch) error {
+	if strings.TrimSpace(vs.Name) == "" {
+		return fmt.Errorf("virtual switch name must not be empty")
+	}
+	switch vs.Mode {
+	case GroupModeAll, GroupModeAny, GroupModeMajority:
+	default:
+		return fmt.Errorf("virtual switch '%s': invalid mode '%s'", vs.Name, vs.Mode)
+	}
+	if len(vs.Members) == 0 {
+		return fmt.Errorf("virtual switch '%s' has no members", vs.Name)
+	}
+	for _, member := range vs.Members {
+		if _, ok := ShortSwitchIDMap[member]; !ok || member == "master_power" {
+			return fmt.Errorf("virtual switch '%s': unknown output '%s'", vs.Name, member)
+		}
+	}
+	return nil
+}
+
 // GetSwitchMapLength returns the number of switches in a thread-safe manner.
 func GetSwitchMapLength() int {
 	SwitchMapMutex.RLock()
@@ -119,7 +978,7 @@ func init() {
 		// Using log.Fatalf here is acceptable as it's a pre-flight check.
 		logger.Fatal("FATAL: Could not get user config directory: %v", err)
 	}
-	appConfigDir := filepath.Join(configDir, "SV241AlpacaProxy")
+	appConfigDir = filepath.Join(configDir, "SV241AlpacaProxy")
 	// The logger setup will create this dir, but it's safe to do it here too.
 	if err := os.MkdirAll(appConfigDir, 0755); err != nil {
 		logger.Fatal("FATAL: Could not create application config directory '%s': %v", appConfigDir, err)
@@ -148,6 +1007,7 @@ func Load() error {
 				HistoryRetentionNights: 10,   // Default to 10 nights
 				TelemetryInterval:      10,   // Default to 10 seconds
 				EnableNotifications:    true, // Default to notifications enabled
+				Site:                   Site{NightBoundary: NightNoon},
 			}
 			for _, internalName := range SwitchIDMap {
 				proxyConfig.SwitchNames[internalName] = internalName
@@ -203,6 +1063,118 @@ func Load() error {
 		proxyConfig.HistoryRetentionNights = 10
 	}
 	// Note: TelemetryInterval=0 is valid (means disabled), so no auto-default here
+	if proxyConfig.Site.NightBoundary == "" {
+		proxyConfig.Site.NightBoundary = NightNoon
+	}
+	if err := ValidateSite(proxyConfig.Site); err != nil {
+		logger.Warn("Invalid observatory site (%v), using noon-to-noon nights in the system time zone.", err)
+		proxyConfig.Site = Site{NightBoundary: NightNoon}
+	}
+	if err := ValidateLoadShedding(proxyConfig.LoadShedding); err != nil {
+		logger.Warn("Invalid load shedding settings (%v), load shedding disabled.", err)
+		proxyConfig.LoadShedding = LoadShedding{}
+	}
+	if err := ValidatePowerBudget(proxyConfig.PowerBudget); err != nil {
+		logger.Warn("Invalid power budget settings (%v), power budget disabled.", err)
+		proxyConfig.PowerBudget = PowerBudget{}
+	}
+	if err := ValidateDewGuard(proxyConfig.DewGuard); err != nil {
+		logger.Warn("Invalid dew guard settings (%v), dew guard disabled.", err)
+		proxyConfig.DewGuard = DewGuard{}
+	}
+	if err := ValidateBattery(proxyConfig.Battery); err != nil {
+		logger.Warn("Invalid battery settings (%v), battery model disabled.", err)
+		proxyConfig.Battery = Battery{}
+	}
+	if err := ValidateLoadProfiles(proxyConfig.LoadProfiles); err != nil {
+		logger.Warn("Invalid load profile settings (%v), load profiling disabled.", err)
+		proxyConfig.LoadProfiles = LoadProfiles{}
+	}
+	if err := ValidateBurstSampling(proxyConfig.BurstSampling); err != nil {
+		logger.Warn("Invalid burst sampling settings (%v), burst sampling disabled.", err)
+		proxyConfig.BurstSampling = BurstSampling{}
+	}
+	if err := ValidateEnergy(proxyConfig.Energy); err != nil {
+		logger.Warn("Invalid energy accounting settings (%v), using defaults.", err)
+		proxyConfig.Energy = Energy{}
+	}
+	if err := ValidateInterlocks(proxyConfig.Interlocks); err != nil {
+		// Keep what can be kept of safety settings instead of dropping them all.
+		logger.Warn("Invalid interlock settings: %v", err)
+		proxyConfig.Interlocks = sanitizeInterlocks(proxyConfig.Interlocks)
+	}
+
+	// Drop invalid virtual switches instead of failing the whole config.
+	validGroups := proxyConfig.VirtualSwitches[:0]
+	for _, vs := range proxyConfig.VirtualSwitches {
+		if err := ValidateVirtualSwitch(vs); err != nil {
+			logger.Warn("Ignoring invalid virtual switch: %v", err)
+			continue
+		}
+		validGroups = append(validGroups, vs)
+	}
+	proxyConfig.VirtualSwitches = validGroups
+
+	validScenes := proxyConfig.Scenes[:0]
+	for _, scene := range proxyConfig.Scenes {
+		if err := ValidateScene(scene); err != nil {
+			logger.Warn("Ignoring invalid scene: %v", err)
+			continue
+		}
+		validScenes = append(validScenes, scene)
+	}
+	proxyConfig.Scenes = validScenes
+
+	validSequences := proxyConfig.Sequences[:0]
+	for _, seq := range proxyConfig.Sequences {
+		if err := ValidateSequence(seq); err != nil {
+			logger.Warn("Ignoring invalid sequence: %v", err)
+			continue
+		}
+		validSequences = append(validSequences, seq)
+	}
+	proxyConfig.Sequences = validSequences
+
+	validSchedules := proxyConfig.Schedules[:0]
+	for _, sched := range proxyConfig.Schedules {
+		if err := ValidateSchedule(sched); err != nil {
+			logger.Warn("Ignoring invalid schedule: %v", err)
+			continue
+		}
+		validSchedules = append(validSchedules, sched)
+	}
+	proxyConfig.Schedules = validSchedules
+
+	validRules := proxyConfig.Rules[:0]
+	for _, rule := range proxyConfig.Rules {
+		if err := ValidateRule(rule); err != nil {
+			logger.Warn("Ignoring invalid rule: %v", err)
+			continue
+		}
+		validRules = append(validRules, rule)
+	}
+	proxyConfig.Rules = validRules
+
+	// Drop dependencies that are invalid or would close a cycle.
+	var validDeps []Dependency
+	for _, d := range proxyConfig.Dependencies {
+		if err := ValidateDependencies(append(validDeps, d)); err != nil {
+			logger.Warn("Ignoring invalid dependency: %v", err)
+			continue
+		}
+		validDeps = append(validDeps, d)
+	}
+	proxyConfig.Dependencies = validDeps
+
+	validThermostats := proxyConfig.Thermostats[:0]
+	for _, t := range proxyConfig.Thermostats {
+		if err := ValidateThermostat(t); err != nil {
+			logger.Warn("Ignoring invalid thermostat: %v", err)
+			continue
+		}
+		validThermostats = append(validThermostats, t)
+	}
+	proxyConfig.Thermostats = validThermostats
 
 	// Wenn das Feld in einer alten Konfigurationsdatei fehlt, setzen wir es auf true,
 	// um das bisherige Verhalten beizubehalten.
@@ -263,13 +1235,20 @@ func GetSetupURL() string {
 // configuration and logging are initialized. It ensures that a second instance
 // opens the correct URL based on the saved listenAddress.
 func GetSetupURLFromFile() string {
+	return GetBaseURLFromFile() + "/setup"
+}
+
+// GetBaseURLFromFile reads the configuration file directly to build the base URL
+// (e.g. "http://127.0.0.1:32241") of a running proxy instance.
+// Like GetSetupURLFromFile, it works before the main configuration is loaded.
+func GetBaseURLFromFile() string {
 	const defaultHost = "127.0.0.1"
 	const defaultPort = 32241
 
 	file, err := os.ReadFile(proxyConfigFile)
 	if err != nil {
 		// File not found or other error, use failsafe defaults.
-		return fmt.Sprintf("http://%s:%d/setup", defaultHost, defaultPort)
+		return fmt.Sprintf("http://%s:%d", defaultHost, defaultPort)
 	}
 
 	var config struct {
@@ -278,7 +1257,7 @@ func GetSetupURLFromFile() string {
 	}
 	if err := json.Unmarshal(file, &config); err != nil {
 		// JSON is corrupt, use failsafe defaults.
-		return fmt.Sprintf("http://%s:%d/setup", defaultHost, defaultPort)
+		return fmt.Sprintf("http://%s:%d", defaultHost, defaultPort)
 	}
 
 	host := config.ListenAddress
@@ -291,5 +1270,5 @@ func GetSetupURLFromFile() string {
 		port = defaultPort
 	}
 
-	return fmt.Sprintf("http://%s:%d/setup", host, port)
+	return fmt.Sprintf("http://%s:%d", host, port)
 }
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Runtime state (e.g. running output timers) is kept in separate JSON files next to
+// proxy_config.json, so it survives restarts without cluttering the user configuration.
+
+func stateFilePath(name string) string {
+	return filepath.Join(appConfigDir, name+".json")
+}
+
+// LoadState reads the runtime state file with the given name into v.
+// A missing file is not an error and leaves v untouched.
+func LoadState(name string, v interface{}) error {
+	data, err := os.ReadFile(stateFilePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read state file '%s': %w", name, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse state file '%s': %w", name, err)
+	}
+	return nil
+}
+
+// SaveState writes v to the runtime state file with the given name.
+// The file is written to a temporary file first and then renamed, so a crash never leaves a truncated file.
+func SaveState(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state '%s': %w", name, err)
+	}
+	path := stateFilePath(name)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file '%s': %w", name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace state file '%s': %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// BurstRecord is the summary of one burst of fast sensor samples.
+type BurstRecord struct {
+	ID              int64
+	StartMs         int64 // Unix time in milliseconds
+	EndMs           int64
+	Trigger         string // The set command that started the burst, or "manual"
+	Samples         int
+	BaselineVoltage sql.NullFloat64 // Last regular reading before the burst
+	BaselineCurrent sql.NullFloat64 // A
+	PeakCurrent     sql.NullFloat64 // A
+	PeakCurrentMs   sql.NullInt64
+	MinVoltage      sql.NullFloat64
+	MinVoltageMs    sql.NullInt64
+}
+
+// BurstSample is one fast sensor reading of a burst.
+type BurstSample struct {
+	TimestampMs int64
+	Voltage     sql.NullFloat64
+	Current     sql.NullFloat64 // A
+	Power       sql.NullFloat64
+}
+
+func migrateBursts(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS bursts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		start_ms INTEGER NOT NULL,
+		end_ms INTEGER NOT NULL,
+		trigger_command TEXT NOT NULL,
+		samples INTEGER NOT NULL,
+		baseline_voltage REAL,
+		baseline_current REAL,
+		peak_current REAL,
+		peak_current_ms INTEGER,
+		min_voltage REAL,
+		min_voltage_ms INTEGER
+	);
+	CREATE INDEX IF NOT EXISTS idx_bursts_start ON bursts(start_ms);
+	CREATE TABLE IF NOT EXISTS burst_samples (
+		burst_id INTEGER NOT NULL REFERENCES bursts(id),
+		timestamp_ms INTEGER NOT NULL,
+		voltage REAL,
+		current REAL,
+		power REAL
+	);
+	CREATE INDEX IF NOT EXISTS idx_burst_samples_burst ON burst_samples(burst_id, timestamp_ms);`)
+	return err
+}
+
+// InsertBurst writes a burst with its samples in one transaction and returns its id.
+func InsertBurst(b BurstRecord, samples []BurstSample) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`INSERT INTO bursts (start_ms, end_ms, trigger_command, samples, baseline_voltage, baseline_current,
+		peak_current, peak_current_ms, min_voltage, min_voltage_ms) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		b.StartMs, b.EndMs, b.Trigger, b.Samples, b.BaselineVoltage, b.BaselineCurrent,
+		b.PeakCurrent, b.PeakCurrentMs, b.MinVoltage, b.MinVoltageMs)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, s := range samples {
+		if _, err := tx.Exec(`INSERT INTO burst_samples (burst_id, timestamp_ms, voltage, current, power) VALUES (?, ?, ?, ?, ?)`,
+			id, s.TimestampMs, s.Voltage, s.Current, s.Power); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return id, tx.Commit()
+}
+
+const burstColumns = `id, start_ms, end_ms, trigger_command, samples, baseline_voltage, baseline_current,
+	peak_current, peak_current_ms, min_voltage, min_voltage_ms`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanBurst(row rowScanner) (BurstRecord, error) {
+	var b BurstRecord
+	err := row.Scan(&b.ID, &b.StartMs, &b.EndMs, &b.Trigger, &b.Samples, &b.BaselineVoltage, &b.BaselineCurrent,
+		&b.PeakCurrent, &b.PeakCurrentMs, &b.MinVoltage, &b.MinVoltageMs)
+	return b, err
+}
+
+// GetBursts returns the bursts started between start and end (unix milliseconds, inclusive), oldest first.
+func GetBursts(startMs, endMs int64) ([]BurstRecord, error) {
+	rows, err := db.Query(`SELECT `+burstColumns+` FROM bursts WHERE start_ms BETWEEN ? AND ? ORDER BY start_ms ASC, id ASC`, startMs, endMs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []BurstRecord
+	for rows.Next() {
+		b, err := scanBurst(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, b)
+	}
+	return result, rows.Err()
+}
+
+// GetBurst returns one burst with its samples. ok is false if there is no burst with that id.
+func GetBurst(id int64) (b BurstRecord, samples []BurstSample, ok bool, err error) {
+	b, err = scanBurst(db.QueryRow(`SELECT `+burstColumns+` FROM bursts WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return b, nil, false, nil
+	}
+	if err != nil {
+		return b, nil, false, err
+	}
+
+	rows, err := db.Query(`SELECT timestamp_ms, voltage, current, power FROM burst_samples
+	          WHERE burst_id = ? ORDER BY timestamp_ms ASC`, id)
+	if err != nil {
+		return b, nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s BurstSample
+		if err := rows.Scan(&s.TimestampMs, &s.Voltage, &s.Current, &s.Power); err != nil {
+			return b, nil, false, err
+		}
+		samples = append(samples, s)
+	}
+	return b, samples, true, rows.Err()
+}
+
+// deleteBurstsBefore removes the bursts started before the given time (unix milliseconds) with their samples.
+func deleteBurstsBefore(beforeMs int64) error {
+	if _, err := db.Exec(`DELETE FROM burst_samples WHERE burst_id IN (SELECT id FROM bursts WHERE start_ms < ?)`, beforeMs); err != nil {
+		return err
+	}
+	_, err := db.Exec(`DELETE FROM bursts WHERE start_ms < ?`, beforeMs)
+	return err
+}
@@ -0,0 +1,236 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// migration is one step of the schema history. Migrations are applied in order of their version
+// and must never be changed once released; a schema change is always a new migration.
+//
+// Databases created before versioning was introduced have no schema_migrations table and are
+// migrated from version 0, so the early migrations tolerate objects that already exist.
+type migration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "fixed-layout telemetry table", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS telemetry_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INTEGER NOT NULL,
+			voltage REAL,
+			current REAL,
+			power REAL,
+			temp_amb REAL,
+			hum_amb REAL,
+			dew_point REAL,
+			temp_lens REAL,
+			pwm1 INTEGER,
+			pwm2 INTEGER,
+			dc1 INTEGER,
+			dc2 INTEGER,
+			dc3 INTEGER,
+			dc4 INTEGER,
+			dc5 INTEGER,
+			usbc12 INTEGER,
+			usb345 INTEGER,
+			adj_conv REAL
+		);
+		CREATE INDEX IF NOT EXISTS idx_timestamp ON telemetry_log(timestamp);`)
+		return err
+	}},
+	{2, "power budget heater limits", func(tx *sql.Tx) error {
+		if err := ensureColumn(tx, "telemetry_log", "pwm1_limit", "REAL DEFAULT 100"); err != nil {
+			return err
+		}
+		return ensureColumn(tx, "telemetry_log", "pwm2_limit", "REAL DEFAULT 100")
+	}},
+	{3, "thermostat log", func(tx *sql.Tx) error {
+		_, err := tx.Exec(`
+		CREATE TABLE IF NOT EXISTS thermostat_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			value REAL,
+			setpoint REAL,
+			output REAL,
+			state TEXT
+		);
+		CREATE INDEX IF NOT EXISTS idx_thermostat_timestamp ON thermostat_log(timestamp);`)
+		return err
+	}},
+	{4, "telemetry as named series", migrateNamedSeries},
+	{5, "telemetry rollups", migrateRollups},
+	{6, "switch event log", migrateSwitchEvents},
+	{7, "burst sampling", migrateBursts},
+}
+
+// migrate brings the schema to the latest version. Pending migrations run in a single transaction:
+// if one fails, none of them is applied and the database keeps its previous version. An existing
+// database is copied to "<file>.v<version>.bak" before it is changed.
+func migrate(dbPath string) error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than this proxy supports (%d); it was written by a newer version", current, latest)
+	}
+	if current == latest {
+		return nil
+	}
+
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables); err != nil {
+		return fmt.Errorf("failed to inspect database: %w", err)
+	}
+	if tables > 0 {
+		backup := fmt.Sprintf("%s.v%d.bak", dbPath, current)
+		if err := backupDatabase(backup); err != nil {
+			return fmt.Errorf("failed to back up database before migration, not migrating: %w", err)
+		}
+		logger.Info("Database: Migrating schema from version %d to %d (backup: %s).", current, latest, backup)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to create migration table: %w", err)
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("database migration %d (%s) failed, database left at version %d: %w", m.version, m.description, current, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, description, applied_at) VALUES (?, ?, ?)`,
+			m.version, m.description, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record database migration %d: %w", m.version, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit database migrations, database left at version %d: %w", current, err)
+	}
+	if tables > 0 {
+		logger.Info("Database: Schema migrated to version %d.", latest)
+	}
+	return nil
+}
+
+// SchemaVersion returns the version of the last applied migration, 0 for an unversioned database.
+func SchemaVersion() (int, error) {
+	var tables int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`).Scan(&tables); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if tables == 0 {
+		return 0, nil
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// backupDatabase writes a consistent copy of the database to path, replacing an older backup.
+func backupDatabase(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err := db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// ensureColumn adds a column to a table if it does not exist yet.
+func ensureColumn(q querier, table, column, definition string) error {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read schema of %s: %w", table, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return fmt.Errorf("failed to read schema of %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	rows.Close()
+	if _, err := q.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	return nil
+}
+
+// legacyColumns maps the columns of the former fixed-layout telemetry_log table to series names.
+var legacyColumns = []struct{ column, series string }{
+	{"voltage", "v"}, {"current", "i"}, {"power", "p"},
+	{"temp_amb", "t_amb"}, {"hum_amb", "h_amb"}, {"dew_point", "d"}, {"temp_lens", "t_lens"},
+	{"pwm1", "pwm1"}, {"pwm2", "pwm2"},
+	{"dc1", "status.d1"}, {"dc2", "status.d2"}, {"dc3", "status.d3"}, {"dc4", "status.d4"}, {"dc5", "status.d5"},
+	{"usbc12", "status.u12"}, {"usb345", "status.u34"}, {"adj_conv", "status.adj"},
+	{"pwm1_limit", "proxy.pwm1_limit"}, {"pwm2_limit", "proxy.pwm2_limit"},
+}
+
+// migrateNamedSeries replaces telemetry_log with the long-format series tables and moves its rows.
+func migrateNamedSeries(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS telemetry_series (
+		id INTEGER PRIMARY KEY,
+		name TEXT NOT NULL UNIQUE
+	);
+	CREATE TABLE IF NOT EXISTS telemetry_samples (
+		timestamp INTEGER NOT NULL,
+		series_id INTEGER NOT NULL,
+		value REAL,
+		PRIMARY KEY (series_id, timestamp)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_samples_timestamp ON telemetry_samples(timestamp);`); err != nil {
+		return err
+	}
+
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'telemetry_log'`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return nil
+	}
+	for _, col := range legacyColumns {
+		id, err := lookupSeries(tx, col.series)
+		if err != nil {
+			return err
+		}
+		query := fmt.Sprintf(`INSERT OR IGNORE INTO telemetry_samples (timestamp, series_id, value)
+		          SELECT timestamp, ?, %[1]s FROM telemetry_log WHERE %[1]s IS NOT NULL`, col.column)
+		if _, err := tx.Exec(query, id); err != nil {
+			return fmt.Errorf("failed to convert column %s: %w", col.column, err)
+		}
+	}
+	_, err := tx.Exec(`DROP TABLE telemetry_log`)
+	return err
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// legacyTelemetryLog is the telemetry table of proxies before the schema was versioned.
+const legacyTelemetryLog = `
+CREATE TABLE telemetry_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	timestamp INTEGER NOT NULL,
+	voltage REAL, current REAL, power REAL,
+	temp_amb REAL, hum_amb REAL, dew_point REAL, temp_lens REAL,
+	pwm1 INTEGER, pwm2 INTEGER,
+	dc1 INTEGER, dc2 INTEGER, dc3 INTEGER, dc4 INTEGER, dc5 INTEGER,
+	usbc12 INTEGER, usb345 INTEGER, adj_conv REAL
+);
+CREATE INDEX idx_timestamp ON telemetry_log(timestamp);`
+
+func TestMigrateLegacyTelemetryLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   []string
+		version int // Schema version before migrating
+		want    map[int64]map[string]*float64
+	}{
+		{
+			// Written before versioning and before the power budget: the heater limits default to 100.
+			name: "unversioned",
+			setup: []string{
+				legacyTelemetryLog,
+				`INSERT INTO telemetry_log (timestamp, voltage, current, temp_amb, pwm1, dc1, dc2, adj_conv)
+				 VALUES (1000, 12.5, 2.25, 4.5, 40, 1, 0, 5), (1010, 12.4, NULL, 4.4, 0, 0, 0, NULL)`,
+			},
+			version: 0,
+			want: map[int64]map[string]*float64{
+				1000: {"v": value(12.5), "i": value(2.25), "t_amb": value(4.5), "pwm1": value(40), "status.d1": value(1), "status.d2": value(0), "status.adj": value(5), "proxy.pwm1_limit": value(100), "proxy.pwm2_limit": value(100)},
+				1010: {"v": value(12.4), "t_amb": value(4.4), "pwm1": value(0), "status.d1": value(0), "status.d2": value(0), "proxy.pwm1_limit": value(100), "proxy.pwm2_limit": value(100)},
+			},
+		},
+		{
+			name: "version 3 with heater limits",
+			setup: []string{
+				legacyTelemetryLog,
+				`ALTER TABLE telemetry_log ADD COLUMN pwm1_limit REAL DEFAULT 100`,
+				`ALTER TABLE telemetry_log ADD COLUMN pwm2_limit REAL DEFAULT 100`,
+				`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at INTEGER NOT NULL)`,
+				`INSERT INTO schema_migrations VALUES (1, 'fixed-layout telemetry table', 0), (2, 'power budget heater limits', 0), (3, 'thermostat log', 0)`,
+				`CREATE TABLE thermostat_log (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp INTEGER NOT NULL, name TEXT NOT NULL,
+				 value REAL, setpoint REAL, output REAL, state TEXT)`,
+				`INSERT INTO telemetry_log (timestamp, power, pwm2, usb345, pwm1_limit, pwm2_limit) VALUES (2000, 30, 75, 1, 100, 60)`,
+			},
+			version: 3,
+			want: map[int64]map[string]*float64{
+				2000: {"p": value(30), "pwm2": value(75), "status.u34": value(1), "proxy.pwm1_limit": value(100), "proxy.pwm2_limit": value(60)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "telemetry.db")
+			legacy, err := sql.Open("sqlite", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stmt := range tt.setup {
+				if _, err := legacy.Exec(stmt); err != nil {
+					t.Fatalf("setting up legacy database: %v", err)
+				}
+			}
+			legacy.Close()
+
+			openTestDBAt(t, path)
+
+			if version, err := SchemaVersion(); err != nil || version != migrations[len(migrations)-1].version {
+				t.Errorf("SchemaVersion = %d, %v; want %d", version, err, migrations[len(migrations)-1].version)
+			}
+			var tables int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'telemetry_log'`).Scan(&tables); err != nil || tables != 0 {
+				t.Errorf("telemetry_log still exists after the migration (%d, %v)", tables, err)
+			}
+			if _, err := os.Stat(fmt.Sprintf("%s.v%d.bak", path, tt.version)); err != nil {
+				t.Errorf("no backup of the version %d database: %v", tt.version, err)
+			}
+
+			rows, err := GetHistory(0, 10000, nil)
+			if err != nil {
+				t.Fatalf("GetHistory: %v", err)
+			}
+			if len(rows) != len(tt.want) {
+				t.Fatalf("got %d rows, want %d: %+v", len(rows), len(tt.want), rows)
+			}
+			for _, row := range rows {
+				want, ok := tt.want[row.Timestamp]
+				if !ok {
+					t.Errorf("unexpected row at %d", row.Timestamp)
+					continue
+				}
+				if len(row.Values) != len(want) {
+					t.Errorf("row %d has %d series, want %d: %v", row.Timestamp, len(row.Values), len(want), row.Values)
+				}
+				for series, w := range want {
+					if g := row.Values[series]; g == nil || *g != *w {
+						t.Errorf("row %d: %s = %v, want %v", row.Timestamp, series, g, *w)
+					}
+				}
+			}
+		})
+	}
+}
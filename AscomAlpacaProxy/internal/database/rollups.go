@@ -0,0 +1,170 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Rollups hold min/max/avg/last per series at coarser resolutions, so long-term history survives
+// the pruning of the raw samples. Each resolution is computed from the next finer one, the finest
+// from the raw samples; buckets are aligned to multiples of the resolution in unix time.
+var RollupResolutions = []int64{60, 600, 3600}
+
+const (
+	// rollupDelay keeps the bucket that is still being written from being rolled up.
+	rollupDelay = 30
+	// rollupChunk is the number of target buckets computed per statement during a catch-up.
+	rollupChunk = 1440
+)
+
+// RollupInfo describes the stored rollups of one resolution.
+type RollupInfo struct {
+	Resolution int64 `json:"resolution"` // Seconds
+	Oldest     int64 `json:"oldest"`     // Start of the oldest bucket, 0 if empty
+	Newest     int64 `json:"newest"`     // Start of the newest bucket, 0 if empty
+	Rows       int64 `json:"rows"`
+}
+
+func migrateRollups(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS telemetry_rollups (
+		resolution INTEGER NOT NULL,
+		bucket INTEGER NOT NULL,
+		series_id INTEGER NOT NULL,
+		min_value REAL,
+		max_value REAL,
+		avg_value REAL,
+		last_value REAL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (resolution, series_id, bucket)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_rollups_bucket ON telemetry_rollups(resolution, bucket);`)
+	return err
+}
+
+// UpdateRollups computes all buckets that were completed before now and are not rolled up yet.
+// It returns the number of rollup rows written.
+func UpdateRollups(now int64) (int64, error) {
+	var total int64
+	source := int64(0)
+	for _, resolution := range RollupResolutions {
+		n, err := updateRollup(resolution, source, now-rollupDelay)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to update %ds rollups: %w", resolution, err)
+		}
+		source = resolution
+	}
+	return total, nil
+}
+
+// updateRollup computes the buckets of one resolution up to until from the source resolution (0 = raw samples).
+func updateRollup(resolution, source, until int64) (int64, error) {
+	var newest sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(bucket) FROM telemetry_rollups WHERE resolution = ?`, resolution).Scan(&newest); err != nil {
+		return 0, err
+	}
+	from := newest.Int64 + resolution
+	if !newest.Valid {
+		oldest, ok, err := oldestData(source)
+		if err != nil || !ok {
+			return 0, err
+		}
+		from = oldest - oldest%resolution
+	}
+	until -= until % resolution
+
+	var total int64
+	for chunkStart := from; chunkStart < until; chunkStart += rollupChunk * resolution {
+		chunkEnd := min(chunkStart+rollupChunk*resolution, until)
+		var res sql.Result
+		var err error
+		if source == 0 {
+			res, err = db.Exec(`INSERT OR REPLACE INTO telemetry_rollups (resolution, bucket, series_id, min_value, max_value, avg_value, last_value, count)
+			SELECT ?, bucket, series_id, MIN(value), MAX(value), AVG(value), MAX(CASE WHEN rank = 1 THEN value END), COUNT(value)
+			FROM (SELECT series_id, value, timestamp - timestamp % ? AS bucket,
+			             ROW_NUMBER() OVER (PARTITION BY series_id, timestamp - timestamp % ?
+			                                ORDER BY value IS NULL, timestamp DESC) AS rank
+			      FROM telemetry_samples WHERE timestamp >= ? AND timestamp < ?)
+			GROUP BY series_id, bucket`, resolution, resolution, resolution, chunkStart, chunkEnd)
+		} else {
+			res, err = db.Exec(`INSERT OR REPLACE INTO telemetry_rollups (resolution, bucket, series_id, min_value, max_value, avg_value, last_value, count)
+			SELECT ?, target, series_id, MIN(min_value), MAX(max_value), SUM(avg_value * count) / NULLIF(SUM(count), 0),
+			       MAX(CASE WHEN rank = 1 THEN last_value END), SUM(count)
+			FROM (SELECT series_id, min_value, max_value, avg_value, last_value, count, bucket - bucket % ? AS target,
+			             ROW_NUMBER() OVER (PARTITION BY series_id, bucket - bucket % ?
+			                                ORDER BY last_value IS NULL, bucket DESC) AS rank
+			      FROM telemetry_rollups WHERE resolution = ? AND bucket >= ? AND bucket < ?)
+			GROUP BY series_id, target`, resolution, resolution, resolution, source, chunkStart, chunkEnd)
+		}
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	return total, nil
+}
+
+// oldestData returns the oldest timestamp of the raw samples (source 0) or of a rollup resolution.
+func oldestData(source int64) (int64, bool, error) {
+	var oldest sql.NullInt64
+	var err error
+	if source == 0 {
+		err = db.QueryRow(`SELECT MIN(timestamp) FROM telemetry_samples`).Scan(&oldest)
+	} else {
+		err = db.QueryRow(`SELECT MIN(bucket) FROM telemetry_rollups WHERE resolution = ?`, source).Scan(&oldest)
+	}
+	return oldest.Int64, oldest.Valid, err
+}
+
+// rollupSource picks the data source for an aggregated query: the coarsest rollup that is not
+// coarser than the bucket size, or the raw samples for buckets below one minute. If that source
+// does not reach back to start (because it was pruned), the next coarser one that does is used.
+func rollupSource(start, bucket int64) (int64, error) {
+	sources := append([]int64{0}, RollupResolutions...)
+	pick := 0
+	for i, resolution := range sources {
+		if resolution <= bucket {
+			pick = i
+		}
+	}
+	for i := pick; i < len(sources); i++ {
+		oldest, ok, err := oldestData(sources[i])
+		if err != nil {
+			return 0, err
+		}
+		if ok && oldest <= start {
+			return sources[i], nil
+		}
+		if !ok && i == pick {
+			return 0, nil // Not rolled up yet
+		}
+	}
+	return sources[pick], nil
+}
+
+// DeleteRollupsBefore removes the rollups of one resolution that start before the given timestamp.
+func DeleteRollupsBefore(resolution, ts int64) (int64, error) {
+	res, err := db.Exec(`DELETE FROM telemetry_rollups WHERE resolution = ? AND bucket < ?`, resolution, ts)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// GetRollupInfo returns the time range and size of each rollup resolution.
+func GetRollupInfo() ([]RollupInfo, error) {
+	result := make([]RollupInfo, 0, len(RollupResolutions))
+	for _, resolution := range RollupResolutions {
+		info := RollupInfo{Resolution: resolution}
+		var oldest, newest sql.NullInt64
+		if err := db.QueryRow(`SELECT MIN(bucket), MAX(bucket), COUNT(*) FROM telemetry_rollups WHERE resolution = ?`, resolution).
+			Scan(&oldest, &newest, &info.Rows); err != nil {
+			return nil, err
+		}
+		info.Oldest, info.Newest = oldest.Int64, newest.Int64
+		result = append(result, info)
+	}
+	return result, nil
+}
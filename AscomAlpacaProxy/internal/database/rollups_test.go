@@ -0,0 +1,188 @@
+package database
+
+import (
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// openTestDB initializes a fresh database in a temporary directory.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	openTestDBAt(t, filepath.Join(t.TempDir(), "telemetry.db"))
+}
+
+// openTestDBAt initializes the database at path. The series id cache belongs to the previous
+// database and is cleared.
+func openTestDBAt(t *testing.T, path string) {
+	t.Helper()
+	seriesMutex.Lock()
+	seriesIDs = make(map[string]int64)
+	seriesMutex.Unlock()
+	if err := Init(path); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	t.Cleanup(Close)
+}
+
+// insertSamples writes one sample of a series per timestamp; nil values are stored as NULL.
+func insertSamples(t *testing.T, series string, samples map[int64]*float64) {
+	t.Helper()
+	for ts, v := range samples {
+		if err := InsertTelemetry(ts, map[string]*float64{series: v}); err != nil {
+			t.Fatalf("InsertTelemetry: %v", err)
+		}
+	}
+}
+
+func value(v float64) *float64 { return &v }
+
+func null(v float64) sql.NullFloat64 { return sql.NullFloat64{Float64: v, Valid: true} }
+
+// base is aligned to all rollup resolutions.
+const base = int64(1700002800)
+
+func TestUpdateRollupsWeighting(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples map[int64]*float64
+		want    SeriesAggregate // Of the 10-minute rollup starting at base
+	}{
+		{
+			// 6 samples of 10 in the first minute, 2 of 40 in the second: the average is weighted
+			// by sample count ((60 + 80) / 8), not averaged over the minutes ((10 + 40) / 2).
+			name: "average weighted by count",
+			samples: map[int64]*float64{
+				base: value(10), base + 10: value(10), base + 20: value(10), base + 30: value(10), base + 40: value(10), base + 50: value(10),
+				base + 60: value(40), base + 70: value(40),
+			},
+			want: SeriesAggregate{Min: null(10), Max: null(40), Avg: null(17.5), Last: null(40), Count: 8},
+		},
+		{
+			// NULL samples (no valid reading) are not counted, and the last value is the newest valid one.
+			name: "null samples ignored",
+			samples: map[int64]*float64{
+				base: value(2), base + 10: value(4), base + 20: nil,
+				base + 300: value(6), base + 310: nil,
+			},
+			want: SeriesAggregate{Min: null(2), Max: null(6), Avg: null(4), Last: null(6), Count: 3},
+		},
+		{
+			name: "single sample in the last minute of the bucket",
+			samples: map[int64]*float64{
+				base + 599: value(-3),
+			},
+			want: SeriesAggregate{Min: null(-3), Max: null(-3), Avg: null(-3), Last: null(-3), Count: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openTestDB(t)
+			insertSamples(t, "x", tt.samples)
+			if _, err := UpdateRollups(base + 3600 + rollupDelay); err != nil {
+				t.Fatalf("UpdateRollups: %v", err)
+			}
+
+			var got SeriesAggregate
+			err := db.QueryRow(`SELECT min_value, max_value, avg_value, last_value, count FROM telemetry_rollups
+			                    WHERE resolution = 600 AND bucket = ?`, base).Scan(&got.Min, &got.Max, &got.Avg, &got.Last, &got.Count)
+			if err != nil {
+				t.Fatalf("reading 10-minute rollup: %v", err)
+			}
+			assertAggregate(t, got, tt.want)
+		})
+	}
+}
+
+func TestGetAggregatedHistoryMergesRawTail(t *testing.T) {
+	openTestDB(t)
+	// The first minute is rolled up, the second is only available as raw samples.
+	insertSamples(t, "x", map[int64]*float64{base: value(10), base + 10: value(10), base + 20: value(10)})
+	if _, err := UpdateRollups(base + 60 + rollupDelay); err != nil {
+		t.Fatalf("UpdateRollups: %v", err)
+	}
+	insertSamples(t, "x", map[int64]*float64{base + 60: value(30), base + 70: nil})
+
+	rows, resolution, err := GetAggregatedHistory(base, base+119, 120, []string{"x"})
+	if err != nil {
+		t.Fatalf("GetAggregatedHistory: %v", err)
+	}
+	if resolution != 60 {
+		t.Errorf("resolution = %d, want 60", resolution)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("got %d rows, want 1: %+v", len(rows), rows)
+	}
+	assertAggregate(t, rows[0], SeriesAggregate{Min: null(10), Max: null(30), Avg: null(15), Last: null(30), Count: 4})
+}
+
+func TestMergeAggregates(t *testing.T) {
+	tests := []struct {
+		name           string
+		earlier, later []SeriesAggregate
+		want           []SeriesAggregate
+	}{
+		{
+			name:    "same bucket combined with weighted average",
+			earlier: []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(1), Max: null(5), Avg: null(2), Last: null(5), Count: 3}},
+			later:   []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(0), Max: null(4), Avg: null(4), Last: null(0), Count: 1}},
+			want:    []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(0), Max: null(5), Avg: null(2.5), Last: null(0), Count: 4}},
+		},
+		{
+			name:    "later bucket without valid values keeps average and last",
+			earlier: []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(1), Max: null(3), Avg: null(2), Last: null(3), Count: 2}},
+			later:   []SeriesAggregate{{Bucket: 0, Series: "x", Count: 0}},
+			want:    []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(1), Max: null(3), Avg: null(2), Last: null(3), Count: 2}},
+		},
+		{
+			name:    "earlier bucket without valid values takes the later ones",
+			earlier: []SeriesAggregate{{Bucket: 0, Series: "x", Count: 0}},
+			later:   []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(7), Max: null(9), Avg: null(8), Last: null(9), Count: 2}},
+			want:    []SeriesAggregate{{Bucket: 0, Series: "x", Min: null(7), Max: null(9), Avg: null(8), Last: null(9), Count: 2}},
+		},
+		{
+			name:    "other series and buckets appended",
+			earlier: []SeriesAggregate{{Bucket: 0, Series: "x", Avg: null(1), Count: 1}},
+			later: []SeriesAggregate{
+				{Bucket: 0, Series: "y", Avg: null(2), Count: 1},
+				{Bucket: 60, Series: "x", Avg: null(3), Count: 1},
+			},
+			want: []SeriesAggregate{
+				{Bucket: 0, Series: "x", Avg: null(1), Count: 1},
+				{Bucket: 0, Series: "y", Avg: null(2), Count: 1},
+				{Bucket: 60, Series: "x", Avg: null(3), Count: 1},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeAggregates(tt.earlier, tt.later)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d aggregates, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i := range got {
+				if got[i].Bucket != tt.want[i].Bucket || got[i].Series != tt.want[i].Series {
+					t.Errorf("aggregate %d is %d/%s, want %d/%s", i, got[i].Bucket, got[i].Series, tt.want[i].Bucket, tt.want[i].Series)
+				}
+				assertAggregate(t, got[i], tt.want[i])
+			}
+		})
+	}
+}
+
+func assertAggregate(t *testing.T, got, want SeriesAggregate) {
+	t.Helper()
+	check := func(name string, g, w sql.NullFloat64) {
+		if g.Valid != w.Valid || (w.Valid && math.Abs(g.Float64-w.Float64) > 1e-9) {
+			t.Errorf("%s = %+v, want %+v", name, g, w)
+		}
+	}
+	check("min", got.Min, want.Min)
+	check("max", got.Max, want.Max)
+	check("avg", got.Avg, want.Avg)
+	check("last", got.Last, want.Last)
+	if got.Count != want.Count {
+		t.Errorf("count = %d, want %d", got.Count, want.Count)
+	}
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"database/sql"
+)
+
+// SwitchEventRecord is one stored state change of an output.
+type SwitchEventRecord struct {
+	TimestampMs int64 // Unix time in milliseconds
+	Output      string
+	Old         sql.NullFloat64
+	New         sql.NullFloat64
+	Source      string
+}
+
+func migrateSwitchEvents(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+	CREATE TABLE IF NOT EXISTS switch_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp_ms INTEGER NOT NULL,
+		output TEXT NOT NULL,
+		old_value REAL,
+		new_value REAL,
+		source TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_switch_events_timestamp ON switch_events(timestamp_ms);
+	CREATE INDEX IF NOT EXISTS idx_switch_events_output ON switch_events(output, timestamp_ms);`)
+	return err
+}
+
+// InsertSwitchEvents writes switch events in one transaction.
+func InsertSwitchEvents(records []SwitchEventRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		if _, err := tx.Exec(`INSERT INTO switch_events (timestamp_ms, output, old_value, new_value, source) VALUES (?, ?, ?, ?, ?)`,
+			r.TimestampMs, r.Output, r.Old, r.New, r.Source); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSwitchEvents returns the events of one output (or all, if output is empty) between start and end
+// (unix milliseconds, inclusive), oldest first.
+func GetSwitchEvents(output string, startMs, endMs int64) ([]SwitchEventRecord, error) {
+	rows, err := db.Query(`SELECT timestamp_ms, output, old_value, new_value, source
+	          FROM switch_events
+	          WHERE timestamp_ms BETWEEN ? AND ? AND (? = '' OR output = ?)
+	          ORDER BY timestamp_ms ASC, id ASC`, startMs, endMs, output, output)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []SwitchEventRecord
+	for rows.Next() {
+		var r SwitchEventRecord
+		if err := rows.Scan(&r.TimestampMs, &r.Output, &r.Old, &r.New, &r.Source); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// LastSwitchEventBefore returns the most recent event of an output before the given time (unix milliseconds).
+// ok is false if there is none.
+func LastSwitchEventBefore(output string, beforeMs int64) (r SwitchEventRecord, ok bool, err error) {
+	err = db.QueryRow(`SELECT timestamp_ms, output, old_value, new_value, source
+	          FROM switch_events WHERE output = ? AND timestamp_ms < ?
+	          ORDER BY timestamp_ms DESC, id DESC LIMIT 1`, output, beforeMs).
+		Scan(&r.TimestampMs, &r.Output, &r.Old, &r.New, &r.Source)
+	if err == sql.ErrNoRows {
+		return r, false, nil
+	}
+	return r, err == nil, err
+}
@@ -0,0 +1,371 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Telemetry is a set of named series. Each sample is one (series, timestamp, value) row, so the
+// schema does not change when the firmware reports new keys.
+
+// TelemetryRow holds the values of all requested series recorded at one timestamp.
+type TelemetryRow struct {
+	Timestamp int64
+	Values    map[string]*float64 // By series name; nil for an invalid reading, missing if not recorded
+}
+
+// SeriesInfo describes a recorded series.
+type SeriesInfo struct {
+	Name   string `json:"name"`
+	Oldest int64  `json:"oldest"`
+	Newest int64  `json:"newest"`
+}
+
+var (
+	seriesMutex sync.Mutex
+	seriesIDs   = make(map[string]int64) // Cache of telemetry_series
+)
+
+// seriesID returns the id of a series, creating it if it does not exist yet.
+func seriesID(name string) (int64, error) {
+	seriesMutex.Lock()
+	defer seriesMutex.Unlock()
+	if id, ok := seriesIDs[name]; ok {
+		return id, nil
+	}
+	id, err := lookupSeries(db, name)
+	if err != nil {
+		return 0, err
+	}
+	seriesIDs[name] = id
+	return id, nil
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// lookupSeries returns the id of a series, creating it if needed, without using the cache.
+func lookupSeries(q querier, name string) (int64, error) {
+	if _, err := q.Exec(`INSERT OR IGNORE INTO telemetry_series (name) VALUES (?)`, name); err != nil {
+		return 0, fmt.Errorf("failed to create series %s: %w", name, err)
+	}
+	var id int64
+	if err := q.QueryRow(`SELECT id FROM telemetry_series WHERE name = ?`, name).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to look up series %s: %w", name, err)
+	}
+	return id, nil
+}
+
+// InsertTelemetry writes the values of one timestamp, keyed by series name, in one transaction.
+// A nil value is stored as NULL: the series was expected but had no valid reading.
+func InsertTelemetry(timestamp int64, values map[string]*float64) error {
+	// Resolve the ids first: creating a series inside the transaction would need a second writer.
+	ids := make(map[string]int64, len(values))
+	for name := range values {
+		id, err := seriesID(name)
+		if err != nil {
+			return err
+		}
+		ids[name] = id
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO telemetry_samples (timestamp, series_id, value) VALUES (?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for name, value := range values {
+		if _, err := stmt.Exec(timestamp, ids[name], value); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetHistory returns the samples between start and end, grouped by timestamp in ascending order.
+// If series is empty, all series are returned.
+func GetHistory(start, end int64, series []string) ([]TelemetryRow, error) {
+	query := `SELECT s.timestamp, n.name, s.value
+	          FROM telemetry_samples s JOIN telemetry_series n ON n.id = s.series_id
+	          WHERE s.timestamp BETWEEN ? AND ?`
+	args := []interface{}{start, end}
+	if len(series) > 0 {
+		query += ` AND n.name IN (?` + strings.Repeat(`, ?`, len(series)-1) + `)`
+		for _, name := range series {
+			args = append(args, name)
+		}
+	}
+	query += ` ORDER BY s.timestamp ASC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []TelemetryRow
+	for rows.Next() {
+		var ts int64
+		var name string
+		var value sql.NullFloat64
+		if err := rows.Scan(&ts, &name, &value); err != nil {
+			return nil, err
+		}
+		if len(result) == 0 || result[len(result)-1].Timestamp != ts {
+			result = append(result, TelemetryRow{Timestamp: ts, Values: make(map[string]*float64)})
+		}
+		var v *float64
+		if value.Valid {
+			v = &value.Float64
+		}
+		result[len(result)-1].Values[name] = v
+	}
+	return result, rows.Err()
+}
+
+// ListSeries returns all series that have samples, ordered by name.
+func ListSeries() ([]SeriesInfo, error) {
+	// Correlated subqueries use the primary key, unlike MIN/MAX over a GROUP BY.
+	rows, err := db.Query(`SELECT name,
+	                 (SELECT MIN(timestamp) FROM telemetry_samples WHERE series_id = n.id),
+	                 (SELECT MAX(timestamp) FROM telemetry_samples WHERE series_id = n.id)
+	          FROM telemetry_series n`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []SeriesInfo
+	for rows.Next() {
+		var info SeriesInfo
+		var oldest, newest sql.NullInt64
+		if err := rows.Scan(&info.Name, &oldest, &newest); err != nil {
+			return nil, err
+		}
+		if !oldest.Valid {
+			continue // All samples pruned
+		}
+		info.Oldest, info.Newest = oldest.Int64, newest.Int64
+		result = append(result, info)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, rows.Err()
+}
+
+// GetTimeRange returns the timestamps of the oldest and newest record.
+// ok is false if the table is empty.
+func GetTimeRange() (oldest, newest int64, ok bool, err error) {
+	var minTs, maxTs sql.NullInt64
+	if err := db.QueryRow(`SELECT MIN(timestamp), MAX(timestamp) FROM telemetry_samples`).Scan(&minTs, &maxTs); err != nil {
+		return 0, 0, false, err
+	}
+	if !minTs.Valid || !maxTs.Valid {
+		return 0, 0, false, nil
+	}
+	return minTs.Int64, maxTs.Int64, true, nil
+}
+
+// HasTelemetry reports whether at least one record exists in [start, end).
+func HasTelemetry(start, end int64) (bool, error) {
+	var exists int
+	err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM telemetry_samples WHERE timestamp >= ? AND timestamp < ?)`, start, end).Scan(&exists)
+	return exists == 1, err
+}
+
+// FirstTelemetry returns the timestamp of the oldest record in [start, end]; ok is false if there is none.
+func FirstTelemetry(start, end int64) (ts int64, ok bool, err error) {
+	var first sql.NullInt64
+	err = db.QueryRow(`SELECT MIN(timestamp) FROM telemetry_samples WHERE timestamp BETWEEN ? AND ?`, start, end).Scan(&first)
+	return first.Int64, first.Valid, err
+}
+
+// FirstSample returns the first sample of a series in [start, end]. value is nil for a NULL sample;
+// ok is false if there is no sample at all.
+func FirstSample(name string, start, end int64) (value *float64, ok bool, err error) {
+	var v sql.NullFloat64
+	err = db.QueryRow(`SELECT value FROM telemetry_samples
+	          WHERE series_id = (SELECT id FROM telemetry_series WHERE name = ?) AND timestamp BETWEEN ? AND ?
+	          ORDER BY timestamp ASC LIMIT 1`, name, start, end).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if v.Valid {
+		value = &v.Float64
+	}
+	return value, true, nil
+}
+
+// DeleteTelemetryBefore removes all samples, thermostat records, switch events and bursts older than the given timestamp.
+func DeleteTelemetryBefore(ts int64) (int64, error) {
+	res, err := db.Exec(`DELETE FROM telemetry_samples WHERE timestamp < ?`, ts)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(`DELETE FROM thermostat_log WHERE timestamp < ?`, ts); err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec(`DELETE FROM switch_events WHERE timestamp_ms < ?`, ts*1000); err != nil {
+		return 0, err
+	}
+	if err := deleteBurstsBefore(ts * 1000); err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// SeriesAggregate summarizes the samples of one series in one time bucket.
+type SeriesAggregate struct {
+	Bucket int64 // Start of the bucket (unix timestamp)
+	Series string
+	Min    sql.NullFloat64
+	Max    sql.NullFloat64
+	Avg    sql.NullFloat64
+	Last   sql.NullFloat64 // Most recent valid value in the bucket
+	Count  int             // Number of valid values
+}
+
+// GetAggregatedHistory groups the samples between start and end into buckets of the given size
+// (seconds, counted from start) and returns min/max/avg/last per series and bucket, ordered by bucket.
+// If series is empty, all series are returned. The source is chosen automatically (see
+// rollupSource); resolution is the rollup resolution used in seconds, 0 for the raw samples.
+func GetAggregatedHistory(start, end, bucket int64, series []string) (rows []SeriesAggregate, resolution int64, err error) {
+	if bucket < 1 {
+		bucket = 1
+	}
+	resolution, err = rollupSource(start, bucket)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resolution == 0 {
+		rows, err = aggregateSamples(start, start, end, bucket, series)
+		return rows, 0, err
+	}
+
+	// The rollups lag behind by up to one resolution step; the rest comes from the raw samples.
+	var newest sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(bucket) FROM telemetry_rollups WHERE resolution = ?`, resolution).Scan(&newest); err != nil {
+		return nil, 0, err
+	}
+	rolledUntil := newest.Int64 + resolution
+	rows, err = aggregateRollups(resolution, start, start, min(end, rolledUntil-1), bucket, series)
+	if err != nil || rolledUntil > end {
+		return rows, resolution, err
+	}
+	tail, err := aggregateSamples(start, max(start, rolledUntil), end, bucket, series)
+	if err != nil {
+		return nil, 0, err
+	}
+	return mergeAggregates(rows, tail), resolution, nil
+}
+
+// aggregateSamples aggregates the raw samples in [from, to] into buckets counted from origin.
+func aggregateSamples(origin, from, to, bucket int64, series []string) ([]SeriesAggregate, error) {
+	filter, args := seriesFilter([]interface{}{origin, bucket, origin, bucket, from, to}, series)
+	// The window function ranks the samples of each bucket so that the newest valid value comes first.
+	query := `SELECT bucket, name, MIN(value), MAX(value), AVG(value), MAX(CASE WHEN rank = 1 THEN value END), COUNT(value)
+	          FROM (SELECT n.name AS name, s.value AS value, (s.timestamp - ?) / ? AS bucket,
+	                       ROW_NUMBER() OVER (PARTITION BY s.series_id, (s.timestamp - ?) / ?
+	                                          ORDER BY s.value IS NULL, s.timestamp DESC) AS rank
+	                FROM telemetry_samples s JOIN telemetry_series n ON n.id = s.series_id
+	                WHERE s.timestamp BETWEEN ? AND ?` + filter + `)
+	          GROUP BY bucket, name
+	          ORDER BY bucket ASC`
+	return queryAggregates(query, args, origin, bucket)
+}
+
+// aggregateRollups aggregates the rollups of one resolution that overlap [from, to] into buckets
+// counted from origin. A rollup that starts before origin is counted in the first bucket.
+func aggregateRollups(resolution, origin, from, to, bucket int64, series []string) ([]SeriesAggregate, error) {
+	filter, args := seriesFilter([]interface{}{origin, origin, bucket, origin, origin, bucket, resolution, from - resolution, to}, series)
+	query := `SELECT bucket, name, MIN(min_value), MAX(max_value), SUM(avg_value * count) / NULLIF(SUM(count), 0),
+	                 MAX(CASE WHEN rank = 1 THEN last_value END), SUM(count)
+	          FROM (SELECT n.name AS name, r.min_value, r.max_value, r.avg_value, r.last_value, r.count,
+	                       (MAX(r.bucket, ?) - ?) / ? AS bucket,
+	                       ROW_NUMBER() OVER (PARTITION BY r.series_id, (MAX(r.bucket, ?) - ?) / ?
+	                                          ORDER BY r.last_value IS NULL, r.bucket DESC) AS rank
+	                FROM telemetry_rollups r JOIN telemetry_series n ON n.id = r.series_id
+	                WHERE r.resolution = ? AND r.bucket > ? AND r.bucket <= ?` + filter + `)
+	          GROUP BY bucket, name
+	          ORDER BY bucket ASC`
+	return queryAggregates(query, args, origin, bucket)
+}
+
+// seriesFilter appends a series name condition to a query on telemetry_series n.
+func seriesFilter(args []interface{}, series []string) (string, []interface{}) {
+	if len(series) == 0 {
+		return "", args
+	}
+	for _, name := range series {
+		args = append(args, name)
+	}
+	return ` AND n.name IN (?` + strings.Repeat(`, ?`, len(series)-1) + `)`, args
+}
+
+func queryAggregates(query string, args []interface{}, origin, bucket int64) ([]SeriesAggregate, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []SeriesAggregate
+	for rows.Next() {
+		var a SeriesAggregate
+		var index int64
+		if err := rows.Scan(&index, &a.Series, &a.Min, &a.Max, &a.Avg, &a.Last, &a.Count); err != nil {
+			return nil, err
+		}
+		a.Bucket = origin + index*bucket
+		result = append(result, a)
+	}
+	return result, rows.Err()
+}
+
+// mergeAggregates appends later aggregates to earlier ones. A bucket present in both is combined.
+func mergeAggregates(earlier, later []SeriesAggregate) []SeriesAggregate {
+	type key struct {
+		bucket int64
+		series string
+	}
+	index := make(map[key]int, len(earlier))
+	for i, a := range earlier {
+		index[key{a.Bucket, a.Series}] = i
+	}
+	for _, b := range later {
+		i, ok := index[key{b.Bucket, b.Series}]
+		if !ok {
+			earlier = append(earlier, b)
+			continue
+		}
+		a := &earlier[i]
+		if b.Min.Valid && (!a.Min.Valid || b.Min.Float64 < a.Min.Float64) {
+			a.Min = b.Min
+		}
+		if b.Max.Valid && (!a.Max.Valid || b.Max.Float64 > a.Max.Float64) {
+			a.Max = b.Max
+		}
+		if b.Count > 0 {
+			a.Avg.Float64 = (a.Avg.Float64*float64(a.Count) + b.Avg.Float64*float64(b.Count)) / float64(a.Count+b.Count)
+			a.Avg.Valid = true
+			a.Last = b.Last
+		}
+		a.Count += b.Count
+	}
+	return earlier
+}
@@ -12,15 +12,32 @@ const (
 	Disconnected ComPortStatus = false
 )
 
+// Notification is a message for the user, shown by the systray as a toast notification.
+type Notification struct {
+	Title   string
+	Message string
+}
+
 var (
 	// ComPortStatusChan is a channel that broadcasts the connection status of the COM port.
 	// The serial manager will write to this channel, and other parts of the application (like systray) can listen to it.
 	ComPortStatusChan = make(chan ComPortStatus, 1)
 
+	// NotificationChan carries notifications from the automation features to the systray.
+	NotificationChan = make(chan Notification, 16)
+
 	// once is used to ensure the listener is only started once.
 	once sync.Once
 )
 
+// Notify queues a notification. It never blocks; if nobody is listening the notification is dropped.
+func Notify(title, message string) {
+	select {
+	case NotificationChan <- Notification{Title: title, Message: message}:
+	default:
+	}
+}
+
 // StartListener ensures that any component that needs to react to events can do so.
 // It is designed to be called multiple times safely, but the listener function will only be executed once.
 func StartListener(listener func()) {
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"time"
+)
+
+// HandleSite returns (GET) or updates (POST) the observatory site.
+func HandleSite(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config.Get().Site)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var site config.Site
+		if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if site.NightBoundary == "" {
+			site.NightBoundary = config.NightNoon
+		}
+		if err := config.ValidateSite(site); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.Site = site
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Observatory site updated via API (lat %.4f, lon %.4f, nights: %s).", site.Latitude, site.Longitude, site.NightBoundary)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(site)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTwilight returns sunset/sunrise, twilight and moon times for a night.
+// Query parameter: date=YYYY-MM-DD (date of the evening, default: the current night).
+func HandleTwilight(w http.ResponseWriter, r *http.Request) {
+	site := astro.CurrentSite()
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = site.NightOf(time.Now())
+	}
+	twilight, err := site.Twilight(date)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(twilight)
+}
+
+// AstroNow is the current position of the sun and moon at the observatory site.
+type AstroNow struct {
+	Time             time.Time        `json:"time"`
+	Night            string           `json:"night"`   // Label of the current night
+	IsNight          bool             `json:"isNight"` // Within the configured night boundaries
+	Sun              astro.Horizontal `json:"sun"`
+	Moon             astro.Horizontal `json:"moon"`
+	MoonIllumination float64          `json:"moonIllumination"`
+	MoonWaxing       bool             `json:"moonWaxing"`
+}
+
+// HandleAstroNow returns the current sun and moon position.
+func HandleAstroNow(w http.ResponseWriter, r *http.Request) {
+	site := astro.CurrentSite()
+	now := time.Now().In(site.Location)
+	label := site.NightOf(now)
+	night, err := site.Night(label)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := AstroNow{
+		Time:    now,
+		Night:   label,
+		IsNight: night.Contains(now),
+		Sun:     roundHorizontal(site.SunHorizontal(now)),
+		Moon:    roundHorizontal(site.MoonHorizontal(now)),
+	}
+	result.MoonIllumination, result.MoonWaxing = astro.MoonIllumination(now)
+	result.MoonIllumination = math.Round(result.MoonIllumination*1000) / 1000
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func roundHorizontal(h astro.Horizontal) astro.Horizontal {
+	return astro.Horizontal{
+		Altitude: math.Round(h.Altitude*100) / 100,
+		Azimuth:  math.Round(h.Azimuth*100) / 100,
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// HandleBattery returns (GET) the battery model settings with the state of charge and runtime estimate,
+// or replaces the settings (POST).
+func HandleBattery(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetBatteryStatus())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var b config.Battery
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateBattery(b); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		wasEnabled := conf.Battery.Enabled
+		conf.Battery = b
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Battery settings updated via API (enabled: %t, %s, %.0f Ah).", b.Enabled, b.Chemistry, b.CapacityAh)
+		if b.Enabled != wasEnabled {
+			// Add or remove the battery sensor switches
+			go serial.SyncFirmwareConfig()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetBatteryStatus())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleBatteryReset sets the state of charge, e.g. after charging the battery elsewhere.
+// Expects a JSON body {"soc": 80}; an empty body resets to 100 %.
+func HandleBatteryReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	payload := struct {
+		SoC float64 `json:"soc"`
+	}{SoC: 100}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := automation.ResetBattery(payload.SoC); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(automation.GetBatteryStatus())
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/power"
+	"time"
+)
+
+// HandleBoosts lists the running heater boosts (GET) or starts one (POST).
+// POST expects {"heater": "pwm1", "percent": 100, "minutes": 10}.
+func HandleBoosts(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(power.ListBoosts())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var payload struct {
+			Heater  string  `json:"heater"`
+			Percent float64 `json:"percent"`
+			Minutes float64 `json:"minutes"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		boost, err := power.BoostHeater(payload.Heater, payload.Percent, time.Duration(payload.Minutes*float64(time.Minute)), "Web UI")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(boost)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleCancelBoost ends a heater boost now and restores the heater's previous settings.
+// Expects a JSON body {"heater": "pwm1"}.
+func HandleCancelBoost(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Heater string `json:"heater"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	found, err := power.CancelBoost(payload.Heater)
+	if err != nil {
+		http.Error(w, err.Error(), SetErrorStatus(err))
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("No boost running for '%s'", payload.Heater), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandlePowerBudget returns (GET) the power budget settings with the measured total and the throttled
+// heaters, or replaces the settings (POST).
+func HandlePowerBudget(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetPowerBudgetStatus())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var pb config.PowerBudget
+		if err := json.NewDecoder(r.Body).Decode(&pb); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidatePowerBudget(pb); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.PowerBudget = pb
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Power budget updated via API (enabled: %t, %.2f A, %.1f W).", pb.Enabled, pb.MaxCurrent, pb.MaxPower)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetPowerBudgetStatus())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
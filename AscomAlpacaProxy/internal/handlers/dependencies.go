@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+)
+
+// HandleDependencies returns (GET) the dependency graph, as JSON or with ?format=dot in Graphviz format,
+// or replaces the configured dependencies (POST).
+func HandleDependencies(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeDependencyGraph(w, r)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var deps []config.Dependency
+		if err := json.NewDecoder(r.Body).Decode(&deps); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateDependencies(deps); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.Dependencies = deps
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Output dependencies updated via API (%d defined).", len(deps))
+		writeDependencyGraph(w, r)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeDependencyGraph(w http.ResponseWriter, r *http.Request) {
+	graph := power.GetDependencyGraph()
+	if r.URL.Query().Get("format") == "dot" {
+		w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+		w.Write([]byte(graph.DOT()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(graph)
+}
@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleDewGuard returns (GET) the dew guard settings with the current dew risk
+// and the recent reactions, or replaces the settings (POST).
+func HandleDewGuard(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetDewGuardStatus())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var dg config.DewGuard
+		if err := json.NewDecoder(r.Body).Decode(&dg); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateDewGuard(dg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.DewGuard = dg
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Dew guard settings updated via API (enabled: %t, threshold %.1f °C, action %s).", dg.Enabled, dg.Threshold, dg.Action)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetDewGuardStatus())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// VirtualSwitchStatus is a virtual switch definition together with its live state.
+type VirtualSwitchStatus struct {
+	config.VirtualSwitch
+	Key   string `json:"key"`
+	State bool   `json:"state"`
+}
+
+// HandleVirtualSwitches lists (GET) or replaces (POST) the user-defined virtual switches.
+func HandleVirtualSwitches(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		groups := config.Get().VirtualSwitches
+		response := make([]VirtualSwitchStatus, 0, len(groups))
+		for i, vs := range groups {
+			response = append(response, VirtualSwitchStatus{
+				VirtualSwitch: vs,
+				Key:           config.VirtualSwitchKey(i),
+				State:         power.GroupState(vs),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var groups []config.VirtualSwitch
+		if err := json.NewDecoder(r.Body).Decode(&groups); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		for _, vs := range groups {
+			if err := config.ValidateVirtualSwitch(vs); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		conf := config.Get()
+		conf.VirtualSwitches = groups
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Virtual switches updated via API (%d defined).", len(groups))
+
+		// Rebuild the Alpaca switch list so the new groups get their IDs.
+		go serial.SyncFirmwareConfig()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleSetVirtualSwitch switches a virtual switch on or off.
+// Expects a JSON body {"key": "group1", "state": true}.
+func HandleSetVirtualSwitch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Key   string `json:"key"`
+		State bool   `json:"state"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	vs, ok := config.GetVirtualSwitch(payload.Key)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown virtual switch '%s'", payload.Key), http.StatusNotFound)
+		return
+	}
+	if err := power.SetGroup(vs, payload.State, "Web UI"); err != nil {
+		http.Error(w, err.Error(), SetErrorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+)
+
+// SetErrorStatus returns the HTTP status for a failed set: 409 Conflict if an interlock blocked it,
+// otherwise 503 (device not reachable or command failed).
+func SetErrorStatus(err error) int {
+	var interlockErr *power.InterlockError
+	if errors.As(err, &interlockErr) {
+		return http.StatusConflict
+	}
+	return http.StatusServiceUnavailable
+}
+
+// HandleInterlocks returns (GET) the interlock settings with the connected ASCOM clients,
+// or replaces the settings (POST).
+func HandleInterlocks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeInterlocks(w)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var il config.Interlocks
+		if err := json.NewDecoder(r.Body).Decode(&il); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateInterlocks(il); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.Interlocks = il
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Interlocks updated via API (%d protected, %d exclusive groups, max adj %.2f V).", len(il.Protected), len(il.Exclusive), il.MaxAdjVoltage)
+		writeInterlocks(w)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeInterlocks(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		config.Interlocks
+		ConnectedClients []power.ConnectedClient `json:"connectedClients"`
+	}{config.Get().Interlocks, power.ConnectedClients()})
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleLoadProfiles returns (GET) the learned per-output profiles with the attribution of the
+// present total draw and the recent deviations, or replaces the settings (POST).
+func HandleLoadProfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetLoadProfileStatus())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var lp config.LoadProfiles
+		if err := json.NewDecoder(r.Body).Decode(&lp); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateLoadProfiles(lp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.LoadProfiles = lp
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Load profile settings updated via API (alert at %.0f %%).", lp.AlertPercent)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetLoadProfileStatus())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleResetLoadProfiles forgets a learned profile, e.g. after connecting different equipment.
+// Expects a JSON body {"output": "dc2"}; an empty output (or body) forgets all profiles.
+func HandleResetLoadProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Output string `json:"output"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := automation.ResetLoadProfiles(payload.Output); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if payload.Output == "" {
+		logger.Info("All load profiles reset via API.")
+	} else {
+		logger.Info("Load profile of %s reset via API.", payload.Output)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(automation.GetLoadProfileStatus())
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleLoadShedding returns (GET) the load shedding settings with the state of each stage
+// and the recent events, or replaces the settings (POST).
+func HandleLoadShedding(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetLoadSheddingStatus())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var ls config.LoadShedding
+		if err := json.NewDecoder(r.Body).Decode(&ls); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateLoadShedding(ls); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		conf := config.Get()
+		conf.LoadShedding = ls
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Load shedding settings updated via API (enabled: %t, %d thresholds).", ls.Enabled, len(ls.Thresholds))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.GetLoadSheddingStatus())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRestoreShedOutputs switches all shed outputs back on, regardless of the battery voltage.
+func HandleRestoreShedOutputs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(automation.RestoreShedOutputs())
+}
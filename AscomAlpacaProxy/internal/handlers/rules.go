@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleRules lists (GET) the rules with their runtime state, or replaces them (POST).
+func HandleRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListRules())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var rules []config.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		names := make(map[string]bool)
+		for _, rule := range rules {
+			if err := automation.ValidateRule(rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if names[strings.ToLower(rule.Name)] {
+				http.Error(w, fmt.Sprintf("Duplicate rule name '%s'", rule.Name), http.StatusBadRequest)
+				return
+			}
+			names[strings.ToLower(rule.Name)] = true
+		}
+
+		conf := config.Get()
+		conf.Rules = rules
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Rules updated via API (%d defined).", len(rules))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListRules())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRuleHistory returns the recent rule firings, most recent first.
+func HandleRuleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(automation.RuleHistory())
+}
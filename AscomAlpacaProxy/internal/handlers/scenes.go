@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+)
+
+// HandleScenes lists (GET) or replaces (POST) the saved output scenes.
+func HandleScenes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		scenes := config.Get().Scenes
+		if scenes == nil {
+			scenes = []config.Scene{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scenes)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var scenes []config.Scene
+		if err := json.NewDecoder(r.Body).Decode(&scenes); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		names := make(map[string]bool)
+		for _, scene := range scenes {
+			if err := config.ValidateScene(scene); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if names[scene.Name] {
+				http.Error(w, fmt.Sprintf("Duplicate scene name '%s'", scene.Name), http.StatusBadRequest)
+				return
+			}
+			names[scene.Name] = true
+		}
+
+		conf := config.Get()
+		conf.Scenes = scenes
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Scenes updated via API (%d defined).", len(scenes))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scenes)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleApplyScene applies a saved scene. Expects a JSON body {"name": "Park"}.
+// The response reports which outputs did not reach their target.
+func HandleApplyScene(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	scene, ok := power.FindScene(payload.Name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown scene '%s'", payload.Name), http.StatusNotFound)
+		return
+	}
+	result, err := power.ApplyScene(scene, "Web UI")
+	if err != nil {
+		http.Error(w, err.Error(), SetErrorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleSchedules lists (GET) the schedules with their next and last run, or replaces them (POST).
+func HandleSchedules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListSchedules())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var schedules []config.Schedule
+		if err := json.NewDecoder(r.Body).Decode(&schedules); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		names := make(map[string]bool)
+		for _, sched := range schedules {
+			if err := automation.ValidateSchedule(sched); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if names[strings.ToLower(sched.Name)] {
+				http.Error(w, fmt.Sprintf("Duplicate schedule name '%s'", sched.Name), http.StatusBadRequest)
+				return
+			}
+			names[strings.ToLower(sched.Name)] = true
+		}
+
+		conf := config.Get()
+		conf.Schedules = schedules
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Schedules updated via API (%d defined).", len(schedules))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListSchedules())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleScheduleHistory returns the recent schedule executions, most recent first.
+func HandleScheduleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(automation.ScheduleHistory())
+}
+
+// HandleRunSchedule executes the action of a schedule immediately. Expects a JSON body {"name": "Dusk"}.
+func HandleRunSchedule(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	run, err := automation.RunScheduleNow(payload.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(run)
+}
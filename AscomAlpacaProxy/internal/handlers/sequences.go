@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+)
+
+// sequenceSettings is the payload of /api/v1/sequences.
+type sequenceSettings struct {
+	Sequences              []config.Sequence `json:"sequences"`
+	MasterPowerOnSequence  string            `json:"masterPowerOnSequence"`
+	MasterPowerOffSequence string            `json:"masterPowerOffSequence"`
+}
+
+// HandleSequences lists (GET) or replaces (POST) the power sequences and the Master Power assignment.
+func HandleSequences(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		conf := config.Get()
+		settings := sequenceSettings{
+			Sequences:              conf.Sequences,
+			MasterPowerOnSequence:  conf.MasterPowerOnSequence,
+			MasterPowerOffSequence: conf.MasterPowerOffSequence,
+		}
+		if settings.Sequences == nil {
+			settings.Sequences = []config.Sequence{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var settings sequenceSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		names := make(map[string]bool)
+		for _, seq := range settings.Sequences {
+			if err := config.ValidateSequence(seq); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if names[strings.ToLower(seq.Name)] {
+				http.Error(w, fmt.Sprintf("Duplicate sequence name '%s'", seq.Name), http.StatusBadRequest)
+				return
+			}
+			names[strings.ToLower(seq.Name)] = true
+		}
+		for _, name := range []string{settings.MasterPowerOnSequence, settings.MasterPowerOffSequence} {
+			if name != "" && !names[strings.ToLower(name)] {
+				http.Error(w, fmt.Sprintf("Master Power sequence '%s' is not defined", name), http.StatusBadRequest)
+				return
+			}
+		}
+
+		conf := config.Get()
+		conf.Sequences = settings.Sequences
+		conf.MasterPowerOnSequence = settings.MasterPowerOnSequence
+		conf.MasterPowerOffSequence = settings.MasterPowerOffSequence
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Sequences updated via API (%d defined).", len(settings.Sequences))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleRunSequence starts a saved sequence as a background job. Expects a JSON body {"name": "Startup"}.
+// The response contains the job status; progress can be followed via /api/v1/sequences/jobs.
+func HandleRunSequence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	seq, ok := power.FindSequence(payload.Name)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown sequence '%s'", payload.Name), http.StatusNotFound)
+		return
+	}
+	status := power.StartSequence(seq, "Web UI")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// HandleSequenceJobs returns the status of the recent sequence jobs, most recent first.
+func HandleSequenceJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(power.ListJobs())
+}
+
+// HandleCancelSequence cancels a running sequence job. Expects a JSON body {"id": 3};
+// an id of 0 (or an empty body) cancels whichever sequence is running.
+func HandleCancelSequence(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		ID int `json:"id"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := power.CancelSequence(payload.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
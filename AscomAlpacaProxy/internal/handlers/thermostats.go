@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// HandleThermostats lists (GET) the thermostats with their loop state, or replaces them (POST).
+func HandleThermostats(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListThermostats())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var thermostats []config.Thermostat
+		if err := json.NewDecoder(r.Body).Decode(&thermostats); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		names := make(map[string]bool)
+		outputs := make(map[string]string)
+		for _, t := range thermostats {
+			if err := automation.ValidateThermostat(t); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if names[strings.ToLower(t.Name)] {
+				http.Error(w, fmt.Sprintf("Duplicate thermostat name '%s'", t.Name), http.StatusBadRequest)
+				return
+			}
+			names[strings.ToLower(t.Name)] = true
+			if other, taken := outputs[t.Output]; taken && !t.Disabled {
+				http.Error(w, fmt.Sprintf("Thermostats '%s' and '%s' both drive '%s'", other, t.Name, t.Output), http.StatusBadRequest)
+				return
+			}
+			if !t.Disabled {
+				outputs[t.Output] = t.Name
+			}
+		}
+
+		conf := config.Get()
+		conf.Thermostats = thermostats
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Thermostats updated via API (%d defined).", len(thermostats))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(automation.ListThermostats())
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
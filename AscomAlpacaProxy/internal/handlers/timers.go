@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/power"
+	"time"
+)
+
+// HandleTimers lists the pending output timers (GET) or starts a new one (POST).
+// POST expects {"output": "dc4", "state": true, "duration": 1200, "mode": "for"};
+// mode "for" (default) switches now and reverts after duration seconds, "after" switches once duration has passed.
+func HandleTimers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(power.ListTimers())
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		payload := struct {
+			Output   string  `json:"output"`
+			State    bool    `json:"state"`
+			Duration float64 `json:"duration"` // Seconds
+			Mode     string  `json:"mode"`
+		}{Mode: power.TimerFor}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		timer, err := power.StartTimer(payload.Output, payload.Mode, payload.State, time.Duration(payload.Duration*float64(time.Second)), "Web UI")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(timer)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleCancelTimer cancels the timer of an output. Expects a JSON body {"output": "dc4"}.
+// The output keeps its current state.
+func HandleCancelTimer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Output string `json:"output"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if !power.CancelTimer(payload.Output) {
+		http.Error(w, fmt.Sprintf("No timer running for '%s'", payload.Output), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,242 @@
+package power
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	boostStateFile  = "heater_boosts"
+	maxBoostMinutes = 240
+)
+
+// HeaterBoost is a running one-shot boost of a heater: manual mode at Percent until ExpiresAt.
+// Boosts are persisted, so the heater is reverted even if the proxy was restarted in between.
+type HeaterBoost struct {
+	Heater    string                 `json:"heater"`
+	Percent   float64                `json:"percent"`
+	Snapshot  map[string]interface{} `json:"snapshot"` // Firmware config entry ("dh") before the boost
+	WasOn     bool                   `json:"wasOn"`    // Switch state before the boost
+	StartedAt time.Time              `json:"startedAt"`
+	ExpiresAt time.Time              `json:"expiresAt"`
+	Source    string                 `json:"source"`
+}
+
+// BoostStatus is a HeaterBoost with its remaining time, as reported by the API.
+type BoostStatus struct {
+	HeaterBoost
+	RemainingSeconds float64 `json:"remainingSeconds"`
+}
+
+var (
+	boostsMutex sync.Mutex
+	boosts      = make(map[string]*HeaterBoost) // Keyed by heater
+	boostsOnce  sync.Once
+)
+
+// StartBoosts loads the persisted boosts and starts the loop that reverts them when they expire.
+// Boosts that expired while the proxy was not running are reverted as soon as the device is reachable.
+func StartBoosts() {
+	boostsOnce.Do(func() {
+		var saved []HeaterBoost
+		if err := config.LoadState(boostStateFile, &saved); err != nil {
+			logger.Warn("Boost: %v", err)
+		}
+		boostsMutex.Lock()
+		for i := range saved {
+			b := saved[i]
+			boosts[b.Heater] = &b
+			logger.Info("Boost: Restored boost of %s (reverts at %s).", b.Heater, b.ExpiresAt.Format(time.RFC3339))
+		}
+		boostsMutex.Unlock()
+
+		go boostLoop()
+	})
+}
+
+// BoostHeater forces a heater to manual mode at percent for the given duration and switches it on.
+// The heater's config entry is saved first and written back when the boost ends. Boosting a heater
+// that is already boosted changes power and duration but keeps the original snapshot.
+func BoostHeater(heater string, percent float64, duration time.Duration, source string) (BoostStatus, error) {
+	if _, err := heaterIndex(heater); err != nil {
+		return BoostStatus{}, err
+	}
+	if percent <= 0 || percent > 100 {
+		return BoostStatus{}, fmt.Errorf("boost power must be between 1 and 100")
+	}
+	if duration <= 0 || duration > maxBoostMinutes*time.Minute {
+		return BoostStatus{}, fmt.Errorf("boost duration must be between 1 second and %d minutes", maxBoostMinutes)
+	}
+
+	now := time.Now()
+	b := &HeaterBoost{Heater: heater, Percent: percent, StartedAt: now, ExpiresAt: now.Add(duration), Source: source}
+
+	// Reserve the heater before reading its config, so a concurrent boost cannot take a snapshot
+	// of the boosted settings.
+	boostsMutex.Lock()
+	existing, boosted := boosts[heater]
+	if boosted && existing.reserved() {
+		boostsMutex.Unlock()
+		return BoostStatus{}, fmt.Errorf("a boost of %s is already being started", heater)
+	}
+	if !boosted {
+		boosts[heater] = &HeaterBoost{Heater: heater, ExpiresAt: b.ExpiresAt}
+	}
+	boostsMutex.Unlock()
+
+	if boosted {
+		b.Snapshot, b.WasOn, b.StartedAt = existing.Snapshot, existing.WasOn, existing.StartedAt
+	} else {
+		snapshot, err := GetHeaterConfig(heater)
+		if err != nil {
+			boostsMutex.Lock()
+			delete(boosts, heater)
+			boostsMutex.Unlock()
+			return BoostStatus{}, err
+		}
+		b.Snapshot = snapshot
+		b.WasOn, _ = OutputState(config.ShortSwitchIDMap[heater])
+	}
+
+	// Persist before changing anything, so a crash in between still reverts the heater.
+	boostsMutex.Lock()
+	boosts[heater] = b
+	saveBoostsLocked()
+	boostsMutex.Unlock()
+
+	if err := SetHeaterConfig(heater, map[string]interface{}{"m": 0, "mp": percent}, source); err != nil {
+		if !boosted {
+			removeBoost(*b)
+		}
+		return BoostStatus{}, err
+	}
+	go serial.SyncFirmwareConfig()
+	if err := SetOutput(heater, true, nil, source); err != nil {
+		logger.Warn("Boost: %s configured, but could not be switched on: %v", heater, err)
+	}
+
+	logger.Info("Boost: %s at %.0f%% for %v (source: %s).", heater, percent, duration.Round(time.Second), source)
+	return b.status(now), nil
+}
+
+// CancelBoost ends the boost of a heater now and reverts it. It returns false if the heater is not boosted.
+func CancelBoost(heater string) (bool, error) {
+	boostsMutex.Lock()
+	b, ok := boosts[heater]
+	boostsMutex.Unlock()
+	if !ok || b.reserved() {
+		return false, nil
+	}
+	if err := revertBoost(*b); err != nil {
+		return true, err
+	}
+	removeBoost(*b)
+	return true, nil
+}
+
+// IsBoosted reports whether a heater is boosted or a boost of it is being started.
+func IsBoosted(heater string) bool {
+	boostsMutex.Lock()
+	defer boostsMutex.Unlock()
+	_, ok := boosts[heater]
+	return ok
+}
+
+// ListBoosts returns the running boosts ordered by expiry.
+func ListBoosts() []BoostStatus {
+	now := time.Now()
+	boostsMutex.Lock()
+	result := make([]BoostStatus, 0, len(boosts))
+	for _, b := range boosts {
+		if !b.reserved() {
+			result = append(result, b.status(now))
+		}
+	}
+	boostsMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].ExpiresAt.Before(result[j].ExpiresAt) })
+	return result
+}
+
+// reserved reports whether the boost is only a placeholder of a boost that is being started.
+func (b *HeaterBoost) reserved() bool {
+	return b.Snapshot == nil
+}
+
+func (b *HeaterBoost) status(now time.Time) BoostStatus {
+	remaining := math.Max(0, b.ExpiresAt.Sub(now).Seconds())
+	return BoostStatus{HeaterBoost: *b, RemainingSeconds: math.Round(remaining)}
+}
+
+// revertBoost writes the saved config entry back and restores the switch state.
+func revertBoost(b HeaterBoost) error {
+	source := fmt.Sprintf("boost end (%s)", b.Source)
+	if err := SetHeaterConfig(b.Heater, b.Snapshot, source); err != nil {
+		return err
+	}
+	go serial.SyncFirmwareConfig()
+	if _, err := Set(map[string]interface{}{config.ShortSwitchIDMap[b.Heater]: b.WasOn}, source); err != nil {
+		logger.Warn("Boost: %s reverted, but could not be switched %s: %v", b.Heater, onOff(b.WasOn), err)
+	}
+	logger.Info("Boost: %s reverted to its previous settings.", b.Heater)
+	return nil
+}
+
+// boostLoop reverts expired boosts. If the device is not reachable, the boost is kept and retried.
+func boostLoop() {
+	ticker := time.NewTicker(timerTickRate)
+	defer ticker.Stop()
+	failing := make(map[string]bool)
+
+	for range ticker.C {
+		now := time.Now()
+		var due []HeaterBoost
+		boostsMutex.Lock()
+		for _, b := range boosts {
+			if !b.reserved() && !now.Before(b.ExpiresAt) {
+				due = append(due, *b)
+			}
+		}
+		boostsMutex.Unlock()
+
+		for _, b := range due {
+			if err := revertBoost(b); err != nil {
+				if !failing[b.Heater] {
+					logger.Warn("Boost: Could not revert %s, will retry: %v", b.Heater, err)
+					failing[b.Heater] = true
+				}
+				continue
+			}
+			delete(failing, b.Heater)
+			removeBoost(b)
+		}
+	}
+}
+
+// removeBoost deletes a reverted boost unless it has been extended in the meantime.
+func removeBoost(b HeaterBoost) {
+	boostsMutex.Lock()
+	defer boostsMutex.Unlock()
+	if current, ok := boosts[b.Heater]; ok && current.ExpiresAt.Equal(b.ExpiresAt) {
+		delete(boosts, b.Heater)
+		saveBoostsLocked()
+	}
+}
+
+// saveBoostsLocked persists the running boosts. The caller must hold boostsMutex.
+func saveBoostsLocked() {
+	list := make([]HeaterBoost, 0, len(boosts))
+	for _, b := range boosts {
+		if !b.reserved() {
+			list = append(list, *b)
+		}
+	}
+	if err := config.SaveState(boostStateFile, list); err != nil {
+		logger.Error("Boost: Failed to persist boosts: %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package power
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+// BuiltinPIDSync marks the dependency of a PID-sync follower heater on its leader.
+const BuiltinPIDSync = "pid-sync"
+
+// DependencyEdge is a dependency with its origin, as shown in the dependency graph.
+type DependencyEdge struct {
+	config.Dependency
+	Builtin string `json:"builtin,omitempty"` // Set for dependencies derived from the firmware config
+}
+
+// DependencyNode is an output in the dependency graph.
+type DependencyNode struct {
+	Output string `json:"output"`
+	Name   string `json:"name"`
+	On     bool   `json:"on"`
+}
+
+// DependencyGraph is the complete dependency graph with the current output states.
+type DependencyGraph struct {
+	Nodes   []DependencyNode `json:"nodes"`
+	Edges   []DependencyEdge `json:"edges"`
+	Pending []PendingSwitch  `json:"pending"`
+}
+
+// PendingSwitch is an output waiting for a dependency delay before it is switched.
+type PendingSwitch struct {
+	Output           string    `json:"output"`
+	State            bool      `json:"state"`
+	After            string    `json:"after"` // Output switched before, the delay is measured from it
+	DueAt            time.Time `json:"dueAt"`
+	Source           string    `json:"source"`
+	RemainingSeconds float64   `json:"remainingSeconds"`
+}
+
+type pendingSwitch struct {
+	PendingSwitch
+	timer *time.Timer
+}
+
+var (
+	pendingMutex sync.Mutex
+	pending      = make(map[string]*pendingSwitch) // Keyed by internal output name
+)
+
+// Dependencies returns the configured dependencies plus the built-in PID leader/follower relationship.
+func Dependencies() []DependencyEdge {
+	deps := config.Get().Dependencies
+	edges := make([]DependencyEdge, 0, len(deps)+1)
+	for _, d := range deps {
+		edges = append(edges, DependencyEdge{Dependency: d})
+	}
+	return append(edges, pidSyncDependencies()...)
+}
+
+// GetDependencyGraph returns all outputs and dependencies for visualization.
+func GetDependencyGraph() DependencyGraph {
+	graph := DependencyGraph{Edges: Dependencies(), Pending: PendingSwitches()}
+	outputs := make(map[string]bool)
+	for _, output := range ActiveOutputs() {
+		outputs[output] = true
+	}
+	for _, e := range graph.Edges {
+		outputs[e.Output] = true
+		outputs[e.DependsOn] = true
+	}
+	names := config.Get().SwitchNames
+	for output := range outputs {
+		on, _ := OutputState(config.ShortSwitchIDMap[output])
+		name := names[output]
+		if name == "" {
+			name = output
+		}
+		graph.Nodes = append(graph.Nodes, DependencyNode{Output: output, Name: name, On: on})
+	}
+	sort.Slice(graph.Nodes, func(i, j int) bool { return graph.Nodes[i].Output < graph.Nodes[j].Output })
+	return graph
+}
+
+// DOT renders the graph in Graphviz format. Arrows point from an output to the output it depends on;
+// outputs that are on are filled, built-in dependencies are dashed.
+func (g DependencyGraph) DOT() string {
+	var b strings.Builder
+	b.WriteString("digraph dependencies {\n\trankdir=LR;\n\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		style := ""
+		if n.On {
+			style = `, style=filled, fillcolor="palegreen"`
+		}
+		fmt.Fprintf(&b, "\t%q [label=%q%s];\n", n.Output, displayName(n.Output), style)
+	}
+	for _, e := range g.Edges {
+		var labels []string
+		if e.PowerOn {
+			labels = append(labels, "powerOn")
+		}
+		if e.Follow {
+			labels = append(labels, "follow")
+		}
+		if e.CascadeOff {
+			labels = append(labels, "cascadeOff")
+		}
+		if e.DelaySeconds > 0 {
+			labels = append(labels, fmt.Sprintf("%gs", e.DelaySeconds))
+		}
+		style := ""
+		if e.Builtin != "" {
+			labels = append(labels, e.Builtin)
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "\t%q -> %q [label=%q%s];\n", e.Output, e.DependsOn, strings.Join(labels, ", "), style)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// pidSyncDependencies derives the leader/follower relationship from the heater modes: a heater in
+// PID-sync mode (3) follows the other heater if that one runs PID (1) or MinTemp (4). Turning the
+// follower on turns the leader on first (if enabled in HeaterAutoEnableLeader), turning the leader
+// off turns the follower off.
+func pidSyncDependencies() []DependencyEdge {
+	modes := heaterModes()
+	heaters := []string{"pwm1", "pwm2"}
+	var edges []DependencyEdge
+	for follower := range heaters {
+		leader := 1 - follower
+		if modes[follower] == 3 && (modes[leader] == 1 || modes[leader] == 4) {
+			edges = append(edges, DependencyEdge{
+				Dependency: config.Dependency{
+					Output:     heaters[follower],
+					DependsOn:  heaters[leader],
+					PowerOn:    config.Get().HeaterAutoEnableLeader[heaters[follower]],
+					CascadeOff: true,
+				},
+				Builtin: BuiltinPIDSync,
+			})
+		}
+	}
+	return edges
+}
+
+// heaterModes returns the firmware modes of both heaters from the status cache ("dm" array), -1 if unknown.
+func heaterModes() [2]int {
+	modes := [2]int{-1, -1}
+	serial.Status.RLock()
+	defer serial.Status.RUnlock()
+	dm, _ := serial.Status.Data["dm"].([]interface{})
+	for i := 0; i < len(dm) && i < len(modes); i++ {
+		if m, ok := dm[i].(float64); ok {
+			modes[i] = int(m)
+		}
+	}
+	return modes
+}
+
+// switchDependencies runs before key is switched: turning it on first turns on the outputs it needs
+// (with their own dependencies), turning it off first turns off the outputs depending on it.
+// It stops at the first dependency with a delay and returns the delay and the dependency; the caller
+// then schedules key after the delay, with the switched dependency already marked as visited.
+func switchDependencies(key string, state bool, source string, visited map[string]bool) (time.Duration, string, error) {
+	for _, e := range Dependencies() {
+		var other string
+		switch {
+		case state && e.PowerOn && e.Output == key:
+			other = e.DependsOn
+		case !state && e.CascadeOff && e.DependsOn == key:
+			other = e.Output
+		default:
+			continue
+		}
+		if visited[other] {
+			continue
+		}
+		if on, ok := OutputState(config.ShortSwitchIDMap[other]); !ok || on == state {
+			continue // Not available or already in the required state
+		}
+
+		logger.Info("Dependencies: Switching %s %s before %s (%s).", other, onOff(state), key, source)
+		if err := setOutput(other, state, nil, source, visited); err != nil {
+			return 0, "", fmt.Errorf("could not switch %s %s: %w", other, onOff(state), err)
+		}
+		if e.DelaySeconds > 0 {
+			return time.Duration(e.DelaySeconds * float64(time.Second)), other, nil
+		}
+	}
+	return 0, "", nil
+}
+
+// resumeAfter schedules key to be switched once delay has passed, continuing with its remaining
+// dependencies. visited is copied, as the caller returns and may reuse its map.
+func resumeAfter(delay time.Duration, key, after string, state bool, value *float64, source string, visited map[string]bool) {
+	resumed := make(map[string]bool, len(visited))
+	for k, v := range visited {
+		resumed[k] = v
+	}
+	logger.Info("Dependencies: Switching %s %s in %v (%s).", key, onOff(state), delay.Round(time.Second), source)
+	schedulePending(PendingSwitch{Output: key, State: state, After: after, Source: source}, delay, func() {
+		if err := setOutput(key, state, value, source, resumed); err != nil {
+			logger.Error("Dependencies: Failed to switch %s %s: %v", key, onOff(state), err)
+		}
+	})
+}
+
+// switchFollowers schedules the outputs that follow key, each after its own delay from now.
+func switchFollowers(key string, source string) {
+	for _, e := range Dependencies() {
+		if !e.Follow || e.DependsOn != key {
+			continue
+		}
+		output := e.Output
+		if on, ok := OutputState(config.ShortSwitchIDMap[output]); !ok || on {
+			continue
+		}
+		delay := time.Duration(e.DelaySeconds * float64(time.Second))
+		schedulePending(PendingSwitch{Output: output, State: true, After: key, Source: source}, delay, func() {
+			if on, ok := OutputState(config.ShortSwitchIDMap[output]); !ok || on {
+				return
+			}
+			logger.Info("Dependencies: Switching %s on after %s (%s).", output, key, source)
+			if err := SetOutput(output, true, nil, source); err != nil {
+				logger.Error("Dependencies: Failed to switch %s on after %s: %v", output, key, err)
+			}
+		})
+	}
+}
+
+// schedulePending runs fn after delay unless the output is switched or its trigger is reverted in the
+// meantime (see cancelPending). A pending switch of the same output is replaced.
+func schedulePending(ps PendingSwitch, delay time.Duration, fn func()) {
+	ps.DueAt = time.Now().Add(delay)
+	p := &pendingSwitch{PendingSwitch: ps}
+
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	if old, ok := pending[ps.Output]; ok {
+		old.timer.Stop()
+	}
+	pending[ps.Output] = p
+	p.timer = time.AfterFunc(delay, func() {
+		pendingMutex.Lock()
+		current := pending[ps.Output] == p
+		if current {
+			delete(pending, ps.Output)
+		}
+		pendingMutex.Unlock()
+		if current {
+			fn()
+		}
+	})
+}
+
+// cancelPending drops the pending switch of key, as key is being switched now. Switching key to
+// state also drops pending switches waiting for key to reach the opposite state, e.g. a follower
+// that would turn on after key has been turned off again.
+func cancelPending(key string, state bool) {
+	pendingMutex.Lock()
+	defer pendingMutex.Unlock()
+	for output, p := range pending {
+		if output == key || (p.After == key && p.State != state) {
+			p.timer.Stop()
+			delete(pending, output)
+			logger.Info("Dependencies: Cancelled pending switch of %s %s.", output, onOff(p.State))
+		}
+	}
+}
+
+// PendingSwitches returns the outputs waiting for a dependency delay, ordered by due time.
+func PendingSwitches() []PendingSwitch {
+	now := time.Now()
+	pendingMutex.Lock()
+	result := make([]PendingSwitch, 0, len(pending))
+	for _, p := range pending {
+		ps := p.PendingSwitch
+		ps.RemainingSeconds = math.Round(math.Max(0, ps.DueAt.Sub(now).Seconds()))
+		result = append(result, ps)
+	}
+	pendingMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].DueAt.Before(result[j].DueAt) })
+	return result
+}
@@ -0,0 +1,72 @@
+package power
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// pendingOutputs returns the outputs with a pending switch.
+func pendingOutputs() []string {
+	var outputs []string
+	for _, ps := range PendingSwitches() {
+		outputs = append(outputs, ps.Output)
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+func TestCancelPending(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		state bool
+		want  []string
+	}{
+		{"output switched", "dc3", true, []string{"dc2"}},
+		{"trigger switched back", "dc1", false, []string{"dc3"}},
+		{"trigger switched again", "dc1", true, []string{"dc2", "dc3"}},
+		{"other output", "dc5", false, []string{"dc2", "dc3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { cancelPending("dc2", true); cancelPending("dc3", true) })
+			// dc2 follows dc1, dc3 waits for its dependency usbc12.
+			schedulePending(PendingSwitch{Output: "dc2", State: true, After: "dc1"}, time.Hour, func() {})
+			schedulePending(PendingSwitch{Output: "dc3", State: true, After: "usbc12"}, time.Hour, func() {})
+
+			cancelPending(tt.key, tt.state)
+			if got := pendingOutputs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pending after switching %s %s = %v, want %v", tt.key, onOff(tt.state), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchedulePending(t *testing.T) {
+	fired := make(chan string, 2)
+	schedulePending(PendingSwitch{Output: "dc4", State: true, After: "dc1"}, time.Hour, func() { fired <- "replaced" })
+	schedulePending(PendingSwitch{Output: "dc4", State: true, After: "dc1"}, 10*time.Millisecond, func() { fired <- "current" })
+
+	list := PendingSwitches()
+	if len(list) != 1 || list[0].Output != "dc4" {
+		t.Fatalf("PendingSwitches = %+v, want one entry for dc4", list)
+	}
+	select {
+	case got := <-fired:
+		if got != "current" {
+			t.Errorf("fired %q, want the replacing switch", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending switch did not fire")
+	}
+	if got := PendingSwitches(); len(got) != 0 {
+		t.Errorf("PendingSwitches after firing = %+v, want none", got)
+	}
+	select {
+	case got := <-fired:
+		t.Errorf("replaced switch fired as well (%q)", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,67 @@
+package power
+
+import (
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// activeMembers returns the short keys of the group members that are currently exposed as switches.
+// Members disabled in the firmware are ignored, just like the firmware's own "all" command does.
+func activeMembers(vs config.VirtualSwitch) []string {
+	active := make(map[string]bool)
+	for _, key := range ActiveOutputs() {
+		active[key] = true
+	}
+
+	var members []string
+	for _, member := range vs.Members {
+		if active[member] {
+			members = append(members, config.ShortSwitchIDMap[member])
+		}
+	}
+	return members
+}
+
+// GroupState evaluates the on/off state of a virtual switch according to its mode.
+// Members with unknown status count as off.
+func GroupState(vs config.VirtualSwitch) bool {
+	members := activeMembers(vs)
+	if len(members) == 0 {
+		return false
+	}
+
+	onCount := 0
+	for _, shortKey := range members {
+		if on, _ := OutputState(shortKey); on {
+			onCount++
+		}
+	}
+
+	switch vs.Mode {
+	case config.GroupModeAny:
+		return onCount > 0
+	case config.GroupModeMajority:
+		return onCount*2 > len(members)
+	default:
+		return onCount == len(members)
+	}
+}
+
+// SetGroup switches all active members of a virtual switch with a single combined set command.
+func SetGroup(vs config.VirtualSwitch, state bool, source string) error {
+	members := activeMembers(vs)
+	if len(members) == 0 {
+		return fmt.Errorf("virtual switch '%s' has no active members", vs.Name)
+	}
+
+	values := make(map[string]interface{}, len(members))
+	for _, shortKey := range members {
+		// Use "true"/"false" for bool to avoid ambiguity with "1"=1V in firmware
+		values[shortKey] = state
+	}
+
+	logger.Info("Setting virtual switch '%s' (%v) to %t.", vs.Name, vs.Members, state)
+	_, err := Set(values, source)
+	return err
+}
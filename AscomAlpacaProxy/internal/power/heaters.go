@@ -0,0 +1,81 @@
+package power
+
+import (
+	"encoding/json"
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"time"
+)
+
+// heaterIndex returns the index of a heater in the firmware's "dh" config array.
+func heaterIndex(key string) (int, error) {
+	switch key {
+	case "pwm1":
+		return 0, nil
+	case "pwm2":
+		return 1, nil
+	}
+	return 0, fmt.Errorf("unknown heater '%s'", key)
+}
+
+// GetHeaterConfig returns the firmware config entry ("dh") of a heater, e.g. {"m":1,"mp":50,"xp":100,...}.
+func GetHeaterConfig(key string) (map[string]interface{}, error) {
+	idx, err := heaterIndex(key)
+	if err != nil {
+		return nil, err
+	}
+	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not get firmware config: %w", err)
+	}
+	var fwConfig struct {
+		DH []map[string]interface{} `json:"dh"`
+	}
+	if err := json.Unmarshal([]byte(configJSON), &fwConfig); err != nil {
+		return nil, fmt.Errorf("could not parse firmware config: %w", err)
+	}
+	if idx >= len(fwConfig.DH) {
+		return nil, fmt.Errorf("firmware config has no entry for %s", key)
+	}
+	return fwConfig.DH[idx], nil
+}
+
+// SetHeaterConfig sends a partial config entry for one heater. The firmware skips empty entries,
+// so the other heater is left untouched.
+func SetHeaterConfig(key string, settings map[string]interface{}, source string) error {
+	idx, err := heaterIndex(key)
+	if err != nil {
+		return err
+	}
+	dh := []map[string]interface{}{{}, {}}
+	dh[idx] = settings
+	command, err := json.Marshal(map[string]interface{}{"sc": map[string]interface{}{"dh": dh}})
+	if err != nil {
+		return err
+	}
+	noteSource([]string{config.ShortSwitchIDMap[key]}, source) // A mode change changes the reported state
+	logger.Debug("Sending heater config from %s: %s", source, command)
+	if _, err := serial.SendCommand(string(command), true, 10*time.Second); err != nil {
+		return fmt.Errorf("failed to send heater config: %w", err)
+	}
+	return nil
+}
+
+// SetHeaterManual switches a heater to manual mode with the given power in % and turns it on
+// (or off for 0 %). The firmware keeps the manual power as the heater's default from then on.
+func SetHeaterManual(key string, percent float64, source string) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("manual power must be between 0 and 100")
+	}
+	logger.Info("Setting %s to manual %.0f%% (%s).", key, percent, source)
+	if err := SetHeaterConfig(key, map[string]interface{}{"m": 0, "mp": percent}, source); err != nil {
+		return err
+	}
+	// A mode change may reveal a previously disabled heater switch.
+	go serial.SyncFirmwareConfig()
+
+	// "true" makes the firmware apply the manual power just configured.
+	return SetOutput(key, percent > 0, nil, source)
+}
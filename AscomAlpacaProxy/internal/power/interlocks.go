@@ -0,0 +1,249 @@
+package power
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+// clientTimeout is how long a connected ASCOM client counts as connected without sending any request.
+// Clients that crash never send Connected=false, so protection would otherwise last until a restart.
+const clientTimeout = 5 * time.Minute
+
+// InterlockError is returned when a set command violates an interlock. ASCOM handlers report it
+// as InvalidOperation (0x40B), the REST API as 409 Conflict.
+type InterlockError struct {
+	Reason string
+}
+
+func (e *InterlockError) Error() string {
+	return "interlock: " + e.Reason
+}
+
+// ConnectedClient is an ASCOM client that has set Connected=true on one of the devices.
+type ConnectedClient struct {
+	ClientID string    `json:"clientId"`
+	Device   string    `json:"device"`
+	Since    time.Time `json:"since"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+var (
+	clientsMutex sync.Mutex
+	clients      = make(map[string]*ConnectedClient) // Keyed by device + client ID
+)
+
+func init() {
+	// Every command passes the interlocks, whichever path it comes from.
+	serial.SetCommandFilter(checkCommand)
+}
+
+// SetClientConnected records an ASCOM client connecting to or disconnecting from a device.
+func SetClientConnected(clientID, device string, connected bool) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	key := device + "/" + clientID
+	if !connected {
+		delete(clients, key)
+		return
+	}
+	now := time.Now()
+	if c, ok := clients[key]; ok {
+		c.LastSeen = now
+		return
+	}
+	clients[key] = &ConnectedClient{ClientID: clientID, Device: device, Since: now, LastSeen: now}
+}
+
+// TouchClient notes activity of a client, keeping its connection alive.
+func TouchClient(clientID string) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	now := time.Now()
+	for _, c := range clients {
+		if c.ClientID == clientID {
+			c.LastSeen = now
+		}
+	}
+}
+
+// ConnectedClients returns the ASCOM clients that are currently connected.
+func ConnectedClients() []ConnectedClient {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+	result := []ConnectedClient{}
+	for key, c := range clients {
+		if time.Since(c.LastSeen) > clientTimeout {
+			delete(clients, key)
+			continue
+		}
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Since.Before(result[j].Since) })
+	return result
+}
+
+// checkCommand checks the outputs of a {"set":{...}} command and the adjustable voltage of a
+// {"sc":{...}} config command against the interlocks.
+func checkCommand(command string) error {
+	if !strings.Contains(command, `"set"`) && !strings.Contains(command, `"sc"`) {
+		return nil
+	}
+	var payload struct {
+		Set map[string]interface{} `json:"set"`
+		SC  map[string]interface{} `json:"sc"`
+	}
+	if err := json.Unmarshal([]byte(command), &payload); err != nil {
+		return nil // The firmware rejects malformed commands itself
+	}
+	var err error
+	if len(payload.Set) > 0 {
+		err = CheckInterlocks(payload.Set)
+	} else if av, ok := payload.SC["av"].(float64); ok {
+		err = checkAdjVoltage(av)
+	}
+	if err != nil {
+		logger.Warn("Blocked command %s: %v", command, err)
+		return err
+	}
+	return nil
+}
+
+// CheckInterlocks checks the targets of a set command (keyed by short key, as sent to the firmware)
+// against the configured interlocks. The "all" key stands for every active output.
+func CheckInterlocks(values map[string]interface{}) error {
+	il := config.Get().Interlocks
+	if len(il.Protected) == 0 && il.MaxAdjVoltage == 0 && len(il.Exclusive) == 0 {
+		return nil
+	}
+
+	longKeys := make(map[string]string, len(config.ShortSwitchIDMap))
+	for long, short := range config.ShortSwitchIDMap {
+		longKeys[short] = long
+	}
+
+	// Resulting on/off state per internal output name; voltages for adj_conv
+	targets := make(map[string]bool)
+	var adjVoltage *float64
+	for shortKey, value := range values {
+		on := targetOn(value)
+		if shortKey == "all" {
+			for _, output := range ActiveOutputs() {
+				if _, explicit := values[config.ShortSwitchIDMap[output]]; !explicit {
+					targets[output] = on
+				}
+			}
+			continue
+		}
+		output, ok := longKeys[shortKey]
+		if !ok {
+			continue
+		}
+		targets[output] = on
+		if v, isNum := value.(float64); isNum && output == "adj_conv" {
+			adjVoltage = &v
+		}
+	}
+
+	// Protected outputs
+	clientConnected := len(ConnectedClients()) > 0
+	for output, mode := range il.Protected {
+		if on, changed := targets[output]; !changed || on {
+			continue
+		}
+		switch {
+		case mode == config.ProtectAlways:
+			return &InterlockError{fmt.Sprintf("output '%s' is protected and cannot be turned off", displayName(output))}
+		case mode == config.ProtectConnected && clientConnected:
+			return &InterlockError{fmt.Sprintf("output '%s' is protected and cannot be turned off while an ASCOM client is connected", displayName(output))}
+		}
+	}
+
+	// Maximum adjustable converter voltage. Switching it on without a voltage uses the stored preset.
+	if il.MaxAdjVoltage > 0 && targets["adj_conv"] {
+		if adjVoltage == nil {
+			preset, err := storedAdjVoltage()
+			if err != nil {
+				return &InterlockError{fmt.Sprintf("could not verify the voltage of '%s': %v", displayName("adj_conv"), err)}
+			}
+			adjVoltage = &preset
+		}
+		if err := checkAdjVoltage(*adjVoltage); err != nil {
+			return err
+		}
+	}
+
+	// Mutually exclusive outputs: after the command at most one member of each group may be on.
+	for _, group := range il.Exclusive {
+		var on []string
+		switchesOn := false
+		for _, output := range group {
+			state, changed := targets[output]
+			if !changed {
+				state, _ = OutputState(config.ShortSwitchIDMap[output])
+			} else if state {
+				switchesOn = true
+			}
+			if state {
+				on = append(on, displayName(output))
+			}
+		}
+		if switchesOn && len(on) > 1 {
+			return &InterlockError{fmt.Sprintf("outputs %s are mutually exclusive", strings.Join(on, " and "))}
+		}
+	}
+	return nil
+}
+
+// checkAdjVoltage checks a voltage for the adjustable converter against the configured maximum.
+func checkAdjVoltage(voltage float64) error {
+	limit := config.Get().Interlocks.MaxAdjVoltage
+	if limit > 0 && voltage > limit {
+		return &InterlockError{fmt.Sprintf("%.2f V exceeds the maximum of %.2f V for '%s'", voltage, limit, displayName("adj_conv"))}
+	}
+	return nil
+}
+
+// storedAdjVoltage reads the preset voltage ("av") the firmware uses when the adjustable converter
+// is switched on without a voltage. The cached RAM target may be stale after a preset change.
+func storedAdjVoltage() (float64, error) {
+	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	if err != nil {
+		return 0, fmt.Errorf("could not get firmware config: %w", err)
+	}
+	var fwConfig struct {
+		AV *float64 `json:"av"`
+	}
+	if err := json.Unmarshal([]byte(configJSON), &fwConfig); err != nil {
+		return 0, fmt.Errorf("could not parse firmware config: %w", err)
+	}
+	if fwConfig.AV == nil {
+		return 0, fmt.Errorf("firmware config has no adjustable voltage")
+	}
+	return *fwConfig.AV, nil
+}
+
+// targetOn interprets a value of a set command: true, or a number above zero (voltage, PWM %, 1 for "all").
+func targetOn(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v > 0
+	}
+	return false
+}
+
+// displayName returns the custom name of an output with its internal name, e.g. "Mount (dc1)".
+func displayName(output string) string {
+	if name := config.Get().SwitchNames[output]; name != "" && name != output {
+		return fmt.Sprintf("%s (%s)", name, output)
+	}
+	return output
+}
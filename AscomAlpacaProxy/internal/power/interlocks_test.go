@@ -0,0 +1,68 @@
+package power
+
+import (
+	"errors"
+	"testing"
+
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+func TestCheckInterlocks(t *testing.T) {
+	conf := config.Get()
+	saved := conf.Interlocks
+	t.Cleanup(func() { conf.Interlocks = saved })
+	conf.Interlocks = config.Interlocks{
+		Protected:     map[string]string{"dc1": config.ProtectAlways, "dc2": config.ProtectConnected},
+		MaxAdjVoltage: 9,
+		Exclusive:     [][]string{{"pwm1", "pwm2"}},
+	}
+
+	// pwm2 runs in manual mode and reports its power in %.
+	serial.Status.Lock()
+	savedStatus := serial.Status.Data
+	serial.Status.Data = map[string]interface{}{"d1": true, "d2": true, "pwm1": false, "pwm2": 45.0}
+	serial.Status.Unlock()
+	t.Cleanup(func() {
+		serial.Status.Lock()
+		serial.Status.Data = savedStatus
+		serial.Status.Unlock()
+	})
+
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		connected bool
+		blocked   bool
+	}{
+		{"protected output turned off", map[string]interface{}{"d1": false}, false, true},
+		{"protected output turned off by number", map[string]interface{}{"d1": 0.0}, false, true},
+		{"protected output turned on", map[string]interface{}{"d1": true}, false, false},
+		{"all off includes protected output", map[string]interface{}{"all": 0.0}, false, true},
+		{"all off with protected output kept on", map[string]interface{}{"all": 0.0, "d1": true}, false, false},
+		{"protected while connected, no client", map[string]interface{}{"d2": false}, false, false},
+		{"protected while connected, client connected", map[string]interface{}{"d2": false}, true, true},
+		{"voltage within limit", map[string]interface{}{"adj": 5.0}, false, false},
+		{"voltage above limit", map[string]interface{}{"adj": 12.0}, false, true},
+		{"voltage 0 switches off", map[string]interface{}{"adj": 0.0}, false, false},
+		{"exclusive output on while other reports percent", map[string]interface{}{"pwm1": true}, false, true},
+		{"exclusive outputs swapped in one command", map[string]interface{}{"pwm1": true, "pwm2": false}, false, false},
+		{"exclusive output already on set again", map[string]interface{}{"pwm2": 60.0}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.connected {
+				SetClientConnected("1", "switch", true)
+				t.Cleanup(func() { SetClientConnected("1", "switch", false) })
+			}
+			err := CheckInterlocks(tt.values)
+			var ie *InterlockError
+			if err != nil && !errors.As(err, &ie) {
+				t.Fatalf("CheckInterlocks(%v) = %v, want an InterlockError", tt.values, err)
+			}
+			if (err != nil) != tt.blocked {
+				t.Errorf("CheckInterlocks(%v) = %v, blocked %v", tt.values, err, tt.blocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package power
+
+import (
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// SetOutput switches a single switch (by internal name) the way the Alpaca SetSwitch/SetSwitchValue
+// handler does, so every caller ends up on the same command path:
+//   - virtual switches send one combined command for their members,
+//   - Master Power runs the configured sequence or the firmware's "all" command,
+//   - heaters in manual mode take value as power in %, the adjustable converter as voltage
+//     (if Alpaca voltage control is enabled), everything else is switched on/off,
+//   - dependencies are switched first (outputs it needs before turning on, dependent outputs
+//     before turning off), followers afterwards; PID leader/follower heaters are one such dependency.
+//
+// value is optional and only used for heaters in manual mode and the adjustable converter.
+func SetOutput(key string, state bool, value *float64, source string) error {
+	return setOutput(key, state, value, source, make(map[string]bool))
+}
+
+// setOutput implements SetOutput. visited holds the outputs already switched for the same request,
+// so dependencies are switched only once.
+func setOutput(key string, state bool, value *float64, source string, visited map[string]bool) error {
+	if config.IsSensorSwitch(key) {
+		return fmt.Errorf("sensor switches are read-only and cannot be set")
+	}
+
+	// Virtual switches send one combined command for all members
+	if vs, isGroup := config.GetVirtualSwitch(key); isGroup {
+		if err := SetGroup(vs, state, source); err != nil {
+			return fmt.Errorf("failed to set virtual switch: %w", err)
+		}
+		return nil
+	}
+
+	shortKey, ok := config.ShortSwitchIDMap[key]
+	if !ok {
+		return fmt.Errorf("unknown output '%s'", key)
+	}
+
+	// Master Power runs the configured power-up/down sequence instead of switching everything at once
+	if key == "master_power" {
+		if seq, ok := MasterPowerSequence(state); ok {
+			StartSequence(seq, source)
+			return nil
+		}
+	}
+
+	// A value of 0 switches heaters and the converter off as well
+	on := state && (value == nil || *value > 0)
+	if key != "master_power" {
+		cancelPending(key, on)
+		visited[key] = true
+		delay, after, err := switchDependencies(key, on, source, visited)
+		if err != nil {
+			return err
+		}
+		if delay > 0 {
+			resumeAfter(delay, key, after, state, value, source, visited)
+			return nil
+		}
+	}
+
+	var command string
+	newVoltageTarget := -1.0
+
+	switch {
+	case (key == "pwm1" || key == "pwm2") && heaterInManualMode(key):
+		if value != nil {
+			command = fmt.Sprintf(`{"set":{"%s":%.0f}}`, shortKey, *value)
+		} else {
+			// Use "true"/"false" so firmware applies default manual power or ON state
+			command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
+		}
+	case key == "adj_conv" && config.Get().EnableAlpacaVoltageControl && value != nil:
+		// If a value is provided, set specific voltage
+		command = fmt.Sprintf(`{"set":{"%s":%.2f}}`, shortKey, *value)
+		newVoltageTarget = *value
+	case key == "master_power":
+		// Master Power "all" command usually expects 0/1 in some firmware versions
+		stateInt := 0
+		if state {
+			stateInt = 1
+		}
+		command = fmt.Sprintf(`{"set":{"%s":%d}}`, shortKey, stateInt)
+	default:
+		// Use "true"/"false" for bool to avoid ambiguity with "1"=1V in firmware
+		command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
+	}
+
+	noteSource([]string{shortKey}, source)
+	logger.Debug("Sending set command from %s: %s", source, command)
+	responseJSON, err := serial.SendCommand(command, true, 0)
+	if err != nil {
+		return fmt.Errorf("failed to send command: %w", err)
+	}
+
+	// Update the Voltage Target Cache if this was a voltage change command
+	if newVoltageTarget >= 0 {
+		serial.VoltageMutex.Lock()
+		serial.ActiveVoltageTarget = newVoltageTarget
+		serial.VoltageMutex.Unlock()
+	}
+
+	// Parse response which can contain mixed types ("status" object and "dm" array)
+	serial.UpdateStatusFromResponse(responseJSON)
+
+	if on && key != "master_power" {
+		switchFollowers(key, source)
+	}
+	return nil
+}
+
+// heaterInManualMode checks the heater mode from the status cache ("dm" array).
+func heaterInManualMode(key string) bool {
+	heaterIdx := 0
+	if key == "pwm2" {
+		heaterIdx = 1
+	}
+
+	serial.Status.RLock()
+	dmVal, found := serial.Status.Data["dm"]
+	serial.Status.RUnlock()
+
+	if dmArray, ok := dmVal.([]interface{}); found && ok && heaterIdx < len(dmArray) {
+		modeFloat, isFloat := dmArray[heaterIdx].(float64)
+		return isFloat && int(modeFloat) == 0
+	}
+	return false
+}
+
+// SetAdjVoltage sets the adjustable converter to a voltage, 0 switches it off. Unlike SetOutput it does
+// not depend on EnableAlpacaVoltageControl, which only concerns ASCOM clients.
+func SetAdjVoltage(voltage float64, source string) error {
+	skipped, err := applyTargets(map[string]interface{}{"adj_conv": voltage}, source)
+	if len(skipped) > 0 {
+		return fmt.Errorf("the adjustable converter is disabled")
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package power
+
+import (
+	"encoding/json"
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// IsOn interprets a value from the status cache.
+// The firmware reports boolean false for OFF, and true or a numeric value (PWM %, voltage) for ON.
+func IsOn(val interface{}) bool {
+	switch v := val.(type) {
+	case bool:
+		return v
+	case float64:
+		return v >= 1.0
+	}
+	return false
+}
+
+// OutputState returns the on/off state of an output (by short key) from the status cache.
+// ok is false if the output is not reported by the device.
+func OutputState(shortKey string) (on bool, ok bool) {
+	serial.Status.RLock()
+	defer serial.Status.RUnlock()
+	val, found := serial.Status.Data[shortKey]
+	if !found {
+		return false, false
+	}
+	return IsOn(val), true
+}
+
+// ActiveOutputs returns the internal names of all physical outputs currently exposed as switches.
+// Sensors, Master Power and virtual switches are excluded, as are outputs disabled in the firmware.
+func ActiveOutputs() []string {
+	config.SwitchMapMutex.RLock()
+	defer config.SwitchMapMutex.RUnlock()
+
+	var outputs []string
+	for id := 0; id < len(config.SwitchIDMap); id++ {
+		key, ok := config.SwitchIDMap[id]
+		if !ok || config.IsSensorSwitch(key) || key == "master_power" {
+			continue
+		}
+		if _, isOutput := config.ShortSwitchIDMap[key]; !isOutput {
+			continue
+		}
+		outputs = append(outputs, key)
+	}
+	return outputs
+}
+
+// Set sends one combined {"set":{...}} command for the given outputs (keyed by short key)
+// and updates the status cache from the device's response.
+// source describes the origin of the request and is used for logging.
+func Set(values map[string]interface{}, source string) (string, error) {
+	if len(values) == 0 {
+		return "", fmt.Errorf("no outputs to set")
+	}
+	payload, err := json.Marshal(map[string]interface{}{"set": values})
+	if err != nil {
+		return "", fmt.Errorf("failed to build set command: %w", err)
+	}
+	command := string(payload)
+
+	keys := make([]string, 0, len(values))
+	for shortKey := range values {
+		keys = append(keys, shortKey)
+	}
+	noteSource(keys, source)
+
+	logger.Debug("Sending set command from %s: %s", source, command)
+	responseJSON, err := serial.SendCommand(command, true, 0)
+	if err != nil {
+		return "", fmt.Errorf("failed to send command: %w", err)
+	}
+	serial.UpdateStatusFromResponse(responseJSON)
+	return responseJSON, nil
+}
@@ -0,0 +1,128 @@
+package power
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// OutputMismatch describes an output that did not reach its scene target.
+type OutputMismatch struct {
+	Output string      `json:"output"`
+	Target interface{} `json:"target"`
+	Actual interface{} `json:"actual"`
+}
+
+// SceneResult reports the outcome of applying a scene.
+type SceneResult struct {
+	Scene   string           `json:"scene"`
+	Success bool             `json:"success"`
+	Skipped []string         `json:"skipped,omitempty"` // Outputs disabled in the firmware
+	Failed  []OutputMismatch `json:"failed,omitempty"`
+}
+
+// FindScene looks up a scene by name (case-insensitive).
+func FindScene(name string) (config.Scene, bool) {
+	for _, scene := range config.Get().Scenes {
+		if strings.EqualFold(scene.Name, name) {
+			return scene, true
+		}
+	}
+	return config.Scene{}, false
+}
+
+// ApplyScene sends all targets of a scene in one combined set command and verifies the resulting status.
+func ApplyScene(scene config.Scene, source string) (*SceneResult, error) {
+	result := &SceneResult{Scene: scene.Name}
+
+	logger.Info("Applying scene '%s' (source: %s).", scene.Name, source)
+	skipped, err := applyTargets(scene.Outputs, fmt.Sprintf("scene '%s' (%s)", scene.Name, source))
+	if err != nil {
+		return nil, fmt.Errorf("scene '%s': %w", scene.Name, err)
+	}
+	result.Skipped = skipped
+	isSkipped := make(map[string]bool)
+	for _, output := range skipped {
+		isSkipped[output] = true
+	}
+
+	// Verify against the status returned by the set command.
+	serial.Status.RLock()
+	for output, target := range scene.Outputs {
+		if isSkipped[output] {
+			continue
+		}
+		actual := serial.Status.Data[config.ShortSwitchIDMap[output]]
+		if !targetReached(target, actual) {
+			result.Failed = append(result.Failed, OutputMismatch{Output: output, Target: target, Actual: actual})
+		}
+	}
+	serial.Status.RUnlock()
+	sort.Slice(result.Failed, func(i, j int) bool { return result.Failed[i].Output < result.Failed[j].Output })
+
+	result.Success = len(result.Failed) == 0
+	if result.Success {
+		logger.Info("Scene '%s' applied successfully.", scene.Name)
+	} else {
+		logger.Warn("Scene '%s' applied, but %d output(s) did not reach their target: %v", scene.Name, len(result.Failed), result.Failed)
+	}
+	return result, nil
+}
+
+// applyTargets sends the given targets (keyed by internal output name) in one combined set command.
+// Outputs that are disabled in the firmware are not sent and returned as skipped.
+func applyTargets(outputs map[string]interface{}, source string) (skipped []string, err error) {
+	active := make(map[string]bool)
+	for _, key := range ActiveOutputs() {
+		active[key] = true
+	}
+
+	values := make(map[string]interface{}, len(outputs))
+	for output, target := range outputs {
+		if !active[output] {
+			skipped = append(skipped, output)
+			continue
+		}
+		values[config.ShortSwitchIDMap[output]] = target
+	}
+	sort.Strings(skipped)
+
+	if len(values) == 0 {
+		return skipped, fmt.Errorf("no active outputs")
+	}
+	if _, err := Set(values, source); err != nil {
+		return skipped, err
+	}
+
+	if v, ok := values["adj"].(float64); ok && v > 0 {
+		serial.VoltageMutex.Lock()
+		serial.ActiveVoltageTarget = v
+		serial.VoltageMutex.Unlock()
+	}
+	return skipped, nil
+}
+
+// targetReached compares a scene target with the value reported in the status cache.
+func targetReached(target, actual interface{}) bool {
+	switch t := target.(type) {
+	case bool:
+		return IsOn(actual) == t
+	case float64:
+		if t <= 0 {
+			return !IsOn(actual)
+		}
+		switch a := actual.(type) {
+		case float64:
+			// Voltages are reported with limited precision, PWM values as integers.
+			return math.Abs(a-t) < 0.1 || math.Round(a) == math.Round(t)
+		case bool:
+			// Heaters in an automatic mode only report true.
+			return a
+		}
+	}
+	return false
+}
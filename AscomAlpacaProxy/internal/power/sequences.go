@@ -0,0 +1,276 @@
+package power
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+// Sequence job states.
+const (
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	conditionPollRate  = 500 * time.Millisecond
+	maxJobHistory      = 20
+)
+
+// JobStatus is a snapshot of a sequence job for progress reporting.
+type JobStatus struct {
+	ID          int       `json:"id"`
+	Sequence    string    `json:"sequence"`
+	Source      string    `json:"source"`
+	State       string    `json:"state"`
+	CurrentStep int       `json:"currentStep"` // 1-based, 0 before the first step
+	TotalSteps  int       `json:"totalSteps"`
+	Message     string    `json:"message"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt,omitempty"`
+}
+
+type sequenceJob struct {
+	status JobStatus
+	cancel chan struct{}
+}
+
+var (
+	jobsMutex sync.Mutex
+	jobs      []*sequenceJob // Most recent last
+	nextJobID = 1
+)
+
+// FindSequence looks up a sequence by name (case-insensitive).
+func FindSequence(name string) (config.Sequence, bool) {
+	for _, seq := range config.Get().Sequences {
+		if strings.EqualFold(seq.Name, name) {
+			return seq, true
+		}
+	}
+	return config.Sequence{}, false
+}
+
+// StartSequence runs a sequence as a background job and returns its initial status.
+// Only one sequence runs at a time; a running sequence is cancelled first.
+func StartSequence(seq config.Sequence, source string) JobStatus {
+	jobsMutex.Lock()
+	for _, job := range jobs {
+		if job.status.State == JobRunning {
+			logger.Info("Sequence: Cancelling running sequence '%s' (job %d) to start '%s'.", job.status.Sequence, job.status.ID, seq.Name)
+			close(job.cancel)
+			job.status.State = JobCancelled
+			job.status.Message = fmt.Sprintf("Superseded by sequence '%s'", seq.Name)
+			job.status.FinishedAt = time.Now()
+		}
+	}
+
+	job := &sequenceJob{
+		status: JobStatus{
+			ID:         nextJobID,
+			Sequence:   seq.Name,
+			Source:     source,
+			State:      JobRunning,
+			TotalSteps: len(seq.Steps),
+			StartedAt:  time.Now(),
+		},
+		cancel: make(chan struct{}),
+	}
+	nextJobID++
+	jobs = append(jobs, job)
+	if len(jobs) > maxJobHistory {
+		jobs = jobs[len(jobs)-maxJobHistory:]
+	}
+	status := job.status
+	jobsMutex.Unlock()
+
+	logger.Info("Sequence: Starting '%s' as job %d (source: %s).", seq.Name, status.ID, source)
+	go runSequence(job, seq)
+	return status
+}
+
+// CancelSequence cancels a running job. An id of 0 cancels whichever sequence is running.
+func CancelSequence(id int) error {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, job := range jobs {
+		if job.status.State == JobRunning && (id == 0 || job.status.ID == id) {
+			close(job.cancel)
+			job.status.State = JobCancelled
+			job.status.Message = "Cancelled by user"
+			job.status.FinishedAt = time.Now()
+			logger.Info("Sequence: Job %d ('%s') cancelled.", job.status.ID, job.status.Sequence)
+			return nil
+		}
+	}
+	if id == 0 {
+		return fmt.Errorf("no sequence is running")
+	}
+	return fmt.Errorf("job %d is not running", id)
+}
+
+// ListJobs returns the status of the recent sequence jobs, most recent first.
+func ListJobs() []JobStatus {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	result := make([]JobStatus, 0, len(jobs))
+	for i := len(jobs) - 1; i >= 0; i-- {
+		result = append(result, jobs[i].status)
+	}
+	return result
+}
+
+// updateJob changes the status of a job unless it has been cancelled in the meantime.
+func updateJob(job *sequenceJob, fn func(s *JobStatus)) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if job.status.State != JobRunning {
+		return false
+	}
+	fn(&job.status)
+	return true
+}
+
+func runSequence(job *sequenceJob, seq config.Sequence) {
+	source := fmt.Sprintf("sequence '%s'", seq.Name)
+
+	for i, step := range seq.Steps {
+		stepNum := i + 1
+		if !updateJob(job, func(s *JobStatus) {
+			s.CurrentStep = stepNum
+			s.Message = fmt.Sprintf("Switching %d output(s)", len(step.Outputs))
+		}) {
+			return
+		}
+
+		logger.Info("Sequence '%s': Step %d/%d.", seq.Name, stepNum, len(seq.Steps))
+		if skipped, err := applyTargets(step.Outputs, source); err != nil {
+			finishJob(job, JobFailed, fmt.Sprintf("Step %d failed: %v", stepNum, err))
+			return
+		} else if len(skipped) > 0 {
+			logger.Warn("Sequence '%s': Step %d skipped disabled outputs %v.", seq.Name, stepNum, skipped)
+		}
+
+		if step.WaitFor != nil {
+			updateJob(job, func(s *JobStatus) { s.Message = "Waiting for condition" })
+			met, cancelled := waitForCondition(job, *step.WaitFor)
+			if cancelled {
+				return
+			}
+			if !met {
+				if step.WaitFor.AbortOnTimeout {
+					finishJob(job, JobFailed, fmt.Sprintf("Step %d: condition not met before timeout", stepNum))
+					return
+				}
+				logger.Warn("Sequence '%s': Step %d condition not met before timeout, continuing.", seq.Name, stepNum)
+			}
+		}
+
+		if step.DelaySeconds > 0 {
+			delay := time.Duration(step.DelaySeconds * float64(time.Second))
+			updateJob(job, func(s *JobStatus) { s.Message = fmt.Sprintf("Waiting %v", delay) })
+			select {
+			case <-job.cancel:
+				return
+			case <-time.After(delay):
+			}
+		}
+	}
+
+	finishJob(job, JobCompleted, "Sequence completed")
+}
+
+func finishJob(job *sequenceJob, state, message string) {
+	if updateJob(job, func(s *JobStatus) {
+		s.State = state
+		s.Message = message
+		s.FinishedAt = time.Now()
+	}) {
+		if state == JobCompleted {
+			logger.Info("Sequence '%s' (job %d): %s.", job.status.Sequence, job.status.ID, message)
+		} else {
+			logger.Error("Sequence '%s' (job %d): %s.", job.status.Sequence, job.status.ID, message)
+		}
+	}
+}
+
+// waitForCondition polls the sensors until the condition holds or its timeout expires.
+// Readings are requested through serial.SendCommand, so they interleave with the regular polling.
+func waitForCondition(job *sequenceJob, cond config.StepCondition) (met bool, cancelled bool) {
+	timeout := defaultWaitTimeout
+	if cond.TimeoutSeconds > 0 {
+		timeout = time.Duration(cond.TimeoutSeconds * float64(time.Second))
+	}
+	deadline := time.Now().Add(timeout)
+	lastCurrent := math.NaN()
+
+	for time.Now().Before(deadline) {
+		select {
+		case <-job.cancel:
+			return false, true
+		case <-time.After(conditionPollRate):
+		}
+
+		voltage, current, err := readPowerSensors()
+		if err != nil {
+			logger.Debug("Sequence: Sensor read failed while waiting: %v", err)
+			continue
+		}
+
+		voltageOK := cond.MinVoltage <= 0 || voltage >= cond.MinVoltage
+		currentOK := cond.CurrentSettled <= 0 || (!math.IsNaN(lastCurrent) && math.Abs(current-lastCurrent) < cond.CurrentSettled)
+		lastCurrent = current
+
+		if voltageOK && currentOK {
+			return true, false
+		}
+	}
+	return false, false
+}
+
+// readPowerSensors requests a fresh sensor reading and returns input voltage (V) and current (A).
+func readPowerSensors() (voltage, current float64, err error) {
+	resp, err := serial.SendCommand(`{"get":"sensors"}`, false, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	var data struct {
+		V *float64 `json:"v"`
+		I *float64 `json:"i"`
+	}
+	if err := json.Unmarshal([]byte(resp), &data); err != nil {
+		return 0, 0, err
+	}
+	if data.V == nil || data.I == nil {
+		return 0, 0, fmt.Errorf("power sensor not available")
+	}
+	// Current is reported in mA
+	return *data.V, *data.I / 1000.0, nil
+}
+
+// MasterPowerSequence returns the sequence configured to replace the Master Power "all" command
+// for the given state. ok is false if none is configured, in which case "all" is used as before.
+func MasterPowerSequence(state bool) (config.Sequence, bool) {
+	conf := config.Get()
+	name := conf.MasterPowerOffSequence
+	if state {
+		name = conf.MasterPowerOnSequence
+	}
+	if name == "" {
+		return config.Sequence{}, false
+	}
+	seq, ok := FindSequence(name)
+	if !ok {
+		logger.Warn("Master Power sequence '%s' not found, using the 'all' command instead.", name)
+	}
+	return seq, ok
+}
@@ -0,0 +1,124 @@
+package power
+
+import (
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	// pendingSourceWindow is how long a set command's source is used for changes of its outputs.
+	// Changes the firmware reports later than that (or without a command) are attributed to the firmware.
+	pendingSourceWindow = 10 * time.Second
+
+	// Sources of changes that were not requested through the power package.
+	SourceFirmware = "firmware" // Detected by the status poll
+	SourceProxy    = "proxy"    // Reported in the response to another command, e.g. a heater mode change
+)
+
+// SwitchEvent is one state change of an output.
+type SwitchEvent struct {
+	Time   time.Time `json:"time"`
+	Output string    `json:"output"` // Internal name, e.g. "dc1"
+	Old    *float64  `json:"old"`    // nil if the output was not reported before
+	New    *float64  `json:"new"`    // nil if the output is no longer reported
+	Source string    `json:"source"`
+}
+
+type pendingSource struct {
+	source  string
+	expires time.Time
+}
+
+var (
+	switchLogMutex     sync.Mutex
+	switchLogListeners []func(SwitchEvent)
+	switchLogOnce      sync.Once
+	pendingSources     = make(map[string]pendingSource) // Keyed by short key
+)
+
+// OnSwitchEvent registers fn to be called for every output state change, whether it was requested
+// through the proxy or detected by the status poll. fn is called from the goroutine that updated the
+// status cache, so it must return quickly.
+func OnSwitchEvent(fn func(SwitchEvent)) {
+	switchLogOnce.Do(func() {
+		serial.OnStatusChange(recordStatusChanges)
+	})
+	switchLogMutex.Lock()
+	defer switchLogMutex.Unlock()
+	switchLogListeners = append(switchLogListeners, fn)
+}
+
+// noteSource remembers the source of a set command for the outputs it addresses (by short key),
+// so the resulting state changes can be attributed to it. "all" addresses every output.
+func noteSource(shortKeys []string, source string) {
+	expires := time.Now().Add(pendingSourceWindow)
+	switchLogMutex.Lock()
+	defer switchLogMutex.Unlock()
+	for _, shortKey := range shortKeys {
+		if shortKey != "all" {
+			pendingSources[shortKey] = pendingSource{source, expires}
+			continue
+		}
+		for key, short := range config.ShortSwitchIDMap {
+			if key != "master_power" {
+				pendingSources[short] = pendingSource{source, expires}
+			}
+		}
+	}
+}
+
+// recordStatusChanges turns status cache changes into switch events for the listeners.
+func recordStatusChanges(t time.Time, changes []serial.StatusChange, polled bool) {
+	outputs := make(map[string]string, len(config.ShortSwitchIDMap))
+	for key, short := range config.ShortSwitchIDMap {
+		if key != "master_power" {
+			outputs[short] = key
+		}
+	}
+
+	var events []SwitchEvent
+	switchLogMutex.Lock()
+	for _, c := range changes {
+		output, ok := outputs[c.Key]
+		if !ok {
+			continue // "dm" and anything that is not an output
+		}
+		event := SwitchEvent{Time: t, Output: output, Old: switchValue(c.Old), New: switchValue(c.New), Source: SourceProxy}
+		if polled {
+			event.Source = SourceFirmware
+		}
+		if p, ok := pendingSources[c.Key]; ok {
+			if t.Before(p.expires) {
+				event.Source = p.source
+			}
+			delete(pendingSources, c.Key)
+		}
+		events = append(events, event)
+	}
+	listeners := append([]func(SwitchEvent){}, switchLogListeners...)
+	switchLogMutex.Unlock()
+
+	for _, event := range events {
+		for _, fn := range listeners {
+			fn(event)
+		}
+	}
+}
+
+// switchValue converts a status value to a number: booleans become 1/0, PWM % and voltages are kept.
+func switchValue(val interface{}) *float64 {
+	var f float64
+	switch v := val.(type) {
+	case bool:
+		if v {
+			f = 1
+		}
+	case float64:
+		f = v
+	default:
+		return nil
+	}
+	return &f
+}
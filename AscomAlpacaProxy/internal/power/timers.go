@@ -0,0 +1,237 @@
+package power
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+// Timer modes.
+const (
+	// TimerFor sets the output to State now and reverts it when the timer expires
+	// ("DC4 on for 20 minutes", "pulse USB345 off for 10 s").
+	TimerFor = "for"
+	// TimerAfter leaves the output untouched and sets it to State when the timer expires (delayed on/off).
+	TimerAfter = "after"
+)
+
+const (
+	timerStateFile = "timers"
+	timerTickRate  = time.Second
+)
+
+// OutputTimer is a pending timed action on a physical output. Timers are persisted and survive restarts.
+type OutputTimer struct {
+	Output    string    `json:"output"` // Internal output name, e.g. "dc4"
+	Mode      string    `json:"mode"`   // TimerFor or TimerAfter
+	State     bool      `json:"state"`  // State set for the duration (TimerFor) or at expiry (TimerAfter)
+	ExpiresAt time.Time `json:"expiresAt"`
+	Source    string    `json:"source"`
+}
+
+// FinalState is the state the output is switched to when the timer expires.
+func (t OutputTimer) FinalState() bool {
+	if t.Mode == TimerFor {
+		return !t.State
+	}
+	return t.State
+}
+
+// TimerStatus is an OutputTimer with its remaining time, as reported by the status API.
+type TimerStatus struct {
+	OutputTimer
+	RemainingSeconds float64 `json:"remainingSeconds"`
+}
+
+var (
+	timersMutex sync.Mutex
+	timers      = make(map[string]*OutputTimer) // Keyed by internal output name
+	timersOnce  sync.Once
+)
+
+// StartTimers loads the persisted timers and starts the background loop that executes them.
+// Timers that expired while the proxy was not running are executed as soon as the device is reachable.
+func StartTimers() {
+	timersOnce.Do(func() {
+		var saved []OutputTimer
+		if err := config.LoadState(timerStateFile, &saved); err != nil {
+			logger.Warn("Timers: %v", err)
+		}
+		timersMutex.Lock()
+		for i := range saved {
+			t := saved[i]
+			timers[t.Output] = &t
+			logger.Info("Timers: Restored timer for '%s' (switches %s at %s).", t.Output, onOff(t.FinalState()), t.ExpiresAt.Format(time.RFC3339))
+		}
+		timersMutex.Unlock()
+
+		go timerLoop()
+	})
+}
+
+// StartTimer sets up a timed action on an output. In TimerFor mode the output is switched to state immediately.
+// An existing timer on the same output is replaced. Outputs are switched through SetOutput, so dependencies
+// and interlocks apply as for any other switch request.
+func StartTimer(output, mode string, state bool, duration time.Duration, source string) (TimerStatus, error) {
+	if err := ValidateTimer(output, mode, duration); err != nil {
+		return TimerStatus{}, err
+	}
+	if mode == TimerFor {
+		if err := SetOutput(output, state, nil, source); err != nil {
+			return TimerStatus{}, err
+		}
+	}
+	return ArmTimer(output, mode, state, duration, source)
+}
+
+// ArmTimer registers a timer without switching the output now. It is used when the caller
+// has already applied the initial state itself, e.g. the Alpaca SetSwitchValue handler.
+func ArmTimer(output, mode string, state bool, duration time.Duration, source string) (TimerStatus, error) {
+	if err := ValidateTimer(output, mode, duration); err != nil {
+		return TimerStatus{}, err
+	}
+	t := &OutputTimer{
+		Output:    output,
+		Mode:      mode,
+		State:     state,
+		ExpiresAt: time.Now().Add(duration),
+		Source:    source,
+	}
+
+	timersMutex.Lock()
+	timers[output] = t
+	saveTimersLocked()
+	timersMutex.Unlock()
+
+	logger.Info("Timers: '%s' switches %s in %v (source: %s).", output, onOff(t.FinalState()), duration.Round(time.Second), source)
+	return t.status(time.Now()), nil
+}
+
+// CancelTimer removes the timer of an output. It returns false if the output has no timer.
+func CancelTimer(output string) bool {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	if _, ok := timers[output]; !ok {
+		return false
+	}
+	delete(timers, output)
+	saveTimersLocked()
+	logger.Info("Timers: Timer for '%s' cancelled.", output)
+	return true
+}
+
+// ListTimers returns all pending timers ordered by expiry.
+func ListTimers() []TimerStatus {
+	now := time.Now()
+	timersMutex.Lock()
+	result := make([]TimerStatus, 0, len(timers))
+	for _, t := range timers {
+		result = append(result, t.status(now))
+	}
+	timersMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].ExpiresAt.Before(result[j].ExpiresAt) })
+	return result
+}
+
+// GetTimer returns the pending timer of an output, if any.
+func GetTimer(output string) (TimerStatus, bool) {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	t, ok := timers[output]
+	if !ok {
+		return TimerStatus{}, false
+	}
+	return t.status(time.Now()), true
+}
+
+func (t *OutputTimer) status(now time.Time) TimerStatus {
+	remaining := math.Max(0, t.ExpiresAt.Sub(now).Seconds())
+	return TimerStatus{OutputTimer: *t, RemainingSeconds: math.Round(remaining)}
+}
+
+// ValidateTimer checks a timer before it is started. Callers that switch the output themselves
+// use it to reject an invalid timer before anything is switched.
+func ValidateTimer(output, mode string, duration time.Duration) error {
+	if mode != TimerFor && mode != TimerAfter {
+		return fmt.Errorf("invalid timer mode '%s' (use '%s' or '%s')", mode, TimerFor, TimerAfter)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("timer duration must be positive")
+	}
+	for _, key := range ActiveOutputs() {
+		if key == output {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' is not an active output", output)
+}
+
+// timerLoop executes expired timers. If the device is not reachable, the timer is kept and retried.
+func timerLoop() {
+	ticker := time.NewTicker(timerTickRate)
+	defer ticker.Stop()
+	failing := make(map[string]bool)
+
+	for range ticker.C {
+		now := time.Now()
+		var due []OutputTimer
+		timersMutex.Lock()
+		for _, t := range timers {
+			if !now.Before(t.ExpiresAt) {
+				due = append(due, *t)
+			}
+		}
+		timersMutex.Unlock()
+
+		for _, t := range due {
+			if _, ok := config.ShortSwitchIDMap[t.Output]; !ok {
+				logger.Warn("Timers: Dropping timer for unknown output '%s'.", t.Output)
+				removeTimer(t)
+				continue
+			}
+			source := fmt.Sprintf("timer (%s)", t.Source)
+			if err := SetOutput(t.Output, t.FinalState(), nil, source); err != nil {
+				if !failing[t.Output] {
+					logger.Warn("Timers: Could not switch '%s' %s, will retry: %v", t.Output, onOff(t.FinalState()), err)
+					failing[t.Output] = true
+				}
+				continue
+			}
+			delete(failing, t.Output)
+			logger.Info("Timers: '%s' switched %s.", t.Output, onOff(t.FinalState()))
+			removeTimer(t)
+		}
+	}
+}
+
+// removeTimer deletes an executed timer unless it has been replaced in the meantime.
+func removeTimer(t OutputTimer) {
+	timersMutex.Lock()
+	defer timersMutex.Unlock()
+	if current, ok := timers[t.Output]; ok && current.ExpiresAt.Equal(t.ExpiresAt) {
+		delete(timers, t.Output)
+		saveTimersLocked()
+	}
+}
+
+// saveTimersLocked persists the pending timers. The caller must hold timersMutex.
+func saveTimersLocked() {
+	list := make([]OutputTimer, 0, len(timers))
+	for _, t := range timers {
+		list = append(list, *t)
+	}
+	if err := config.SaveState(timerStateFile, list); err != nil {
+		logger.Error("Timers: Failed to persist timers: %v", err)
+	}
+}
+
+func onOff(state bool) string {
+	if state {
+		return "ON"
+	}
+	return "OFF"
+}
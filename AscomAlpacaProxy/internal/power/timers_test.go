@@ -0,0 +1,73 @@
+package power
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateTimer(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		mode     string
+		duration time.Duration
+		wantErr  bool
+	}{
+		{"for", "dc4", TimerFor, 20 * time.Minute, false},
+		{"after", "usb345", TimerAfter, 10 * time.Second, false},
+		{"unknown mode", "dc4", "until", time.Minute, true},
+		{"zero duration", "dc4", TimerFor, 0, true},
+		{"negative duration", "dc4", TimerFor, -time.Second, true},
+		{"master power", "master_power", TimerFor, time.Minute, true},
+		{"sensor", "sensor_voltage", TimerFor, time.Minute, true},
+		{"unknown output", "dc9", TimerFor, time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTimer(tt.output, tt.mode, tt.duration)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateTimer(%q, %q, %v) error = %v, wantErr %v", tt.output, tt.mode, tt.duration, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimerFinalState(t *testing.T) {
+	tests := []struct {
+		mode  string
+		state bool
+		want  bool
+	}{
+		{TimerFor, true, false},
+		{TimerFor, false, true},
+		{TimerAfter, true, true},
+		{TimerAfter, false, false},
+	}
+	for _, tt := range tests {
+		timer := OutputTimer{Output: "dc4", Mode: tt.mode, State: tt.state}
+		if got := timer.FinalState(); got != tt.want {
+			t.Errorf("FinalState of %s %v = %v, want %v", tt.mode, tt.state, got, tt.want)
+		}
+	}
+}
+
+func TestTimerRemainingSeconds(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		expiresAt time.Time
+		want      float64
+	}{
+		{"pending", now.Add(90*time.Second + 400*time.Millisecond), 90},
+		{"rounded up", now.Add(1600 * time.Millisecond), 2},
+		{"expired", now.Add(-time.Minute), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timer := &OutputTimer{Output: "dc4", Mode: TimerFor, ExpiresAt: tt.expiresAt}
+			if got := timer.status(now).RemainingSeconds; got != tt.want {
+				t.Errorf("RemainingSeconds = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package serial
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheSnapshot is a copy of the status and sensor caches taken after a completed update cycle.
+type CacheSnapshot struct {
+	Time       time.Time
+	Status     map[string]interface{} // Same keys as Status.Data
+	Conditions map[string]interface{} // Same keys as Conditions.Data
+}
+
+// StatusChange is one status key whose value differs between two consecutive status updates.
+// Old is nil if the key was not reported before, New is nil if it is no longer reported.
+type StatusChange struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+var (
+	cacheListenersMutex sync.Mutex
+	cacheListeners      []func(CacheSnapshot)
+	changeListeners     []func(t time.Time, changes []StatusChange, polled bool)
+	setListeners        []func(t time.Time, command string)
+
+	// commandFilter checks every command before it is queued (see SetCommandFilter).
+	commandFilter func(command string) error
+)
+
+// SetCommandFilter installs a check that every command passes before it is sent to the device,
+// whatever path it comes from. A command the filter rejects is not sent and SendCommand returns
+// the filter's error. It must be called during initialization, before any command is sent.
+func SetCommandFilter(fn func(command string) error) {
+	commandFilter = fn
+}
+
+// OnCacheUpdate registers fn to be called after every successful cache update cycle
+// (every few seconds while the device is connected). Listeners are called one after another
+// from the polling goroutine, so they must return quickly and hand slow work to a goroutine.
+func OnCacheUpdate(fn func(CacheSnapshot)) {
+	cacheListenersMutex.Lock()
+	defer cacheListenersMutex.Unlock()
+	cacheListeners = append(cacheListeners, fn)
+}
+
+// OnStatusChange registers fn to be called whenever a status update changes any value.
+// polled is true if the change was seen by the periodic status poll, false if it came with
+// the response to a command sent by the proxy. The same rules as for OnCacheUpdate apply.
+func OnStatusChange(fn func(t time.Time, changes []StatusChange, polled bool)) {
+	cacheListenersMutex.Lock()
+	defer cacheListenersMutex.Unlock()
+	changeListeners = append(changeListeners, fn)
+}
+
+// OnSetCommand registers fn to be called after the device has answered a "set" command, whichever
+// part of the proxy sent it. fn is called from the sending goroutine, so it must return quickly.
+func OnSetCommand(fn func(t time.Time, command string)) {
+	cacheListenersMutex.Lock()
+	defer cacheListenersMutex.Unlock()
+	setListeners = append(setListeners, fn)
+}
+
+// notifySetCommand passes a completed "set" command to all registered listeners.
+func notifySetCommand(command string) {
+	if !strings.Contains(command, `"set"`) {
+		return
+	}
+	cacheListenersMutex.Lock()
+	listeners := append([]func(time.Time, string){}, setListeners...)
+	cacheListenersMutex.Unlock()
+	t := time.Now()
+	for _, fn := range listeners {
+		fn(t, command)
+	}
+}
+
+// diffStatus returns the keys whose values differ between two status maps.
+// Nothing is reported for the first status after startup (old is nil).
+func diffStatus(old, new map[string]interface{}) []StatusChange {
+	if old == nil {
+		return nil
+	}
+	var changes []StatusChange
+	for k, v := range new {
+		if prev, ok := old[k]; !ok || !reflect.DeepEqual(prev, v) {
+			changes = append(changes, StatusChange{Key: k, Old: old[k], New: v})
+		}
+	}
+	for k, v := range old {
+		if _, ok := new[k]; !ok {
+			changes = append(changes, StatusChange{Key: k, Old: v})
+		}
+	}
+	return changes
+}
+
+// notifyStatusChange passes detected status changes to all registered listeners.
+func notifyStatusChange(t time.Time, changes []StatusChange, polled bool) {
+	if len(changes) == 0 {
+		return
+	}
+	cacheListenersMutex.Lock()
+	listeners := append([]func(time.Time, []StatusChange, bool){}, changeListeners...)
+	cacheListenersMutex.Unlock()
+	for _, fn := range listeners {
+		fn(t, changes, polled)
+	}
+}
+
+// notifyCacheListeners passes a snapshot of the caches to all registered listeners.
+func notifyCacheListeners() {
+	cacheListenersMutex.Lock()
+	listeners := append([]func(CacheSnapshot){}, cacheListeners...)
+	cacheListenersMutex.Unlock()
+	if len(listeners) == 0 {
+		return
+	}
+
+	snapshot := CacheSnapshot{Time: time.Now()}
+	Status.RLock()
+	snapshot.Status = make(map[string]interface{}, len(Status.Data))
+	for k, v := range Status.Data {
+		snapshot.Status[k] = v
+	}
+	Status.RUnlock()
+	Conditions.RLock()
+	snapshot.Conditions = make(map[string]interface{}, len(Conditions.Data))
+	for k, v := range Conditions.Data {
+		snapshot.Conditions[k] = v
+	}
+	Conditions.RUnlock()
+
+	for _, fn := range listeners {
+		fn(snapshot)
+	}
+}
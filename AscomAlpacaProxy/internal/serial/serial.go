@@ -124,6 +124,11 @@ func GetFirmwareVersion() string {
 
 // SendCommand queues a command to be sent to the device.
 func SendCommand(command string, isHighPriority bool, timeout time.Duration) (string, error) {
+	if commandFilter != nil {
+		if err := commandFilter(command); err != nil {
+			return "", err
+		}
+	}
 	if timeout == 0 {
 		timeout = 3 * time.Second // Default timeout
 	}
@@ -148,6 +153,7 @@ func SendCommand(command string, isHighPriority bool, timeout time.Duration) (st
 
 	select {
 	case response := <-responseChan:
+		notifySetCommand(command)
 		return response, nil
 	case err := <-errorChan:
 		return "", err
@@ -540,6 +546,7 @@ func periodicCacheUpdater(initDone chan struct{}) {
 
 func performCacheUpdate() {
 	logger.Debug("Performing on-demand cache update.")
+	statusUpdated, conditionsUpdated := false, false
 	statusJSON, err := SendCommand(`{"get":"status"}`, false, 0)
 	if err == nil {
 		var rootData map[string]interface{}
@@ -556,6 +563,7 @@ func performCacheUpdate() {
 					statusMap["dm"] = dmVal
 				}
 
+				changes := diffStatus(Status.Data, statusMap)
 				Status.Data = statusMap
 
 				// Sync ActiveVoltageTarget from firmware report if available
@@ -567,6 +575,8 @@ func performCacheUpdate() {
 					}
 				}
 				Status.Unlock()
+				notifyStatusChange(time.Now(), changes, true)
+				statusUpdated = true
 			} else {
 				logger.Warn("Status JSON missing 'status' object")
 			}
@@ -585,6 +595,7 @@ func performCacheUpdate() {
 			Conditions.Data = conditionsData
 			logMemoryStatus(conditionsData)
 			Conditions.Unlock()
+			conditionsUpdated = true
 			logger.Debug("Successfully unmarshaled conditions cache data.")
 		} else {
 			logger.Warn("Failed to unmarshal conditions JSON from device. Raw data: %s", conditionsJSON)
@@ -592,6 +603,36 @@ func performCacheUpdate() {
 	} else {
 		logger.Warn("Failed to get conditions for cache update: %v", err)
 	}
+
+	if statusUpdated && conditionsUpdated {
+		notifyCacheListeners()
+	}
+}
+
+// UpdateStatusFromResponse stores the status block returned by a "set" command in the cache.
+// The "dm" (Dew Mode) array is not part of "set" responses, so the cached one is preserved.
+func UpdateStatusFromResponse(responseJSON string) {
+	var rootData map[string]interface{}
+	if json.Unmarshal([]byte(responseJSON), &rootData) != nil {
+		logger.Warn("Failed to unmarshal status JSON from device after set command. Raw data: %s", responseJSON)
+		return
+	}
+	statusMap, ok := rootData["status"].(map[string]interface{})
+	if !ok {
+		logger.Warn("Status JSON missing 'status' object after set command.")
+		return
+	}
+
+	Status.Lock()
+	if dmVal, found := rootData["dm"]; found {
+		statusMap["dm"] = dmVal
+	} else if existingDM, exists := Status.Data["dm"]; exists {
+		statusMap["dm"] = existingDM
+	}
+	changes := diffStatus(Status.Data, statusMap)
+	Status.Data = statusMap
+	Status.Unlock()
+	notifyStatusChange(time.Now(), changes, false)
 }
 
 func FetchFirmwareVersion() {
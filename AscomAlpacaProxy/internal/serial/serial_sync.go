@@ -104,10 +104,28 @@ func SyncFirmwareConfig() {
 		currentID++
 	}
 
-	// 3. Master Power (Always Last)
+	// 3. Master Power
 	if config.Get().EnableMasterPower {
 		newIDMap[currentID] = "master_power"
 		newShortKeyByID[currentID] = "all"
+		currentID++
+	}
+
+	// 4. Battery estimates (before the groups, so their IDs do not depend on the number of groups)
+	if config.Get().Battery.Enabled {
+		for _, key := range []string{config.SensorBatterySoCKey, config.SensorBatteryRuntimeKey} {
+			newIDMap[currentID] = key
+			newShortKeyByID[currentID] = key
+			currentID++
+		}
+	}
+
+	// 5. Virtual Switches (user-defined output groups, last so adding one does not renumber anything else)
+	for i := range config.Get().VirtualSwitches {
+		key := config.VirtualSwitchKey(i)
+		newIDMap[currentID] = key
+		newShortKeyByID[currentID] = key
+		currentID++
 	}
 
 	// Update Global Config with mutex protection
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"sv241pro-alpaca-proxy/internal/handlers"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/logstream"
+	"sv241pro-alpaca-proxy/internal/power"
 	"sv241pro-alpaca-proxy/internal/serial"
 	"sv241pro-alpaca-proxy/internal/telemetry"
 )
@@ -85,7 +87,50 @@ func setupRoutes(frontendFS fs.FS, appVersion string) {
 	http.HandleFunc("/api/v1/telemetry/dates", telemetry.HandleGetLogDates)
 	http.HandleFunc("/api/v1/telemetry/history", telemetry.HandleGetHistory)
 	http.HandleFunc("/api/v1/telemetry/download", telemetry.HandleDownloadCSV)
+	http.HandleFunc("/api/v1/telemetry/thermostats", telemetry.HandleGetThermostatHistory)
+	http.HandleFunc("/api/v1/telemetry/series", telemetry.HandleGetSeries)
+	http.HandleFunc("/api/v1/telemetry/rollups", telemetry.HandleRollups)
+	http.HandleFunc("/api/v1/telemetry/switchevents", telemetry.HandleGetSwitchEvents)
+	http.HandleFunc("/api/v1/telemetry/ontime", telemetry.HandleGetOnTime)
+	http.HandleFunc("/api/v1/telemetry/energy", telemetry.HandleGetEnergy)
+	http.HandleFunc("/api/v1/telemetry/energy/nights", telemetry.HandleGetNightlyEnergy)
+	http.HandleFunc("/api/v1/telemetry/energy/settings", telemetry.HandleEnergySettings)
+	http.HandleFunc("/api/v1/telemetry/bursts", telemetry.HandleGetBursts)
+	http.HandleFunc("/api/v1/telemetry/bursts/detail", telemetry.HandleGetBurst)
+	http.HandleFunc("/api/v1/telemetry/bursts/trigger", telemetry.HandleTriggerBurst)
+	http.HandleFunc("/api/v1/telemetry/bursts/settings", telemetry.HandleBurstSettings)
 	http.HandleFunc("/api/v1/log/download", handleDownloadLog)
+	http.HandleFunc("/api/v1/groups", handlers.HandleVirtualSwitches)
+	http.HandleFunc("/api/v1/groups/set", handlers.HandleSetVirtualSwitch)
+	http.HandleFunc("/api/v1/scenes", handlers.HandleScenes)
+	http.HandleFunc("/api/v1/scenes/apply", handlers.HandleApplyScene)
+	http.HandleFunc("/api/v1/sequences", handlers.HandleSequences)
+	http.HandleFunc("/api/v1/sequences/run", handlers.HandleRunSequence)
+	http.HandleFunc("/api/v1/sequences/jobs", handlers.HandleSequenceJobs)
+	http.HandleFunc("/api/v1/sequences/cancel", handlers.HandleCancelSequence)
+	http.HandleFunc("/api/v1/timers", handlers.HandleTimers)
+	http.HandleFunc("/api/v1/timers/cancel", handlers.HandleCancelTimer)
+	http.HandleFunc("/api/v1/heaters/boost", handlers.HandleBoosts)
+	http.HandleFunc("/api/v1/heaters/boost/cancel", handlers.HandleCancelBoost)
+	http.HandleFunc("/api/v1/site", handlers.HandleSite)
+	http.HandleFunc("/api/v1/astro/twilight", handlers.HandleTwilight)
+	http.HandleFunc("/api/v1/astro/now", handlers.HandleAstroNow)
+	http.HandleFunc("/api/v1/schedules", handlers.HandleSchedules)
+	http.HandleFunc("/api/v1/schedules/history", handlers.HandleScheduleHistory)
+	http.HandleFunc("/api/v1/schedules/run", handlers.HandleRunSchedule)
+	http.HandleFunc("/api/v1/rules", handlers.HandleRules)
+	http.HandleFunc("/api/v1/rules/history", handlers.HandleRuleHistory)
+	http.HandleFunc("/api/v1/loadshedding", handlers.HandleLoadShedding)
+	http.HandleFunc("/api/v1/loadshedding/restore", handlers.HandleRestoreShedOutputs)
+	http.HandleFunc("/api/v1/powerbudget", handlers.HandlePowerBudget)
+	http.HandleFunc("/api/v1/battery", handlers.HandleBattery)
+	http.HandleFunc("/api/v1/battery/reset", handlers.HandleBatteryReset)
+	http.HandleFunc("/api/v1/loadprofiles", handlers.HandleLoadProfiles)
+	http.HandleFunc("/api/v1/loadprofiles/reset", handlers.HandleResetLoadProfiles)
+	http.HandleFunc("/api/v1/interlocks", handlers.HandleInterlocks)
+	http.HandleFunc("/api/v1/dependencies", handlers.HandleDependencies)
+	http.HandleFunc("/api/v1/thermostats", handlers.HandleThermostats)
+	http.HandleFunc("/api/v1/dewguard", handlers.HandleDewGuard)
 	http.HandleFunc("/api/serial/release", handleSerialRelease)
 	http.HandleFunc("/api/serial/resume", handleSerialResume)
 
@@ -233,15 +278,34 @@ func handleSetFirmwareConfig(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprint(w, resp)
 }
 
+// handleGetPowerStatus returns the device status cache. With ?timers=true the pending output timers
+// are added under "timers", keyed by short key like the outputs themselves; this is opt-in so clients
+// that treat every key as a status value are not affected.
 func handleGetPowerStatus(w http.ResponseWriter, r *http.Request) {
+	withTimers, _ := strconv.ParseBool(r.URL.Query().Get("timers"))
+
 	serial.Status.RLock()
-	defer serial.Status.RUnlock()
 	if serial.Status.Data == nil {
+		serial.Status.RUnlock()
 		http.Error(w, "Status cache is not yet populated", http.StatusServiceUnavailable)
 		return
 	}
+	status := make(map[string]interface{}, len(serial.Status.Data)+1)
+	for k, v := range serial.Status.Data {
+		status[k] = v
+	}
+	serial.Status.RUnlock()
+
+	if withTimers {
+		timers := make(map[string]power.TimerStatus)
+		for _, t := range power.ListTimers() {
+			timers[config.ShortSwitchIDMap[t.Output]] = t
+		}
+		status["timers"] = timers
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(serial.Status.Data)
+	json.NewEncoder(w).Encode(status)
 }
 
 func handleSetAllPower(w http.ResponseWriter, r *http.Request) {
@@ -253,22 +317,19 @@ func handleSetAllPower(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if seq, ok := power.MasterPowerSequence(payload.State); ok {
+		power.StartSequence(seq, "Web UI")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	stateInt := 0
 	if payload.State {
 		stateInt = 1
 	}
-	command := fmt.Sprintf(`{"set":{"all":%d}}`, stateInt)
-	responseJSON, err := serial.SendCommand(command, true, 0)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
+	if _, err := power.Set(map[string]interface{}{"all": stateInt}, "Web UI"); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), handlers.SetErrorStatus(err))
 		return
 	}
-	var statusData map[string]map[string]interface{}
-	if json.Unmarshal([]byte(responseJSON), &statusData) == nil {
-		serial.Status.Lock()
-		serial.Status.Data = statusData["status"]
-		serial.Status.Unlock()
-	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -322,7 +383,7 @@ func handleDeviceCommand(w http.ResponseWriter, r *http.Request) {
 	// Use a timeout that's appropriate for commands that might take a moment.
 	resp, err := serial.SendCommand(commandJSON, true, 5*time.Second)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
+		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), handlers.SetErrorStatus(err))
 		return
 	}
 
@@ -427,6 +488,45 @@ func handleRestoreBackup(w http.ResponseWriter, r *http.Request) {
 	conf.EnableAlpacaVoltageControl = backup.ProxyConfig.EnableAlpacaVoltageControl
 	conf.EnableMasterPower = backup.ProxyConfig.EnableMasterPower
 	conf.AutoDetectPort = backup.ProxyConfig.AutoDetectPort
+	conf.VirtualSwitches = backup.ProxyConfig.VirtualSwitches
+	conf.Scenes = backup.ProxyConfig.Scenes
+	conf.Sequences = backup.ProxyConfig.Sequences
+	conf.MasterPowerOnSequence = backup.ProxyConfig.MasterPowerOnSequence
+	conf.MasterPowerOffSequence = backup.ProxyConfig.MasterPowerOffSequence
+	conf.Schedules = backup.ProxyConfig.Schedules
+	conf.Rules = backup.ProxyConfig.Rules
+	conf.Thermostats = backup.ProxyConfig.Thermostats
+	conf.RollupRetention = backup.ProxyConfig.RollupRetention
+	if err := config.ValidateLoadShedding(backup.ProxyConfig.LoadShedding); err == nil {
+		conf.LoadShedding = backup.ProxyConfig.LoadShedding
+	}
+	if err := config.ValidatePowerBudget(backup.ProxyConfig.PowerBudget); err == nil {
+		conf.PowerBudget = backup.ProxyConfig.PowerBudget
+	}
+	if err := config.ValidateEnergy(backup.ProxyConfig.Energy); err == nil {
+		conf.Energy = backup.ProxyConfig.Energy
+	}
+	if err := config.ValidateBattery(backup.ProxyConfig.Battery); err == nil {
+		conf.Battery = backup.ProxyConfig.Battery
+	}
+	if err := config.ValidateLoadProfiles(backup.ProxyConfig.LoadProfiles); err == nil {
+		conf.LoadProfiles = backup.ProxyConfig.LoadProfiles
+	}
+	if err := config.ValidateBurstSampling(backup.ProxyConfig.BurstSampling); err == nil {
+		conf.BurstSampling = backup.ProxyConfig.BurstSampling
+	}
+	if err := config.ValidateDewGuard(backup.ProxyConfig.DewGuard); err == nil {
+		conf.DewGuard = backup.ProxyConfig.DewGuard
+	}
+	if err := config.ValidateInterlocks(backup.ProxyConfig.Interlocks); err == nil {
+		conf.Interlocks = backup.ProxyConfig.Interlocks
+	}
+	if err := config.ValidateDependencies(backup.ProxyConfig.Dependencies); err == nil {
+		conf.Dependencies = backup.ProxyConfig.Dependencies
+	}
+	if err := config.ValidateSite(backup.ProxyConfig.Site); err == nil {
+		conf.Site = backup.ProxyConfig.Site // Older backups have no site; keep the current one then
+	}
 	conf.SerialPortName = "" // Clear port to trigger auto-detection
 	logger.Info("Serial port name cleared to trigger auto-detection.")
 	logger.SetLevelFromString(conf.LogLevel)
@@ -143,8 +143,8 @@ func ShowNotification(title, message string) {
 	}
 }
 
-// listenForComPortEvents waits for status updates from the serial manager
-// and shows notifications accordingly.
+// listenForComPortEvents waits for status updates from the serial manager and for
+// notifications from the automation features, and shows notifications accordingly.
 func listenForComPortEvents() {
 	logger.Info("Systray is now listening for COM port connection events.")
 	go func() {
@@ -158,4 +158,9 @@ func listenForComPortEvents() {
 		}
 		logger.Info("Systray stopped listening for COM port events.")
 	}()
+	go func() {
+		for n := range events.NotificationChan {
+			go ShowNotification(n.Title, n.Message)
+		}
+	}()
 }
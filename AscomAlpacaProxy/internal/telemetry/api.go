@@ -1,6 +1,7 @@
 package telemetry
 
 import (
+	"database/sql"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
@@ -14,120 +15,430 @@ import (
 	"sv241pro-alpaca-proxy/internal/logger"
 )
 
+// DataPoint is one record in the fixed layout used by the web interface.
+// Values are nil (JSON null) where no valid reading was recorded, e.g. for a disconnected sensor,
+// a failed poll or a disabled output.
 type DataPoint struct {
-	Timestamp int64   `json:"t"`
-	Voltage   float64 `json:"v"`
-	Current   float64 `json:"c"`
-	Power     float64 `json:"p"`
-	TempAmb   float64 `json:"temp"`
-	HumAmb    float64 `json:"hum"`
-	DewPoint  float64 `json:"dew"`
-	TempLens  float64 `json:"lens"`
-	PWM1      int     `json:"pwm1"`
-	PWM2      int     `json:"pwm2"`
-	DC1       int     `json:"dc1"`
-	DC2       int     `json:"dc2"`
-	DC3       int     `json:"dc3"`
-	DC4       int     `json:"dc4"`
-	DC5       int     `json:"dc5"`
-	USBC12    int     `json:"usbc12"`
-	USB345    int     `json:"usb345"`
-	AdjConv   float64 `json:"adj_conv"`
+	Timestamp int64    `json:"t"`
+	Voltage   *float64 `json:"v"`
+	Current   *float64 `json:"c"`
+	Power     *float64 `json:"p"`
+	TempAmb   *float64 `json:"temp"`
+	HumAmb    *float64 `json:"hum"`
+	DewPoint  *float64 `json:"dew"`
+	TempLens  *float64 `json:"lens"`
+	PWM1      *int     `json:"pwm1"`
+	PWM2      *int     `json:"pwm2"`
+	DC1       *int     `json:"dc1"`
+	DC2       *int     `json:"dc2"`
+	DC3       *int     `json:"dc3"`
+	DC4       *int     `json:"dc4"`
+	DC5       *int     `json:"dc5"`
+	USBC12    *int     `json:"usbc12"`
+	USB345    *int     `json:"usb345"`
+	AdjConv   *float64 `json:"adj_conv"`
+	PWM1Limit float64  `json:"pwm1_limit"` // Power budget limit in % (100 = not throttled)
+	PWM2Limit float64  `json:"pwm2_limit"`
+}
+
+// legacySeries maps the DataPoint fields and legacy CSV column keys to series names.
+var legacySeries = []struct{ key, series string }{
+	{"voltage", "v"}, {"current", "i"}, {"power", "p"},
+	{"t_amb", "t_amb"}, {"h_amb", "h_amb"}, {"dew_point", "d"}, {"t_lens", "t_lens"},
+	{"pwm1", "pwm1"}, {"pwm2", "pwm2"},
+	{"dc1", "status.d1"}, {"dc2", "status.d2"}, {"dc3", "status.d3"}, {"dc4", "status.d4"}, {"dc5", "status.d5"},
+	{"usbc12", "status.u12"}, {"usb345", "status.u34"}, {"adj_conv", "status.adj"},
+	{"pwm1_limit", "proxy.pwm1_limit"}, {"pwm2_limit", "proxy.pwm2_limit"},
+}
+
+// legacySeriesNames returns the series that make up a DataPoint.
+func legacySeriesNames() []string {
+	names := make([]string, 0, len(legacySeries))
+	for _, l := range legacySeries {
+		names = append(names, l.series)
+	}
+	return names
+}
+
+// seriesParam splits a comma-separated list of series names. Legacy CSV column keys are translated.
+func seriesParam(param string) []string {
+	var names []string
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		for _, l := range legacySeries {
+			if l.key == name {
+				name = l.series
+				break
+			}
+		}
+		names = append(names, name)
+	}
+	return names
 }
 
 // HandleGetHistory reads from the DB and returns JSON data.
+// Without ?series= the fixed DataPoint layout is returned. With ?series=v,status.d1,... (or "all"),
+// each point is an object with "t" and the values of the requested series that were recorded.
+// With ?bucket= or ?points= the samples are aggregated (see handleAggregatedHistory).
 func HandleGetHistory(w http.ResponseWriter, r *http.Request) {
+	start, end, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seriesQuery := r.URL.Query().Get("series")
+	series := legacySeriesNames()
+	if seriesQuery == "all" {
+		series = nil
+	} else if seriesQuery != "" {
+		series = seriesParam(seriesQuery)
+	}
+
+	if r.URL.Query().Get("bucket") != "" || r.URL.Query().Get("points") != "" {
+		handleAggregatedHistory(w, r, start, end, series)
+		return
+	}
+
+	records, err := database.GetHistory(start, end, series)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Downsampling if too many points
+	// If more than 2000 points, take every Nth
+	count := len(records)
+	step := 1
+	if count > 2000 {
+		step = count / 2000
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if seriesQuery != "" {
+		result := make([]map[string]interface{}, 0, count/step+1)
+		for i := 0; i < count; i += step {
+			point := map[string]interface{}{"t": records[i].Timestamp}
+			for _, name := range series {
+				point[name] = nil // Requested but not recorded at this time
+			}
+			for name, value := range records[i].Values {
+				point[name] = value
+			}
+			result = append(result, point)
+		}
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+
+	var result []DataPoint
+	for i := 0; i < count; i += step {
+		result = append(result, toDataPoint(records[i]))
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+const (
+	defaultHistoryPoints = 2000
+	maxHistoryPoints     = 20000
+)
+
+// AggregatedHistory is the columnar response of an aggregated history query. T holds the start of
+// every bucket that contains data; the columns of each series are aligned with T and are null where
+// the series has no valid value in a bucket.
+type AggregatedHistory struct {
+	Start      int64                     `json:"start"`
+	End        int64                     `json:"end"`
+	Bucket     int64                     `json:"bucket"`     // Seconds
+	Resolution int64                     `json:"resolution"` // Rollup resolution used in seconds, 0 = raw samples
+	T          []int64                   `json:"t"`
+	Series     map[string]*SeriesColumns `json:"series"`
+}
+
+// SeriesColumns holds the requested aggregates of one series, one entry per bucket.
+type SeriesColumns struct {
+	Min   []*float64 `json:"min,omitempty"`
+	Max   []*float64 `json:"max,omitempty"`
+	Avg   []*float64 `json:"avg,omitempty"`
+	Last  []*float64 `json:"last,omitempty"`
+	Count []int      `json:"count"`
+}
+
+// handleAggregatedHistory returns min/max/avg/last per bucket, computed in SQL from the raw samples
+// or, for buckets of a minute or more, from the rollups (see database.GetAggregatedHistory). The bucket size is
+// given by ?bucket= (seconds or a duration like "5m") or derived from ?points= (target number of
+// buckets, default 2000). ?agg=min,max selects the aggregates (default all).
+func handleAggregatedHistory(w http.ResponseWriter, r *http.Request, start, end int64, series []string) {
+	bucket, err := bucketSize(r, start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aggs := map[string]bool{"min": true, "max": true, "avg": true, "last": true}
+	if aggParam := r.URL.Query().Get("agg"); aggParam != "" {
+		aggs = make(map[string]bool)
+		for _, agg := range strings.Split(aggParam, ",") {
+			agg = strings.TrimSpace(agg)
+			if agg != "min" && agg != "max" && agg != "avg" && agg != "last" {
+				http.Error(w, fmt.Sprintf("Unknown aggregate '%s' (min, max, avg, last)", agg), http.StatusBadRequest)
+				return
+			}
+			aggs[agg] = true
+		}
+	}
+
+	rows, resolution, err := database.GetAggregatedHistory(start, end, bucket, series)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	result := AggregatedHistory{Start: start, End: end, Bucket: bucket, Resolution: resolution, T: []int64{}, Series: make(map[string]*SeriesColumns)}
+	for _, name := range series {
+		result.Series[name] = &SeriesColumns{}
+	}
+	for _, row := range rows {
+		if n := len(result.T); n == 0 || result.T[n-1] != row.Bucket {
+			result.T = append(result.T, row.Bucket)
+			for _, cols := range result.Series {
+				cols.extend(aggs)
+			}
+		}
+		cols, ok := result.Series[row.Series]
+		if !ok {
+			cols = &SeriesColumns{}
+			for range result.T {
+				cols.extend(aggs)
+			}
+			result.Series[row.Series] = cols
+		}
+		i := len(result.T) - 1
+		if aggs["min"] {
+			cols.Min[i] = nullableValue(row.Min)
+		}
+		if aggs["max"] {
+			cols.Max[i] = nullableValue(row.Max)
+		}
+		if aggs["avg"] {
+			cols.Avg[i] = nullableValue(row.Avg)
+		}
+		if aggs["last"] {
+			cols.Last[i] = nullableValue(row.Last)
+		}
+		cols.Count[i] = row.Count
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// bucketSize returns the bucket size in seconds requested by ?bucket= or ?points=.
+func bucketSize(r *http.Request, start, end int64) (int64, error) {
+	if param := r.URL.Query().Get("bucket"); param != "" {
+		if seconds, err := strconv.ParseInt(param, 10, 64); err == nil && seconds > 0 {
+			return seconds, nil
+		}
+		d, err := time.ParseDuration(param)
+		if err != nil || d < time.Second {
+			return 0, fmt.Errorf("Invalid bucket size")
+		}
+		return int64(d / time.Second), nil
+	}
+	points := int64(defaultHistoryPoints)
+	if param := r.URL.Query().Get("points"); param != "" {
+		p, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || p < 1 || p > maxHistoryPoints {
+			return 0, fmt.Errorf("points must be between 1 and %d", maxHistoryPoints)
+		}
+		points = p
+	}
+	span := end - start + 1
+	bucket := (span + points - 1) / points
+	if bucket < 1 {
+		bucket = 1
+	}
+	return bucket, nil
+}
+
+// extend appends an empty bucket to the selected columns.
+func (c *SeriesColumns) extend(aggs map[string]bool) {
+	if aggs["min"] {
+		c.Min = append(c.Min, nil)
+	}
+	if aggs["max"] {
+		c.Max = append(c.Max, nil)
+	}
+	if aggs["avg"] {
+		c.Avg = append(c.Avg, nil)
+	}
+	if aggs["last"] {
+		c.Last = append(c.Last, nil)
+	}
+	c.Count = append(c.Count, 0)
+}
+
+func nullableValue(v sql.NullFloat64) *float64 {
+	if !v.Valid {
+		return nil
+	}
+	f := v.Float64
+	return &f
+}
+
+// HandleGetSeries returns the recorded series with the timestamps of their oldest and newest sample.
+func HandleGetSeries(w http.ResponseWriter, r *http.Request) {
+	series, err := database.ListSeries()
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if series == nil {
+		series = []database.SeriesInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// historyRange returns the time range of a history request: start and end (unix timestamps),
+// a night (date), a duration before now (e.g. "12h"), or the last 12 hours.
+func historyRange(r *http.Request) (start, end int64, err error) {
 	startParam := r.URL.Query().Get("start")
 	endParam := r.URL.Query().Get("end")
 	dateParam := r.URL.Query().Get("date")
 	durationParam := r.URL.Query().Get("duration")
 
-	var start, end int64
 	end = time.Now().Unix()
 
 	if startParam != "" && endParam != "" {
 		// Custom range (unix timestamps)
 		s, err1 := strconv.ParseInt(startParam, 10, 64)
 		e, err2 := strconv.ParseInt(endParam, 10, 64)
-		if err1 == nil && err2 == nil {
-			start = s
-			end = e
-		} else {
-			http.Error(w, "Invalid timestamp", http.StatusBadRequest)
-			return
+		if err1 != nil || err2 != nil {
+			return 0, 0, fmt.Errorf("Invalid timestamp")
 		}
+		return s, e, nil
 	} else if dateParam != "" {
-		// Specific date (full 24h of represented day)
-		t, err := time.Parse("2006-01-02", dateParam)
+		// Specific night, as defined by the observatory site
+		s, e, err := nightRange(dateParam)
 		if err != nil {
-			http.Error(w, "Invalid date format", http.StatusBadRequest)
-			return
+			return 0, 0, fmt.Errorf("Invalid date format")
 		}
-		start = t.Unix()
-		end = t.Add(24 * time.Hour).Unix()
+		return s, e, nil
 	} else if durationParam != "" {
 		// Parse duration like "12h"
 		d, err := time.ParseDuration(durationParam)
 		if err == nil {
-			start = time.Now().Add(-d).Unix()
-		} else {
-			start = time.Now().Add(-12 * time.Hour).Unix() // Fallback
+			return time.Now().Add(-d).Unix(), end, nil
 		}
-	} else {
-		start = time.Now().Add(-12 * time.Hour).Unix()
 	}
+	return time.Now().Add(-12 * time.Hour).Unix(), end, nil // Default and fallback
+}
+
+// ThermostatPoint is one logged state of a thermostat loop.
+type ThermostatPoint struct {
+	Timestamp int64    `json:"t"`
+	Name      string   `json:"name"`
+	Value     *float64 `json:"value"`
+	Setpoint  float64  `json:"setpoint"`
+	Output    float64  `json:"output"`
+	State     string   `json:"state"`
+}
 
-	records, err := database.GetHistory(start, end)
+// HandleGetThermostatHistory returns the logged thermostat states, optionally filtered by ?name=.
+// The time range parameters are the same as for the telemetry history.
+func HandleGetThermostatHistory(w http.ResponseWriter, r *http.Request) {
+	start, end, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := database.GetThermostatHistory(r.URL.Query().Get("name"), start, end)
 	if err != nil {
 		logger.Error("DB Query failed: %v", err)
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
 	}
 
-	// Downsampling if too many points
-	// If more than 2000 points, take every Nth
-	var result []DataPoint
-	count := len(records)
-	step := 1
-	if count > 2000 {
-		step = count / 2000
+	result := make([]ThermostatPoint, 0, len(records))
+	for _, rec := range records {
+		point := ThermostatPoint{Timestamp: rec.Timestamp, Name: rec.Name, Setpoint: rec.Setpoint, Output: rec.Output, State: rec.State}
+		if rec.Value.Valid {
+			v := rec.Value.Float64
+			point.Value = &v
+		}
+		result = append(result, point)
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
 
-	for i := 0; i < count; i += step {
-		r := records[i]
-		// Map DB record to API DataPoint
-		// NOTE: API DataPoint struct is fixed, but frontend will only graph what it needs.
-		// We could optimize by only filling requested fields, but for JSON it handles omitempty if we wanted.
-		// For now send full object, it's not huge.
-		result = append(result, DataPoint{
-			Timestamp: r.Timestamp,
-			Voltage:   r.Voltage,
-			Current:   r.Current,
-			Power:     r.Power,
-			TempAmb:   r.TempAmb,
-			HumAmb:    r.HumAmb,
-			DewPoint:  r.DewPoint,
-			TempLens:  r.TempLens,
-			PWM1:      r.PWM1,
-			PWM2:      r.PWM2,
-			DC1:       r.DC1,
-			DC2:       r.DC2,
-			DC3:       r.DC3,
-			DC4:       r.DC4,
-			DC5:       r.DC5,
-			USBC12:    r.USBC12,
-			USB345:    r.USB345,
-			AdjConv:   r.AdjConv,
-		})
+// GetRecentHistory returns all telemetry points recorded within the given duration before now.
+// It is used by callers outside the HTTP API (e.g. ASCOM Actions) that need raw history.
+func GetRecentHistory(d time.Duration) ([]DataPoint, error) {
+	end := time.Now().Unix()
+	start := time.Now().Add(-d).Unix()
+
+	records, err := database.GetHistory(start, end, legacySeriesNames())
+	if err != nil {
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	result := make([]DataPoint, 0, len(records))
+	for _, r := range records {
+		result = append(result, toDataPoint(r))
+	}
+	return result, nil
 }
 
-// HandleGetLogDates returns available dates from DB.
+// toDataPoint maps the legacy series of a DB row to the API DataPoint.
+func toDataPoint(r database.TelemetryRow) DataPoint {
+	v := r.Values
+	state := func(series string) *int {
+		if v[series] == nil {
+			return nil
+		}
+		i := int(*v[series])
+		return &i
+	}
+	limit := func(series string) float64 {
+		if v[series] != nil {
+			return *v[series]
+		}
+		return 100
+	}
+	return DataPoint{
+		Timestamp: r.Timestamp,
+		Voltage:   v["v"],
+		Current:   v["i"],
+		Power:     v["p"],
+		TempAmb:   v["t_amb"],
+		HumAmb:    v["h_amb"],
+		DewPoint:  v["d"],
+		TempLens:  v["t_lens"],
+		PWM1:      state("pwm1"),
+		PWM2:      state("pwm2"),
+		DC1:       state("status.d1"),
+		DC2:       state("status.d2"),
+		DC3:       state("status.d3"),
+		DC4:       state("status.d4"),
+		DC5:       state("status.d5"),
+		USBC12:    state("status.u12"),
+		USB345:    state("status.u34"),
+		AdjConv:   v["status.adj"],
+		PWM1Limit: limit("proxy.pwm1_limit"),
+		PWM2Limit: limit("proxy.pwm2_limit"),
+	}
+}
+
+// HandleGetLogDates returns the nights (YYYY-MM-DD of the evening) that contain telemetry.
 func HandleGetLogDates(w http.ResponseWriter, r *http.Request) {
-	dates, err := database.GetDistinctDates()
+	dates, err := RecordedNights()
 	if err != nil {
 		// Return empty list on error
 		dates = []string{}
@@ -163,61 +474,55 @@ func HandleDownloadCSV(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	} else if dateParam != "" {
-		t, err := time.Parse("2006-01-02", dateParam)
+		s, e, err := nightRange(dateParam)
 		if err != nil {
 			http.Error(w, "Invalid date", http.StatusBadRequest)
 			return
 		}
-		start = t.Unix()
-		end = t.Add(24 * time.Hour).Unix()
+		start = s
+		end = e
 		filename = fmt.Sprintf("telemetry_%s.csv", dateParam)
 	} else {
 		http.Error(w, "Missing range parameters", http.StatusBadRequest)
 		return
 	}
 
-	records, err := database.GetHistory(start, end)
-	if err != nil {
-		http.Error(w, "Database error", http.StatusInternalServerError)
-		return
+	// Columns are legacy keys (voltage, dc1, ...) or any recorded series name.
+	// If cols is empty or contains nothing known, the legacy columns are written.
+	known := make(map[string]bool)
+	for _, l := range legacySeries {
+		known[l.key] = true
 	}
-
-	// Parse columns
-	// Available map: key -> label (or just key checking)
-	// We want to write 'timestamp' always + selected columns.
-	// If cols is empty, write all (legacy behavior).
-
-	validCols := map[string]bool{
-		"voltage": true, "current": true, "power": true,
-		"t_amb": true, "h_amb": true, "dew_point": true, "t_lens": true,
-		"pwm1": true, "pwm2": true,
-		"dc1": true, "dc2": true, "dc3": true, "dc4": true, "dc5": true,
-		"usbc12": true, "usb345": true, "adj_conv": true,
+	if colsParam != "" {
+		series, err := database.ListSeries()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for _, s := range series {
+			known[s.Name] = true
+		}
 	}
 
 	var selectedCols []string
-	if colsParam != "" {
-		// "voltage,raw_current,..."
-		// Need to match csv header keys used in legacy
-		// Legacy keys: timestamp,voltage,current,power,t_amb,h_amb,dew_point,t_lens,pwm1,pwm2,dc1...
-		// Let's split colsParam
-		// Let's split colsParam
-		parts := strings.Split(colsParam, ",")
-		for _, p := range parts {
-			p = strings.TrimSpace(p)
-			if validCols[p] {
-				selectedCols = append(selectedCols, p)
-			}
+	for _, col := range strings.Split(colsParam, ",") {
+		col = strings.TrimSpace(col)
+		if known[col] {
+			selectedCols = append(selectedCols, col)
 		}
 	}
-
-	// If no valid cols selected, default to all
 	if len(selectedCols) == 0 {
-		selectedCols = []string{
-			"voltage", "current", "power", "t_amb", "h_amb", "dew_point", "t_lens", "pwm1", "pwm2",
-			"dc1", "dc2", "dc3", "dc4", "dc5", "usbc12", "usb345", "adj_conv",
+		for _, l := range legacySeries {
+			selectedCols = append(selectedCols, l.key)
 		}
 	}
+	selectedSeries := seriesParam(strings.Join(selectedCols, ","))
+
+	records, err := database.GetHistory(start, end, selectedSeries)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/csv")
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
@@ -240,48 +545,11 @@ func HandleDownloadCSV(w http.ResponseWriter, r *http.Request) {
 	writer.Write(header)
 
 	for _, r := range records {
-		ts := time.Unix(r.Timestamp, 0).Format(time.RFC3339)
-
-		var row []string
-		row = append(row, ts) // Timestamp first
-
-		for _, col := range selectedCols {
-			var val string
-			switch col {
-			case "voltage":
-				val = fmt.Sprintf("%v", r.Voltage)
-			case "current":
-				val = fmt.Sprintf("%v", r.Current)
-			case "power":
-				val = fmt.Sprintf("%v", r.Power)
-			case "t_amb":
-				val = fmt.Sprintf("%v", r.TempAmb)
-			case "h_amb":
-				val = fmt.Sprintf("%v", r.HumAmb)
-			case "dew_point":
-				val = fmt.Sprintf("%v", r.DewPoint)
-			case "t_lens":
-				val = fmt.Sprintf("%v", r.TempLens)
-			case "pwm1":
-				val = fmt.Sprintf("%d", r.PWM1)
-			case "pwm2":
-				val = fmt.Sprintf("%d", r.PWM2)
-			case "dc1":
-				val = fmt.Sprintf("%d", r.DC1)
-			case "dc2":
-				val = fmt.Sprintf("%d", r.DC2)
-			case "dc3":
-				val = fmt.Sprintf("%d", r.DC3)
-			case "dc4":
-				val = fmt.Sprintf("%d", r.DC4)
-			case "dc5":
-				val = fmt.Sprintf("%d", r.DC5)
-			case "usbc12":
-				val = fmt.Sprintf("%d", r.USBC12)
-			case "usb345":
-				val = fmt.Sprintf("%d", r.USB345)
-			case "adj_conv":
-				val = fmt.Sprintf("%.1f", r.AdjConv)
+		row := []string{time.Unix(r.Timestamp, 0).Format(time.RFC3339)} // Timestamp first
+		for _, series := range selectedSeries {
+			val := ""
+			if v := r.Values[series]; v != nil {
+				val = strconv.FormatFloat(*v, 'f', -1, 64)
 			}
 			row = append(row, val)
 		}
@@ -0,0 +1,378 @@
+package telemetry
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+const (
+	defaultBurstInterval = 200 * time.Millisecond
+	defaultBurstDuration = 10 * time.Second
+	defaultBurstGap      = 60 * time.Second
+	burstMaxErrors       = 3 // Consecutive failed readings that end a burst, e.g. after a disconnect
+	burstManualTrigger   = "manual"
+	// burstEventLead is how long before its start switch events are shown with a burst, so a change
+	// that was reported just before a manual trigger is not missed.
+	burstEventLead = time.Second
+)
+
+// burst is a running burst. Its samples are only touched by the sampler goroutine.
+type burst struct {
+	record  database.BurstRecord
+	samples []database.BurstSample
+	until   time.Time
+}
+
+var (
+	burstMutex     sync.Mutex
+	activeBurst    *burst    // nil while no burst runs
+	lastBurstStart time.Time // Start of the most recent burst, manual or not
+)
+
+// startBurstSampling starts a burst after set commands while burst sampling is enabled. Commands within
+// the minimum gap after the previous burst are skipped, so automation that sends a set command every
+// cycle (e.g. a thermostat in PID mode) does not keep the sampler running.
+func startBurstSampling() {
+	serial.OnSetCommand(func(t time.Time, command string) {
+		bs := config.Get().BurstSampling
+		if !bs.Enabled {
+			return
+		}
+		burstMutex.Lock()
+		tooSoon := t.Sub(lastBurstStart) < burstGap(bs)
+		burstMutex.Unlock()
+		if !tooSoon {
+			TriggerBurst(command)
+		}
+	})
+}
+
+// TriggerBurst starts polling the sensors at the burst interval for the burst duration. trigger is stored
+// with the burst, e.g. the set command that caused it. A burst that is still running ends here, so the
+// samples after every trigger are kept as a burst of their own.
+func TriggerBurst(trigger string) {
+	bs := config.Get().BurstSampling
+	now := time.Now()
+	b := &burst{
+		record: database.BurstRecord{StartMs: now.UnixMilli(), Trigger: trigger},
+		until:  now.Add(burstDuration(bs)),
+	}
+
+	// The cached reading is from the last regular poll, taken before the trigger.
+	serial.Conditions.RLock()
+	b.record.BaselineVoltage = burstValue(serial.Conditions.Data, "v", 1)
+	b.record.BaselineCurrent = burstValue(serial.Conditions.Data, "i", 1000)
+	serial.Conditions.RUnlock()
+
+	burstMutex.Lock()
+	running := activeBurst != nil
+	activeBurst = b
+	lastBurstStart = now
+	burstMutex.Unlock()
+	if !running {
+		go burstSampler(b)
+	}
+}
+
+// burstSampler polls the sensors until no burst is active. A new trigger replaces the active burst;
+// the previous one is then stored and sampling continues for the new one.
+func burstSampler(current *burst) {
+	failures := 0
+	for {
+		burstMutex.Lock()
+		if activeBurst != current {
+			go saveBurst(current)
+			current = activeBurst
+		}
+		burstMutex.Unlock()
+
+		next := time.Now().Add(burstInterval(config.Get().BurstSampling))
+		sample, err := readBurstSample()
+
+		burstMutex.Lock()
+		if err == nil {
+			failures = 0
+			current.samples = append(current.samples, sample)
+		} else if failures++; failures >= burstMaxErrors {
+			logger.Warn("Burst sampling: Stopped after %d failed readings: %v", failures, err)
+			current.until = time.Now()
+		}
+		if activeBurst == current && !time.Now().Before(current.until) {
+			activeBurst = nil
+			burstMutex.Unlock()
+			go saveBurst(current)
+			return
+		}
+		burstMutex.Unlock()
+
+		time.Sleep(time.Until(next))
+	}
+}
+
+// readBurstSample reads the power sensors once, bypassing the cache.
+func readBurstSample() (database.BurstSample, error) {
+	response, err := serial.SendCommand(`{"get":"sensors"}`, false, time.Second)
+	if err != nil {
+		return database.BurstSample{}, err
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal([]byte(response), &data); err != nil {
+		return database.BurstSample{}, fmt.Errorf("invalid sensor response: %v", err)
+	}
+	return database.BurstSample{
+		TimestampMs: time.Now().UnixMilli(),
+		Voltage:     burstValue(data, "v", 1),
+		Current:     burstValue(data, "i", 1000), // Reported in mA
+		Power:       burstValue(data, "p", 1),
+	}, nil
+}
+
+func burstValue(data map[string]interface{}, key string, divisor float64) sql.NullFloat64 {
+	v, ok := data[key].(float64)
+	if !ok || invalidReading(key, v) {
+		return sql.NullFloat64{}
+	}
+	return sql.NullFloat64{Float64: v / divisor, Valid: true}
+}
+
+// saveBurst stores a finished burst with its peak current and minimum voltage.
+func saveBurst(b *burst) {
+	rec := b.record
+	rec.Samples = len(b.samples)
+	rec.EndMs = rec.StartMs
+	for _, s := range b.samples {
+		rec.EndMs = s.TimestampMs
+		if s.Current.Valid && (!rec.PeakCurrent.Valid || s.Current.Float64 > rec.PeakCurrent.Float64) {
+			rec.PeakCurrent = s.Current
+			rec.PeakCurrentMs = sql.NullInt64{Int64: s.TimestampMs, Valid: true}
+		}
+		if s.Voltage.Valid && (!rec.MinVoltage.Valid || s.Voltage.Float64 < rec.MinVoltage.Float64) {
+			rec.MinVoltage = s.Voltage
+			rec.MinVoltageMs = sql.NullInt64{Int64: s.TimestampMs, Valid: true}
+		}
+	}
+	if rec.Samples == 0 {
+		return
+	}
+	if _, err := database.InsertBurst(rec, b.samples); err != nil {
+		logger.Error("Burst sampling: Failed to store burst: %v", err)
+		return
+	}
+	logger.Debug("Burst sampling: %d samples after '%s', peak %.3f A, minimum %.2f V.",
+		rec.Samples, rec.Trigger, rec.PeakCurrent.Float64, rec.MinVoltage.Float64)
+}
+
+func burstInterval(bs config.BurstSampling) time.Duration {
+	if bs.IntervalMs == 0 {
+		return defaultBurstInterval
+	}
+	return time.Duration(bs.IntervalMs) * time.Millisecond
+}
+
+func burstDuration(bs config.BurstSampling) time.Duration {
+	if bs.DurationSeconds == 0 {
+		return defaultBurstDuration
+	}
+	return time.Duration(bs.DurationSeconds * float64(time.Second))
+}
+
+func burstGap(bs config.BurstSampling) time.Duration {
+	if bs.MinGapSeconds == 0 {
+		return defaultBurstGap
+	}
+	return time.Duration(bs.MinGapSeconds * float64(time.Second))
+}
+
+// BurstSummary is one burst as returned by the REST API.
+type BurstSummary struct {
+	ID              int64    `json:"id"`
+	StartMs         int64    `json:"startMs"`
+	EndMs           int64    `json:"endMs"`
+	Trigger         string   `json:"trigger"`
+	Samples         int      `json:"samples"`
+	BaselineVoltage *float64 `json:"baselineVoltage"`
+	BaselineCurrent *float64 `json:"baselineCurrent"` // A
+	PeakCurrent     *float64 `json:"peakCurrent"`     // A
+	PeakCurrentMs   *int64   `json:"peakCurrentMs"`
+	MinVoltage      *float64 `json:"minVoltage"`
+	MinVoltageMs    *int64   `json:"minVoltageMs"`
+}
+
+// BurstSamplePoint is one fast sensor reading.
+type BurstSamplePoint struct {
+	TimeMs  int64    `json:"timeMs"`
+	Voltage *float64 `json:"voltage"`
+	Current *float64 `json:"current"` // A
+	Power   *float64 `json:"power"`
+}
+
+// BurstDetail is a burst with its samples and the switch events around it.
+type BurstDetail struct {
+	BurstSummary
+	SwitchEvents []SwitchEventPoint `json:"switchEvents"`
+	Points       []BurstSamplePoint `json:"points"`
+}
+
+func burstSummary(b database.BurstRecord) BurstSummary {
+	nullableTime := func(v sql.NullInt64) *int64 {
+		if !v.Valid {
+			return nil
+		}
+		return &v.Int64
+	}
+	return BurstSummary{
+		ID: b.ID, StartMs: b.StartMs, EndMs: b.EndMs, Trigger: b.Trigger, Samples: b.Samples,
+		BaselineVoltage: nullableValue(b.BaselineVoltage), BaselineCurrent: nullableValue(b.BaselineCurrent),
+		PeakCurrent: nullableValue(b.PeakCurrent), PeakCurrentMs: nullableTime(b.PeakCurrentMs),
+		MinVoltage: nullableValue(b.MinVoltage), MinVoltageMs: nullableTime(b.MinVoltageMs),
+	}
+}
+
+// HandleGetBursts returns the bursts of a time range (same parameters as the telemetry history)
+// without their samples, oldest first.
+func HandleGetBursts(w http.ResponseWriter, r *http.Request) {
+	start, end, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := database.GetBursts(start*1000, end*1000+999)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	result := make([]BurstSummary, 0, len(records))
+	for _, rec := range records {
+		result = append(result, burstSummary(rec))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// HandleGetBurst returns one burst (?id=) with its samples and the switch events that happened
+// during it. &format=csv returns the samples as CSV.
+func HandleGetBurst(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid id", http.StatusBadRequest)
+		return
+	}
+	rec, samples, ok, err := database.GetBurst(id)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Burst not found", http.StatusNotFound)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		writeBurstCSV(w, rec, samples)
+		return
+	}
+
+	detail := BurstDetail{BurstSummary: burstSummary(rec), SwitchEvents: []SwitchEventPoint{}, Points: make([]BurstSamplePoint, 0, len(samples))}
+	for _, s := range samples {
+		detail.Points = append(detail.Points, BurstSamplePoint{
+			TimeMs: s.TimestampMs, Voltage: nullableValue(s.Voltage), Current: nullableValue(s.Current), Power: nullableValue(s.Power),
+		})
+	}
+	events, err := database.GetSwitchEvents("", rec.StartMs-burstEventLead.Milliseconds(), rec.EndMs)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for _, e := range events {
+		detail.SwitchEvents = append(detail.SwitchEvents, SwitchEventPoint{
+			TimeMs: e.TimestampMs, Output: e.Output, Old: nullableValue(e.Old), New: nullableValue(e.New), Source: e.Source,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+func writeBurstCSV(w http.ResponseWriter, rec database.BurstRecord, samples []database.BurstSample) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"burst_%d.csv\"", rec.ID))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"time", "offset_ms", "voltage_v", "current_a", "power_w"})
+	format := func(v sql.NullFloat64) string {
+		if !v.Valid {
+			return ""
+		}
+		return strconv.FormatFloat(v.Float64, 'f', 3, 64)
+	}
+	for _, s := range samples {
+		writer.Write([]string{
+			time.UnixMilli(s.TimestampMs).Format("2006-01-02T15:04:05.000Z07:00"),
+			strconv.FormatInt(s.TimestampMs-rec.StartMs, 10),
+			format(s.Voltage), format(s.Current), format(s.Power),
+		})
+	}
+	writer.Flush()
+}
+
+// HandleTriggerBurst starts a burst on demand, whether or not bursts after set commands are enabled.
+func HandleTriggerBurst(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bs := config.Get().BurstSampling
+	TriggerBurst(burstManualTrigger)
+	logger.Info("Burst sampling started via API.")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"intervalMs":      burstInterval(bs).Milliseconds(),
+		"durationSeconds": burstDuration(bs).Seconds(),
+	})
+}
+
+// HandleBurstSettings returns (GET) or replaces (POST) the burst sampling settings.
+func HandleBurstSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config.Get().BurstSampling)
+
+	case http.MethodPost:
+		var settings config.BurstSampling
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateBurstSampling(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conf := config.Get()
+		conf.BurstSampling = settings
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Burst sampling settings updated via API (after set commands: %t).", settings.Enabled)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -1,10 +1,15 @@
 package telemetry
 
 import (
+	"math"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/automation"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/database"
 	"sv241pro-alpaca-proxy/internal/logger"
@@ -26,10 +31,20 @@ func Init() {
 		return
 	}
 
+	startSwitchEventLog()
+	startBurstSampling()
+
+	// Roll up what has not been rolled up yet before raw samples are pruned
+	updateRollups()
+	if err := PruneOldRollups(); err != nil {
+		logger.Error("Failed to prune telemetry rollups: %v", err)
+	}
+	go rollupLoop()
+
 	// Prune old data based on config
 	conf := config.Get()
 	if conf.HistoryRetentionNights > 0 {
-		if err := database.PruneOldTelemetry(conf.HistoryRetentionNights); err != nil {
+		if err := PruneOldTelemetry(conf.HistoryRetentionNights); err != nil {
 			logger.Error("Failed to prune old telemetry: %v", err)
 		}
 	}
@@ -40,9 +55,22 @@ func Init() {
 	}
 
 	// Start the logging loop (unless disabled)
+	serial.OnCacheUpdate(func(snapshot serial.CacheSnapshot) {
+		lastPoll.Store(snapshot.Time.Unix())
+	})
 	go loggingLoop()
 }
 
+// nextSiteNoon returns the next noon after t in the observatory site's time zone.
+func nextSiteNoon(t time.Time) time.Time {
+	site := astro.CurrentSite()
+	_, end, err := site.NoonSpan(site.NightOf(t))
+	if err != nil {
+		return t.Add(24 * time.Hour)
+	}
+	return end
+}
+
 func loggingLoop() {
 	conf := config.Get()
 	interval := time.Duration(conf.TelemetryInterval) * time.Second
@@ -58,12 +86,8 @@ func loggingLoop() {
 
 	logger.Info("Database Telemetry Logging started. Interval: %v", interval)
 
-	// Calculate next cleanup time (next 12:00 PM)
-	now := time.Now()
-	nextPruneTime := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, now.Location())
-	if now.After(nextPruneTime) {
-		nextPruneTime = nextPruneTime.Add(24 * time.Hour)
-	}
+	// Calculate next cleanup time (next noon at the observatory site, i.e. the end of the current night)
+	nextPruneTime := nextSiteNoon(time.Now())
 	logger.Info("Next database cleanup scheduled for: %v", nextPruneTime.Format(time.RFC1123))
 
 	for range ticker.C {
@@ -71,7 +95,7 @@ func loggingLoop() {
 		if time.Now().After(nextPruneTime) {
 			logger.Info("Running scheduled daily database cleanup...")
 			if conf.HistoryRetentionNights > 0 {
-				if err := database.PruneOldTelemetry(conf.HistoryRetentionNights); err != nil {
+				if err := PruneOldTelemetry(conf.HistoryRetentionNights); err != nil {
 					logger.Error("Failed to prune old telemetry: %v", err)
 				} else {
 					logger.Info("Daily database cleanup completed successfully.")
@@ -85,8 +109,8 @@ func loggingLoop() {
 				logger.Info("Daily WAL checkpoint completed.")
 			}
 
-			// Schedule next run for tomorrow 12:00 PM
-			nextPruneTime = nextPruneTime.Add(24 * time.Hour)
+			// Schedule next run for tomorrow's noon
+			nextPruneTime = nextSiteNoon(time.Now())
 			logger.Info("Next database cleanup scheduled for: %v", nextPruneTime.Format(time.RFC1123))
 		}
 
@@ -94,146 +118,148 @@ func loggingLoop() {
 	}
 }
 
+// staleCacheAge is how old the last successful poll of the device may be before the cached values
+// are no longer logged.
+const staleCacheAge = 30 * time.Second
+
+var (
+	lastPoll   atomic.Int64 // Unix time of the last successful cache update
+	lastSeries []string     // Series of the last record; only used by the logging loop
+)
+
+// logTelemetry records every numeric value of the sensors and status caches as a named series:
+// sensor keys as reported ("v", "t_lens", "hf"), status keys prefixed with "status." ("status.d1",
+// "status.dm.0") and values computed by the proxy prefixed with "proxy.". Booleans are stored as 1/0.
+// Null and sentinel readings are stored as NULL, so gaps stay gaps instead of becoming zeros.
 func logTelemetry() {
-	// 1. Get current conditions (thread-safe copy)
+	timestamp := time.Now().Unix()
+
+	if time.Since(time.Unix(lastPoll.Load(), 0)) > staleCacheAge {
+		// The device does not answer: mark the gap once instead of repeating the cached values.
+		if len(lastSeries) > 0 {
+			gap := make(map[string]*float64, len(lastSeries))
+			for _, name := range lastSeries {
+				gap[name] = nil
+			}
+			if err := database.InsertTelemetry(timestamp, gap); err != nil {
+				logger.Error("Failed to insert telemetry: %v", err)
+			}
+			lastSeries = nil
+		}
+		return
+	}
+
+	values := make(map[string]*float64)
+
 	serial.Conditions.RLock()
-	data := serial.Conditions.Data
+	hasData := serial.Conditions.Data != nil
+	flattenSeries("", serial.Conditions.Data, values)
 	serial.Conditions.RUnlock()
 
-	if data == nil {
+	if !hasData {
 		return // No data yet
 	}
 
-	// Helper to safely get float
-	getFloat := func(key string) float64 {
-		if v, ok := data[key]; ok {
-			// It might be float64 or int or string depending on JSON unmarshal, usually float64
-			switch val := v.(type) {
-			case float64:
-				return val
-			case int:
-				return float64(val)
-			default:
-				return 0
-			}
+	serial.Status.RLock()
+	flattenSeries("status", serial.Status.Data, values)
+	serial.Status.RUnlock()
+
+	// Heater limits of the power budget (100 = not throttled)
+	limits := automation.HeaterLimits()
+	for _, heater := range []string{"pwm1", "pwm2"} {
+		limit, ok := limits[heater]
+		if !ok {
+			limit = 100
 		}
-		return 0
-	}
-
-	getInt := func(key string) int {
-		if v, ok := data[key]; ok {
-			switch val := v.(type) {
-			case float64:
-				return int(val)
-			case int:
-				return val
-			default:
-				return 0
-			}
+		values["proxy."+heater+"_limit"] = &limit
+	}
+
+	// Draw attributed to each output with a learned profile (0 while off)
+	if config.Get().LoadProfiles.Enabled {
+		for _, load := range automation.OutputLoads() {
+			current := load.EstimatedCurrent
+			values["proxy.load."+load.Output] = &current
 		}
-		return 0
 	}
 
-	record := database.TelemetryRecord{
-		Timestamp: time.Now().Unix(),
-		Voltage:   getFloat("v"),
-		Current:   getFloat("i"),
-		Power:     getFloat("p"),
-		TempAmb:   getFloat("t_amb"),
-		HumAmb:    getFloat("h_amb"),
-		DewPoint:  getFloat("d"),
-		TempLens:  getFloat("t_lens"),
-		PWM1:      getInt("pwm1"),
-		PWM2:      getInt("pwm2"),
+	// Battery estimates (runtime in hours; NULL while not discharging)
+	if config.Get().Battery.Enabled {
+		values["proxy.battery_soc"], values["proxy.battery_runtime"] = automation.BatteryEstimate()
 	}
 
-	// Add switch states
-	serial.Status.RLock()
-	statusData := serial.Status.Data
-	serial.Status.RUnlock()
+	if err := database.InsertTelemetry(timestamp, values); err != nil {
+		logger.Error("Failed to insert telemetry: %v", err)
+	}
+	lastSeries = lastSeries[:0]
+	for name := range values {
+		lastSeries = append(lastSeries, name)
+	}
 
-	if statusData != nil {
-		// Helper for switches
-		getSwitch := func(shortKey string) int {
-			if val, ok := statusData[shortKey]; ok {
-				switch v := val.(type) {
-				case bool:
-					if v {
-						return 1
-					} else {
-						return 0
-					}
-				case float64:
-					if v >= 1.0 {
-						return 1
-					}
-					return 0
-				default:
-					return 0
-				}
-			}
-			return 0
+	// Thermostat loops
+	var loops []database.ThermostatRecord
+	for _, sample := range automation.ThermostatSamples() {
+		rec := database.ThermostatRecord{Timestamp: timestamp, Name: sample.Name, Setpoint: sample.Setpoint, Output: sample.Output, State: sample.State}
+		if sample.Value != nil {
+			rec.Value.Float64, rec.Value.Valid = *sample.Value, true
 		}
+		loops = append(loops, rec)
+	}
+	if len(loops) > 0 {
+		if err := database.InsertThermostatRecords(loops); err != nil {
+			logger.Error("Failed to insert thermostat telemetry: %v", err)
+		}
+	}
+}
 
-		// Map from config keys. We hardcode mapping here or use the map logic from before?
-		// The previous logic used config.ShortSwitchIDMap.
-		// Let's assume standard names based on previous implementation.
-		// Layout: dc1..dc5, usbc12, usb345, adj_conv
-
-		// We need to resolve long names to short keys again?
-		// Actually, `serial.Status.Data` uses short keys (e.g. "S1", "S2").
-		// To be robust, we need to look up which switch corresponds to "dc1".
-		// For now, let's use the same look up logic as before strictly if we want to be correct.
-
-		config.SwitchMapMutex.RLock()
-		// Replicate logic: iterate switch order, find short key
-		switchOrder := []string{"dc1", "dc2", "dc3", "dc4", "dc5", "usbc12", "usb345", "adj_conv"}
-		for i, longKey := range switchOrder {
-			shortKey := config.ShortSwitchIDMap[longKey]
-			val := 0
-
-			// Check existence
-			isEnabled := false
-			for _, k := range config.SwitchIDMap {
-				if k == longKey {
-					isEnabled = true
-					break
-				}
-			}
-
-			if isEnabled {
-				if longKey == "adj_conv" {
-					if v, ok := statusData[shortKey]; ok {
-						if f, ok := v.(float64); ok {
-							record.AdjConv = f
-						}
-					}
-				} else {
-					val = getSwitch(shortKey)
-					// Assign to correct field
-					switch i {
-					case 0:
-						record.DC1 = val
-					case 1:
-						record.DC2 = val
-					case 2:
-						record.DC3 = val
-					case 3:
-						record.DC4 = val
-					case 4:
-						record.DC5 = val
-					case 5:
-						record.USBC12 = val
-					case 6:
-						record.USB345 = val
-					}
-				}
-			}
+// flattenSeries adds the numeric values of a decoded JSON value to out. Objects and arrays are
+// flattened with "." (e.g. "dm.0"). Nulls and invalid readings are added as nil; strings are skipped.
+func flattenSeries(prefix string, value interface{}, out map[string]*float64) {
+	switch v := value.(type) {
+	case nil:
+		if prefix != "" {
+			out[prefix] = nil
+		}
+	case float64:
+		if invalidReading(prefix, v) {
+			out[prefix] = nil
+		} else {
+			out[prefix] = &v
+		}
+	case bool:
+		f := 0.0
+		if v {
+			f = 1
+		}
+		out[prefix] = &f
+	case map[string]interface{}:
+		for key, item := range v {
+			flattenSeries(seriesName(prefix, key), item, out)
+		}
+	case []interface{}:
+		for i, item := range v {
+			flattenSeries(seriesName(prefix, strconv.Itoa(i)), item, out)
 		}
-		config.SwitchMapMutex.RUnlock()
 	}
+}
 
-	if err := database.InsertTelemetry(record); err != nil {
-		logger.Error("Failed to insert telemetry: %v", err)
+// invalidReading reports the values the firmware and its sensor libraries use for missing readings.
+func invalidReading(series string, v float64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return true
+	}
+	switch series {
+	case "t_amb", "t_lens", "d":
+		// The DS18B20 library reports -127 °C for a disconnected probe and 85 °C before its first conversion.
+		return v <= -127 || (series == "t_lens" && v == 85)
+	case "h_amb":
+		return v < 0 || v > 100
+	}
+	return false
+}
+
+func seriesName(prefix, key string) string {
+	if prefix == "" {
+		return key
 	}
+	return prefix + "." + key
 }
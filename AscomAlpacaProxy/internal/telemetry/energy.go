@@ -0,0 +1,458 @@
+package telemetry
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// The energy accounting integrates the logged power ("p", W) and current ("i", mA) over time.
+// Consecutive samples are integrated with the trapezoidal rule; samples further apart than three
+// logging intervals (at least minSampleGap) are not, so a gap (device not answering, logging disabled) is reported as uncovered
+// time instead of being bridged with a guess. The part of a range whose raw samples were pruned is
+// computed from the rollups: the average per bucket times the time its samples cover (valid samples
+// times the logging interval), so a bucket with a few samples does not count as fully covered.
+
+const (
+	defaultSessionGap = 30 * time.Minute
+	minSampleGap      = 30 // Seconds
+	// defaultSampleSeconds is the default logging interval, used to weight rollups while logging is disabled.
+	defaultSampleSeconds = 10
+	maxEnergyNights      = 366
+)
+
+var energySeries = []string{"p", "i", "pwm1", "pwm2"}
+
+// EnergySummary is the energy drawn during a time range or session.
+type EnergySummary struct {
+	Start          int64    `json:"start"`
+	End            int64    `json:"end"`
+	Wh             float64  `json:"wh"`
+	Ah             float64  `json:"ah"`
+	PeakCurrent    *float64 `json:"peakCurrent"`   // A, nil without current readings
+	PeakCurrentAt  *int64   `json:"peakCurrentAt"` // Unix time of the peak
+	AvgPower       *float64 `json:"avgPower"`      // W over the covered time
+	HeaterWh       *float64 `json:"heaterWh"`      // Estimated from the heater outputs and heaterWatts
+	HeaterShare    *float64 `json:"heaterShare"`   // HeaterWh in % of Wh
+	CoveredSeconds float64  `json:"coveredSeconds"`
+	GapSeconds     float64  `json:"gapSeconds"` // Time of the range without integrated readings
+}
+
+// EnergyReport is the energy of a time range (or night) with its sessions.
+type EnergyReport struct {
+	EnergySummary
+	Date       string          `json:"date,omitempty"`
+	Resolution int64           `json:"resolution"` // 0 = raw samples only, otherwise the rollup resolution in seconds used before them
+	Sessions   []EnergySummary `json:"sessions"`
+}
+
+// energyInterval is a time span with the average readings over it. nil values had no valid reading.
+type energyInterval struct {
+	from, to    int64
+	seconds     float64  // Time covered by the power readings
+	currentSecs float64  // Time covered by the current readings
+	power       *float64 // W
+	current     *float64 // mA
+	heaters     [2]*float64
+	peakCurrent *float64 // mA
+	peakAt      int64
+}
+
+// ComputeEnergy integrates power and current between start and end.
+func ComputeEnergy(start, end int64) (EnergyReport, error) {
+	intervals, resolution, err := energyIntervals(start, end)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+	conf := config.Get().Energy
+	gap := defaultSessionGap
+	if conf.SessionGapMinutes > 0 {
+		gap = time.Duration(conf.SessionGapMinutes * float64(time.Minute))
+	}
+
+	report := EnergyReport{Resolution: resolution, Sessions: []EnergySummary{}}
+	report.EnergySummary = summarize(start, end, intervals, conf.HeaterWatts)
+
+	// A session is a run of intervals with power readings not interrupted by more than the session gap.
+	var session []energyInterval
+	flush := func() {
+		if len(session) > 0 {
+			report.Sessions = append(report.Sessions, summarize(session[0].from, session[len(session)-1].to, session, conf.HeaterWatts))
+		}
+		session = nil
+	}
+	for _, iv := range intervals {
+		if iv.power == nil {
+			continue
+		}
+		if len(session) > 0 && time.Duration(iv.from-session[len(session)-1].to)*time.Second > gap {
+			flush()
+		}
+		session = append(session, iv)
+	}
+	flush()
+	return report, nil
+}
+
+// summarize adds up the intervals of a range.
+func summarize(start, end int64, intervals []energyInterval, heaterWatts map[string]float64) EnergySummary {
+	s := EnergySummary{Start: start, End: end}
+	var heaterWh float64
+	heaterKnown := false
+	for _, iv := range intervals {
+		hours := iv.seconds / 3600
+		if iv.power != nil {
+			s.Wh += *iv.power * hours
+			s.CoveredSeconds += iv.seconds
+			for h, duty := range iv.heaters {
+				if watts := heaterWatts[fmt.Sprintf("pwm%d", h+1)]; watts > 0 && duty != nil {
+					heaterWh += *duty / 100 * watts * hours
+					heaterKnown = true
+				}
+			}
+		}
+		if iv.current != nil {
+			s.Ah += *iv.current / 1000 * iv.currentSecs / 3600
+		}
+		if iv.peakCurrent != nil && (s.PeakCurrent == nil || *iv.peakCurrent/1000 > *s.PeakCurrent) {
+			peak, at := *iv.peakCurrent/1000, iv.peakAt
+			s.PeakCurrent, s.PeakCurrentAt = &peak, &at
+		}
+	}
+	s.GapSeconds = math.Max(0, float64(end-start)-s.CoveredSeconds)
+	if s.CoveredSeconds > 0 {
+		avg := round3(s.Wh / (s.CoveredSeconds / 3600))
+		s.AvgPower = &avg
+	}
+	if heaterKnown {
+		heaterWh = math.Min(heaterWh, s.Wh)
+		if s.Wh > 0 {
+			share := round3(heaterWh / s.Wh * 100)
+			s.HeaterShare = &share
+		}
+		heaterWh = round3(heaterWh)
+		s.HeaterWh = &heaterWh
+	}
+	s.Wh, s.Ah = round3(s.Wh), round3(s.Ah)
+	return s
+}
+
+// round3 rounds to three decimals, which is far below the accuracy of the INA219.
+func round3(v float64) float64 {
+	return math.Round(v*1000) / 1000
+}
+
+// energyIntervals reads the range from the raw samples and the part before the oldest raw sample
+// (pruned) from the rollups, like database.GetAggregatedHistory combines both sources.
+func energyIntervals(start, end int64) ([]energyInterval, int64, error) {
+	rawFrom, found, err := database.FirstTelemetry(start, end)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !found {
+		rawFrom = end
+	}
+
+	var intervals []energyInterval
+	var resolution int64
+	if rawFrom > start {
+		rows, res, err := database.GetAggregatedHistory(start, rawFrom-1, 60, energySeries)
+		if err != nil {
+			return nil, 0, err
+		}
+		if res > 60 {
+			// Only a coarser rollup reaches back this far: use its buckets as they are.
+			if rows, _, err = database.GetAggregatedHistory(start, rawFrom-1, res, energySeries); err != nil {
+				return nil, 0, err
+			}
+		}
+		if res > 0 {
+			intervals, resolution = rollupIntervals(rows, res, start, rawFrom), res
+		}
+	}
+
+	if found {
+		rows, err := database.GetHistory(rawFrom, end, energySeries)
+		if err != nil {
+			return nil, 0, err
+		}
+		intervals = append(intervals, sampleIntervals(rows)...)
+	}
+	return intervals, resolution, nil
+}
+
+// sampleIntervals pairs consecutive raw samples that are close enough to be integrated.
+func sampleIntervals(rows []database.TelemetryRow) []energyInterval {
+	maxGap := int64(minSampleGap)
+	if interval := int64(config.Get().TelemetryInterval); 3*interval > maxGap {
+		maxGap = 3 * interval
+	}
+	average := func(a, b *float64) *float64 {
+		if a == nil || b == nil {
+			return nil
+		}
+		v := (*a + *b) / 2
+		return &v
+	}
+
+	var intervals []energyInterval
+	for k := 1; k < len(rows); k++ {
+		prev, cur := rows[k-1], rows[k]
+		if cur.Timestamp-prev.Timestamp > maxGap {
+			continue
+		}
+		iv := energyInterval{
+			from: prev.Timestamp, to: cur.Timestamp,
+			seconds: float64(cur.Timestamp - prev.Timestamp), currentSecs: float64(cur.Timestamp - prev.Timestamp),
+			power:   average(prev.Values["p"], cur.Values["p"]),
+			current: average(prev.Values["i"], cur.Values["i"]),
+			heaters: [2]*float64{average(prev.Values["pwm1"], cur.Values["pwm1"]), average(prev.Values["pwm2"], cur.Values["pwm2"])},
+		}
+		for _, r := range []database.TelemetryRow{prev, cur} {
+			if i := r.Values["i"]; i != nil && (iv.peakCurrent == nil || *i > *iv.peakCurrent) {
+				peak := *i
+				iv.peakCurrent, iv.peakAt = &peak, r.Timestamp
+			}
+		}
+		intervals = append(intervals, iv)
+	}
+	return intervals
+}
+
+// rollupIntervals turns aggregated buckets into intervals of the bucket length, clipped to the range.
+// The covered time of a bucket is its number of valid samples times the logging interval, scaled
+// down with the bucket if it was clipped.
+func rollupIntervals(rows []database.SeriesAggregate, bucket, start, end int64) []energyInterval {
+	sampleSeconds := float64(config.Get().TelemetryInterval)
+	if sampleSeconds <= 0 {
+		sampleSeconds = defaultSampleSeconds // Logging is disabled now; assume the default it ran with
+	}
+	byBucket := make(map[int64]*energyInterval)
+	var order []int64
+	for _, a := range rows {
+		iv, ok := byBucket[a.Bucket]
+		if !ok {
+			iv = &energyInterval{from: max(a.Bucket, start), to: min(a.Bucket+bucket, end), peakAt: a.Bucket}
+			byBucket[a.Bucket] = iv
+			order = append(order, a.Bucket)
+		}
+		avg := nullableValue(a.Avg)
+		covered := math.Min(1, float64(a.Count)*sampleSeconds/float64(bucket)) * float64(iv.to-iv.from)
+		switch a.Series {
+		case "p":
+			iv.power = avg
+			iv.seconds = covered
+		case "i":
+			iv.current = avg
+			iv.currentSecs = covered
+			iv.peakCurrent = nullableValue(a.Max)
+		case "pwm1":
+			iv.heaters[0] = avg
+		case "pwm2":
+			iv.heaters[1] = avg
+		}
+	}
+	intervals := make([]energyInterval, 0, len(order))
+	for _, b := range order {
+		if iv := byBucket[b]; iv.to > iv.from {
+			intervals = append(intervals, *iv)
+		}
+	}
+	return intervals
+}
+
+// NightEnergy computes the energy of one night; the current night is computed up to now.
+func NightEnergy(date string) (EnergyReport, error) {
+	start, end, err := nightRange(date)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+	if now := time.Now().Unix(); end > now {
+		end = now
+	}
+	report, err := ComputeEnergy(start, end)
+	report.Date = date
+	return report, err
+}
+
+// HandleGetEnergy returns the energy of a night (?date=, default: the current night) or of a time range
+// (start/end or duration, as for the history) with its sessions. &format=csv returns the sessions as CSV.
+func HandleGetEnergy(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var report EnergyReport
+	var err error
+	if q.Get("start") != "" || q.Get("duration") != "" {
+		start, end, rangeErr := historyRange(r)
+		if rangeErr != nil {
+			http.Error(w, rangeErr.Error(), http.StatusBadRequest)
+			return
+		}
+		report, err = ComputeEnergy(start, end)
+	} else {
+		date := q.Get("date")
+		if date == "" {
+			date = astro.CurrentSite().NightOf(time.Now())
+		}
+		if _, _, rangeErr := nightRange(date); rangeErr != nil {
+			http.Error(w, "Invalid date format", http.StatusBadRequest)
+			return
+		}
+		report, err = NightEnergy(date)
+	}
+	if err != nil {
+		logger.Error("Energy accounting failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		rows := []energyCSVRow{{"range", report.Date, report.EnergySummary}}
+		for n, s := range report.Sessions {
+			rows = append(rows, energyCSVRow{"session", strconv.Itoa(n + 1), s})
+		}
+		writeEnergyCSV(w, fmt.Sprintf("energy_%d_%d.csv", report.Start, report.End), rows)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// HandleGetNightlyEnergy returns the energy of every night from ?from= to ?to= (dates, default: all
+// recorded nights), most recent first. &format=csv returns one CSV row per night.
+func HandleGetNightlyEnergy(w http.ResponseWriter, r *http.Request) {
+	dates, err := energyNights(r.URL.Query().Get("from"), r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reports := make([]EnergyReport, 0, len(dates))
+	for _, date := range dates {
+		report, err := NightEnergy(date)
+		if err != nil {
+			logger.Error("Energy accounting failed: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if report.CoveredSeconds > 0 {
+			reports = append(reports, report)
+		}
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		rows := make([]energyCSVRow, 0, len(reports))
+		for _, report := range reports {
+			rows = append(rows, energyCSVRow{"night", report.Date, report.EnergySummary})
+		}
+		writeEnergyCSV(w, "energy_nights.csv", rows)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// energyNights returns the nights of a report, most recent first.
+func energyNights(from, to string) ([]string, error) {
+	if from == "" && to == "" {
+		nights, err := RecordedNights()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine recorded nights: %w", err)
+		}
+		return nights, nil
+	}
+	site := astro.CurrentSite()
+	if to == "" {
+		to = site.NightOf(time.Now())
+	}
+	if from == "" {
+		from = to
+	}
+	first, err1 := site.ParseDate(from)
+	last, err2 := site.ParseDate(to)
+	if err1 != nil || err2 != nil || last.Before(first) {
+		return nil, fmt.Errorf("Invalid date range")
+	}
+	var nights []string
+	for day := last; !day.Before(first); day = day.AddDate(0, 0, -1) {
+		if len(nights) == maxEnergyNights {
+			return nil, fmt.Errorf("at most %d nights per request", maxEnergyNights)
+		}
+		nights = append(nights, day.Format(astro.DateLayout))
+	}
+	return nights, nil
+}
+
+type energyCSVRow struct {
+	kind, label string
+	summary     EnergySummary
+}
+
+// writeEnergyCSV writes energy summaries as CSV, one row each.
+func writeEnergyCSV(w http.ResponseWriter, filename string, rows []energyCSVRow) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"type", "label", "start", "end", "wh", "ah", "peak_current_a", "avg_power_w",
+		"heater_wh", "heater_share_pct", "covered_s", "gap_s"})
+	format := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', 3, 64)
+	}
+	for _, row := range rows {
+		s := row.summary
+		wh, ah := s.Wh, s.Ah
+		writer.Write([]string{
+			row.kind, row.label,
+			time.Unix(s.Start, 0).Format(time.RFC3339), time.Unix(s.End, 0).Format(time.RFC3339),
+			format(&wh), format(&ah), format(s.PeakCurrent), format(s.AvgPower),
+			format(s.HeaterWh), format(s.HeaterShare),
+			strconv.FormatFloat(s.CoveredSeconds, 'f', 0, 64), strconv.FormatFloat(s.GapSeconds, 'f', 0, 64),
+		})
+	}
+	writer.Flush()
+}
+
+// HandleEnergySettings returns (GET) or replaces (POST) the energy accounting settings.
+func HandleEnergySettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config.Get().Energy)
+
+	case http.MethodPost:
+		var settings config.Energy
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := config.ValidateEnergy(settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		conf := config.Get()
+		conf.Energy = settings
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Energy accounting settings updated via API.")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(settings)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
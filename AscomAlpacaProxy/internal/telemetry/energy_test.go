@@ -0,0 +1,157 @@
+package telemetry
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+)
+
+func value(v float64) *float64 { return &v }
+
+// row is a raw telemetry row with power (W), current (mA) and the duty of heater 1 (%).
+func row(ts int64, p, i, pwm1 *float64) database.TelemetryRow {
+	return database.TelemetryRow{Timestamp: ts, Values: map[string]*float64{"p": p, "i": i, "pwm1": pwm1}}
+}
+
+// withTelemetryInterval sets the logging interval for the duration of a test.
+func withTelemetryInterval(t *testing.T, seconds int) {
+	conf := config.Get()
+	saved := conf.TelemetryInterval
+	conf.TelemetryInterval = seconds
+	t.Cleanup(func() { conf.TelemetryInterval = saved })
+}
+
+func TestSampleEnergy(t *testing.T) {
+	withTelemetryInterval(t, 10)
+	tests := []struct {
+		name        string
+		rows        []database.TelemetryRow
+		start, end  int64
+		heaterWatts map[string]float64
+		wantWh      float64
+		wantAh      float64
+		wantCovered float64
+		wantGap     float64
+		wantPeak    *float64 // A
+		wantHeater  *float64 // Wh
+	}{
+		{
+			// Trapezoids: (360 + 360) / 2 W for 10 s and (360 + 720) / 2 W for 10 s.
+			name:        "trapezoidal rule",
+			rows:        []database.TelemetryRow{row(0, value(360), value(1000), nil), row(10, value(360), value(3000), nil), row(20, value(720), value(2000), nil)},
+			start:       0,
+			end:         30,
+			wantWh:      2.5,
+			wantAh:      0.0125,
+			wantCovered: 20,
+			wantGap:     10,
+			wantPeak:    value(3),
+		},
+		{
+			// 100 s exceed three logging intervals: the gap is not bridged.
+			name:        "gap not integrated",
+			rows:        []database.TelemetryRow{row(0, value(360), nil, nil), row(10, value(360), nil, nil), row(110, value(3600), nil, nil)},
+			start:       0,
+			end:         110,
+			wantWh:      1,
+			wantCovered: 10,
+			wantGap:     100,
+		},
+		{
+			name:        "missing power reading",
+			rows:        []database.TelemetryRow{row(0, value(360), nil, nil), row(10, nil, nil, nil), row(20, value(360), nil, nil)},
+			start:       0,
+			end:         20,
+			wantWh:      0,
+			wantCovered: 0,
+			wantGap:     20,
+		},
+		{
+			// 50 % of a 360 W heater for 20 s is 1 Wh of the 4 Wh.
+			name:        "heater share",
+			rows:        []database.TelemetryRow{row(0, value(720), nil, value(50)), row(10, value(720), nil, value(50)), row(20, value(720), nil, value(50))},
+			start:       0,
+			end:         20,
+			heaterWatts: map[string]float64{"pwm1": 360},
+			wantWh:      4,
+			wantCovered: 20,
+			wantHeater:  value(1),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarize(tt.start, tt.end, sampleIntervals(tt.rows), tt.heaterWatts)
+			if s.Wh != tt.wantWh || s.Ah != round3(tt.wantAh) {
+				t.Errorf("Wh, Ah = %v, %v; want %v, %v", s.Wh, s.Ah, tt.wantWh, round3(tt.wantAh))
+			}
+			if s.CoveredSeconds != tt.wantCovered || s.GapSeconds != tt.wantGap {
+				t.Errorf("covered, gap = %v, %v; want %v, %v", s.CoveredSeconds, s.GapSeconds, tt.wantCovered, tt.wantGap)
+			}
+			assertOptional(t, "peak current", s.PeakCurrent, tt.wantPeak)
+			assertOptional(t, "heater Wh", s.HeaterWh, tt.wantHeater)
+		})
+	}
+}
+
+func TestRollupEnergy(t *testing.T) {
+	withTelemetryInterval(t, 10)
+	avg := func(v float64) sql.NullFloat64 { return sql.NullFloat64{Float64: v, Valid: true} }
+	tests := []struct {
+		name        string
+		rows        []database.SeriesAggregate
+		start, end  int64
+		wantWh      float64
+		wantCovered float64
+	}{
+		{
+			name:        "fully covered bucket",
+			rows:        []database.SeriesAggregate{{Bucket: 0, Series: "p", Avg: avg(120), Count: 60}},
+			start:       0,
+			end:         600,
+			wantWh:      20,
+			wantCovered: 600,
+		},
+		{
+			// 30 samples of 10 s cover half of the 10-minute bucket.
+			name:        "partly covered bucket",
+			rows:        []database.SeriesAggregate{{Bucket: 0, Series: "p", Avg: avg(120), Count: 30}},
+			start:       0,
+			end:         600,
+			wantWh:      10,
+			wantCovered: 300,
+		},
+		{
+			// The range starts in the middle of the bucket; its coverage is scaled down with it.
+			name:        "clipped bucket",
+			rows:        []database.SeriesAggregate{{Bucket: 0, Series: "p", Avg: avg(120), Count: 30}},
+			start:       300,
+			end:         600,
+			wantWh:      5,
+			wantCovered: 150,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := summarize(tt.start, tt.end, rollupIntervals(tt.rows, 600, tt.start, tt.end), nil)
+			if s.Wh != tt.wantWh || s.CoveredSeconds != tt.wantCovered {
+				t.Errorf("Wh, covered = %v, %v; want %v, %v", s.Wh, s.CoveredSeconds, tt.wantWh, tt.wantCovered)
+			}
+		})
+	}
+}
+
+func assertOptional(t *testing.T, name string, got, want *float64) {
+	t.Helper()
+	text := func(v *float64) string {
+		if v == nil {
+			return "nil"
+		}
+		return fmt.Sprint(*v)
+	}
+	if (got == nil) != (want == nil) || (got != nil && *got != *want) {
+		t.Errorf("%s = %s, want %s", name, text(got), text(want))
+	}
+}
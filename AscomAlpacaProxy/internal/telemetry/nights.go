@@ -0,0 +1,83 @@
+package telemetry
+
+import (
+	"fmt"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// Telemetry is grouped into nights as defined by the observatory site (see astro.Site.Night),
+// so date lists, date queries, CSV exports and pruning all use the same boundaries.
+
+// RecordedNights returns the labels (YYYY-MM-DD) of all nights that contain telemetry, most recent first.
+func RecordedNights() ([]string, error) {
+	oldest, newest, ok, err := database.GetTimeRange()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	site := astro.CurrentSite()
+	var nights []string
+	date := site.NightOf(time.Unix(newest, 0))
+	first := site.NightOf(time.Unix(oldest, 0))
+	for {
+		night, err := site.Night(date)
+		if err != nil {
+			return nil, err
+		}
+		found, err := database.HasTelemetry(night.Start.Unix(), night.End.Unix())
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			nights = append(nights, date)
+		}
+		if date <= first {
+			break
+		}
+		day, _ := site.ParseDate(date)
+		date = day.AddDate(0, 0, -1).Format(astro.DateLayout)
+	}
+	return nights, nil
+}
+
+// nightRange returns the start and end timestamps of the night with the given label.
+func nightRange(date string) (start, end int64, err error) {
+	night, err := astro.CurrentSite().Night(date)
+	if err != nil {
+		return 0, 0, err
+	}
+	return night.Start.Unix(), night.End.Unix(), nil
+}
+
+// PruneOldTelemetry keeps the specified number of most recent recorded nights and deletes everything
+// before the oldest of them. The cut is made at the noon preceding that night, so no data of a kept night is lost.
+func PruneOldTelemetry(minNights int) error {
+	if minNights <= 0 {
+		return nil // Keep everything
+	}
+
+	nights, err := RecordedNights()
+	if err != nil {
+		return fmt.Errorf("failed to determine recorded nights: %w", err)
+	}
+	// If we have fewer recorded nights than minNights, keep everything
+	if len(nights) <= minNights {
+		return nil
+	}
+
+	oldestNightToKeep := nights[minNights-1]
+	cutoff, _, err := astro.CurrentSite().NoonSpan(oldestNightToKeep)
+	if err != nil {
+		return err
+	}
+	deleted, err := database.DeleteTelemetryBefore(cutoff.Unix())
+	if err != nil {
+		return fmt.Errorf("failed to prune old records: %w", err)
+	}
+	logger.Info("Pruned %d telemetry records older than night %s.", deleted, oldestNightToKeep)
+	return nil
+}
@@ -0,0 +1,115 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// rollupInterval is how often completed buckets are rolled up.
+const rollupInterval = time.Minute
+
+// rollupLoop keeps the rollups up to date and prunes them daily at noon, independently of the
+// raw logging interval, so existing data is still rolled up when logging is disabled.
+func rollupLoop() {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	nextPruneTime := nextSiteNoon(time.Now())
+	for range ticker.C {
+		updateRollups()
+		if time.Now().After(nextPruneTime) {
+			if err := PruneOldRollups(); err != nil {
+				logger.Error("Failed to prune telemetry rollups: %v", err)
+			}
+			nextPruneTime = nextSiteNoon(time.Now())
+		}
+	}
+}
+
+func updateRollups() {
+	written, err := database.UpdateRollups(time.Now().Unix())
+	if err != nil {
+		logger.Error("Failed to update telemetry rollups: %v", err)
+		return
+	}
+	if written > 0 {
+		logger.Debug("Telemetry rollups: %d rows written.", written)
+	}
+}
+
+// PruneOldRollups deletes the rollups that are older than the retention of their resolution.
+func PruneOldRollups() error {
+	retention := config.Get().RollupRetention
+	for _, resolution := range database.RollupResolutions {
+		days := retention.Days(resolution)
+		if days == 0 {
+			continue // Keep forever
+		}
+		cutoff := time.Now().AddDate(0, 0, -days).Unix()
+		deleted, err := database.DeleteRollupsBefore(resolution, cutoff)
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			logger.Info("Pruned %d telemetry rollups (%v) older than %d days.", deleted, time.Duration(resolution)*time.Second, days)
+		}
+	}
+	return nil
+}
+
+// RollupStatus is the rollup retention with the effective days and the stored rollups.
+type RollupStatus struct {
+	Retention     config.RollupRetention `json:"retention"`
+	EffectiveDays map[string]int         `json:"effectiveDays"` // By resolution ("1m0s", ...); 0 = forever
+	Rollups       []database.RollupInfo  `json:"rollups"`
+}
+
+// HandleRollups returns (GET) or replaces (POST) the rollup retention. Shorter retentions take effect immediately.
+func HandleRollups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		info, err := database.GetRollupInfo()
+		if err != nil {
+			logger.Error("DB Query failed: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		retention := config.Get().RollupRetention
+		status := RollupStatus{Retention: retention, EffectiveDays: make(map[string]int), Rollups: info}
+		for _, resolution := range database.RollupResolutions {
+			status.EffectiveDays[(time.Duration(resolution) * time.Second).String()] = retention.Days(resolution)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+
+	case http.MethodPost:
+		var retention config.RollupRetention
+		if err := json.NewDecoder(r.Body).Decode(&retention); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		conf := config.Get()
+		conf.RollupRetention = retention
+		if err := config.Save(); err != nil {
+			logger.Error("Failed to save proxy config: %v", err)
+			http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Telemetry rollup retention updated via API.")
+		go func() {
+			if err := PruneOldRollups(); err != nil {
+				logger.Error("Failed to prune telemetry rollups: %v", err)
+			}
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(retention)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,221 @@
+package telemetry
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/astro"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/power"
+)
+
+// switchEventBuffer is the number of events that may wait for the database writer. The status
+// cache is updated from the serial goroutines, which must not block on the database.
+const switchEventBuffer = 256
+
+var switchEvents = make(chan power.SwitchEvent, switchEventBuffer)
+
+// startSwitchEventLog records every output state change in the database, independently of the
+// telemetry interval.
+func startSwitchEventLog() {
+	power.OnSwitchEvent(func(e power.SwitchEvent) {
+		select {
+		case switchEvents <- e:
+		default:
+			logger.Warn("Switch event log: Buffer full, dropped change of %s.", e.Output)
+		}
+	})
+	go switchEventWriter()
+}
+
+// switchEventWriter writes queued events, batching those that arrived together.
+func switchEventWriter() {
+	for e := range switchEvents {
+		batch := []database.SwitchEventRecord{switchEventRecord(e)}
+		for more := true; more; {
+			select {
+			case e := <-switchEvents:
+				batch = append(batch, switchEventRecord(e))
+			default:
+				more = false
+			}
+		}
+		if err := database.InsertSwitchEvents(batch); err != nil {
+			logger.Error("Switch event log: Failed to write %d event(s): %v", len(batch), err)
+		}
+	}
+}
+
+func switchEventRecord(e power.SwitchEvent) database.SwitchEventRecord {
+	r := database.SwitchEventRecord{TimestampMs: e.Time.UnixMilli(), Output: e.Output, Source: e.Source}
+	if e.Old != nil {
+		r.Old = sql.NullFloat64{Float64: *e.Old, Valid: true}
+	}
+	if e.New != nil {
+		r.New = sql.NullFloat64{Float64: *e.New, Valid: true}
+	}
+	return r
+}
+
+// SwitchEventPoint is one logged output state change.
+type SwitchEventPoint struct {
+	TimeMs int64    `json:"timeMs"` // Unix time in milliseconds
+	Output string   `json:"output"`
+	Old    *float64 `json:"old"`
+	New    *float64 `json:"new"`
+	Source string   `json:"source"`
+}
+
+// HandleGetSwitchEvents returns the logged switch events, optionally filtered by ?output=.
+// The time range parameters are the same as for the telemetry history.
+func HandleGetSwitchEvents(w http.ResponseWriter, r *http.Request) {
+	start, end, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records, err := database.GetSwitchEvents(r.URL.Query().Get("output"), start*1000, end*1000+999)
+	if err != nil {
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	result := make([]SwitchEventPoint, 0, len(records))
+	for _, rec := range records {
+		result = append(result, SwitchEventPoint{
+			TimeMs: rec.TimestampMs, Output: rec.Output,
+			Old: nullableValue(rec.Old), New: nullableValue(rec.New), Source: rec.Source,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// OutputOnTime is the time an output was on during one night.
+type OutputOnTime struct {
+	Output    string  `json:"output"`
+	OnSeconds float64 `json:"onSeconds"`
+	Switches  int     `json:"switches"`  // Number of on/off transitions in the night
+	OnAtStart *bool   `json:"onAtStart"` // nil if the state at the start of the night is unknown
+	OnAtEnd   bool    `json:"onAtEnd"`   // State at the end of the night (or now)
+}
+
+// NightOnTime is the per-output on-time of one night.
+type NightOnTime struct {
+	Date    string         `json:"date"`
+	Start   int64          `json:"start"`
+	End     int64          `json:"end"` // End of the night, or now for the current night
+	Outputs []OutputOnTime `json:"outputs"`
+}
+
+// NightOnTimes derives the on-time of every output during a night from the switch event log.
+// The state at the start of the night is taken from the last event before it, or, if there is none,
+// from the first event in the night or the first logged status sample.
+func NightOnTimes(date string) (NightOnTime, error) {
+	start, end, err := nightRange(date)
+	if err != nil {
+		return NightOnTime{}, err
+	}
+	if now := time.Now().Unix(); end > now {
+		end = now
+	}
+	result := NightOnTime{Date: date, Start: start, End: end, Outputs: []OutputOnTime{}}
+	if end <= start {
+		return result, nil
+	}
+
+	events, err := database.GetSwitchEvents("", start*1000, end*1000)
+	if err != nil {
+		return result, err
+	}
+	byOutput := make(map[string][]database.SwitchEventRecord)
+	for _, e := range events {
+		byOutput[e.Output] = append(byOutput[e.Output], e)
+	}
+
+	for key, shortKey := range config.ShortSwitchIDMap {
+		if key == "master_power" {
+			continue
+		}
+		initial, err := initialSwitchState(key, shortKey, start, end, byOutput[key])
+		if err != nil {
+			return result, err
+		}
+		if initial == nil && len(byOutput[key]) == 0 {
+			continue // Never reported in this night
+		}
+
+		ot := OutputOnTime{Output: key, OnAtStart: initial}
+		on := initial != nil && *initial
+		since := start * 1000
+		var onMs int64
+		for _, e := range byOutput[key] {
+			next := e.New.Valid && power.IsOn(e.New.Float64)
+			if next == on {
+				continue // A value change without on/off transition, e.g. a new PWM power
+			}
+			if on {
+				onMs += e.TimestampMs - since
+			}
+			on, since = next, e.TimestampMs
+			ot.Switches++
+		}
+		if on {
+			onMs += end*1000 - since
+		}
+		ot.OnSeconds = float64(onMs) / 1000
+		ot.OnAtEnd = on
+		result.Outputs = append(result.Outputs, ot)
+	}
+	sort.Slice(result.Outputs, func(i, j int) bool { return result.Outputs[i].Output < result.Outputs[j].Output })
+	return result, nil
+}
+
+// initialSwitchState determines whether an output was on at the start of a night. nil means unknown.
+func initialSwitchState(key, shortKey string, start, end int64, events []database.SwitchEventRecord) (*bool, error) {
+	known := func(v sql.NullFloat64) *bool {
+		on := v.Valid && power.IsOn(v.Float64)
+		return &on
+	}
+	last, ok, err := database.LastSwitchEventBefore(key, start*1000)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return known(last.New), nil
+	}
+	if len(events) > 0 && events[0].Old.Valid {
+		return known(events[0].Old), nil
+	}
+	value, ok, err := database.FirstSample("status."+shortKey, start, end)
+	if err != nil || !ok || value == nil {
+		return nil, err
+	}
+	return known(sql.NullFloat64{Float64: *value, Valid: true}), nil
+}
+
+// HandleGetOnTime returns the per-output on-time of the night given by ?date= (default: the current night).
+func HandleGetOnTime(w http.ResponseWriter, r *http.Request) {
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = astro.CurrentSite().NightOf(time.Now())
+	}
+	result, err := NightOnTimes(date)
+	if err != nil {
+		if _, _, rangeErr := nightRange(date); rangeErr != nil {
+			http.Error(w, "Invalid date format", http.StatusBadRequest)
+			return
+		}
+		logger.Error("DB Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"embed"
 	"io/fs"
+	"os"
 	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/automation"
+	"sv241pro-alpaca-proxy/internal/cli"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/logstream"
+	"sv241pro-alpaca-proxy/internal/power"
 	"sv241pro-alpaca-proxy/internal/serial"
 	"sv241pro-alpaca-proxy/internal/server"
 	"sv241pro-alpaca-proxy/internal/systray"
@@ -26,6 +30,15 @@ var frontendFS fs.FS
 var AppVersion string = "dev"
 
 func main() {
+	// Command line mode: control an already running instance and exit (e.g. "-scene Park").
+	if handled, err := cli.Run(os.Args[1:]); handled {
+		if err != nil {
+			systray.ShowMessageBox("SV241 Alpaca Proxy", err.Error(), 0x10)
+			os.Exit(1)
+		}
+		return
+	}
+
 	var err error
 	frontendFS, err = fs.Sub(embeddedFS, "frontend-vue/dist")
 	if err != nil {
@@ -64,6 +77,36 @@ func startApp() {
 	// This will perform the initial connection attempt.
 	serial.StartManager()
 
+	// Resume output timers that were pending when the proxy was last stopped.
+	power.StartTimers()
+
+	// Revert heater boosts when they expire, including boosts started before a restart.
+	power.StartBoosts()
+
+	// Start the scheduler; it catches up with triggers missed while the proxy was not running.
+	automation.StartScheduler()
+
+	// Evaluate the automation rules after every cache update.
+	automation.StartRules()
+
+	// Watch the battery voltage and shed outputs in priority order when it sags.
+	automation.StartLoadShedding()
+
+	// Throttle the dew heaters while the total draw exceeds the power budget.
+	automation.StartPowerBudget()
+
+	// Run the proxy-side thermostat loops.
+	automation.StartThermostats()
+
+	// Alert (and react) when dew is imminent while a heater is not heating.
+	automation.StartDewGuard()
+
+	// Track the battery state of charge from the measured current and the resting voltage.
+	automation.StartBattery()
+
+	// Learn the draw of each output from the change of the total current when it is switched.
+	automation.StartLoadProfiles()
+
 	// Ensure the systray listener is ready. This call is safe to make here.
 	events.StartListener(func() {}) // This just ensures the 'once.Do' is triggered if it hasn't been already.
 